@@ -0,0 +1,701 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/misc"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ACMEDefaultDirectoryURL    = "https://acme-v02.api.letsencrypt.org/directory" // ACMEDefaultDirectoryURL is the production directory of Let's Encrypt.
+	ACMEChallengeHTTP01        = "http-01"                                        // ACMEChallengeHTTP01 is answered by the insecure HTTP daemon.
+	ACMEChallengeTLSALPN01     = "tls-alpn-01"                                    // ACMEChallengeTLSALPN01 is answered by the HTTPS daemon.
+	ACMETLSALPNProtocol        = "acme-tls/1"                                     // ACMETLSALPNProtocol is the ALPN protocol name of TLS-ALPN-01 challenge.
+	ACMEHTTPChallengePath      = "/.well-known/acme-challenge/"                   // ACMEHTTPChallengePath is the URL path prefix of HTTP-01 challenge.
+	ACMEDefaultRenewBeforeDays = 30                                               // ACMEDefaultRenewBeforeDays is the default number of days before expiry to renew certificate.
+	ACMECheckIntervalSec       = 12 * 3600                                        // ACMECheckIntervalSec is the interval between certificate expiry checks.
+	ACMERetryIntervalSec       = 3600                                             // ACMERetryIntervalSec is the interval between retries of failed certificate requests.
+	ACMEPollTimeoutSec         = 120                                              // ACMEPollTimeoutSec is the maximum duration to wait for authorisation and order to complete.
+	ACMEPollIntervalSec        = 2                                                // ACMEPollIntervalSec is the interval between polls of authorisation and order status.
+	ACMEIOTimeoutSec           = 30                                               // ACMEIOTimeoutSec is the IO timeout of each request made to the directory.
+	ACMEMaxResponseSize        = 1024 * 1024                                      // ACMEMaxResponseSize is the maximum size of a response read from the directory.
+
+	acmeAccountKeyFileName = "account-key.pem" // acmeAccountKeyFileName is the cached account key file in cache directory.
+	acmeCertFileName       = "cert.pem"        // acmeCertFileName is the cached certificate chain file in cache directory.
+	acmeKeyFileName        = "key.pem"         // acmeKeyFileName is the cached certificate key file in cache directory.
+	acmeBadNonceError      = "urn:ietf:params:acme:error:badNonce"
+)
+
+// oidACMEIdentifier is the critical extension that carries key authorisation digest in TLS-ALPN-01 challenge certificate.
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// acmeDirectory is the list of resource URLs offered by an ACME directory.
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeProblem is the error document responded by an ACME directory.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (problem *acmeProblem) String() string {
+	if problem == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %s", problem.Type, problem.Detail)
+}
+
+// acmeOrder is a request for certificate of one or more domain names.
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+// acmeChallenge is a way to prove the control over a domain name.
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// acmeAuthorization is the proof of control over a domain name that must be completed by one of its challenges.
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// certManagerState is shared by all copies of a CertManager.
+type certManagerState struct {
+	mutex       sync.Mutex // mutex protects certificate, challenge responses, and renewal status.
+	obtainMutex sync.Mutex // obtainMutex allows only one conversation with the directory at a time.
+
+	client     *http.Client
+	accountKey *ecdsa.PrivateKey
+	accountURL string
+	directory  acmeDirectory
+	nonce      string
+
+	cert        *tls.Certificate
+	httpTokens  map[string]string           // httpTokens maps HTTP-01 challenge tokens to key authorisations.
+	alpnCerts   map[string]*tls.Certificate // alpnCerts maps domain names to TLS-ALPN-01 challenge certificates.
+	renewing    bool
+	stopRenewal chan struct{}
+}
+
+/*
+CertManager obtains TLS certificate from an ACME (RFC 8555) certificate authority such as Let's Encrypt, answers the
+authority's HTTP-01 and TLS-ALPN-01 challenges, keeps the certificate in a cache directory, and renews it before it
+expires. HTTP and mail daemons retrieve the latest certificate on each TLS handshake, hence a renewed certificate takes
+effect without restarting them.
+*/
+type CertManager struct {
+	DirectoryURL        string   `json:"DirectoryURL"`        // DirectoryURL is the ACME directory of certificate authority, it defaults to Let's Encrypt.
+	DirectoryCACertPath string   `json:"DirectoryCACertPath"` // DirectoryCACertPath is an optional PEM file of CA certificates trusted for talking to the directory.
+	Domains             []string `json:"Domains"`             // Domains are the names of certificate, the first one is also its common name.
+	ContactEmail        string   `json:"ContactEmail"`        // ContactEmail is an optional address to receive notifications from certificate authority.
+	CacheDir            string   `json:"CacheDir"`            // CacheDir keeps account key, certificate, and its key.
+	RenewBeforeDays     int      `json:"RenewBeforeDays"`     // RenewBeforeDays is the number of days before expiry to renew certificate.
+	ChallengeTypes      []string `json:"ChallengeTypes"`      // ChallengeTypes are the preferred challenges in order, they default to HTTP-01 then TLS-ALPN-01.
+
+	state  *certManagerState
+	logger misc.Logger
+}
+
+// IsConfigured returns true only if domain names of certificate are specified.
+func (cm *CertManager) IsConfigured() bool {
+	return len(cm.Domains) > 0
+}
+
+// Initialise checks configuration, sets default parameters, and loads account key and certificate from cache directory.
+func (cm *CertManager) Initialise() error {
+	cm.logger = misc.Logger{ComponentName: "CertManager", ComponentID: strings.Join(cm.Domains, ",")}
+	if len(cm.Domains) == 0 {
+		return errors.New("CertManager.Initialise: Domains must not be empty")
+	}
+	for i, domain := range cm.Domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			return errors.New("CertManager.Initialise: domain name must not be empty")
+		}
+		cm.Domains[i] = domain
+	}
+	if cm.CacheDir == "" {
+		return errors.New("CertManager.Initialise: CacheDir must not be empty")
+	}
+	if cm.DirectoryURL == "" {
+		cm.DirectoryURL = ACMEDefaultDirectoryURL
+	}
+	if cm.RenewBeforeDays < 1 {
+		cm.RenewBeforeDays = ACMEDefaultRenewBeforeDays
+	}
+	if len(cm.ChallengeTypes) == 0 {
+		cm.ChallengeTypes = []string{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01}
+	}
+	for _, challengeType := range cm.ChallengeTypes {
+		if challengeType != ACMEChallengeHTTP01 && challengeType != ACMEChallengeTLSALPN01 {
+			return fmt.Errorf("CertManager.Initialise: unsupported challenge type \"%s\"", challengeType)
+		}
+	}
+	tlsConfig := &tls.Config{}
+	if cm.DirectoryCACertPath != "" {
+		caCerts, err := ioutil.ReadFile(cm.DirectoryCACertPath)
+		if err != nil {
+			return fmt.Errorf("CertManager.Initialise: failed to read directory CA certificates - %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCerts) {
+			return errors.New("CertManager.Initialise: directory CA certificate file does not contain a certificate")
+		}
+	}
+	if err := os.MkdirAll(cm.CacheDir, 0700); err != nil {
+		return fmt.Errorf("CertManager.Initialise: failed to create cache directory - %v", err)
+	}
+	state := &certManagerState{
+		client: &http.Client{
+			Timeout:   ACMEIOTimeoutSec * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+		httpTokens: make(map[string]string),
+		alpnCerts:  make(map[string]*tls.Certificate),
+	}
+	var err error
+	if state.accountKey, err = loadOrCreateECKey(filepath.Join(cm.CacheDir, acmeAccountKeyFileName)); err != nil {
+		return fmt.Errorf("CertManager.Initialise: failed to prepare account key - %v", err)
+	}
+	cm.state = state
+	// A missing or unusable certificate will be obtained by renewal
+	certPath, keyPath := filepath.Join(cm.CacheDir, acmeCertFileName), filepath.Join(cm.CacheDir, acmeKeyFileName)
+	if _, err := os.Stat(certPath); err == nil {
+		if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+			cm.logger.Warningf("Initialise", "", err, "failed to load cached certificate")
+		} else if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			cm.logger.Warningf("Initialise", "", err, "failed to parse cached certificate")
+		} else {
+			state.cert = &cert
+		}
+	}
+	return nil
+}
+
+// loadOrCreateECKey reads an ECDSA private key from the PEM file, or generates a P-256 key and saves it into the file.
+func loadOrCreateECKey(path string) (*ecdsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM file", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(path, keyPEM, 0600)
+}
+
+// encodeECKey returns the ECDSA private key in PEM encoding.
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// b64 returns the input in URL-safe base64 encoding without padding, as required by JWS.
+func b64(in []byte) string {
+	return base64.RawURLEncoding.EncodeToString(in)
+}
+
+// jwk returns the public account key in JSON web key representation.
+func (cm *CertManager) jwk() map[string]string {
+	pub := cm.state.accountKey.PublicKey
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64(pub.X.FillBytes(make([]byte, 32))),
+		"y":   b64(pub.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the account key.
+func (cm *CertManager) thumbprint() string {
+	// Keys of a map are marshalled in sorted order and without white spaces, just as the thumbprint requires.
+	jwkJSON, _ := json.Marshal(cm.jwk())
+	digest := sha256.Sum256(jwkJSON)
+	return b64(digest[:])
+}
+
+// getNonce returns the nonce from the latest response, or asks the directory for a new one.
+func (cm *CertManager) getNonce() (string, error) {
+	if nonce := cm.state.nonce; nonce != "" {
+		cm.state.nonce = ""
+		return nonce, nil
+	}
+	resp, err := cm.state.client.Head(cm.state.directory.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("directory did not offer a nonce")
+	}
+	return nonce, nil
+}
+
+/*
+signedPost sends the payload in a JWS signed by the account key, and returns the response header and body. A nil
+payload makes a POST-as-GET request. A request rejected for using a bad nonce is retried once.
+*/
+func (cm *CertManager) signedPost(url string, payload interface{}) (http.Header, []byte, error) {
+	var payloadJSON []byte
+	if payload != nil {
+		var err error
+		if payloadJSON, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		nonce, err := cm.getNonce()
+		if err != nil {
+			return nil, nil, fmt.Errorf("CertManager.signedPost: failed to get nonce - %v", err)
+		}
+		protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+		if cm.state.accountURL == "" {
+			protected["jwk"] = cm.jwk()
+		} else {
+			protected["kid"] = cm.state.accountURL
+		}
+		protectedJSON, err := json.Marshal(protected)
+		if err != nil {
+			return nil, nil, err
+		}
+		signingInput := b64(protectedJSON) + "." + b64(payloadJSON)
+		digest := sha256.Sum256([]byte(signingInput))
+		r, s, err := ecdsa.Sign(rand.Reader, cm.state.accountKey, digest[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		reqBody, err := json.Marshal(map[string]string{
+			"protected": b64(protectedJSON),
+			"payload":   b64(payloadJSON),
+			"signature": b64(signature),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := cm.state.client.Do(req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("CertManager.signedPost: failed to reach %s - %v", url, err)
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ACMEMaxResponseSize))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("CertManager.signedPost: failed to read response from %s - %v", url, err)
+		}
+		cm.state.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode/100 == 2 {
+			return resp.Header, body, nil
+		}
+		problem := &acmeProblem{}
+		json.Unmarshal(body, problem)
+		if problem.Type == acmeBadNonceError && attempt == 0 {
+			continue
+		}
+		return nil, nil, fmt.Errorf("CertManager.signedPost: %s responded with HTTP %d - %s", url, resp.StatusCode, problem)
+	}
+}
+
+// fetchDirectory retrieves resource URLs from the directory.
+func (cm *CertManager) fetchDirectory() error {
+	resp, err := cm.state.client.Get(cm.DirectoryURL)
+	if err != nil {
+		return fmt.Errorf("CertManager.fetchDirectory: failed to reach directory - %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ACMEMaxResponseSize))
+	if err != nil {
+		return fmt.Errorf("CertManager.fetchDirectory: failed to read directory - %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CertManager.fetchDirectory: directory responded with HTTP %d", resp.StatusCode)
+	}
+	var directory acmeDirectory
+	if err := json.Unmarshal(body, &directory); err != nil || directory.NewNonce == "" || directory.NewAccount == "" || directory.NewOrder == "" {
+		return fmt.Errorf("CertManager.fetchDirectory: directory is malformed - %v", err)
+	}
+	cm.state.directory = directory
+	return nil
+}
+
+// makeALPNCert returns a self-signed certificate that answers the TLS-ALPN-01 challenge of the domain.
+func makeALPNCert(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	extValue, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		DNSNames:        []string{domain},
+		ExtraExtensions: []pkix.Extension{{Id: oidACMEIdentifier, Critical: true, Value: extValue}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// authorize completes the authorisation by answering one of its challenges, and waits for it to become valid.
+func (cm *CertManager) authorize(authzURL string) error {
+	_, body, err := cm.signedPost(authzURL, nil)
+	if err != nil {
+		return err
+	}
+	var authz acmeAuthorization
+	if err := json.Unmarshal(body, &authz); err != nil {
+		return fmt.Errorf("CertManager.authorize: malformed authorisation - %v", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	} else if authz.Status != "pending" {
+		return fmt.Errorf("CertManager.authorize: authorisation of %s is %s", authz.Identifier.Value, authz.Status)
+	}
+	var challenge *acmeChallenge
+	for _, preferred := range cm.ChallengeTypes {
+		for i := range authz.Challenges {
+			if authz.Challenges[i].Type == preferred {
+				challenge = &authz.Challenges[i]
+				break
+			}
+		}
+		if challenge != nil {
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("CertManager.authorize: directory did not offer any of the challenges %v for %s", cm.ChallengeTypes, authz.Identifier.Value)
+	}
+	// Get ready to answer the challenge before asking the directory to validate it
+	keyAuth := challenge.Token + "." + cm.thumbprint()
+	domain := strings.ToLower(authz.Identifier.Value)
+	switch challenge.Type {
+	case ACMEChallengeHTTP01:
+		cm.state.mutex.Lock()
+		cm.state.httpTokens[challenge.Token] = keyAuth
+		cm.state.mutex.Unlock()
+		defer func() {
+			cm.state.mutex.Lock()
+			delete(cm.state.httpTokens, challenge.Token)
+			cm.state.mutex.Unlock()
+		}()
+	case ACMEChallengeTLSALPN01:
+		alpnCert, err := makeALPNCert(domain, keyAuth)
+		if err != nil {
+			return fmt.Errorf("CertManager.authorize: failed to make challenge certificate - %v", err)
+		}
+		cm.state.mutex.Lock()
+		cm.state.alpnCerts[domain] = alpnCert
+		cm.state.mutex.Unlock()
+		defer func() {
+			cm.state.mutex.Lock()
+			delete(cm.state.alpnCerts, domain)
+			cm.state.mutex.Unlock()
+		}()
+	}
+	cm.logger.Printf("authorize", domain, nil, "answering %s challenge", challenge.Type)
+	if _, _, err := cm.signedPost(challenge.URL, struct{}{}); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(ACMEPollTimeoutSec * time.Second); time.Now().Before(deadline); time.Sleep(ACMEPollIntervalSec * time.Second) {
+		if _, body, err = cm.signedPost(authzURL, nil); err != nil {
+			return err
+		}
+		authz = acmeAuthorization{}
+		if err := json.Unmarshal(body, &authz); err != nil {
+			return fmt.Errorf("CertManager.authorize: malformed authorisation - %v", err)
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+			continue
+		}
+		var problems []string
+		for _, answered := range authz.Challenges {
+			if answered.Error != nil {
+				problems = append(problems, answered.Error.String())
+			}
+		}
+		return fmt.Errorf("CertManager.authorize: authorisation of %s is %s - %s", domain, authz.Status, strings.Join(problems, "; "))
+	}
+	return fmt.Errorf("CertManager.authorize: authorisation of %s did not complete in time", domain)
+}
+
+// pollOrder waits for the order to become valid and returns it.
+func (cm *CertManager) pollOrder(orderURL string) (order acmeOrder, err error) {
+	for deadline := time.Now().Add(ACMEPollTimeoutSec * time.Second); time.Now().Before(deadline); time.Sleep(ACMEPollIntervalSec * time.Second) {
+		var body []byte
+		if _, body, err = cm.signedPost(orderURL, nil); err != nil {
+			return
+		}
+		order = acmeOrder{}
+		if err = json.Unmarshal(body, &order); err != nil {
+			err = fmt.Errorf("CertManager.pollOrder: malformed order - %v", err)
+			return
+		}
+		switch order.Status {
+		case "valid":
+			return
+		case "pending", "ready", "processing":
+			continue
+		}
+		err = fmt.Errorf("CertManager.pollOrder: order is %s - %s", order.Status, order.Error)
+		return
+	}
+	err = errors.New("CertManager.pollOrder: order did not complete in time")
+	return
+}
+
+/*
+ObtainCertificate registers an account with the directory, orders a certificate for all domain names, answers the
+challenges, and then saves the issued certificate into cache directory and puts it into use.
+*/
+func (cm *CertManager) ObtainCertificate() error {
+	cm.state.obtainMutex.Lock()
+	defer cm.state.obtainMutex.Unlock()
+	if err := cm.fetchDirectory(); err != nil {
+		return err
+	}
+	// Registration is idempotent, the directory responds with the existing account of the key.
+	cm.state.accountURL = ""
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if cm.ContactEmail != "" {
+		account["contact"] = []string{"mailto:" + cm.ContactEmail}
+	}
+	header, _, err := cm.signedPost(cm.state.directory.NewAccount, account)
+	if err != nil {
+		return err
+	}
+	if cm.state.accountURL = header.Get("Location"); cm.state.accountURL == "" {
+		return errors.New("CertManager.ObtainCertificate: directory did not respond with account URL")
+	}
+	// Order the certificate and complete all authorisations
+	identifiers := make([]map[string]string, 0, len(cm.Domains))
+	for _, domain := range cm.Domains {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": domain})
+	}
+	header, body, err := cm.signedPost(cm.state.directory.NewOrder, map[string]interface{}{"identifiers": identifiers})
+	if err != nil {
+		return err
+	}
+	orderURL := header.Get("Location")
+	var order acmeOrder
+	if err := json.Unmarshal(body, &order); err != nil || orderURL == "" {
+		return fmt.Errorf("CertManager.ObtainCertificate: malformed order - %v", err)
+	}
+	for _, authzURL := range order.Authorizations {
+		if err := cm.authorize(authzURL); err != nil {
+			return err
+		}
+	}
+	// Finalise the order with a new certificate key
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cm.Domains[0]},
+		DNSNames: cm.Domains,
+	}, certKey)
+	if err != nil {
+		return fmt.Errorf("CertManager.ObtainCertificate: failed to create certificate request - %v", err)
+	}
+	if _, _, err := cm.signedPost(order.Finalize, map[string]string{"csr": b64(csr)}); err != nil {
+		return err
+	}
+	if order, err = cm.pollOrder(orderURL); err != nil {
+		return err
+	}
+	_, certPEM, err := cm.signedPost(order.Certificate, nil)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeECKey(certKey)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("CertManager.ObtainCertificate: directory issued an unusable certificate - %v", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("CertManager.ObtainCertificate: directory issued an unusable certificate - %v", err)
+	}
+	// Cache the certificate before putting it into use
+	if err := ioutil.WriteFile(filepath.Join(cm.CacheDir, acmeKeyFileName), keyPEM, 0600); err != nil {
+		return fmt.Errorf("CertManager.ObtainCertificate: failed to save certificate key - %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cm.CacheDir, acmeCertFileName), certPEM, 0600); err != nil {
+		return fmt.Errorf("CertManager.ObtainCertificate: failed to save certificate - %v", err)
+	}
+	cm.state.mutex.Lock()
+	cm.state.cert = &cert
+	cm.state.mutex.Unlock()
+	cm.logger.Printf("ObtainCertificate", "", nil, "obtained certificate valid until %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// NeedsRenewal returns true if there is no certificate, or it is about to expire, or it does not cover all domain names.
+func (cm *CertManager) NeedsRenewal() bool {
+	cm.state.mutex.Lock()
+	defer cm.state.mutex.Unlock()
+	if cm.state.cert == nil || cm.state.cert.Leaf == nil {
+		return true
+	}
+	leaf := cm.state.cert.Leaf
+	if time.Now().Add(time.Duration(cm.RenewBeforeDays) * 24 * time.Hour).After(leaf.NotAfter) {
+		return true
+	}
+	for _, domain := range cm.Domains {
+		if leaf.VerifyHostname(domain) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+StartRenewal obtains a certificate in background right away if necessary, and then periodically renews it before it
+expires. Calling the function more than once has no further effect.
+*/
+func (cm *CertManager) StartRenewal() {
+	cm.state.mutex.Lock()
+	if cm.state.renewing {
+		cm.state.mutex.Unlock()
+		return
+	}
+	cm.state.renewing = true
+	stop := make(chan struct{})
+	cm.state.stopRenewal = stop
+	cm.state.mutex.Unlock()
+	go func() {
+		for {
+			intervalSec := ACMECheckIntervalSec
+			if cm.NeedsRenewal() {
+				if err := cm.ObtainCertificate(); err != nil {
+					cm.logger.Warningf("StartRenewal", "", err, "failed to obtain certificate, will retry in %d seconds", ACMERetryIntervalSec)
+					intervalSec = ACMERetryIntervalSec
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Duration(intervalSec) * time.Second):
+			}
+		}
+	}()
+}
+
+// StopRenewal stops the background renewal started by StartRenewal.
+func (cm *CertManager) StopRenewal() {
+	cm.state.mutex.Lock()
+	defer cm.state.mutex.Unlock()
+	if cm.state.renewing {
+		close(cm.state.stopRenewal)
+		cm.state.renewing = false
+	}
+}
+
+/*
+GetCertificate returns the TLS-ALPN-01 challenge certificate to the certificate authority that validates a challenge,
+or the latest certificate to everyone else. It is meant for tls.Config.
+*/
+func (cm *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cm.state.mutex.Lock()
+	defer cm.state.mutex.Unlock()
+	for _, proto := range hello.SupportedProtos {
+		if proto == ACMETLSALPNProtocol {
+			if alpnCert, found := cm.state.alpnCerts[strings.ToLower(hello.ServerName)]; found {
+				return alpnCert, nil
+			}
+			return nil, fmt.Errorf("CertManager.GetCertificate: there is no pending challenge for \"%s\"", hello.ServerName)
+		}
+	}
+	if cm.state.cert == nil {
+		return nil, errors.New("CertManager.GetCertificate: certificate has not yet been obtained")
+	}
+	return cm.state.cert, nil
+}
+
+// ServeHTTPChallenge responds to HTTP-01 challenge with the key authorisation of the token in URL path.
+func (cm *CertManager) ServeHTTPChallenge(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, ACMEHTTPChallengePath)
+	cm.state.mutex.Lock()
+	keyAuth, found := cm.state.httpTokens[token]
+	cm.state.mutex.Unlock()
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+}
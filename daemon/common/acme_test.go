@@ -0,0 +1,476 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is a minimal ACME directory that verifies JWS and validates challenges for real.
+type fakeACME struct {
+	server       *httptest.Server
+	httpURL      string // httpURL is the base URL of HTTP-01 challenge responder
+	tlsAddr      string // tlsAddr is the address of TLS-ALPN-01 challenge responder
+	rejectNonce  bool   // rejectNonce rejects the next request for using a bad nonce
+	caKey        *ecdsa.PrivateKey
+	caCert       *x509.Certificate
+	mutex        sync.Mutex
+	nonceCounter int
+	nonces       map[string]bool
+	accountJWKs  map[string]map[string]string
+	authzStatus  map[string]string
+	orderStatus  string
+	certPEM      []byte
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "laitos test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeACME{
+		caKey:       caKey,
+		caCert:      caCert,
+		nonces:      make(map[string]bool),
+		accountJWKs: make(map[string]map[string]string),
+		authzStatus: make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", fake.handleDirectory)
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		fake.newNonce(w)
+	})
+	mux.HandleFunc("/account", fake.handleAccount)
+	mux.HandleFunc("/new-order", fake.handleNewOrder)
+	mux.HandleFunc("/authz/", fake.handleAuthz)
+	mux.HandleFunc("/chal/", fake.handleChallenge)
+	mux.HandleFunc("/finalize", fake.handleFinalize)
+	mux.HandleFunc("/order", fake.handleOrder)
+	mux.HandleFunc("/cert", fake.handleCert)
+	fake.server = httptest.NewTLSServer(mux)
+	return fake
+}
+
+// newNonce issues a nonce in response header. Caller must hold the mutex.
+func (fake *fakeACME) newNonce(w http.ResponseWriter) {
+	fake.nonceCounter++
+	nonce := fmt.Sprintf("nonce%d", fake.nonceCounter)
+	fake.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+// respond writes the JSON document with a new nonce. Caller must hold the mutex.
+func (fake *fakeACME) respond(w http.ResponseWriter, status int, doc interface{}) {
+	fake.newNonce(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// verify checks nonce, URL, and signature of the JWS request, and returns its payload and JWK of the account.
+func (fake *fakeACME) verify(w http.ResponseWriter, r *http.Request) (payload []byte, jwk map[string]string, ok bool) {
+	var jws struct{ Protected, Payload, Signature string }
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &jws); err != nil {
+		fake.respond(w, http.StatusBadRequest, acmeProblem{Type: "urn:ietf:params:acme:error:malformed", Detail: err.Error()})
+		return
+	}
+	protectedJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	json.Unmarshal(protectedJSON, &protected)
+	if !fake.nonces[protected.Nonce] || fake.rejectNonce {
+		fake.rejectNonce = false
+		fake.respond(w, http.StatusBadRequest, acmeProblem{Type: acmeBadNonceError})
+		return
+	}
+	delete(fake.nonces, protected.Nonce)
+	if jwk = protected.JWK; jwk == nil {
+		jwk = fake.accountJWKs[protected.Kid]
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwk["x"])
+	y, _ := base64.RawURLEncoding.DecodeString(jwk["y"])
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if protected.Alg != "ES256" || protected.URL != fake.server.URL+r.URL.Path || len(signature) != 64 ||
+		!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		fake.respond(w, http.StatusUnauthorized, acmeProblem{Type: "urn:ietf:params:acme:error:unauthorized"})
+		return
+	}
+	return payload, jwk, true
+}
+
+func (fake *fakeACME) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(acmeDirectory{
+		NewNonce:   fake.server.URL + "/nonce",
+		NewAccount: fake.server.URL + "/account",
+		NewOrder:   fake.server.URL + "/new-order",
+	})
+}
+
+func (fake *fakeACME) handleAccount(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if _, jwk, ok := fake.verify(w, r); ok {
+		accountURL := fake.server.URL + "/acct/" + jwk["x"]
+		fake.accountJWKs[accountURL] = jwk
+		w.Header().Set("Location", accountURL)
+		fake.respond(w, http.StatusCreated, map[string]string{"status": "valid"})
+	}
+}
+
+// order returns the order document. Caller must hold the mutex.
+func (fake *fakeACME) order() acmeOrder {
+	order := acmeOrder{Status: fake.orderStatus, Finalize: fake.server.URL + "/finalize"}
+	for domain := range fake.authzStatus {
+		order.Authorizations = append(order.Authorizations, fake.server.URL+"/authz/"+domain)
+	}
+	if order.Status == "valid" {
+		order.Certificate = fake.server.URL + "/cert"
+	}
+	return order
+}
+
+func (fake *fakeACME) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	payload, _, ok := fake.verify(w, r)
+	if !ok {
+		return
+	}
+	var newOrder struct {
+		Identifiers []struct{ Type, Value string }
+	}
+	json.Unmarshal(payload, &newOrder)
+	fake.authzStatus = make(map[string]string)
+	for _, identifier := range newOrder.Identifiers {
+		fake.authzStatus[identifier.Value] = "pending"
+	}
+	fake.orderStatus = "pending"
+	w.Header().Set("Location", fake.server.URL+"/order")
+	fake.respond(w, http.StatusCreated, fake.order())
+}
+
+// authz returns the authorisation document of the domain. Caller must hold the mutex.
+func (fake *fakeACME) authz(domain string) acmeAuthorization {
+	authz := acmeAuthorization{Status: fake.authzStatus[domain]}
+	authz.Identifier.Type = "dns"
+	authz.Identifier.Value = domain
+	for _, challengeType := range []string{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01} {
+		challenge := acmeChallenge{Type: challengeType, URL: fake.server.URL + "/chal/" + challengeType + "/" + domain, Token: "token-" + domain, Status: authz.Status}
+		if authz.Status == "invalid" {
+			challenge.Error = &acmeProblem{Type: "urn:ietf:params:acme:error:incorrectResponse"}
+		}
+		authz.Challenges = append(authz.Challenges, challenge)
+	}
+	return authz
+}
+
+func (fake *fakeACME) handleAuthz(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if _, _, ok := fake.verify(w, r); ok {
+		fake.respond(w, http.StatusOK, fake.authz(strings.TrimPrefix(r.URL.Path, "/authz/")))
+	}
+}
+
+// validate visits the challenge responder and returns true only if it answers with the correct key authorisation.
+func (fake *fakeACME) validate(challengeType, domain, keyAuth string) bool {
+	switch challengeType {
+	case ACMEChallengeHTTP01:
+		resp, err := http.Get(fake.httpURL + ACMEHTTPChallengePath + "token-" + domain)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode == http.StatusOK && string(body) == keyAuth
+	case ACMEChallengeTLSALPN01:
+		conn, err := tls.Dial("tcp", fake.tlsAddr, &tls.Config{InsecureSkipVerify: true, ServerName: domain, NextProtos: []string{ACMETLSALPNProtocol}})
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		digest := sha256.Sum256([]byte(keyAuth))
+		expected, _ := asn1.Marshal(digest[:])
+		if state.NegotiatedProtocol != ACMETLSALPNProtocol || len(state.PeerCertificates) != 1 {
+			return false
+		}
+		for _, ext := range state.PeerCertificates[0].Extensions {
+			if ext.Id.Equal(oidACMEIdentifier) && ext.Critical && bytes.Equal(ext.Value, expected) {
+				return state.PeerCertificates[0].VerifyHostname(domain) == nil
+			}
+		}
+	}
+	return false
+}
+
+func (fake *fakeACME) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	_, jwk, ok := fake.verify(w, r)
+	if !ok {
+		return
+	}
+	typeAndDomain := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/chal/"), "/", 2)
+	jwkJSON, _ := json.Marshal(jwk)
+	thumbprint := sha256.Sum256(jwkJSON)
+	keyAuth := "token-" + typeAndDomain[1] + "." + base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	if fake.validate(typeAndDomain[0], typeAndDomain[1], keyAuth) {
+		fake.authzStatus[typeAndDomain[1]] = "valid"
+	} else {
+		fake.authzStatus[typeAndDomain[1]] = "invalid"
+	}
+	fake.respond(w, http.StatusOK, acmeChallenge{Type: typeAndDomain[0], Status: fake.authzStatus[typeAndDomain[1]]})
+}
+
+func (fake *fakeACME) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	payload, _, ok := fake.verify(w, r)
+	if !ok {
+		return
+	}
+	for _, status := range fake.authzStatus {
+		if status != "valid" {
+			fake.respond(w, http.StatusForbidden, acmeProblem{Type: "urn:ietf:params:acme:error:orderNotReady"})
+			return
+		}
+	}
+	var finalize struct{ CSR string }
+	json.Unmarshal(payload, &finalize)
+	csrDER, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil || csr.CheckSignature() != nil || len(csr.DNSNames) != len(fake.authzStatus) {
+		fake.respond(w, http.StatusBadRequest, acmeProblem{Type: "urn:ietf:params:acme:error:badCSR"})
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, fake.caCert, csr.PublicKey, fake.caKey)
+	if err != nil {
+		fake.respond(w, http.StatusInternalServerError, acmeProblem{Type: "urn:ietf:params:acme:error:serverInternal", Detail: err.Error()})
+		return
+	}
+	fake.certPEM = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fake.caCert.Raw})...)
+	fake.orderStatus = "valid"
+	fake.respond(w, http.StatusOK, fake.order())
+}
+
+func (fake *fakeACME) handleOrder(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if _, _, ok := fake.verify(w, r); ok {
+		fake.respond(w, http.StatusOK, fake.order())
+	}
+}
+
+func (fake *fakeACME) handleCert(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if _, _, ok := fake.verify(w, r); ok {
+		fake.newNonce(w)
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(fake.certPEM)
+	}
+}
+
+func TestCertManager(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "laitos-TestCertManager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fake := newFakeACME(t)
+	defer fake.server.Close()
+	caPath := filepath.Join(tmpDir, "directory-ca.pem")
+	if err := ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fake.server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check configuration
+	cm := CertManager{}
+	if cm.IsConfigured() {
+		t.Fatal("should not be configured")
+	}
+	cm.Domains = []string{"Example.com", "www.example.com"}
+	if err := cm.Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+	cm.CacheDir = filepath.Join(tmpDir, "cache")
+	cm.ChallengeTypes = []string{"dns-01"}
+	if err := cm.Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+	cm.ChallengeTypes = nil
+	cm.DirectoryURL = fake.server.URL + "/dir"
+	cm.DirectoryCACertPath = caPath
+	if err := cm.Initialise(); err != nil || cm.Domains[0] != "example.com" || cm.RenewBeforeDays != ACMEDefaultRenewBeforeDays {
+		t.Fatal(err, cm)
+	}
+	if !cm.NeedsRenewal() {
+		t.Fatal("should need renewal")
+	}
+	if _, err := cm.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"}); err == nil {
+		t.Fatal("should have failed")
+	}
+
+	// Answer HTTP-01 challenges and tolerate a bad nonce
+	httpResponder := httptest.NewServer(http.HandlerFunc(cm.ServeHTTPChallenge))
+	defer httpResponder.Close()
+	fake.httpURL = httpResponder.URL
+	fake.rejectNonce = true
+	if err := cm.ObtainCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cm.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil || cert.Leaf.VerifyHostname("www.example.com") != nil || cm.NeedsRenewal() {
+		t.Fatal(err, cert)
+	}
+	// Challenge responses are removed after use
+	if resp, err := http.Get(httpResponder.URL + ACMEHTTPChallengePath + "token-example.com"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatal(err, resp)
+	}
+
+	// Account key and certificate are loaded from cache directory
+	cached := CertManager{Domains: []string{"example.com", "www.example.com"}, CacheDir: cm.CacheDir}
+	if err := cached.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if cached.NeedsRenewal() || cached.thumbprint() != cm.thumbprint() {
+		t.Fatal("did not load from cache")
+	}
+	if cachedCert, err := cached.GetCertificate(&tls.ClientHelloInfo{}); err != nil || cachedCert.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Fatal(err)
+	}
+	// Renew when certificate is about to expire or does not cover all domains
+	cached.RenewBeforeDays = 100
+	if !cached.NeedsRenewal() {
+		t.Fatal("should need renewal")
+	}
+	cached.RenewBeforeDays = 30
+	cached.Domains = append(cached.Domains, "mail.example.com")
+	if !cached.NeedsRenewal() {
+		t.Fatal("should need renewal")
+	}
+
+	// A wrong answer to challenge fails the order
+	fake.httpURL = fake.server.URL
+	if err := cm.ObtainCertificate(); err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Fatal(err)
+	}
+
+	// Answer TLS-ALPN-01 challenges, and hand out the renewed certificate without restarting TLS listener.
+	cm.ChallengeTypes = []string{ACMEChallengeTLSALPN01}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: cm.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", ACMETLSALPNProtocol},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	fake.tlsAddr = listener.Addr().String()
+	if err := cm.ObtainCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: "www.example.com", RootCAs: func() *x509.CertPool {
+		pool := x509.NewCertPool()
+		pool.AddCert(fake.caCert)
+		return pool
+	}()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer := conn.ConnectionState().PeerCertificates[0]; peer.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		t.Fatal("did not hand out renewed certificate")
+	}
+	conn.Close()
+	// Without a pending challenge, the challenge handshake fails.
+	if _, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, ServerName: "example.com", NextProtos: []string{ACMETLSALPNProtocol}}); err == nil {
+		t.Fatal("should have failed")
+	}
+
+	// Renewal obtains certificate in background
+	renewing := CertManager{Domains: []string{"example.com"}, CacheDir: filepath.Join(tmpDir, "renewing"), DirectoryURL: fake.server.URL + "/dir", DirectoryCACertPath: caPath}
+	if err := renewing.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	renewingResponder := httptest.NewServer(http.HandlerFunc(renewing.ServeHTTPChallenge))
+	defer renewingResponder.Close()
+	fake.mutex.Lock()
+	fake.httpURL = renewingResponder.URL
+	fake.mutex.Unlock()
+	renewing.StartRenewal()
+	renewing.StartRenewal()
+	defer renewing.StopRenewal()
+	for i := 0; i < 50 && renewing.NeedsRenewal(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if renewing.NeedsRenewal() {
+		t.Fatal("did not obtain certificate in background")
+	}
+	if _, err := os.Stat(filepath.Join(renewing.CacheDir, acmeCertFileName)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"strings"
+)
+
+// MaxChainCommands is the maximum number of commands (including those in pipelines) that may be chained in a single input.
+const MaxChainCommands = 10
+
+/*
+CommandChain lets several toolbox commands run one after another from a single input, which helps to save messages
+sent from expensive channels such as SMS. Chaining is disabled unless the separators are configured.
+*/
+type CommandChain struct {
+	Separator     string `json:"Separator"`     // Separator separates independent commands, e.g. ";;".
+	PipeSeparator string `json:"PipeSeparator"` // PipeSeparator gives output of the command on its left to the command on its right, e.g. "|>".
+}
+
+// IsChained returns true only if the command content consists of more than one command.
+func (chain CommandChain) IsChained(content string) bool {
+	return chain.Separator != "" && strings.Contains(content, chain.Separator) ||
+		chain.PipeSeparator != "" && strings.Contains(content, chain.PipeSeparator)
+}
+
+/*
+Split breaks down command content into pipelines, each pipeline consists of one or more commands. Empty pipelines are
+discarded.
+*/
+func (chain CommandChain) Split(content string) (pipelines [][]string) {
+	pipelines = make([][]string, 0, 4)
+	segments := []string{content}
+	if chain.Separator != "" {
+		segments = strings.Split(content, chain.Separator)
+	}
+	for _, segment := range segments {
+		if strings.TrimSpace(segment) == "" {
+			continue
+		}
+		pipeline := []string{segment}
+		if chain.PipeSeparator != "" {
+			pipeline = strings.Split(segment, chain.PipeSeparator)
+		}
+		for i, cmd := range pipeline {
+			pipeline[i] = strings.TrimSpace(cmd)
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+	return
+}
+
+/*
+processChain runs each pipeline of chained commands one after another, and the timeout of input command is evenly
+split among the commands, each gets at least one second. In a pipeline, output of a command is appended to the
+parameters of the next command. A pipeline stops at the first error, which does not stop the pipelines that follow it.
+Return aggregated output of all pipelines, one pipeline per line, and the triggers of all features involved. The
+result carries an error if any pipeline failed.
+*/
+func (proc *CommandProcessor) processChain(cmd toolbox.Command) (*toolbox.Result, toolbox.Trigger) {
+	pipelines := proc.Chain.Split(cmd.Content)
+	numCommands := 0
+	for _, pipeline := range pipelines {
+		numCommands += len(pipeline)
+	}
+	if numCommands > MaxChainCommands {
+		return &toolbox.Result{Error: fmt.Errorf("chain may not have more than %d commands", MaxChainCommands)}, ""
+	}
+	stepTimeoutSec := 1
+	if numCommands > 0 && cmd.TimeoutSec/numCommands > 1 {
+		stepTimeoutSec = cmd.TimeoutSec / numCommands
+	}
+	outputs := make([]string, 0, len(pipelines))
+	triggers := make([]string, 0, numCommands)
+	numFailed := 0
+	for _, pipeline := range pipelines {
+		var output string
+		for i, content := range pipeline {
+			stepCmd := cmd
+			stepCmd.Content = content
+			stepCmd.TimeoutSec = stepTimeoutSec
+			if i > 0 {
+				stepCmd.Content += " " + output
+			}
+			feature, trigger, err := proc.matchFeature(&stepCmd)
+			if trigger != "" {
+				triggers = append(triggers, string(trigger))
+			}
+			var result *toolbox.Result
+			if err == nil {
+				proc.logger.Printf("processChain", "CommandProcessor", nil, "going to run %+v", stepCmd)
+				result = feature.Execute(stepCmd)
+			} else {
+				result = &toolbox.Result{Error: err}
+			}
+			if result.Error != nil {
+				output = result.ResetCombinedText()
+				numFailed++
+				break
+			}
+			output = strings.TrimSpace(result.Output)
+		}
+		outputs = append(outputs, output)
+	}
+	ret := &toolbox.Result{Output: strings.Join(outputs, "\n")}
+	if numFailed > 0 {
+		ret.Error = fmt.Errorf("%d of %d pipelines failed", numFailed, len(pipelines))
+	}
+	return ret, toolbox.Trigger(strings.Join(triggers, ","))
+}
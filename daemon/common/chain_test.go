@@ -0,0 +1,52 @@
+package common
+
+import (
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandChain_Split(t *testing.T) {
+	chain := CommandChain{}
+	if chain.IsChained(".s a ;; .s b |> .s c") {
+		t.Fatal("should not be chained")
+	}
+	chain = CommandChain{Separator: ";;", PipeSeparator: "|>"}
+	if chain.IsChained(".s a; b | c") || !chain.IsChained(".s a ;; .s b") || !chain.IsChained(".s a |> .s b") {
+		t.Fatal("wrong chain detection")
+	}
+	if pipelines := chain.Split(" .s a ;; ;; .s b |> .m c ;; "); !reflect.DeepEqual(pipelines, [][]string{{".s a"}, {".s b", ".m c"}}) {
+		t.Fatal(pipelines)
+	}
+	chain = CommandChain{PipeSeparator: "|>"}
+	if pipelines := chain.Split(".s a ;; .s b |> .m c"); !reflect.DeepEqual(pipelines, [][]string{{".s a ;; .s b", ".m c"}}) {
+		t.Fatal(pipelines)
+	}
+}
+
+func TestCommandProcessorChain(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	proc.Chain = CommandChain{Separator: ";;", PipeSeparator: "|>"}
+	// Independent commands and a pipeline, an error stops only its own pipeline.
+	result := proc.Process(toolbox.Command{TimeoutSec: 5, Content: "verysecret .s echo a ;; .s echo b |> .s echo c ;; .tg |> .s echo d ;; .s echo e"})
+	if result.ErrText() != "1 of 4 pipelines failed" || result.Output != "a\nc b\nbad prefix or feature is not configured\ne" ||
+		result.Command.Content != ".s echo a ;; .s echo b |> .s echo c ;; .tg |> .s echo d ;; .s echo e" {
+		t.Fatalf("%+v", result)
+	}
+	// Aggregated output is subject to LintText
+	result = proc.Process(toolbox.Command{TimeoutSec: 5, Content: "verysecret .s seq 1 20 ;; .s seq 21 40"})
+	if result.Error != nil || len(result.CombinedOutput) != 35 || !strings.HasPrefix(result.CombinedOutput, "1\n2\n3\n") {
+		t.Fatalf("%+v", result)
+	}
+	// Timeout is split among the commands
+	result = proc.Process(toolbox.Command{TimeoutSec: 4, Content: "verysecret .s sleep 3 ;; .s echo a"})
+	if result.ErrText() != "1 of 2 pipelines failed" || !strings.HasSuffix(result.Output, "\na") {
+		t.Fatalf("%+v", result)
+	}
+	// Too many commands
+	result = proc.Process(toolbox.Command{TimeoutSec: 5, Content: "verysecret" + strings.Repeat(" .s echo ;;", MaxChainCommands+1)})
+	if result.Error == nil {
+		t.Fatalf("%+v", result)
+	}
+}
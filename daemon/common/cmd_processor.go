@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/toolbox"
 	"github.com/HouzuoGuo/laitos/toolbox/filter"
@@ -26,6 +27,9 @@ const (
 // ErrBadPrefix is a command execution error triggered if the command does not contain a valid toolbox feature trigger.
 var ErrBadPrefix = errors.New("bad prefix or feature is not configured")
 
+// ErrFeatureNotAllowed is a command execution error triggered if the principal is not permitted to use the feature.
+var ErrFeatureNotAllowed = errors.New("feature is not permitted")
+
 // ErrBadPLT reminds user of the proper syntax to invoke PLT magic.
 var ErrBadPLT = errors.New(PrefixCommandPLT + " P L T command")
 
@@ -39,6 +43,12 @@ type CommandProcessor struct {
 	Features       *toolbox.FeatureSet    // Features is the aggregation of initialised toolbox feature routines.
 	CommandFilters []filter.CommandFilter // CommandFilters are applied one by one to alter input command content and/or timeout.
 	ResultFilters  []filter.ResultFilter  // ResultFilters are applied one by one to alter command execution result.
+	Chain          CommandChain           // Chain configures separators of several commands in a single input.
+	/*
+		NoPagination truncates long output to the maximum length of LintText bridge, instead of retaining the output for
+		the client to read it page by page. It suits front-ends that do not take further commands from the recipient.
+	*/
+	NoPagination bool
 
 	logger misc.Logger
 }
@@ -81,12 +91,23 @@ func (proc *CommandProcessor) IsSaneForInternet() (errs []error) {
 		seenPIN := false
 		for _, cmdBridge := range proc.CommandFilters {
 			if pin, yes := cmdBridge.(*filter.PINAndShortcuts); yes {
-				if pin.PIN == "" && (pin.Shortcuts == nil || len(pin.Shortcuts) == 0) {
+				if !pin.IsConfigured() {
 					errs = append(errs, errors.New(ErrBadProcessorConfig+"PIN is empty and there is no shortcut defined, hence no command will ever execute."))
 				}
 				if pin.PIN != "" && len(pin.PIN) < 7 {
 					errs = append(errs, errors.New(ErrBadProcessorConfig+"PIN is too short, make it at least 7 characters long to be somewhat secure."))
 				}
+				for name, principal := range pin.Principals {
+					if principal.PIN == "" && len(principal.Shortcuts) == 0 && len(principal.DaemonShortcuts) == 0 {
+						errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"Principal \"%s\" has neither PIN nor shortcut.", name))
+					}
+					if principal.PIN != "" && len(principal.PIN) < 7 {
+						errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"PIN of principal \"%s\" is too short, make it at least 7 characters long to be somewhat secure.", name))
+					}
+				}
+				if err := pin.Check(); err != nil {
+					errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"%v", err))
+				}
 				seenPIN = true
 				break
 			}
@@ -94,6 +115,14 @@ func (proc *CommandProcessor) IsSaneForInternet() (errs []error) {
 		if !seenPIN {
 			errs = append(errs, errors.New(ErrBadProcessorConfig+"\"PINAndShortcuts\" bridge is not used, this is horribly insecure."))
 		}
+		// Check whether TOTP bridge, if used, is able to calculate passwords
+		for _, cmdBridge := range proc.CommandFilters {
+			if totp, yes := cmdBridge.(*filter.TOTP); yes {
+				if err := totp.Check(); err != nil {
+					errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"TOTP secret is not valid base32 text - %v", err))
+				}
+			}
+		}
 	}
 	if proc.ResultFilters == nil {
 		errs = append(errs, errors.New(ErrBadProcessorConfig+"ResultFilters is not assigned"))
@@ -112,15 +141,60 @@ func (proc *CommandProcessor) IsSaneForInternet() (errs []error) {
 		if !seenLinter {
 			errs = append(errs, errors.New(ErrBadProcessorConfig+"\"LintText\" bridge is not used, this may cause crashes or undesired telephone cost."))
 		}
+		// Check whether transliteration, if used, is able to load its pinyin table
+		for _, resultBridge := range proc.ResultFilters {
+			if trans, yes := resultBridge.(*filter.TransliterateText); yes && trans.IsConfigured() {
+				if err := trans.Check(); err != nil {
+					errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"transliteration is misconfigured - %v", err))
+				}
+			}
+		}
+		// Check whether output encryption, if used, has valid recipient keys and fits into the maximum output length
+		for _, resultBridge := range proc.ResultFilters {
+			if enc, yes := resultBridge.(*filter.EncryptOutput); yes && enc.IsConfigured() {
+				if err := enc.Check(); err != nil {
+					errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"output encryption is misconfigured and no output will be delivered - %v", err))
+					continue
+				}
+				for _, lintBridge := range proc.ResultFilters {
+					if linter, yes := lintBridge.(*filter.LintText); yes && linter.MaxLength > 0 && enc.MaxPlainTextLength(linter.MaxLength) < 1 {
+						errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"Maximum output length %d cannot accommodate encrypted output, make it at least %d.", linter.MaxLength, enc.ArmoredLength(1)))
+					}
+				}
+			}
+		}
 	}
 	return
 }
 
+/*
+IsTriggerAllowed returns true only if the principal may use the feature of the trigger, according to the configuration
+of PINAndShortcuts filter. The default PIN and shortcuts (empty principal name) may use all features.
+*/
+func (proc *CommandProcessor) IsTriggerAllowed(principalName string, trigger toolbox.Trigger) bool {
+	if principalName == "" {
+		return true
+	}
+	for _, cmdBridge := range proc.CommandFilters {
+		if pin, yes := cmdBridge.(*filter.PINAndShortcuts); yes {
+			return pin.IsTriggerAllowed(principalName, trigger)
+		}
+	}
+	return false
+}
+
 /*
 Process applies filters to the command, invokes toolbox feature functions to process the content, and then applies
 filters to the execution result and return.
 A special content prefix called "PLT prefix" alters filter settings to temporarily override timeout and max.length
 settings, and it may optionally discard a number of characters from the beginning.
+The principal identified by PIN or shortcut is recorded in the command of execution result, and the command is rejected
+if the principal is not permitted to use the feature.
+Special content prefixes run the command as a background job and retrieve job output. If command chain is configured,
+several commands in the content run one after another and their output is aggregated into a single result.
+If the client is identified by the command, a long output is retained for the client and the first page is returned,
+the remaining pages are retrieved by another special content prefix without running the command again.
+If client lockout is configured, a client who repeatedly fails to match PIN or TOTP code is rejected for a while.
 */
 func (proc *CommandProcessor) Process(cmd toolbox.Command) (ret *toolbox.Result) {
 	// Put execution duration into statistics
@@ -132,18 +206,37 @@ func (proc *CommandProcessor) Process(cmd toolbox.Command) (ret *toolbox.Result)
 	if misc.EmergencyLockDown {
 		return &toolbox.Result{Error: misc.ErrEmergencyLockDown}
 	}
+	// Do not execute a command if its client has failed to match PIN too many times
+	if ClientLockouts != nil {
+		if err := ClientLockouts.Check(cmd); err != nil {
+			return &toolbox.Result{Error: err}
+		}
+	}
 	var bridgeErr error
 	var matchedFeature toolbox.Feature
+	var matchedTrigger toolbox.Trigger
 	var overrideLintText filter.LintText
 	var hasOverrideLintText bool
+	var isJob bool
+	var isNextPage, canPaginate bool
+	var matchErr error
 	logCommandContent := cmd.Content
 	// Walk the command through all bridges
 	for _, cmdBridge := range proc.CommandFilters {
 		cmd, bridgeErr = cmdBridge.Transform(cmd)
 		if bridgeErr != nil {
+			// Someone who overheard the PIN must not be able to guess TOTP code without limit
+			if (bridgeErr == filter.ErrPINAndShortcutNotFound || bridgeErr == filter.ErrTOTPNotFound) && ClientLockouts != nil {
+				ClientLockouts.RecordFailure(cmd)
+			}
 			ret = &toolbox.Result{Error: bridgeErr}
 			goto result
 		}
+		// Should a later bridge fail (e.g. TOTP mismatch), do not log the PIN that has already been removed.
+		logCommandContent = cmd.Content
+	}
+	if ClientLockouts != nil {
+		ClientLockouts.RecordSuccess(cmd)
 	}
 	// Trim spaces and expect non-empty command
 	if ret = cmd.Trim(); ret != nil {
@@ -151,6 +244,12 @@ func (proc *CommandProcessor) Process(cmd toolbox.Command) (ret *toolbox.Result)
 	}
 	// If bridges did not throw an error, they should have got rid of bits and pieces of command content that must not be logged.
 	logCommandContent = cmd.Content
+	// Only the results of commands that made it through bridges may be retained for pagination
+	canPaginate = true
+	// Commands that made it through bridges are recorded in audit log
+	defer func() {
+		proc.writeAuditRecord(ret, matchedTrigger, beginTimeNano)
+	}()
 	// Look for PLT (position, length, timeout) override, it is going to affect LintText bridge.
 	if cmd.FindAndRemovePrefix(PrefixCommandPLT) {
 		// Find the configured LintText bridge
@@ -190,16 +289,38 @@ func (proc *CommandProcessor) Process(cmd toolbox.Command) (ret *toolbox.Result)
 			goto result
 		}
 	}
+	// Look for next page retrieval, the page has already gone through LintText bridge.
+	if cmd.FindAndRemovePrefix(PrefixCommandNextPage) {
+		isNextPage = true
+		page, err := PaginatedOutputs.GetNextPage(cmd)
+		ret = &toolbox.Result{Output: page, Error: err}
+		goto result
+	}
+	// Several commands may be chained and piped in a single input
+	if proc.Chain.IsChained(cmd.Content) {
+		ret, matchedTrigger = proc.processChain(cmd)
+		goto result
+	}
+	// Look for job output retrieval, it does not involve a feature.
+	if cmd.FindAndRemovePrefix(PrefixCommandJobOutput) {
+		ret = proc.getJobOutput(cmd, overrideLintText, hasOverrideLintText)
+		goto result
+	}
+	// Look for job prefix, the command will run in background once its feature is matched.
+	isJob = cmd.FindAndRemovePrefix(PrefixCommandJob)
 	// Look for command's prefix among configured features
-	for prefix, configuredFeature := range proc.Features.LookupByTrigger {
-		if cmd.FindAndRemovePrefix(string(prefix)) {
-			matchedFeature = configuredFeature
-			break
-		}
+	if matchedFeature, matchedTrigger, matchErr = proc.matchFeature(&cmd); matchErr != nil {
+		ret = &toolbox.Result{Error: matchErr}
+		goto result
 	}
-	// Unknown command prefix or the requested feature is not configured
-	if matchedFeature == nil {
-		ret = &toolbox.Result{Error: ErrBadPrefix}
+	// Run the feature in background and respond with job ID
+	if isJob {
+		proc.logger.Printf("Process", "CommandProcessor", nil, "going to run job %+v", cmd)
+		if jobID, err := BackgroundJobs.Start(matchedFeature, matchedTrigger, cmd); err == nil {
+			ret = &toolbox.Result{Output: fmt.Sprintf("job %d started", jobID)}
+		} else {
+			ret = &toolbox.Result{Error: err}
+		}
 		goto result
 	}
 	// Run the feature
@@ -218,19 +339,112 @@ result:
 		after triggering bridges, and before triggering features.
 	*/
 	ret.Command.Content = logCommandContent
+	ret.Trigger = matchedTrigger
 	// Walk through result bridges
 	for _, resultBridge := range proc.ResultFilters {
-		// LintText bridge may have been manipulated by override
-		if _, isLintText := resultBridge.(*filter.LintText); isLintText && hasOverrideLintText {
-			resultBridge = &overrideLintText
+		if lint, isLintText := resultBridge.(*filter.LintText); isLintText {
+			if hasOverrideLintText {
+				// LintText bridge may have been manipulated by override
+				lint = &overrideLintText
+			} else if isNextPage {
+				continue
+			}
+			// Leave room for the encryption that takes place after linting
+			fitLint := *lint
+			fitLint.MaxLength = proc.fitEncryptedOutput(lint.MaxLength)
+			if !hasOverrideLintText && canPaginate && !proc.NoPagination && PaginatedOutputs.Paginate(ret, &fitLint) {
+				// Instead of truncating the output, the first page is given and the rest may be retrieved later.
+				continue
+			}
+			resultBridge = &fitLint
 		}
 		if err := resultBridge.Transform(ret); err != nil {
-			return &toolbox.Result{Command: ret.Command, Error: bridgeErr}
+			return &toolbox.Result{Command: ret.Command, Error: err}
 		}
 	}
 	return
 }
 
+/*
+matchFeature looks for command's prefix among configured features and removes the prefix from command content. Return
+ErrBadPrefix if the prefix is unknown or the feature is not configured, or ErrFeatureNotAllowed if the principal
+identified by PIN or shortcut is not permitted to use the feature.
+*/
+func (proc *CommandProcessor) matchFeature(cmd *toolbox.Command) (toolbox.Feature, toolbox.Trigger, error) {
+	for prefix, configuredFeature := range proc.Features.LookupByTrigger {
+		if cmd.FindAndRemovePrefix(string(prefix)) {
+			if !proc.IsTriggerAllowed(cmd.Principal, prefix) {
+				proc.logger.Warningf("Process", "CommandProcessor", nil, "principal \"%s\" is not permitted to use feature \"%s\"", cmd.Principal, prefix)
+				return nil, prefix, ErrFeatureNotAllowed
+			}
+			return configuredFeature, prefix, nil
+		}
+	}
+	return nil, "", ErrBadPrefix
+}
+
+/*
+getJobOutput retrieves status or a page of output of a background job. Each page fits into the maximum output length
+of LintText bridge.
+*/
+func (proc *CommandProcessor) getJobOutput(cmd toolbox.Command, overrideLintText filter.LintText, hasOverrideLintText bool) *toolbox.Result {
+	pageSize := 0
+	if hasOverrideLintText {
+		pageSize = overrideLintText.MaxLength
+	} else {
+		for _, resultBridge := range proc.ResultFilters {
+			if aBridge, isLintText := resultBridge.(*filter.LintText); isLintText {
+				pageSize = aBridge.MaxLength
+				break
+			}
+		}
+	}
+	pageSize = proc.fitEncryptedOutput(pageSize)
+	out, err := BackgroundJobs.GetOutputByParams(cmd.Principal, cmd.Content, pageSize)
+	return &toolbox.Result{Output: out, Error: err}
+}
+
+/*
+fitEncryptedOutput returns the maximum length of plain text output that still fits into maxLength once it is encrypted
+by EncryptOutput result filter. If output encryption is not configured, or maxLength cannot accommodate encrypted output
+at all, maxLength is returned as-is.
+*/
+func (proc *CommandProcessor) fitEncryptedOutput(maxLength int) int {
+	if maxLength <= 0 {
+		return maxLength
+	}
+	for _, resultBridge := range proc.ResultFilters {
+		if enc, yes := resultBridge.(*filter.EncryptOutput); yes && enc.IsConfigured() {
+			if plainLength := enc.MaxPlainTextLength(maxLength); plainLength > 0 {
+				return plainLength
+			}
+		}
+	}
+	return maxLength
+}
+
+// writeAuditRecord records command execution result in the audit log, if the audit log is configured.
+func (proc *CommandProcessor) writeAuditRecord(result *toolbox.Result, trigger toolbox.Trigger, beginTimeNano int64) {
+	if misc.CommandAuditLog == nil || result == nil {
+		return
+	}
+	now := time.Now()
+	record := misc.AuditRecord{
+		Time:         now,
+		DaemonName:   result.Command.DaemonName,
+		ClientID:     result.Command.ClientID,
+		Principal:    result.Command.Principal,
+		Trigger:      string(trigger),
+		Command:      result.Command.Content,
+		DurationMS:   (now.UnixNano() - beginTimeNano) / 1000000,
+		Error:        result.ErrText(),
+		OutputLength: len(result.CombinedOutput),
+	}
+	if err := misc.CommandAuditLog.Write(record); err != nil {
+		proc.logger.Warningf("writeAuditRecord", result.Command.ClientID, err, "failed to write audit record")
+	}
+}
+
 // Return a realistic command processor for test cases. The only feature made available and initialised is shell execution.
 func GetTestCommandProcessor() *CommandProcessor {
 	// Prepare feature set - the shell execution feature should be available even without configuration
@@ -4,8 +4,13 @@ import (
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/toolbox"
 	"github.com/HouzuoGuo/laitos/toolbox/filter"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCommandProcessorProcess(t *testing.T) {
@@ -96,6 +101,170 @@ func TestCommandProcessorProcess(t *testing.T) {
 	misc.EmergencyLockDown = false
 }
 
+func TestCommandProcessorPrincipals(t *testing.T) {
+	features := &toolbox.FeatureSet{}
+	if err := features.Initialise(); err != nil {
+		t.Fatal(features)
+	}
+	proc := CommandProcessor{
+		Features: features,
+		CommandFilters: []filter.CommandFilter{&filter.PINAndShortcuts{
+			PIN: "mypin",
+			Principals: map[string]filter.Principal{
+				"alice": {PIN: "alicepin", AllowTriggers: []string{".e"}},
+				"bob":   {Shortcuts: map[string]string{"bobecho": ".s echo bob"}},
+			},
+		}},
+		ResultFilters: []filter.ResultFilter{&filter.ResetCombinedText{}},
+	}
+	// Default PIN may use all features
+	result := proc.Process(toolbox.Command{TimeoutSec: 5, Content: "mypin.s echo hi"})
+	if result.Error != nil || result.Output != "hi\n" || result.Command.Principal != "" {
+		t.Fatalf("%+v", result)
+	}
+	// Principal may only use permitted features
+	result = proc.Process(toolbox.Command{TimeoutSec: 5, Content: "alicepin.s echo hi"})
+	if !reflect.DeepEqual(result.Command, toolbox.Command{TimeoutSec: 5, Content: ".s echo hi", Principal: "alice"}) ||
+		result.Error != ErrFeatureNotAllowed || result.Output != "" {
+		t.Fatalf("%+v", result)
+	}
+	result = proc.Process(toolbox.Command{TimeoutSec: 5, Content: "alicepin.e info"})
+	if result.Error != nil || result.Command.Principal != "alice" {
+		t.Fatalf("%+v", result)
+	}
+	// Principal without restriction may use all features
+	result = proc.Process(toolbox.Command{TimeoutSec: 5, Content: "bobecho"})
+	if result.Error != nil || result.Output != "bob\n" || result.Command.Principal != "bob" {
+		t.Fatalf("%+v", result)
+	}
+	if !proc.IsTriggerAllowed("", ".s") || proc.IsTriggerAllowed("alice", ".s") || proc.IsTriggerAllowed("nobody", ".e") {
+		t.Fatal("wrong permission")
+	}
+}
+
+func TestCommandProcessorTOTP(t *testing.T) {
+	features := &toolbox.FeatureSet{}
+	if err := features.Initialise(); err != nil {
+		t.Fatal(features)
+	}
+	proc := CommandProcessor{
+		Features: features,
+		CommandFilters: []filter.CommandFilter{
+			&filter.PINAndShortcuts{PIN: "mypin", Shortcuts: map[string]string{"sc": ".s echo sc"}},
+			&filter.TOTP{Secret: "JBSWY3DPEHPK3PXP"},
+		},
+		ResultFilters: []filter.ResultFilter{&filter.ResetCombinedText{}},
+	}
+	code, err := toolbox.GetTwoFACodeForTimeDivision("JBSWY3DPEHPK3PXP", time.Now().Unix()/filter.TOTPIntervalSec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neither PIN nor TOTP code shall be logged when the code is missing
+	result := proc.Process(toolbox.Command{TimeoutSec: 5, Content: "mypin.s echo hi"})
+	if result.Error != filter.ErrTOTPNotFound || result.Command.Content != ".s echo hi" {
+		t.Fatalf("%+v", result)
+	}
+	// Shortcut does not carry a code
+	result = proc.Process(toolbox.Command{TimeoutSec: 5, Content: "sc"})
+	if result.Error != filter.ErrTOTPNotFound {
+		t.Fatalf("%+v", result)
+	}
+	result = proc.Process(toolbox.Command{TimeoutSec: 5, Content: "mypin" + code + " .s echo hi"})
+	if result.Error != nil || result.Output != "hi\n" || result.Command.Content != ".s echo hi" {
+		t.Fatalf("%+v", result)
+	}
+	// Code may not be used again
+	result = proc.Process(toolbox.Command{TimeoutSec: 5, Content: "mypin" + code + " .s echo hi"})
+	if result.Error != filter.ErrTOTPNotFound {
+		t.Fatalf("%+v", result)
+	}
+}
+
+func TestCommandProcessorAuditLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "laitos-TestCommandProcessorAuditLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	auditLog := &misc.AuditLog{FilePath: filepath.Join(tmpDir, "audit.log")}
+	if err := auditLog.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	misc.CommandAuditLog = auditLog
+	defer func() {
+		misc.CommandAuditLog = nil
+	}()
+	proc := GetTestCommandProcessor()
+	// PIN mismatch is not recorded
+	proc.Process(toolbox.Command{TimeoutSec: 5, Content: "wrongpin.s echo hi", DaemonName: "test", ClientID: "client"})
+	proc.Process(toolbox.Command{TimeoutSec: 5, Content: "verysecret.s echo hi", DaemonName: "test", ClientID: "client"})
+	records, err := auditLog.Read(10, "")
+	if err != nil || len(records) != 1 {
+		t.Fatal(records, err)
+	}
+	record := records[0]
+	if record.DaemonName != "test" || record.ClientID != "client" || record.Trigger != ".s" || record.Command != ".s echo hi" ||
+		record.Error != "" || record.OutputLength != 2 || strings.Contains(record.String(), "verysecret") {
+		t.Fatalf("%+v", record)
+	}
+}
+
+func TestCommandProcessorJobs(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	result := proc.Process(toolbox.Command{TimeoutSec: 1, Content: "verysecret.job .s sleep 2; echo job output"})
+	if result.Error != nil || !strings.HasPrefix(result.Output, "job ") || !strings.HasSuffix(result.Output, " started") {
+		t.Fatalf("%+v", result)
+	}
+	jobID := strings.TrimSuffix(strings.TrimPrefix(result.Output, "job "), " started")
+	// Job runs beyond the timeout of command that started it
+	time.Sleep(1500 * time.Millisecond)
+	result = proc.Process(toolbox.Command{TimeoutSec: 1, Content: "verysecret.out " + jobID})
+	if result.Error != nil || !strings.Contains(result.Output, "has been running") {
+		t.Fatalf("%+v", result)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	result = proc.Process(toolbox.Command{TimeoutSec: 1, Content: "verysecret.out " + jobID})
+	if result.Error != nil || result.CombinedOutput != "job output" {
+		t.Fatalf("%+v", result)
+	}
+	result = proc.Process(toolbox.Command{TimeoutSec: 1, Content: "verysecret.out"})
+	if result.Error != nil || !strings.Contains(result.Output, jobID+" done .s sleep 2; echo job output") {
+		t.Fatalf("%+v", result)
+	}
+	result = proc.Process(toolbox.Command{TimeoutSec: 1, Content: "verysecret.out 0"})
+	if result.Error != ErrJobNotFound {
+		t.Fatalf("%+v", result)
+	}
+	result = proc.Process(toolbox.Command{TimeoutSec: 1, Content: "verysecret.job .tg"})
+	if result.Error != ErrBadPrefix {
+		t.Fatalf("%+v", result)
+	}
+}
+
+func TestCommandProcessorEncryptOutput(t *testing.T) {
+	privateKey, publicKey, err := filter.GenerateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := &filter.EncryptOutput{RecipientPublicKeys: []string{publicKey}}
+	proc := GetTestCommandProcessor()
+	proc.ResultFilters = []filter.ResultFilter{&filter.ResetCombinedText{}, &filter.LintText{MaxLength: 500}, enc}
+	// Encrypted output fits into the maximum output length
+	result := proc.Process(toolbox.Command{TimeoutSec: 5, Content: "verysecret .s seq 1 1000"})
+	if result.Error != nil || len(result.CombinedOutput) > 500 {
+		t.Fatalf("%+v", result)
+	}
+	decrypted, err := filter.DecryptOutput(result.CombinedOutput, privateKey)
+	if err != nil || len(decrypted) != enc.MaxPlainTextLength(500) || !strings.HasPrefix(decrypted, "1\n2\n3\n") {
+		t.Fatal(decrypted, err)
+	}
+	// Encryption failure is reported
+	enc.RecipientPublicKeys = []string{"aGVsbG8="}
+	if result := proc.Process(toolbox.Command{TimeoutSec: 5, Content: "verysecret .s echo hi"}); result.Error == nil || result.CombinedOutput != "" {
+		t.Fatalf("%+v", result)
+	}
+}
+
 func TestCommandProcessorIsSaneForInternet(t *testing.T) {
 	proc := CommandProcessor{
 		Features:       nil,
@@ -139,6 +308,11 @@ func TestCommandProcessorIsSaneForInternet(t *testing.T) {
 	if errs := proc.IsSaneForInternet(); len(errs) != 2 {
 		t.Fatal(errs)
 	}
+	// Principals have short PIN or nothing at all
+	proc.CommandFilters = []filter.CommandFilter{&filter.PINAndShortcuts{Principals: map[string]filter.Principal{"a": {PIN: "aaaaaa"}, "b": {}}}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 3 {
+		t.Fatal(errs)
+	}
 	// Good PIN bridge
 	proc.CommandFilters = []filter.CommandFilter{&filter.PINAndShortcuts{PIN: "very-long-pin"}}
 	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
@@ -159,6 +333,50 @@ func TestCommandProcessorIsSaneForInternet(t *testing.T) {
 	if errs := proc.IsSaneForInternet(); len(errs) != 0 {
 		t.Fatal(errs)
 	}
+	// TOTP bridge has bad secret
+	proc.CommandFilters = []filter.CommandFilter{&filter.PINAndShortcuts{PIN: "very-long-pin"}, &filter.TOTP{Secret: "not-base32!"}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
+		t.Fatal(errs)
+	}
+	// Good TOTP bridge
+	proc.CommandFilters = []filter.CommandFilter{&filter.PINAndShortcuts{PIN: "very-long-pin"}, &filter.TOTP{Secret: "JBSWY3DPEHPK3PXP"}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	// Shortcut begins with a placeholder
+	proc.CommandFilters = []filter.CommandFilter{&filter.PINAndShortcuts{PIN: "very-long-pin", Shortcuts: map[string]string{"$1": ".s $1"}}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
+		t.Fatal(errs)
+	}
+	proc.CommandFilters = []filter.CommandFilter{&filter.PINAndShortcuts{PIN: "very-long-pin", Shortcuts: map[string]string{"s $1": ".s $1"}}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	// Output encryption has bad public key
+	proc.ResultFilters = []filter.ResultFilter{&filter.LintText{MaxLength: 35}, &filter.EncryptOutput{RecipientPublicKeys: []string{"aGVsbG8="}}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
+		t.Fatal(errs)
+	}
+	// Output encryption does not fit into maximum output length
+	proc.ResultFilters = []filter.ResultFilter{&filter.LintText{MaxLength: 160}, &filter.EncryptOutput{RecipientPublicKeys: []string{"3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FiPGBSo="}}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
+		t.Fatal(errs)
+	}
+	// Good output encryption
+	proc.ResultFilters = []filter.ResultFilter{&filter.LintText{MaxLength: 1000}, &filter.EncryptOutput{RecipientPublicKeys: []string{"3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FiPGBSo="}}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	// Transliteration cannot load its pinyin table
+	proc.ResultFilters = []filter.ResultFilter{&filter.TransliterateText{ToASCII: true, PinyinTablePath: "/does-not-exist"}, &filter.LintText{MaxLength: 35}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
+		t.Fatal(errs)
+	}
+	// Good transliteration
+	proc.ResultFilters = []filter.ResultFilter{&filter.TransliterateText{ToASCII: true, CompactEncoding: true}, &filter.LintText{MaxLength: 35}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
 
 }
 
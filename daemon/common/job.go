@@ -0,0 +1,201 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	/*
+		PrefixCommandJob is the magic string to prefix command input, in order to run the command in background and
+		immediately respond with a job ID. It helps front-ends with short timeout (e.g. Twilio) to run long commands.
+	*/
+	PrefixCommandJob = ".job"
+	// PrefixCommandJobOutput is the magic string to prefix a job ID (and optionally page number), in order to retrieve job status and output.
+	PrefixCommandJobOutput = ".out"
+
+	JobDefaultMaxRunning   = 4     // JobDefaultMaxRunning is the default number of jobs that may run at the same time.
+	JobDefaultRetentionSec = 3600  // JobDefaultRetentionSec is the default number of seconds to retain a finished job.
+	JobDefaultTimeoutSec   = 600   // JobDefaultTimeoutSec is the default timeout of a job.
+	JobMaxOutputLength     = 65536 // JobMaxOutputLength is the maximum number of characters of job output to retain.
+	JobPageMarkerLength    = 10    // JobPageMarkerLength is the room reserved for page marker (e.g. "[2/5] ") in each page of output.
+)
+
+var (
+	ErrTooManyJobs   = errors.New("too many jobs are running")
+	ErrJobNotFound   = errors.New("job does not exist or has expired")
+	ErrBadJobCommand = errors.New(PrefixCommandJobOutput + " job_id [page]")
+)
+
+// RegexJobIDAndPage parses job ID and optional page number that follow PrefixCommandJobOutput.
+var RegexJobIDAndPage = regexp.MustCompile(`^\s*(\d+)(?:[^\d]+(\d+))?\s*$`)
+
+// Job is a toolbox command that runs in background.
+type Job struct {
+	ID        int            // ID is a sequence number assigned to the job.
+	Principal string         // Principal is the name of user who started the job.
+	Command   string         // Command is the command content, including feature trigger.
+	Started   time.Time      // Started is the time job began to run.
+	Finished  time.Time      // Finished is the time job finished, it is zero if the job is still running.
+	Result    toolbox.Result // Result is the feature execution result with combined text, it is present after job finishes.
+}
+
+/*
+JobStore runs jobs in background and retains their results for later retrieval. All command processors share the same
+job store, so that a job started by one front-end may be retrieved from another front-end.
+*/
+type JobStore struct {
+	MaxRunning   int `json:"MaxRunning"`   // MaxRunning is the number of jobs that may run at the same time.
+	RetentionSec int `json:"RetentionSec"` // RetentionSec is the number of seconds to retain a finished job.
+	TimeoutSec   int `json:"TimeoutSec"`   // TimeoutSec is the timeout of each job.
+
+	lastID  int
+	jobs    map[int]*Job
+	running int
+	mutex   *sync.Mutex
+}
+
+// BackgroundJobs is the job store shared by all command processors.
+var BackgroundJobs = &JobStore{}
+
+func init() {
+	BackgroundJobs.Initialise()
+}
+
+// Initialise prepares internal states and sets default limits.
+func (store *JobStore) Initialise() {
+	if store.MaxRunning < 1 {
+		store.MaxRunning = JobDefaultMaxRunning
+	}
+	if store.RetentionSec < 1 {
+		store.RetentionSec = JobDefaultRetentionSec
+	}
+	if store.TimeoutSec < 1 {
+		store.TimeoutSec = JobDefaultTimeoutSec
+	}
+	store.jobs = make(map[int]*Job)
+	store.mutex = new(sync.Mutex)
+}
+
+// prune removes finished jobs that have exceeded retention period. Caller must hold the mutex.
+func (store *JobStore) prune() {
+	for id, job := range store.jobs {
+		if !job.Finished.IsZero() && time.Since(job.Finished) > time.Duration(store.RetentionSec)*time.Second {
+			delete(store.jobs, id)
+		}
+	}
+}
+
+// Start runs the command in background using the feature, and returns the new job's ID.
+func (store *JobStore) Start(feature toolbox.Feature, trigger toolbox.Trigger, cmd toolbox.Command) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.prune()
+	if store.running >= store.MaxRunning {
+		return 0, ErrTooManyJobs
+	}
+	store.lastID++
+	store.running++
+	job := &Job{
+		ID:        store.lastID,
+		Principal: cmd.Principal,
+		Command:   string(trigger) + " " + cmd.Content,
+		Started:   time.Now(),
+	}
+	store.jobs[job.ID] = job
+	cmd.TimeoutSec = store.TimeoutSec
+	go func() {
+		result := feature.Execute(cmd)
+		result.ResetCombinedText()
+		if len(result.CombinedOutput) > JobMaxOutputLength {
+			// Do not cut a multi-byte character in half
+			cut := JobMaxOutputLength
+			for cut > 0 && !utf8.RuneStart(result.CombinedOutput[cut]) {
+				cut--
+			}
+			result.CombinedOutput = result.CombinedOutput[:cut]
+		}
+		store.mutex.Lock()
+		job.Result = *result
+		job.Finished = time.Now()
+		store.running--
+		store.mutex.Unlock()
+	}()
+	return job.ID, nil
+}
+
+/*
+GetOutput returns status of the job if it is still running, or a page of its output if it has finished. Page number
+begins from 1, and each page is at most pageSize characters long including the page marker. If pageSize is 0, the
+entire output is returned in a single page. The default PIN (empty principal name) may retrieve all jobs, whereas a
+named principal may only retrieve their own jobs.
+*/
+func (store *JobStore) GetOutput(principal string, id, page, pageSize int) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.prune()
+	job, exists := store.jobs[id]
+	if !exists || (principal != "" && principal != job.Principal) {
+		return "", ErrJobNotFound
+	}
+	if job.Finished.IsZero() {
+		return fmt.Sprintf("job %d has been running for %ds", id, int(time.Since(job.Started).Seconds())), nil
+	}
+	output, _, err := GetPage(job.Result.CombinedOutput, page, pageSize)
+	return output, err
+}
+
+// List returns the jobs (latest job comes first) visible to the principal, one job per line.
+func (store *JobStore) List(principal string) string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.prune()
+	ids := make([]int, 0, len(store.jobs))
+	for id, job := range store.jobs {
+		if principal == "" || principal == job.Principal {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	lines := make([]string, 0, len(ids))
+	for _, id := range ids {
+		job := store.jobs[id]
+		status := "running"
+		if !job.Finished.IsZero() {
+			status = "done"
+			if job.Result.Error != nil {
+				status = "failed"
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%d %s %s", id, status, job.Command))
+	}
+	return strings.Join(lines, "\n")
+}
+
+/*
+GetOutputByParams interprets parameters that follow PrefixCommandJobOutput - job ID and optional page number - and
+returns job status or a page of its output. Without parameters, all jobs visible to the principal are listed.
+*/
+func (store *JobStore) GetOutputByParams(principal, params string, pageSize int) (string, error) {
+	if strings.TrimSpace(params) == "" {
+		return store.List(principal), nil
+	}
+	idAndPage := RegexJobIDAndPage.FindStringSubmatch(params)
+	if len(idAndPage) != 3 { // 2 groups + 1
+		return "", ErrBadJobCommand
+	}
+	id, _ := strconv.Atoi(idAndPage[1])
+	page := 1
+	if idAndPage[2] != "" {
+		page, _ = strconv.Atoi(idAndPage[2])
+	}
+	return store.GetOutput(principal, id, page, pageSize)
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForJob waits until the job finishes and returns its output.
+func waitForJob(t *testing.T, store *JobStore, principal string, id, page, pageSize int) string {
+	for i := 0; i < 100; i++ {
+		out, err := store.GetOutput(principal, id, page, pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, "has been running") {
+			return out
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("job did not finish")
+	return ""
+}
+
+func TestJobStore(t *testing.T) {
+	store := &JobStore{MaxRunning: 1, RetentionSec: 1}
+	store.Initialise()
+	if store.TimeoutSec != JobDefaultTimeoutSec {
+		t.Fatal(store.TimeoutSec)
+	}
+	shell := &toolbox.Shell{}
+	if err := shell.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.Start(shell, shell.Trigger(), toolbox.Command{Content: "sleep 1; echo 0123456789abcdefghij", Principal: "alice"})
+	if err != nil || id != 1 {
+		t.Fatal(id, err)
+	}
+	// Concurrency limit
+	if _, err := store.Start(shell, shell.Trigger(), toolbox.Command{Content: "echo hi"}); err != ErrTooManyJobs {
+		t.Fatal(err)
+	}
+	if out, err := store.GetOutput("alice", 1, 1, 0); err != nil || !strings.Contains(out, "job 1 has been running for") {
+		t.Fatal(out, err)
+	}
+	if list := store.List(""); list != "1 running .s sleep 1; echo 0123456789abcdefghij" {
+		t.Fatal(list)
+	}
+	// Another principal may not see the job
+	if _, err := store.GetOutput("bob", 1, 1, 0); err != ErrJobNotFound {
+		t.Fatal(err)
+	}
+	if list := store.List("bob"); list != "" {
+		t.Fatal(list)
+	}
+	// Entire output in a single page
+	if out := waitForJob(t, store, "", 1, 1, 0); out != "0123456789abcdefghij\n" {
+		t.Fatal(out)
+	}
+	// Output in pages of 5 characters plus room for page marker
+	if out, err := store.GetOutput("alice", 1, 1, JobPageMarkerLength+5); err != nil || out != "[1/5] 01234" {
+		t.Fatal(out, err)
+	}
+	if out, err := store.GetOutputByParams("alice", " 1 5 ", JobPageMarkerLength+5); err != nil || out != "[5/5] \n" {
+		t.Fatal(out, err)
+	}
+	if _, err := store.GetOutputByParams("alice", "1 6", JobPageMarkerLength+5); err == nil {
+		t.Fatal("should have failed")
+	}
+	if _, err := store.GetOutputByParams("alice", "abc", JobPageMarkerLength+5); err != ErrBadJobCommand {
+		t.Fatal(err)
+	}
+	if list, err := store.GetOutputByParams("alice", "", 0); err != nil || list != "1 done .s sleep 1; echo 0123456789abcdefghij" {
+		t.Fatal(list, err)
+	}
+	// Job is discarded after retention period
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := store.GetOutput("", 1, 1, 0); err != ErrJobNotFound {
+		t.Fatal(err)
+	}
+}
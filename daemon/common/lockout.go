@@ -0,0 +1,249 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	LockoutDefaultFreeFailures = 3     // LockoutDefaultFreeFailures is the default number of failures tolerated before back-off begins.
+	LockoutDefaultBaseDelaySec = 2     // LockoutDefaultBaseDelaySec is the default back-off delay after the first failure that is not tolerated.
+	LockoutDefaultBanSec       = 3600  // LockoutDefaultBanSec is the default duration of the first ban.
+	LockoutDefaultForgetSec    = 86400 // LockoutDefaultForgetSec is the default number of seconds after which a client's failures are forgotten.
+
+	LockoutMaxDelaySec      = 300       // LockoutMaxDelaySec is the maximum back-off delay.
+	LockoutMaxBanSec        = 7 * 86400 // LockoutMaxBanSec is the maximum duration of a ban.
+	LockoutMaxClients       = 10000     // LockoutMaxClients is the maximum number of clients whose failures are tracked.
+	LockoutAlertIntervalSec = 60        // LockoutAlertIntervalSec is the minimum interval between alert mails.
+	LockoutMailDaemonName   = "mail"    // LockoutMailDaemonName is the daemon name of mail command runner, its senders are not tracked by default.
+	lockoutMaxShift         = 20        // lockoutMaxShift prevents exponential back-off calculation from overflowing.
+)
+
+var ErrClientLockedOut = errors.New("too many failed attempts, try again later")
+
+/*
+ClientLockouts tracks PIN mismatches of clients for all command processors. It is nil (disabled) unless configured
+by the user.
+*/
+var ClientLockouts *Lockout
+
+// LockoutRecord is the failure history of a client.
+type LockoutRecord struct {
+	DaemonName   string    `json:"DaemonName"`   // DaemonName is the daemon that received the latest failed attempt.
+	Failures     int       `json:"Failures"`     // Failures is the number of consecutive failures since the last success or ban.
+	Bans         int       `json:"Bans"`         // Bans is the number of times the client has been banned.
+	LastFailure  time.Time `json:"LastFailure"`  // LastFailure is the time of latest failed attempt.
+	BlockedUntil time.Time `json:"BlockedUntil"` // BlockedUntil is the moment the client may try again.
+}
+
+/*
+Lockout slows down and eventually bans clients that repeatedly fail to match PIN or shortcut. Clients are identified by
+their IP address, phone number, chat user name, or mail address. After a number of tolerated failures, each further
+failure blocks the client for an exponentially growing delay, and reaching the ban threshold blocks the client for a
+long period, which doubles with each subsequent ban. Bans survive program restart if state file is configured.
+*/
+type Lockout struct {
+	BanAfterFailures int      `json:"BanAfterFailures"` // BanAfterFailures is the number of consecutive failures that get a client banned.
+	FreeFailures     int      `json:"FreeFailures"`     // FreeFailures is the number of failures tolerated before back-off begins.
+	BaseDelaySec     int      `json:"BaseDelaySec"`     // BaseDelaySec is the back-off delay after the first failure that is not tolerated, it doubles with each further failure.
+	BanSec           int      `json:"BanSec"`           // BanSec is the duration of the first ban.
+	ForgetSec        int      `json:"ForgetSec"`        // ForgetSec is the number of seconds after which failures and bans of a client are forgotten.
+	TrackMailSenders bool     `json:"TrackMailSenders"` // TrackMailSenders tracks senders of incoming mails that do not carry PIN.
+	StateFilePath    string   `json:"StateFilePath"`    // StateFilePath is the location of file that retains failures and bans.
+	AlertRecipients  []string `json:"AlertRecipients"`  // AlertRecipients receive alert mail when a client is banned.
+
+	MailClient inet.MailClient `json:"-"` // MailClient delivers alert mails.
+
+	clients   map[string]*LockoutRecord
+	lastAlert time.Time
+	mutex     *sync.Mutex
+	logger    misc.Logger
+}
+
+// IsConfigured returns true only if ban threshold is set.
+func (lockout *Lockout) IsConfigured() bool {
+	return lockout.BanAfterFailures > 0
+}
+
+// Initialise sets default parameters and loads failures and bans from state file.
+func (lockout *Lockout) Initialise() error {
+	lockout.logger = misc.Logger{ComponentName: "Lockout", ComponentID: lockout.StateFilePath}
+	if lockout.BanAfterFailures < 1 {
+		return errors.New("Lockout.Initialise: BanAfterFailures must be greater than 0")
+	}
+	if lockout.FreeFailures < 1 {
+		lockout.FreeFailures = LockoutDefaultFreeFailures
+	}
+	if lockout.BaseDelaySec < 1 {
+		lockout.BaseDelaySec = LockoutDefaultBaseDelaySec
+	}
+	if lockout.BanSec < 1 {
+		lockout.BanSec = LockoutDefaultBanSec
+	}
+	if lockout.ForgetSec < 1 {
+		lockout.ForgetSec = LockoutDefaultForgetSec
+	}
+	if len(lockout.AlertRecipients) > 0 && !lockout.MailClient.IsConfigured() {
+		return errors.New("Lockout.Initialise: MailClient must be configured to send alerts")
+	}
+	lockout.clients = make(map[string]*LockoutRecord)
+	lockout.mutex = new(sync.Mutex)
+	if lockout.StateFilePath != "" {
+		content, err := ioutil.ReadFile(lockout.StateFilePath)
+		if err == nil {
+			if err := json.Unmarshal(content, &lockout.clients); err != nil {
+				return fmt.Errorf("Lockout.Initialise: failed to parse state file - %v", err)
+			}
+			if lockout.clients == nil {
+				lockout.clients = make(map[string]*LockoutRecord)
+			}
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("Lockout.Initialise: failed to read state file - %v", err)
+		}
+	}
+	return nil
+}
+
+// isTracked returns true only if the client who issued the command can be identified and tracked.
+func (lockout *Lockout) isTracked(cmd toolbox.Command) bool {
+	// Mail command runner examines every incoming mail, most of which are ordinary mails without PIN.
+	return cmd.ClientID != "" && (cmd.DaemonName != LockoutMailDaemonName || lockout.TrackMailSenders)
+}
+
+// saveState writes all records into state file. Caller must hold the mutex.
+func (lockout *Lockout) saveState() {
+	if lockout.StateFilePath == "" {
+		return
+	}
+	content, err := json.Marshal(lockout.clients)
+	if err == nil {
+		err = ioutil.WriteFile(lockout.StateFilePath, content, 0600)
+	}
+	if err != nil {
+		lockout.logger.Warningf("saveState", "", err, "failed to save state file")
+	}
+}
+
+// prune removes records that are no longer blocked and whose last failure has been forgotten. Caller must hold the mutex.
+func (lockout *Lockout) prune(now time.Time) {
+	for clientID, record := range lockout.clients {
+		if now.After(record.BlockedUntil) && now.Sub(record.LastFailure) > time.Duration(lockout.ForgetSec)*time.Second {
+			delete(lockout.clients, clientID)
+		}
+	}
+}
+
+// Check returns ErrClientLockedOut if the client who issued the command is still blocked.
+func (lockout *Lockout) Check(cmd toolbox.Command) error {
+	if !lockout.isTracked(cmd) {
+		return nil
+	}
+	lockout.mutex.Lock()
+	defer lockout.mutex.Unlock()
+	if record, exists := lockout.clients[cmd.ClientID]; exists && time.Now().Before(record.BlockedUntil) {
+		return ErrClientLockedOut
+	}
+	return nil
+}
+
+// shiftDuration returns the number of seconds doubled n times, capped by the maximum.
+func shiftDuration(sec int, n int, maxSec int) time.Duration {
+	if n < 0 {
+		n = 0
+	}
+	if n > lockoutMaxShift {
+		n = lockoutMaxShift
+	}
+	if shifted := sec << uint(n); shifted < maxSec {
+		return time.Duration(shifted) * time.Second
+	}
+	return time.Duration(maxSec) * time.Second
+}
+
+/*
+RecordFailure records a failed attempt of the client who issued the command, and blocks the client for back-off delay or
+ban as necessary.
+*/
+func (lockout *Lockout) RecordFailure(cmd toolbox.Command) {
+	if !lockout.isTracked(cmd) {
+		return
+	}
+	now := time.Now()
+	lockout.mutex.Lock()
+	defer lockout.mutex.Unlock()
+	record, exists := lockout.clients[cmd.ClientID]
+	if exists && now.After(record.BlockedUntil) && now.Sub(record.LastFailure) > time.Duration(lockout.ForgetSec)*time.Second {
+		// Earlier failures and bans have been forgotten
+		*record = LockoutRecord{}
+	}
+	if !exists {
+		lockout.prune(now)
+		if len(lockout.clients) >= LockoutMaxClients {
+			lockout.logger.Warningf("RecordFailure", cmd.ClientID, nil, "there are too many clients to track")
+			return
+		}
+		record = &LockoutRecord{}
+		lockout.clients[cmd.ClientID] = record
+	}
+	record.DaemonName = cmd.DaemonName
+	record.Failures++
+	record.LastFailure = now
+	if record.Failures >= lockout.BanAfterFailures {
+		record.Bans++
+		record.Failures = 0
+		record.BlockedUntil = now.Add(shiftDuration(lockout.BanSec, record.Bans-1, LockoutMaxBanSec))
+		lockout.logger.Warningf("RecordFailure", cmd.ClientID, nil, "banned client of %s until %s", cmd.DaemonName, record.BlockedUntil.Format(time.RFC3339))
+		lockout.alert(cmd.ClientID, *record, now)
+	} else if record.Failures > lockout.FreeFailures {
+		record.BlockedUntil = now.Add(shiftDuration(lockout.BaseDelaySec, record.Failures-lockout.FreeFailures-1, LockoutMaxDelaySec))
+	}
+	lockout.saveState()
+}
+
+// RecordSuccess forgets the failures of the client who issued the command.
+func (lockout *Lockout) RecordSuccess(cmd toolbox.Command) {
+	if !lockout.isTracked(cmd) {
+		return
+	}
+	lockout.mutex.Lock()
+	defer lockout.mutex.Unlock()
+	if _, exists := lockout.clients[cmd.ClientID]; exists {
+		delete(lockout.clients, cmd.ClientID)
+		lockout.saveState()
+	}
+}
+
+// alert sends an alert mail in background about the ban, unless an alert was recently sent. Caller must hold the mutex.
+func (lockout *Lockout) alert(clientID string, record LockoutRecord, now time.Time) {
+	if len(lockout.AlertRecipients) == 0 || now.Sub(lockout.lastAlert) < LockoutAlertIntervalSec*time.Second {
+		return
+	}
+	lockout.lastAlert = now
+	go func() {
+		subject := inet.OutgoingMailSubjectKeyword + "-lockout-" + clientID
+		body := fmt.Sprintf("Client \"%s\" of %s failed to match PIN %d times and is banned until %s. It has been banned %d time(s).",
+			clientID, record.DaemonName, lockout.BanAfterFailures, record.BlockedUntil.Format(time.RFC3339), record.Bans)
+		if err := lockout.MailClient.Send(subject, body, lockout.AlertRecipients...); err != nil {
+			lockout.logger.Warningf("alert", clientID, err, "failed to send alert mail")
+		}
+	}()
+}
+
+// GetRecords returns a copy of failure records of all tracked clients.
+func (lockout *Lockout) GetRecords() map[string]LockoutRecord {
+	lockout.mutex.Lock()
+	defer lockout.mutex.Unlock()
+	ret := make(map[string]LockoutRecord)
+	for clientID, record := range lockout.clients {
+		ret[clientID] = *record
+	}
+	return ret
+}
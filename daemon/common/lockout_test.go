@@ -0,0 +1,141 @@
+package common
+
+import (
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/HouzuoGuo/laitos/toolbox/filter"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "laitos-TestLockout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	lockout := Lockout{}
+	if lockout.IsConfigured() {
+		t.Fatal("should not be configured")
+	}
+	if err := lockout.Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+	lockout = Lockout{BanAfterFailures: 5, FreeFailures: 2, BaseDelaySec: 1, BanSec: 2, StateFilePath: filepath.Join(tmpDir, "lockout.json")}
+	if err := lockout.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	cmd := toolbox.Command{DaemonName: "test", ClientID: "client"}
+	// Tolerated failures
+	for i := 0; i < 2; i++ {
+		lockout.RecordFailure(cmd)
+		if err := lockout.Check(cmd); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	// Back-off
+	lockout.RecordFailure(cmd)
+	if err := lockout.Check(cmd); err != ErrClientLockedOut {
+		t.Fatal(err)
+	}
+	if err := lockout.Check(toolbox.Command{DaemonName: "test", ClientID: "another client"}); err != nil {
+		t.Fatal(err)
+	}
+	if records := lockout.GetRecords(); records["client"].Failures != 3 || records["client"].BlockedUntil.Sub(time.Now()) > time.Second {
+		t.Fatal(records)
+	}
+	lockout.RecordFailure(cmd)
+	if records := lockout.GetRecords(); records["client"].BlockedUntil.Sub(time.Now()) < 1500*time.Millisecond {
+		t.Fatal(records)
+	}
+	// Ban, doubling with each subsequent ban
+	lockout.RecordFailure(cmd)
+	if records := lockout.GetRecords(); records["client"].Failures != 0 || records["client"].Bans != 1 || records["client"].BlockedUntil.Sub(time.Now()) < 1500*time.Millisecond {
+		t.Fatal(records)
+	}
+	for i := 0; i < 5; i++ {
+		lockout.RecordFailure(cmd)
+	}
+	if records := lockout.GetRecords(); records["client"].Bans != 2 || records["client"].BlockedUntil.Sub(time.Now()) < 3500*time.Millisecond {
+		t.Fatal(records)
+	}
+	// Bans survive restart
+	restarted := Lockout{BanAfterFailures: 5, StateFilePath: lockout.StateFilePath}
+	if err := restarted.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Check(cmd); err != ErrClientLockedOut {
+		t.Fatal(err)
+	}
+	// Success forgets failures
+	restarted.RecordSuccess(cmd)
+	if err := restarted.Check(cmd); err != nil || len(restarted.GetRecords()) != 0 {
+		t.Fatal(err)
+	}
+	// Mail senders and unidentified clients are not tracked by default
+	for _, untracked := range []toolbox.Command{{DaemonName: LockoutMailDaemonName, ClientID: "me@example.com"}, {DaemonName: "test"}} {
+		for i := 0; i < 10; i++ {
+			restarted.RecordFailure(untracked)
+		}
+		if err := restarted.Check(untracked); err != nil || len(restarted.GetRecords()) != 0 {
+			t.Fatal(err)
+		}
+	}
+	restarted.TrackMailSenders = true
+	for i := 0; i < 10; i++ {
+		restarted.RecordFailure(toolbox.Command{DaemonName: LockoutMailDaemonName, ClientID: "me@example.com"})
+	}
+	if err := restarted.Check(toolbox.Command{DaemonName: LockoutMailDaemonName, ClientID: "me@example.com"}); err != ErrClientLockedOut {
+		t.Fatal(err)
+	}
+	// Alert requires mail client
+	restarted.AlertRecipients = []string{"me@example.com"}
+	if err := restarted.Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+}
+
+func TestCommandProcessorLockout(t *testing.T) {
+	ClientLockouts = &Lockout{BanAfterFailures: 3, FreeFailures: 1, BaseDelaySec: 1}
+	defer func() {
+		ClientLockouts = nil
+	}()
+	if err := ClientLockouts.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	proc := GetTestCommandProcessor()
+	cmd := toolbox.Command{TimeoutSec: 5, Content: "wrongpin.s echo hi", DaemonName: "test", ClientID: "client"}
+	if result := proc.Process(cmd); result.Error != filter.ErrPINAndShortcutNotFound {
+		t.Fatal(result)
+	}
+	// Correct PIN resets failures
+	cmd.Content = "verysecret.s echo hi"
+	if result := proc.Process(cmd); result.Error != nil || result.CombinedOutput != "hi" {
+		t.Fatal(result)
+	}
+	// The second failure in a row leads to back-off, which rejects even the correct PIN.
+	cmd.Content = "wrongpin.s echo hi"
+	proc.Process(cmd)
+	proc.Process(cmd)
+	cmd.Content = "verysecret.s echo hi"
+	if result := proc.Process(cmd); result.Error != ErrClientLockedOut {
+		t.Fatal(result)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if result := proc.Process(cmd); result.Error != nil || result.CombinedOutput != "hi" {
+		t.Fatal(result)
+	}
+	// Failing to match TOTP code after the correct PIN also counts as failure
+	proc.CommandFilters = append(proc.CommandFilters, &filter.TOTP{Secret: "JBSWY3DPEHPK3PXP"})
+	cmd.Content = "verysecret000000 .s echo hi"
+	for i := 0; i < 2; i++ {
+		if result := proc.Process(cmd); result.Error != filter.ErrTOTPNotFound {
+			t.Fatal(i, result)
+		}
+	}
+	if result := proc.Process(cmd); result.Error != ErrClientLockedOut {
+		t.Fatal(result)
+	}
+}
@@ -0,0 +1,184 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/HouzuoGuo/laitos/toolbox/filter"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	/*
+		PrefixCommandNextPage is the magic string to retrieve the next page of the latest command result that was too long
+		to fit into a single reply. It may be followed by a page number to jump to that page.
+	*/
+	PrefixCommandNextPage = ".next"
+
+	PageRetentionSec = 600  // PageRetentionSec is the number of seconds to retain a paginated command result.
+	PageMaxClients   = 1000 // PageMaxClients is the maximum number of clients whose paginated command result is retained.
+)
+
+var (
+	ErrNoMorePages  = errors.New("there are no more pages")
+	ErrPagesExpired = errors.New("there is no paginated output or it has expired")
+)
+
+/*
+GetPage returns a page of the text with a page marker (e.g. "[2/5] "), page number begins from 1. Each page is at most
+pageSize characters long including the page marker, and a page never cuts a multi-byte character in half. If the text
+fits into a single page, or the page size is too small to accommodate the page marker, the entire text is returned
+without a marker.
+*/
+func GetPage(text string, page, pageSize int) (string, int, error) {
+	if pageSize <= JobPageMarkerLength || len(text) <= pageSize {
+		return text, 1, nil
+	}
+	pageSize -= JobPageMarkerLength
+	// Find where each page begins
+	pageBegins := []int{0}
+	for begin := 0; begin+pageSize < len(text); {
+		// Do not cut a multi-byte character in half
+		end := begin + pageSize
+		for end > begin && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		if end == begin {
+			// The page is too small for the character, give it the entire character anyways.
+			for end = begin + 1; end < len(text) && !utf8.RuneStart(text[end]); end++ {
+			}
+		}
+		pageBegins = append(pageBegins, end)
+		begin = end
+	}
+	numPages := len(pageBegins)
+	if page < 1 || page > numPages {
+		return "", numPages, fmt.Errorf("page number must be between 1 and %d", numPages)
+	}
+	end := len(text)
+	if page < numPages {
+		end = pageBegins[page]
+	}
+	return fmt.Sprintf("[%d/%d] %s", page, numPages, text[pageBegins[page-1]:end]), numPages, nil
+}
+
+// pagedOutput is a command result that was too long to fit into a single reply.
+type pagedOutput struct {
+	text     string    // text is the entire command result that has gone through LintText except its length limit.
+	pageSize int       // pageSize is the length limit of each page including page marker.
+	lastPage int       // lastPage is the page number that was last given to the client.
+	expiry   time.Time // expiry is the moment after which the result is discarded.
+}
+
+/*
+PageCache retains the latest long command result of each client for a short while, so that the client may read it page
+by page without having to run the command again. All command processors share the same cache.
+*/
+type PageCache struct {
+	outputs map[string]*pagedOutput
+	mutex   *sync.Mutex
+}
+
+// PaginatedOutputs is the page cache shared by all command processors.
+var PaginatedOutputs = &PageCache{}
+
+func init() {
+	PaginatedOutputs.Initialise()
+}
+
+// Initialise prepares internal states.
+func (cache *PageCache) Initialise() {
+	cache.outputs = make(map[string]*pagedOutput)
+	cache.mutex = new(sync.Mutex)
+}
+
+/*
+getClientKey returns the identity of the client who issued the command. An empty string is returned if the front-end
+daemon does not identify its clients, in which case the command result cannot be paginated.
+*/
+func getClientKey(cmd toolbox.Command) string {
+	if cmd.DaemonName == "" || cmd.ClientID == "" {
+		return ""
+	}
+	return cmd.DaemonName + "/" + cmd.ClientID + "/" + cmd.Principal
+}
+
+// prune removes expired results. Caller must hold the mutex.
+func (cache *PageCache) prune() {
+	now := time.Now()
+	for key, output := range cache.outputs {
+		if now.After(output.expiry) {
+			delete(cache.outputs, key)
+		}
+	}
+}
+
+/*
+Paginate lints the result's combined output using the LintText bridge, but instead of truncating the output to its
+maximum length, the output is retained for the client and only the first page is kept in the result. Return false if
+the result cannot be paginated, in which case the result is left untouched.
+*/
+func (cache *PageCache) Paginate(result *toolbox.Result, lint *filter.LintText) bool {
+	key := getClientKey(result.Command)
+	if key == "" || lint.MaxLength <= JobPageMarkerLength {
+		return false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.prune()
+	if _, exists := cache.outputs[key]; !exists && len(cache.outputs) >= PageMaxClients {
+		return false
+	}
+	untruncated := *lint
+	untruncated.MaxLength = 0
+	untruncated.Transform(result)
+	if len(result.CombinedOutput) <= lint.MaxLength {
+		// The output fits into a single reply, hence the previous long output (if any) is no longer relevant.
+		delete(cache.outputs, key)
+		return true
+	}
+	cache.outputs[key] = &pagedOutput{
+		text:     result.CombinedOutput,
+		pageSize: lint.MaxLength,
+		lastPage: 1,
+		expiry:   time.Now().Add(PageRetentionSec * time.Second),
+	}
+	result.CombinedOutput, _, _ = GetPage(result.CombinedOutput, 1, lint.MaxLength)
+	return true
+}
+
+/*
+GetNextPage returns the page that follows the page last given to the client who issued the command. The command content
+may be a page number instead, to go to that page.
+*/
+func (cache *PageCache) GetNextPage(cmd toolbox.Command) (string, error) {
+	key := getClientKey(cmd)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.prune()
+	output, exists := cache.outputs[key]
+	if key == "" || !exists {
+		return "", ErrPagesExpired
+	}
+	page := output.lastPage + 1
+	if param := strings.TrimSpace(cmd.Content); param != "" {
+		var err error
+		if page, err = strconv.Atoi(param); err != nil {
+			return "", fmt.Errorf("%s [page number]", PrefixCommandNextPage)
+		}
+	}
+	text, numPages, err := GetPage(output.text, page, output.pageSize)
+	if err != nil {
+		if page == numPages+1 {
+			return "", ErrNoMorePages
+		}
+		return "", err
+	}
+	output.lastPage = page
+	output.expiry = time.Now().Add(PageRetentionSec * time.Second)
+	return text, nil
+}
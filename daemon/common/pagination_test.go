@@ -0,0 +1,84 @@
+package common
+
+import (
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"strings"
+	"testing"
+)
+
+func TestGetPage(t *testing.T) {
+	if page, numPages, err := GetPage("0123456789abcdefghij", 1, 0); err != nil || page != "0123456789abcdefghij" || numPages != 1 {
+		t.Fatal(page, numPages, err)
+	}
+	if page, numPages, err := GetPage("0123456789abcdefghij", 2, JobPageMarkerLength+8); err != nil || page != "[2/3] 89abcdef" || numPages != 3 {
+		t.Fatal(page, numPages, err)
+	}
+	if page, numPages, err := GetPage("0123456789abcdefghij", 3, JobPageMarkerLength+8); err != nil || page != "[3/3] ghij" || numPages != 3 {
+		t.Fatal(page, numPages, err)
+	}
+	if _, _, err := GetPage("0123456789abcdefghij", 4, JobPageMarkerLength+8); err == nil {
+		t.Fatal("should have failed")
+	}
+	// Multi-byte characters are not cut in half
+	for page, expected := range []string{"[1/4] 0123", "[2/4] 好好", "[3/4] 好89a", "[4/4] b"} {
+		if text, numPages, err := GetPage("0123好好好89ab", page+1, JobPageMarkerLength+6); err != nil || text != expected || numPages != 4 {
+			t.Fatal(page, text, numPages, err)
+		}
+	}
+}
+
+func TestCommandProcessorPagination(t *testing.T) {
+	PaginatedOutputs.Initialise()
+	proc := GetTestCommandProcessor()
+	// LintText of the test command processor limits output to 35 characters, hence 25 characters of output in each page.
+	cmd := toolbox.Command{TimeoutSec: 5, Content: "verysecret.s echo 0123456789abcdefghijklmnopqrstuvwxyz0123456789ABCDEFGHIJKLMNOP", DaemonName: "test", ClientID: "client"}
+	if result := proc.Process(cmd); result.CombinedOutput != "[1/3] 0123456789abcdefghijklmno" {
+		t.Fatalf("%+v", result)
+	}
+	// Another client does not see the pages
+	otherClient := toolbox.Command{TimeoutSec: 5, Content: "verysecret.next", DaemonName: "test", ClientID: "other"}
+	if result := proc.Process(otherClient); result.Error != ErrPagesExpired {
+		t.Fatalf("%+v", result)
+	}
+	// Next page does not run the command again
+	cmd.Content = "verysecret .next"
+	for _, expected := range []string{"[2/3] pqrstuvwxyz0123456789ABCD", "[3/3] EFGHIJKLMNOP"} {
+		if result := proc.Process(cmd); result.Error != nil || result.CombinedOutput != expected {
+			t.Fatalf("%+v", result)
+		}
+	}
+	if result := proc.Process(cmd); result.Error != ErrNoMorePages {
+		t.Fatalf("%+v", result)
+	}
+	// Go to a page
+	cmd.Content = "verysecret .next 2"
+	if result := proc.Process(cmd); result.CombinedOutput != "[2/3] pqrstuvwxyz0123456789ABCD" {
+		t.Fatalf("%+v", result)
+	}
+	cmd.Content = "verysecret .next 4"
+	if result := proc.Process(cmd); result.Error == nil {
+		t.Fatalf("%+v", result)
+	}
+	cmd.Content = "verysecret .next abc"
+	if result := proc.Process(cmd); result.Error == nil {
+		t.Fatalf("%+v", result)
+	}
+	// PIN is required
+	cmd.Content = ".next"
+	if result := proc.Process(cmd); result.Error == nil || strings.Contains(result.CombinedOutput, "[") {
+		t.Fatalf("%+v", result)
+	}
+	// A short output does not have page marker, and the previous pages are discarded.
+	cmd.Content = "verysecret.s echo hi"
+	if result := proc.Process(cmd); result.CombinedOutput != "hi" {
+		t.Fatalf("%+v", result)
+	}
+	cmd.Content = "verysecret .next"
+	if result := proc.Process(cmd); result.Error != ErrPagesExpired {
+		t.Fatalf("%+v", result)
+	}
+	// Without client identity, the output is truncated as usual.
+	if result := proc.Process(toolbox.Command{TimeoutSec: 5, Content: "verysecret.s echo 0123456789abcdefghijklmnopqrstuvwxyz0123456789ABCDEFGHIJKLMNOP"}); result.CombinedOutput != "0123456789abcdefghijklmnopqrstuvwxy" {
+		t.Fatalf("%+v", result)
+	}
+}
@@ -0,0 +1,340 @@
+package dnsd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/inet"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BlackListFormatHosts   = "hosts"   // BlackListFormatHosts is the format of hosts file, e.g. "0.0.0.0 ads.example.com".
+	BlackListFormatPlain   = "plain"   // BlackListFormatPlain is the format of one domain name per line.
+	BlackListFormatAdBlock = "adblock" // BlackListFormatAdBlock is the format of AdBlock filter rules, only "||domain^" rules are used.
+
+	BlackListCheckIntervalSec = 60 // BlackListCheckIntervalSec is how often black list sources are checked for whether they are due for refresh.
+	/*
+		MinBlackListRetainRatio is the minimum size of a refreshed black list source relative to its previous retrieval.
+		A refreshed list that is any smaller is likely caused by a broken source, and it will be rejected.
+	*/
+	MinBlackListRetainRatio = 0.5
+	/*
+		MaxBlackListRejections is the number of consecutive rejections of a shrunken black list source, after which the
+		shrunken list is accepted, as the source has most likely been pruned for good.
+	*/
+	MaxBlackListRejections = 3
+)
+
+/*
+DefaultBlackListSources are used when black list sources are not configured. They are the ad-server lists of
+pgl.yoyo.org and winhelp2002.mvps.org.
+*/
+var DefaultBlackListSources = []BlackListSource{
+	{
+		URL:    "https://pgl.yoyo.org/adservers/serverlist.php?hostformat=nohtml&showintro=0&mimetype=plaintext",
+		Format: BlackListFormatPlain,
+	},
+	{
+		URL:    "http://winhelp2002.mvps.org/hosts.txt",
+		Format: BlackListFormatHosts,
+	},
+}
+
+// BlackListSource is a list of domain names to be black-listed, the list is downloaded from a URL or read from a local file.
+type BlackListSource struct {
+	URL                string `json:"URL"`                // URL to download the list from.
+	FilePath           string `json:"FilePath"`           // FilePath is the local file to read the list from, if URL is not given.
+	Format             string `json:"Format"`             // Format is one of "hosts", "plain", and "adblock".
+	RefreshIntervalSec int    `json:"RefreshIntervalSec"` // RefreshIntervalSec is the interval of list update, 0 means BlacklistUpdateIntervalSec.
+}
+
+// Name returns the URL or file path of the source.
+func (src BlackListSource) Name() string {
+	if src.URL != "" {
+		return src.URL
+	}
+	return src.FilePath
+}
+
+// Check returns an error if the source configuration is incomplete or ambiguous.
+func (src BlackListSource) Check() error {
+	if (src.URL == "") == (src.FilePath == "") {
+		return errors.New("black list source must have either a URL or a file path, but not both")
+	}
+	switch src.Format {
+	case BlackListFormatHosts, BlackListFormatPlain, BlackListFormatAdBlock:
+	default:
+		return fmt.Errorf("black list source \"%s\" has an unknown format \"%s\"", src.Name(), src.Format)
+	}
+	if src.RefreshIntervalSec < 0 {
+		return fmt.Errorf("black list source \"%s\" must not have a negative refresh interval", src.Name())
+	}
+	return nil
+}
+
+// Retrieve downloads or reads the list, and then returns the domain names among it.
+func (src BlackListSource) Retrieve() ([]string, error) {
+	var content []byte
+	if src.URL != "" {
+		resp, err := inet.DoHTTP(inet.HTTPRequest{TimeoutSec: 30}, src.URL)
+		if err != nil {
+			return nil, err
+		}
+		if statusErr := resp.Non2xxToError(); statusErr != nil {
+			return nil, statusErr
+		}
+		content = resp.Body
+	} else {
+		var err error
+		if content, err = ioutil.ReadFile(src.FilePath); err != nil {
+			return nil, err
+		}
+	}
+	names := ParseBlackList(string(content), src.Format)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("DNSD.Retrieve: black list \"%s\" does not have any entry", src.Name())
+	}
+	return names, nil
+}
+
+// ParseBlackList returns the domain names found in the black list content of the format.
+func ParseBlackList(content, format string) []string {
+	names := make([]string, 0, 16384)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		switch format {
+		case BlackListFormatHosts:
+			// Comment may follow host names on the same line
+			if index := strings.IndexRune(line, '#'); index != -1 {
+				line = line[:index]
+			}
+			// The first field is the IP address, the rest are host names
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			for _, field := range fields[1:] {
+				if name := normaliseBlackListName(field); name != "" {
+					names = append(names, name)
+				}
+			}
+		case BlackListFormatPlain:
+			if index := strings.IndexAny(line, "#!"); index != -1 {
+				line = line[:index]
+			}
+			if fields := strings.Fields(line); len(fields) > 0 {
+				if name := normaliseBlackListName(fields[0]); name != "" {
+					names = append(names, name)
+				}
+			}
+		case BlackListFormatAdBlock:
+			// Only rules that block an entire domain apply to DNS, e.g. "||ads.example.com^"
+			if !strings.HasPrefix(line, "||") || !strings.HasSuffix(line, "^") {
+				continue
+			}
+			if name := normaliseBlackListName(line[2 : len(line)-1]); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+/*
+normaliseBlackListName returns the domain name in lower case without trailing full-stop. Return an empty string if the
+input is not a domain name, or it is a well-known local name such as "localhost".
+*/
+func normaliseBlackListName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if !strings.Contains(name, ".") || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	switch name {
+	case "localhost.localdomain", "0.0.0.0", "127.0.0.1":
+		return ""
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return ""
+		}
+	}
+	return name
+}
+
+// blackListSourceState is the latest entries retrieved from a black list source.
+type blackListSourceState struct {
+	entries     []string
+	lastAttempt time.Time // lastAttempt is the time of latest retrieval, successful or not.
+	rejections  int       // rejections is the number of consecutive retrievals rejected for being suspiciously short.
+}
+
+var (
+	blackListStats      = make(map[string]int) // blackListStats is the number of entries of each black list source of all DNS daemons.
+	blackListStatsMutex = new(sync.Mutex)
+)
+
+// GetBlackListStats returns the latest number of entries in each black list source, in a single line of text.
+func GetBlackListStats() string {
+	blackListStatsMutex.Lock()
+	defer blackListStatsMutex.Unlock()
+	names := make([]string, 0, len(blackListStats))
+	for name := range blackListStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stats := make([]string, 0, len(names))
+	for _, name := range names {
+		stats = append(stats, fmt.Sprintf("%s: %d", name, blackListStats[name]))
+	}
+	return strings.Join(stats, ", ")
+}
+
+/*
+UpdatedAdBlockLists retrieves entries from black list sources that are due for refresh, and then rebuilds the black list
+from the entries of all sources along with the extra black list. If a source fails to refresh, or its refreshed list
+is suspiciously shorter than its previous one, its previous entries are kept.
+*/
+func (daemon *Daemon) UpdatedAdBlockLists() {
+	var updated bool
+	for i, src := range daemon.BlackListSources {
+		intervalSec := src.RefreshIntervalSec
+		if intervalSec == 0 {
+			intervalSec = BlacklistUpdateIntervalSec
+		}
+		daemon.blackListMutex.Lock()
+		state := daemon.blackListSourceStates[i]
+		daemon.blackListMutex.Unlock()
+		if !state.lastAttempt.IsZero() && time.Since(state.lastAttempt) < time.Duration(intervalSec)*time.Second {
+			continue
+		}
+		entries, err := src.Retrieve()
+		daemon.blackListMutex.Lock()
+		state = daemon.blackListSourceStates[i]
+		state.lastAttempt = time.Now()
+		prevCount := len(state.entries)
+		if err == nil && float64(len(entries)) < float64(prevCount)*MinBlackListRetainRatio {
+			if state.rejections++; state.rejections < MaxBlackListRejections {
+				err = fmt.Errorf("DNSD.UpdatedAdBlockLists: rejected the new list of %d entries as it is suspiciously shorter than the previous one of %d entries (%d of %d consecutive rejections)",
+					len(entries), prevCount, state.rejections, MaxBlackListRejections)
+			}
+		}
+		if err == nil {
+			state.entries = entries
+			state.rejections = 0
+			updated = true
+		}
+		daemon.blackListSourceStates[i] = state
+		daemon.blackListMutex.Unlock()
+		if err != nil {
+			daemon.logger.Warningf("UpdatedAdBlockLists", src.Name(), err, "failed to update ad-blacklist")
+			continue
+		}
+		if len(entries) < prevCount {
+			daemon.logger.Printf("UpdatedAdBlockLists", src.Name(), nil, "ad-blacklist shrank from %d to %d entries", prevCount, len(entries))
+		}
+		daemon.logger.Printf("UpdatedAdBlockLists", src.Name(), nil, "successfully retrieved ad-blacklist with %d entries", len(entries))
+		if strings.Contains(src.URL, "mvps.org") {
+			daemon.logger.Printf("UpdatedAdBlockLists", src.Name(), nil, "Please comply with the following liences for your usage of http://winhelp2002.mvps.org/hosts.txt: %s", MVPSLicense)
+		}
+		blackListStatsMutex.Lock()
+		blackListStats[src.Name()] = len(entries)
+		blackListStatsMutex.Unlock()
+	}
+	if updated {
+		daemon.rebuildBlackList()
+		daemon.saveBlackListSnapshot()
+	}
+}
+
+/*
+rebuildBlackList constructs black list from the latest entries of all sources along with the extra black list. Until
+every source has been successfully retrieved, entries of the snapshot are used in place of the missing sources. Once
+every source has been retrieved, the snapshot is no longer used, unless the retrieved entries are suspiciously fewer
+than the snapshot, in which case the snapshot is kept until the same happens several rebuilds in a row.
+*/
+func (daemon *Daemon) rebuildBlackList() {
+	daemon.blackListMutex.Lock()
+	defer daemon.blackListMutex.Unlock()
+	blackList := make(map[string]struct{})
+	var missingSource bool
+	for _, state := range daemon.blackListSourceStates {
+		if state.entries == nil {
+			missingSource = true
+		}
+		for _, name := range state.entries {
+			blackList[name] = struct{}{}
+		}
+	}
+	for _, name := range daemon.ExtraBlackList {
+		blackList[strings.ToLower(strings.TrimSuffix(name, "."))] = struct{}{}
+	}
+	if !missingSource && daemon.blackListSnapshot != nil {
+		// Sources have not been compared against anything since startup, compare them against the snapshot instead.
+		if float64(len(blackList)) < float64(len(daemon.blackListSnapshot))*MinBlackListRetainRatio {
+			if daemon.snapshotRejections++; daemon.snapshotRejections < MaxBlackListRejections {
+				daemon.logger.Warningf("UpdatedAdBlockLists", "", nil, "keep using the snapshot as the retrieved %d entries are suspiciously fewer than the snapshot of %d entries (%d of %d consecutive rejections)",
+					len(blackList), len(daemon.blackListSnapshot), daemon.snapshotRejections, MaxBlackListRejections)
+				missingSource = true
+			}
+		}
+		if !missingSource {
+			daemon.blackListSnapshot = nil
+			daemon.snapshotRejections = 0
+		}
+	}
+	if missingSource {
+		for _, name := range daemon.blackListSnapshot {
+			blackList[name] = struct{}{}
+		}
+	}
+	daemon.blackList = blackList
+	daemon.logger.Printf("UpdatedAdBlockLists", "", nil, "ad-blacklist now has %d entries", len(daemon.blackList))
+}
+
+// loadBlackListSnapshot reads the black list saved by previous refresh. A missing snapshot file is not an error.
+func (daemon *Daemon) loadBlackListSnapshot() error {
+	if daemon.BlackListSnapshotPath == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(daemon.BlackListSnapshotPath)
+	if os.IsNotExist(err) {
+		daemon.logger.Printf("loadBlackListSnapshot", daemon.BlackListSnapshotPath, nil, "snapshot does not yet exist")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	daemon.blackListSnapshot = ParseBlackList(string(content), BlackListFormatPlain)
+	daemon.logger.Printf("loadBlackListSnapshot", daemon.BlackListSnapshotPath, nil, "loaded %d entries", len(daemon.blackListSnapshot))
+	return nil
+}
+
+// saveBlackListSnapshot writes the current black list into snapshot file, so that it is available to next startup.
+func (daemon *Daemon) saveBlackListSnapshot() {
+	if daemon.BlackListSnapshotPath == "" {
+		return
+	}
+	daemon.blackListMutex.Lock()
+	names := make([]string, 0, len(daemon.blackList))
+	for name := range daemon.blackList {
+		names = append(names, name)
+	}
+	daemon.blackListMutex.Unlock()
+	sort.Strings(names)
+	content := "# laitos DNS daemon ad-blacklist snapshot, made at " + time.Now().Format(time.RFC3339) + "\n" + strings.Join(names, "\n") + "\n"
+	// Write into a temporary file first, so that a crash does not leave behind a partially written snapshot.
+	tmpPath := daemon.BlackListSnapshotPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(content), 0600); err != nil {
+		daemon.logger.Warningf("saveBlackListSnapshot", daemon.BlackListSnapshotPath, err, "failed to write snapshot")
+		return
+	}
+	if err := os.Rename(tmpPath, daemon.BlackListSnapshotPath); err != nil {
+		daemon.logger.Warningf("saveBlackListSnapshot", daemon.BlackListSnapshotPath, err, "failed to write snapshot")
+		return
+	}
+	daemon.logger.Printf("saveBlackListSnapshot", daemon.BlackListSnapshotPath, nil, "saved %d entries", len(names))
+}
@@ -0,0 +1,227 @@
+package dnsd
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBlackList(t *testing.T) {
+	hosts := `# comment 0.0.0.0 comment.example.com
+127.0.0.1 localhost
+::1 localhost ip6-localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 Ads.Example.com. tracker.example.com # comment
+0.0.0.0 bad/name.example.com
+`
+	if names := ParseBlackList(hosts, BlackListFormatHosts); !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names)
+	}
+	plain := `! comment
+ads.example.com
+  tracker.example.com   # comment
+localhost
+`
+	if names := ParseBlackList(plain, BlackListFormatPlain); !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names)
+	}
+	adblock := `[Adblock Plus 2.0]
+! comment
+||ads.example.com^
+||tracker.example.com^$third-party
+@@||good.example.com^
+||example.com/banner.gif
+/banner/*/img^
+||*.example.com^
+`
+	if names := ParseBlackList(adblock, BlackListFormatAdBlock); !reflect.DeepEqual(names, []string{"ads.example.com"}) {
+		t.Fatal(names)
+	}
+}
+
+func TestBlackListSource_Check(t *testing.T) {
+	bad := []BlackListSource{
+		{Format: BlackListFormatHosts},
+		{URL: "http://example.com", FilePath: "/tmp/a", Format: BlackListFormatHosts},
+		{URL: "http://example.com", Format: "abc"},
+		{URL: "http://example.com", Format: BlackListFormatPlain, RefreshIntervalSec: -1},
+	}
+	for i, src := range bad {
+		if err := src.Check(); err == nil {
+			t.Fatal(i, "did not error")
+		}
+	}
+	if err := (BlackListSource{FilePath: "/tmp/a", Format: BlackListFormatAdBlock}).Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDaemon_UpdatedAdBlockLists(t *testing.T) {
+	listFile, err := ioutil.TempFile("", "laitos-dnsd-TestBlackList")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(listFile.Name())
+	if _, err := listFile.WriteString("||ads.example.com^\n||github.com^\n"); err != nil {
+		t.Fatal(err)
+	}
+	listFile.Close()
+	daemon := Daemon{
+		Address:              "127.0.0.1",
+		TCPPort:              1,
+		TCPForwarder:         []string{"127.0.0.1:1"},
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"192."},
+		BlackListSources:     []BlackListSource{{FilePath: listFile.Name(), Format: BlackListFormatAdBlock}},
+		WhiteList:            []string{"api.github.com", "good.example.com"},
+		ExtraBlackList:       []string{"Example.com."},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Extra black list takes effect right away
+	if !daemon.NamesAreBlackListed(ExtractDomainName(makeQuery(t, "ads.example.com", TypeA))) {
+		t.Fatal("did not block extra black list")
+	}
+	daemon.UpdatedAdBlockLists()
+	if len(daemon.blackList) != 3 {
+		t.Fatal(daemon.blackList)
+	}
+	if stats := GetBlackListStats(); !strings.Contains(stats, listFile.Name()+": 2") {
+		t.Fatal(stats)
+	}
+	for name, blocked := range map[string]bool{
+		"ads.example.com":       true,
+		"a.ads.example.com":     true,
+		"example.com":           true,
+		"good.example.com":      false,
+		"a.good.example.com":    false,
+		"github.com":            true,
+		"api.github.com":        false,
+		"a.api.github.com":      false,
+		"raw.githubusercontent": false,
+	} {
+		if daemon.NamesAreBlackListed(ExtractDomainName(makeQuery(t, name, TypeA))) != blocked {
+			t.Fatal(name, blocked)
+		}
+	}
+	// A white-listed CNAME target does not exempt another black-listed target in the same response
+	if !daemon.NamesAreBlackListed(append(appendDomainNames(nil, "api.github.com"), appendDomainNames(nil, "ads.example.com")...)) {
+		t.Fatal("did not block CNAME target")
+	}
+	if daemon.NamesAreBlackListed(append(appendDomainNames(nil, "api.github.com"), appendDomainNames(nil, "good.example.com")...)) {
+		t.Fatal("did not allow white-listed CNAME targets")
+	}
+	// Source that fails to refresh keeps its previous entries
+	os.Remove(listFile.Name())
+	daemon.blackListSourceStates[0].lastAttempt = daemon.blackListSourceStates[0].lastAttempt.Add(-2 * BlacklistUpdateIntervalSec * time.Second)
+	daemon.UpdatedAdBlockLists()
+	if len(daemon.blackList) != 3 || len(daemon.blackListSourceStates[0].entries) != 2 {
+		t.Fatal(daemon.blackList)
+	}
+}
+
+func TestDaemon_BlackListSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "laitos-dnsd-TestBlackListSnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	listPath := tmpDir + "/list.txt"
+	snapshotPath := tmpDir + "/snapshot.txt"
+	if err := ioutil.WriteFile(listPath, []byte("a.example.com\nb.example.com\nc.example.com\nd.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newDaemon := func() *Daemon {
+		daemon := &Daemon{
+			Address:               "127.0.0.1",
+			TCPPort:               1,
+			TCPForwarder:          []string{"127.0.0.1:1"},
+			PerIPLimit:            10,
+			AllowQueryIPPrefixes:  []string{"192."},
+			BlackListSources:      []BlackListSource{{FilePath: listPath, Format: BlackListFormatPlain}},
+			BlackListSnapshotPath: snapshotPath,
+		}
+		if err := daemon.Initialise(); err != nil {
+			t.Fatal(err)
+		}
+		return daemon
+	}
+	// Snapshot is written after refresh
+	daemon := newDaemon()
+	if len(daemon.blackList) != 0 {
+		t.Fatal(daemon.blackList)
+	}
+	daemon.UpdatedAdBlockLists()
+	if content, err := ioutil.ReadFile(snapshotPath); err != nil || !strings.Contains(string(content), "\na.example.com\nb.example.com\nc.example.com\nd.example.com\n") {
+		t.Fatal(string(content), err)
+	}
+	// The next startup loads snapshot, and uses it while the source is unavailable.
+	if err := os.Rename(listPath, listPath+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	daemon = newDaemon()
+	if len(daemon.blackList) != 4 {
+		t.Fatal(daemon.blackList)
+	}
+	daemon.UpdatedAdBlockLists()
+	if len(daemon.blackList) != 4 || !daemon.NamesAreBlackListed([]string{"d.example.com"}) {
+		t.Fatal(daemon.blackList)
+	}
+	// The first retrieval after startup is compared against the snapshot, a suspiciously short one does not replace it.
+	refresh := func(content string) {
+		if err := ioutil.WriteFile(listPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		daemon.blackListSourceStates[0].lastAttempt = daemon.blackListSourceStates[0].lastAttempt.Add(-2 * BlacklistUpdateIntervalSec * time.Second)
+		daemon.UpdatedAdBlockLists()
+	}
+	for i := 1; i < MaxBlackListRejections; i++ {
+		refresh("a.example.com\n")
+		if len(daemon.blackList) != 4 || !daemon.NamesAreBlackListed([]string{"d.example.com"}) || daemon.snapshotRejections != i {
+			t.Fatal(i, daemon.blackList)
+		}
+		if content, err := ioutil.ReadFile(snapshotPath); err != nil || !strings.Contains(string(content), "d.example.com") {
+			t.Fatal(string(content), err)
+		}
+	}
+	// Until it stays short for several retrievals in a row
+	refresh("a.example.com\n")
+	if len(daemon.blackList) != 1 || daemon.NamesAreBlackListed([]string{"d.example.com"}) || daemon.snapshotRejections != 0 {
+		t.Fatal(daemon.blackList)
+	}
+	if content, err := ioutil.ReadFile(snapshotPath); err != nil || strings.Contains(string(content), "d.example.com") {
+		t.Fatal(string(content), err)
+	}
+	// A list that grows is accepted
+	refresh("a.example.com\nb.example.com\nc.example.com\ne.example.com\nf.example.com\n")
+	if len(daemon.blackList) != 5 {
+		t.Fatal(daemon.blackList)
+	}
+	if content, err := ioutil.ReadFile(snapshotPath); err != nil || !strings.Contains(string(content), "f.example.com") {
+		t.Fatal(string(content), err)
+	}
+	// A list that shrinks suspiciously is rejected, until it stays short for several retrievals in a row.
+	for i := 1; i < MaxBlackListRejections; i++ {
+		refresh("a.example.com\n")
+		if len(daemon.blackList) != 5 || daemon.blackListSourceStates[0].rejections != i {
+			t.Fatal(i, daemon.blackList)
+		}
+	}
+	refresh("a.example.com\n")
+	if len(daemon.blackList) != 1 || daemon.blackListSourceStates[0].rejections != 0 {
+		t.Fatal(daemon.blackList)
+	}
+	if content, err := ioutil.ReadFile(snapshotPath); err != nil || strings.Contains(string(content), "f.example.com") {
+		t.Fatal(string(content), err)
+	}
+	// A slightly shorter list is accepted right away
+	refresh("a.example.com\nb.example.com\n")
+	refresh("a.example.com\n")
+	if len(daemon.blackList) != 1 {
+		t.Fatal(daemon.blackList)
+	}
+}
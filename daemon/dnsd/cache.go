@@ -0,0 +1,282 @@
+package dnsd
+
+import (
+	"container/list"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultCacheSize = 4096  // DefaultCacheSize is the maximum number of responses kept in cache if the size is not configured.
+	MaxCacheTTLSec   = 86400 // MaxCacheTTLSec is the longest duration a response may stay in cache, regardless of its TTL.
+	MinUDPPayload    = 512   // MinUDPPayload is the largest UDP response a client may receive without using EDNS (RFC 1035).
+)
+
+var cacheHits, cacheMisses uint64 // cacheHits and cacheMisses count the outcome of cache lookups made by all DNS daemons.
+
+// GetCacheStats returns the number of cache hits and misses that have occurred in all DNS daemons.
+func GetCacheStats() (hits, misses uint64) {
+	return atomic.LoadUint64(&cacheHits), atomic.LoadUint64(&cacheMisses)
+}
+
+/*
+cacheKey identifies a cached response by the question it answers, and by the DNSSEC flags of the query, as they decide
+whether the response carries DNSSEC records and whether it has been validated.
+*/
+type cacheKey struct {
+	name             string
+	qType            uint16
+	qClass           uint16
+	dnssecOK         bool
+	checkingDisabled bool
+}
+
+// cacheEntry is a cached response along with its time of expiry.
+type cacheEntry struct {
+	key       cacheKey
+	response  *Message
+	storedAt  time.Time
+	expiresAt time.Time
+}
+
+/*
+ResponseCache memorises responses made by forwarders, so that repeated queries can be answered without asking the
+forwarders again. A response stays in cache for the lowest TTL among its records; a negative response (NXDOMAIN and
+NODATA) stays in cache for the duration determined by SOA record in its authority section. When the cache is full, the
+least recently used response is evicted.
+Remember to create the cache via NewResponseCache() function!
+*/
+type ResponseCache struct {
+	MaxEntries int // MaxEntries is the maximum number of responses to keep in cache.
+
+	mutex   *sync.Mutex
+	entries map[cacheKey]*list.Element // entries helps to find responses in LRU list.
+	lru     *list.List                 // lru stores cacheEntry, the most recently used entry is at the front.
+}
+
+// NewResponseCache returns an initialised response cache that holds up to the specified number of responses.
+func NewResponseCache(maxEntries int) *ResponseCache {
+	if maxEntries < 1 {
+		maxEntries = DefaultCacheSize
+	}
+	return &ResponseCache{
+		MaxEntries: maxEntries,
+		mutex:      new(sync.Mutex),
+		entries:    make(map[cacheKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// getCacheKey returns the cache key of a standard query or response that carries exactly one question.
+func getCacheKey(msg *Message) (key cacheKey, ok bool) {
+	if msg.Header.Opcode != OpcodeQuery || len(msg.Questions) != 1 {
+		return
+	}
+	question := msg.Questions[0]
+	key = cacheKey{
+		name:             strings.ToLower(question.Name),
+		qType:            question.Type,
+		qClass:           question.Class,
+		dnssecOK:         msg.OPT != nil && msg.OPT.DNSSECOK,
+		checkingDisabled: msg.Header.CheckingDisabled,
+	}
+	return key, true
+}
+
+// sameQuestion returns true only if both cache keys are made for the same question, regardless of their DNSSEC flags.
+func (key cacheKey) sameQuestion(other cacheKey) bool {
+	return key.name == other.name && key.qType == other.qType && key.qClass == other.qClass
+}
+
+/*
+Lookup finds a cached response to the query. The response is returned in wire format carrying query's transaction ID,
+and TTLs of its records are reduced by the duration it has spent in cache. The response carries EDNS record only if the
+query does. If the query came over UDP and the response does not fit into the payload size permitted by the client,
+the response is truncated so that the client will retry over TCP. Return nil if there is no cached response.
+*/
+func (cache *ResponseCache) Lookup(queryNoLength []byte, overUDP bool) []byte {
+	query, err := ParseMessage(queryNoLength)
+	if err != nil || query.Header.Response {
+		return nil
+	}
+	key, ok := getCacheKey(query)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	cache.mutex.Lock()
+	elem, exists := cache.entries[key]
+	if !exists {
+		cache.mutex.Unlock()
+		atomic.AddUint64(&cacheMisses, 1)
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expiresAt) {
+		cache.lru.Remove(elem)
+		delete(cache.entries, key)
+		cache.mutex.Unlock()
+		atomic.AddUint64(&cacheMisses, 1)
+		return nil
+	}
+	cache.lru.MoveToFront(elem)
+	cache.mutex.Unlock()
+	atomic.AddUint64(&cacheHits, 1)
+
+	// Make a copy of the cached response to avoid modifying it in-place
+	elapsedSec := uint32(now.Sub(entry.storedAt) / time.Second)
+	response := *entry.response
+	response.Header.ID = query.Header.ID
+	response.Header.RecursionDesired = query.Header.RecursionDesired
+	// Letter case of the question should be exactly as it was asked
+	response.Questions = []Question{query.Questions[0]}
+	response.Answers = reduceTTL(entry.response.Answers, elapsedSec)
+	response.Authorities = reduceTTL(entry.response.Authorities, elapsedSec)
+	response.Additionals = reduceTTL(entry.response.Additionals, elapsedSec)
+	if query.OPT == nil {
+		response.OPT = nil
+	}
+	packet, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	if overUDP {
+		maxSize := MinUDPPayload
+		if query.OPT != nil && int(query.OPT.UDPSize) > maxSize {
+			maxSize = int(query.OPT.UDPSize)
+		}
+		if len(packet) > maxSize {
+			response.Header.Truncated = true
+			response.Answers = nil
+			response.Authorities = nil
+			response.Additionals = nil
+			if packet, err = response.Pack(); err != nil {
+				return nil
+			}
+		}
+	}
+	return packet
+}
+
+// reduceTTL returns a copy of the resource records with their TTL reduced by the number of seconds.
+func reduceTTL(records []ResourceRecord, sec uint32) []ResourceRecord {
+	ret := make([]ResourceRecord, len(records))
+	for i, rr := range records {
+		ret[i] = rr
+		if rr.TTL > sec {
+			ret[i].TTL = rr.TTL - sec
+		} else {
+			ret[i].TTL = 0
+		}
+	}
+	return ret
+}
+
+/*
+getCacheTTL determines how long a response may stay in cache. Return 0 if the response must not be cached.
+Positive responses use the lowest TTL among all records, negative responses (RFC 2308) use the lower of SOA record's TTL
+and its minimum field.
+*/
+func getCacheTTL(response *Message) (ttl uint32) {
+	if response.Header.Truncated {
+		return 0
+	}
+	switch response.Header.Rcode {
+	case RcodeSuccess:
+		if len(response.Answers) == 0 {
+			// No data for the type of record, it is a negative response.
+			return getNegativeCacheTTL(response)
+		}
+		ttl = MaxCacheTTLSec
+		for _, section := range [][]ResourceRecord{response.Answers, response.Authorities, response.Additionals} {
+			for _, rr := range section {
+				if rr.TTL < ttl {
+					ttl = rr.TTL
+				}
+			}
+		}
+		return
+	case RcodeNameError:
+		return getNegativeCacheTTL(response)
+	default:
+		// Server failures and refusals may be temporary, and should never be cached.
+		return 0
+	}
+}
+
+// getNegativeCacheTTL returns the TTL of a negative response determined by its SOA record, or 0 if there is no SOA record.
+func getNegativeCacheTTL(response *Message) uint32 {
+	for _, rr := range response.Authorities {
+		// The minimum field occupies the last four bytes of SOA data
+		if rr.Type != TypeSOA || len(rr.Data) < 20 {
+			continue
+		}
+		ttl := binary.BigEndian.Uint32(rr.Data[len(rr.Data)-4:])
+		if rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+		if ttl > MaxCacheTTLSec {
+			ttl = MaxCacheTTLSec
+		}
+		return ttl
+	}
+	return 0
+}
+
+/*
+Store places forwarder's response to the query into cache. The response is not cached if it does not answer the query,
+if it indicates a server failure, or if its TTL is 0.
+*/
+func (cache *ResponseCache) Store(queryNoLength, responseNoLength []byte) {
+	query, err := ParseMessage(queryNoLength)
+	if err != nil || query.Header.Response {
+		return
+	}
+	key, ok := getCacheKey(query)
+	if !ok {
+		return
+	}
+	response, err := ParseMessage(responseNoLength)
+	if err != nil || !response.Header.Response || response.Header.ID != query.Header.ID {
+		return
+	}
+	// The response must answer the very same question
+	if responseKey, ok := getCacheKey(response); !ok || !responseKey.sameQuestion(key) {
+		return
+	}
+	ttl := getCacheTTL(response)
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{
+		key:       key,
+		response:  response,
+		storedAt:  now,
+		expiresAt: now.Add(time.Duration(ttl) * time.Second),
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if elem, exists := cache.entries[key]; exists {
+		elem.Value = entry
+		cache.lru.MoveToFront(elem)
+		return
+	}
+	cache.entries[key] = cache.lru.PushFront(entry)
+	// Evict least recently used entries to make room
+	for cache.lru.Len() > cache.MaxEntries {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Len returns the number of responses currently in cache, including those that have expired but not yet evicted.
+func (cache *ResponseCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.lru.Len()
+}
@@ -0,0 +1,165 @@
+package dnsd
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	cache := NewResponseCache(2)
+	cnameQuery := mustDecodeHex(t, "7a110100000100000000000003777777"+"0667697468756203636f6d0000010001")
+	nxQuery := mustDecodeHex(t, "424201000001000000000000"+"0b6e6f6e6578697374656e74076578616d706c6503636f6d0000010001")
+	if resp := cache.Lookup(cnameQuery, false); resp != nil {
+		t.Fatal(resp)
+	}
+	hitsBefore, missesBefore := GetCacheStats()
+
+	// Response that does not match the query must not be cached
+	cache.Store(cnameQuery, mustDecodeHex(t, sampleNXDomain))
+	cache.Store(githubComUDPQuery, mustDecodeHex(t, sampleCNAMEResp))
+	if cache.Len() != 0 {
+		t.Fatal(cache.Len())
+	}
+	// Positive response
+	cache.Store(cnameQuery, mustDecodeHex(t, sampleCNAMEResp))
+	if cache.Len() != 1 {
+		t.Fatal(cache.Len())
+	}
+	// Use a different transaction ID and letter case to look up the response
+	anotherQuery := mustDecodeHex(t, "12340100000100000000000003777777"+"0647495448554203636f6d0000010001")
+	resp := cache.Lookup(anotherQuery, false)
+	msg, err := ParseMessage(resp)
+	if err != nil {
+		t.Fatal(err, hex.EncodeToString(resp))
+	}
+	if msg.Header.ID != 0x1234 || msg.Questions[0].Name != "www.GITHUB.com" || len(msg.Answers) != 2 || msg.Answers[1].TTL != 60 {
+		t.Fatalf("%+v", msg)
+	}
+	if hits, misses := GetCacheStats(); hits != hitsBefore+1 || misses != missesBefore {
+		t.Fatal(hits, misses)
+	}
+	// TTL is reduced by the time spent in cache
+	cache.entries[cacheKey{name: "www.github.com", qType: TypeA, qClass: ClassIN}].Value.(*cacheEntry).storedAt = time.Now().Add(-10 * time.Second)
+	msg, err = ParseMessage(cache.Lookup(anotherQuery, false))
+	if err != nil || msg.Answers[0].TTL != 3590 || msg.Answers[1].TTL != 50 {
+		t.Fatalf("%+v %v", msg, err)
+	}
+
+	// Negative response is cached according to SOA
+	cache.Store(nxQuery, mustDecodeHex(t, sampleNXDomain))
+	elem := cache.entries[cacheKey{name: "nonexistent.example.com", qType: TypeA, qClass: ClassIN}]
+	if elem == nil {
+		t.Fatal("did not cache NXDOMAIN")
+	}
+	if ttl := elem.Value.(*cacheEntry).expiresAt.Sub(time.Now()); ttl < 3590*time.Second || ttl > 3600*time.Second {
+		t.Fatal(ttl)
+	}
+	msg, err = ParseMessage(cache.Lookup(nxQuery, false))
+	if err != nil || msg.Header.Rcode != RcodeNameError || len(msg.Authorities) != 1 {
+		t.Fatalf("%+v %v", msg, err)
+	}
+
+	// Expired response is not used
+	elem.Value.(*cacheEntry).expiresAt = time.Now()
+	if resp := cache.Lookup(nxQuery, false); resp != nil {
+		t.Fatal(resp)
+	}
+	if cache.Len() != 1 {
+		t.Fatal(cache.Len())
+	}
+
+	// Least recently used response is evicted when cache is full
+	cache.Store(nxQuery, mustDecodeHex(t, sampleNXDomain))
+	cache.Lookup(cnameQuery, false)
+	aaaaQuery := mustDecodeHex(t, sampleAAAAQuery)
+	aaaaResp := RespondWith0(aaaaQuery)
+	cache.Store(aaaaQuery, aaaaResp)
+	if cache.Len() != 2 || cache.Lookup(nxQuery, false) != nil || cache.Lookup(cnameQuery, false) == nil || cache.Lookup(aaaaQuery, false) == nil {
+		t.Fatal("did not evict LRU entry")
+	}
+}
+
+func TestGetCacheTTL(t *testing.T) {
+	msg, err := ParseMessage(mustDecodeHex(t, sampleCNAMEResp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := getCacheTTL(msg); ttl != 60 {
+		t.Fatal(ttl)
+	}
+	msg.Header.Truncated = true
+	if ttl := getCacheTTL(msg); ttl != 0 {
+		t.Fatal(ttl)
+	}
+	msg.Header.Truncated = false
+	msg.Header.Rcode = RcodeServerFailure
+	if ttl := getCacheTTL(msg); ttl != 0 {
+		t.Fatal(ttl)
+	}
+	// NODATA without SOA
+	msg.Header.Rcode = RcodeSuccess
+	msg.Answers = nil
+	if ttl := getCacheTTL(msg); ttl != 0 {
+		t.Fatal(ttl)
+	}
+	// NXDOMAIN uses the lower of SOA TTL and SOA minimum
+	msg, err = ParseMessage(mustDecodeHex(t, sampleNXDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Authorities[0].TTL = 100
+	if ttl := getCacheTTL(msg); ttl != 100 {
+		t.Fatal(ttl)
+	}
+}
+
+func TestResponseCache_Transport(t *testing.T) {
+	cache := NewResponseCache(10)
+	pack := func(msg *Message) []byte {
+		packet, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packet
+	}
+	// A large response obtained over TCP by an EDNS query
+	ednsQuery := &Message{
+		Header:    Header{ID: 1, RecursionDesired: true},
+		Questions: []Question{{Name: "large.example.com", Type: TypeA, Class: ClassIN}},
+		OPT:       &OPTRecord{UDPSize: 4096},
+	}
+	response := ednsQuery.Reply()
+	for i := 0; i < 50; i++ {
+		response.Answers = append(response.Answers, ResourceRecord{Name: "large.example.com", Type: TypeA, Class: ClassIN, TTL: 60, Data: []byte{10, 0, 0, byte(i)}})
+	}
+	cache.Store(pack(ednsQuery), pack(response))
+	if cache.Len() != 1 {
+		t.Fatal(cache.Len())
+	}
+	// EDNS client with a large buffer gets the entire response over UDP
+	msg, err := ParseMessage(cache.Lookup(pack(ednsQuery), true))
+	if err != nil || msg.Header.Truncated || len(msg.Answers) != 50 || msg.OPT == nil {
+		t.Fatalf("%+v %v", msg, err)
+	}
+	// Client without EDNS gets a truncated response over UDP, and the entire response over TCP, neither carries OPT.
+	plainQuery := makeQuery(t, "large.example.com", TypeA)
+	msg, err = ParseMessage(cache.Lookup(plainQuery, true))
+	if err != nil || !msg.Header.Truncated || len(msg.Answers) != 0 || msg.OPT != nil || msg.Header.ID != 0x4321 {
+		t.Fatalf("%+v %v", msg, err)
+	}
+	msg, err = ParseMessage(cache.Lookup(plainQuery, false))
+	if err != nil || msg.Header.Truncated || len(msg.Answers) != 50 || msg.OPT != nil {
+		t.Fatalf("%+v %v", msg, err)
+	}
+	// Queries with DNSSEC OK or checking disabled do not share the cached response
+	ednsQuery.OPT.DNSSECOK = true
+	if resp := cache.Lookup(pack(ednsQuery), false); resp != nil {
+		t.Fatal(resp)
+	}
+	ednsQuery.OPT.DNSSECOK = false
+	ednsQuery.Header.CheckingDisabled = true
+	if resp := cache.Lookup(pack(ednsQuery), false); resp != nil {
+		t.Fatal(resp)
+	}
+}
@@ -1,7 +1,7 @@
 package dnsd
 
 import (
-	"bytes"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -18,7 +18,7 @@ const (
 	IOTimeoutSec               = 60   // IO timeout for both read and write operations
 	MaxPacketSize              = 9038 // Maximum acceptable UDP packet size
 	NumQueueRatio              = 10   // Upon initialisation, create (PerIPLimit/NumQueueRatio) number of queues to handle queries.
-	BlacklistUpdateIntervalSec = 7200 // Update ad-server blacklist at this interval
+	BlacklistUpdateIntervalSec = 7200 // Update ad-server blacklist at this interval, unless the black list source specifies its own interval.
 	MinNameQuerySize           = 14   // If a query packet is shorter than this length, it cannot possibly be a name query.
 	PublicIPRefreshIntervalSec = 900  // PublicIPRefreshIntervalSec is how often the program places its latest public IP address into array of IPs that may query the server.
 	MVPSLicense                = `Disclaimer: this file is free to use for personal use only. Furthermore it is NOT permitted to ` +
@@ -40,7 +40,7 @@ type TCPForwarderQuery struct {
 	QueryPacket []byte
 }
 
-// A DNS forwarder daemon that selectively refuse to answer certain A record requests made against advertisement servers.
+// A DNS forwarder daemon that selectively refuse to answer queries made against advertisement servers.
 type Daemon struct {
 	Address              string   `json:"Address"`              // Network address for both TCP and UDP to listen to, e.g. 0.0.0.0 for all network interfaces.
 	AllowQueryIPPrefixes []string `json:"AllowQueryIPPrefixes"` // AllowQueryIPPrefixes are the string prefixes in IPv4 and IPv6 client addresses that are allowed to query the DNS server.
@@ -50,33 +50,73 @@ type Daemon struct {
 	UDPForwarder []string `json:"UDPForwarders"` // Forward UDP DNS queries to these address (IP:Port)
 	TCPPort      int      `json:"TCPPort"`       // TCP port to listen on
 	TCPForwarder []string `json:"TCPForwarders"` // Forward TCP DNS queries to these addresses (IP:Port)
+	TLSPort      int      `json:"TLSPort"`       // (Optional) DNS-over-TLS port to listen on, queries are forwarded to TCP forwarders.
+	TLSCertPath  string   `json:"TLSCertPath"`   // (Optional) serve DNS-over-TLS via this certificate
+	TLSKeyPath   string   `json:"TLSKeyPath"`    // (Optional) serve DNS-over-TLS via this certificate (key)
+
+	AnswerBlackListWithNXDomain bool `json:"AnswerBlackListWithNXDomain"` // Answer NXDOMAIN to black-listed names instead of 0.0.0.0, :: and empty answers
+	CacheSize                   int  `json:"CacheSize"`                   // Maximum number of forwarder responses to keep in cache, 0 means DefaultCacheSize.
+
+	LocalRecords map[string]LocalRecords `json:"LocalRecords"` // Static records answered authoritatively by the daemon itself, keyed by domain name.
+
+	BlackListSources []BlackListSource `json:"BlackListSources"` // Download or read black-listed domain names from these sources, DefaultBlackListSources are used if empty.
+	WhiteList        []string          `json:"WhiteList"`        // Domain names (and their sub-domains) that are never black-listed, this overrides all black lists.
+	ExtraBlackList   []string          `json:"ExtraBlackList"`   // Domain names (and their sub-domains) that are black-listed in addition to those from black list sources.
+	// BlackListSnapshotPath is the file to save black list into after each refresh, the file is loaded upon startup so that ad-blocking works right away.
+	BlackListSnapshotPath string `json:"BlackListSnapshotPath"`
 
 	tcpListener       net.Listener     // Once TCP daemon is started, this is its listener.
-	udpForwardConn    []net.Conn       // UDP connections made toward forwarder
+	tlsListener       net.Listener     // Once DNS-over-TLS daemon is started, this is its listener.
+	tlsCert           tls.Certificate  // tlsCert is the certificate loaded from TLSCertPath and TLSKeyPath.
 	udpForwarderQueue []chan *UDPQuery // Processing queues that handle UDP forward queries
 	udpBlackHoleQueue []chan *UDPQuery // Processing queues that handle UDP black-list answers
 	udpListener       *net.UDPConn     // Once UDP daemon is started, this is its listener.
+	responseCache     *ResponseCache   // Memorise forwarders' responses for both TCP and UDP queries.
+	localZone         *localZone       // Answer queries on local records before checking black list and forwarding.
+
+	udpForwarders []*forwarderState // udpForwarders are the health states of UDP forwarders.
+	tcpForwarders []*forwarderState // tcpForwarders are the health states of TCP forwarders.
 
-	blackListMutex       *sync.Mutex         // Protect against concurrent access to black list
-	blackList            map[string]struct{} // Do not answer to type A queries made toward these domains
-	allowQueryMutex      *sync.Mutex         // allowQueryMutex guards against concurrent access to AllowQueryIPPrefixes.
-	allowQueryLastUpdate int64               // allowQueryLastUpdate is the Unix timestamp of the very latest automatic placement of computer's public IP into the array of AllowQueryIPPrefixes.
-	rateLimit            *misc.RateLimit     // Rate limit counter
-	logger               misc.Logger
+	blackListMutex        *sync.Mutex            // Protect against concurrent access to black list, white list, and black list source states
+	blackList             map[string]struct{}    // Do not answer to queries made toward these domains
+	whiteList             map[string]struct{}    // whiteList is the lower case white list.
+	blackListSourceStates []blackListSourceState // blackListSourceStates are the latest entries of each black list source.
+	blackListSnapshot     []string               // blackListSnapshot are the entries loaded from snapshot file upon startup.
+	snapshotRejections    int                    // snapshotRejections is the number of consecutive rebuilds that rejected the retrieved sources for being suspiciously shorter than the snapshot.
+	allowQueryMutex       *sync.Mutex            // allowQueryMutex guards against concurrent access to AllowQueryIPPrefixes.
+	allowQueryLastUpdate  int64                  // allowQueryLastUpdate is the Unix timestamp of the very latest automatic placement of computer's public IP into the array of AllowQueryIPPrefixes.
+	rateLimit             *misc.RateLimit        // Rate limit counter
+	refreshMutex          *sync.Mutex            // refreshMutex guards against concurrent start and stop of background refresh.
+	refreshUsers          int                    // refreshUsers is the number of callers who need background refresh of black list and forwarders.
+	stopRefresh           chan bool              // stopRefresh is closed to stop background refresh of black list and forwarders.
+	logger                misc.Logger
 }
 
 // Check configuration and initialise internal states.
 func (daemon *Daemon) Initialise() error {
-	daemon.logger = misc.Logger{ComponentName: "DNSD", ComponentID: fmt.Sprintf("%s:%d&%d", daemon.Address, daemon.TCPPort, daemon.UDPPort)}
+	daemon.logger = misc.Logger{ComponentName: "DNSD", ComponentID: fmt.Sprintf("%s:%d&%d&%d", daemon.Address, daemon.TCPPort, daemon.UDPPort, daemon.TLSPort)}
 	if daemon.Address == "" {
 		return errors.New("DNSD.Initialise: listen address must not be empty")
 	}
-	if daemon.UDPPort < 1 && daemon.TCPPort < 1 {
-		return errors.New("DNSD.Initialise: either or both TCP and UDP ports must be specified and be greater than 0")
+	if daemon.UDPPort < 1 && daemon.TCPPort < 1 && daemon.TLSPort < 1 {
+		return errors.New("DNSD.Initialise: either or both TCP and UDP ports, or the TLS port, must be specified and be greater than 0")
 	}
 	if (daemon.UDPForwarder == nil || len(daemon.UDPForwarder) == 0) && (daemon.TCPForwarder == nil || len(daemon.TCPForwarder) == 0) {
 		return errors.New("DNSD.Initialise: there must be at least one UDP or TCP forwarder address")
 	}
+	if daemon.TLSPort > 0 {
+		if daemon.TLSCertPath == "" || daemon.TLSKeyPath == "" {
+			return errors.New("DNSD.Initialise: TLS certificate or key path is missing")
+		}
+		if len(daemon.TCPForwarder) == 0 {
+			return errors.New("DNSD.Initialise: DNS-over-TLS requires at least one TCP forwarder address")
+		}
+		var err error
+		daemon.tlsCert, err = tls.LoadX509KeyPair(daemon.TLSCertPath, daemon.TLSKeyPath)
+		if err != nil {
+			return fmt.Errorf("DNSD.Initialise: failed to read TLS certificate - %v", err)
+		}
+	}
 	if daemon.PerIPLimit < 10 {
 		return errors.New("DNSD.Initialise: PerIPLimit must be greater than 9")
 	}
@@ -92,8 +132,32 @@ func (daemon *Daemon) Initialise() error {
 	daemon.AllowQueryIPPrefixes = append(daemon.AllowQueryIPPrefixes, "127.", "::1")
 
 	daemon.allowQueryMutex = new(sync.Mutex)
+	daemon.refreshMutex = new(sync.Mutex)
+	if len(daemon.BlackListSources) == 0 {
+		daemon.BlackListSources = DefaultBlackListSources
+	}
+	for _, src := range daemon.BlackListSources {
+		if err := src.Check(); err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+	}
 	daemon.blackListMutex = new(sync.Mutex)
-	daemon.blackList = make(map[string]struct{})
+	daemon.blackListSourceStates = make([]blackListSourceState, len(daemon.BlackListSources))
+	daemon.whiteList = make(map[string]struct{})
+	for _, name := range daemon.WhiteList {
+		daemon.whiteList[strings.ToLower(strings.TrimSuffix(name, "."))] = struct{}{}
+	}
+	// Snapshot and extra black list take effect before black list sources are retrieved
+	if err := daemon.loadBlackListSnapshot(); err != nil {
+		return fmt.Errorf("DNSD.Initialise: failed to load black list snapshot - %v", err)
+	}
+	daemon.rebuildBlackList()
+	daemon.responseCache = NewResponseCache(daemon.CacheSize)
+	localZone, err := newLocalZone(daemon.LocalRecords)
+	if err != nil {
+		return fmt.Errorf("DNSD.Initialise: %v", err)
+	}
+	daemon.localZone = localZone
 
 	daemon.rateLimit = &misc.RateLimit{
 		MaxCount: daemon.PerIPLimit,
@@ -101,6 +165,21 @@ func (daemon *Daemon) Initialise() error {
 		Logger:   daemon.logger,
 	}
 	daemon.rateLimit.Initialise()
+	// Forwarder addresses are resolved right away to catch configuration mistakes early
+	daemon.udpForwarders = make([]*forwarderState, 0, len(daemon.UDPForwarder))
+	for _, addr := range daemon.UDPForwarder {
+		if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+			return fmt.Errorf("DNSD.Initialise: failed to resolve UDP address - %v", err)
+		}
+		daemon.udpForwarders = append(daemon.udpForwarders, getForwarderState("udp", addr))
+	}
+	daemon.tcpForwarders = make([]*forwarderState, 0, len(daemon.TCPForwarder))
+	for _, addr := range daemon.TCPForwarder {
+		if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+			return fmt.Errorf("DNSD.Initialise: failed to resolve TCP address - %v", err)
+		}
+		daemon.tcpForwarders = append(daemon.tcpForwarders, getForwarderState("tcp", addr))
+	}
 	// Create a number of forwarder queues to handle incoming UDP DNS queries
 	// Keep in mind, TCP queries are not handled by queues.
 	if daemon.UDPPort > 0 {
@@ -109,23 +188,13 @@ func (daemon *Daemon) Initialise() error {
 		if numQueues < len(daemon.UDPForwarder) {
 			numQueues = len(daemon.UDPForwarder)
 		}
-		daemon.udpForwardConn = make([]net.Conn, numQueues)
 		daemon.udpForwarderQueue = make([]chan *UDPQuery, numQueues)
 		daemon.udpBlackHoleQueue = make([]chan *UDPQuery, numQueues)
 		for i := 0; i < numQueues; i++ {
 			/*
-				Each queue is connected to a different forwarder.
-				When a DNS query comes in, it is assigned a random forwarder to be processed.
+				When a DNS query comes in, it is assigned a random queue to be processed.
+				The queue then picks a healthy forwarder to answer the query.
 			*/
-			forwarderAddr, err := net.ResolveUDPAddr("udp", daemon.UDPForwarder[i%len(daemon.UDPForwarder)])
-			if err != nil {
-				return fmt.Errorf("DNSD.Initialise: failed to resolve UDP address - %v", err)
-			}
-			forwarderConn, err := net.DialTimeout("udp", forwarderAddr.String(), IOTimeoutSec*time.Second)
-			if err != nil {
-				return fmt.Errorf("DNSD.Initialise: failed to connect to UDP forwarder - %v", err)
-			}
-			daemon.udpForwardConn[i] = forwarderConn
 			daemon.udpForwarderQueue[i] = make(chan *UDPQuery, 16) // there really is no need for a deeper queue
 			daemon.udpBlackHoleQueue[i] = make(chan *UDPQuery, 4)  // there is also no need for a deeper queue here
 		}
@@ -167,6 +236,11 @@ func (daemon *Daemon) allowMyPublicIP() {
 	}
 }
 
+// IsClientAllowed returns true only if the client IP is allowed to query, e.g. by DNS-over-HTTPS handler of web server.
+func (daemon *Daemon) IsClientAllowed(clientIP string) bool {
+	return daemon.checkAllowClientIP(clientIP)
+}
+
 // checkAllowClientIP returns true only if the input IP address is among the allowed addresses.
 func (daemon *Daemon) checkAllowClientIP(clientIP string) bool {
 	// At regular time interval, make sure that the latest public IP is allowed to query.
@@ -182,87 +256,84 @@ func (daemon *Daemon) checkAllowClientIP(clientIP string) bool {
 	return false
 }
 
-// Download ad-servers list from pgl.yoyo.org and return those domain names.
-func (daemon *Daemon) GetAdBlacklistPGL() ([]string, error) {
-	yoyo := "https://pgl.yoyo.org/adservers/serverlist.php?hostformat=nohtml&showintro=0&mimetype=plaintext"
-	resp, err := inet.DoHTTP(inet.HTTPRequest{TimeoutSec: 30}, yoyo)
-	if err != nil {
-		return nil, err
+// BlackHoleTTL is the TTL of answers made to black-listed domain names.
+const BlackHoleTTL = 1466
+
+//                            Domain     A    IN      TTL 1466  IPv4     0.0.0.0
+var BlackHoleAnswer = []byte{192, 12, 0, 1, 0, 1, 0, 0, 5, 186, 0, 4, 0, 0, 0, 0} // DNS answer 0.0.0.0 in wire format
+
+/*
+Create a DNS response packet without prefix length bytes, that points incoming query to 0.0.0.0 for A record, or to ::
+for AAAA record. Queries on other types of record get a response without answer (NODATA).
+Return an empty packet if the query is malformed.
+*/
+func RespondWith0(queryNoLength []byte) []byte {
+	return respondToBlackListed(queryNoLength, false)
+}
+
+/*
+Create a DNS response packet without prefix length bytes, that tells the queried name does not exist (NXDOMAIN).
+Return an empty packet if the query is malformed.
+*/
+func RespondWithNXDomain(queryNoLength []byte) []byte {
+	return respondToBlackListed(queryNoLength, true)
+}
+
+// respondToBlackListed creates a black hole response to the query, or an NXDOMAIN response if asked to.
+func respondToBlackListed(queryNoLength []byte, nxDomain bool) []byte {
+	if queryNoLength == nil || len(queryNoLength) < MinNameQuerySize {
+		return []byte{}
 	}
-	if statusErr := resp.Non2xxToError(); statusErr != nil {
-		return nil, statusErr
+	query, err := ParseMessage(queryNoLength)
+	if err != nil || len(query.Questions) == 0 {
+		return []byte{}
 	}
-	lines := strings.Split(string(resp.Body), "\n")
-	if len(lines) < 100 {
-		return nil, fmt.Errorf("DNSD.GetAdBlacklistPGL: PGL's ad-server list is suspiciously short at only %d lines", len(lines))
+	response := query.Reply()
+	question := query.Questions[0]
+	if nxDomain {
+		response.Header.Rcode = RcodeNameError
+	} else if question.Class == ClassIN {
+		switch question.Type {
+		case TypeA:
+			response.Answers = []ResourceRecord{{Name: question.Name, Type: TypeA, Class: ClassIN, TTL: BlackHoleTTL, Data: net.IPv4zero.To4()}}
+		case TypeAAAA:
+			response.Answers = []ResourceRecord{{Name: question.Name, Type: TypeAAAA, Class: ClassIN, TTL: BlackHoleTTL, Data: []byte(net.IPv6zero)}}
+		}
 	}
-	names := make([]string, 0, len(lines))
-	for _, line := range lines {
-		names = append(names, strings.TrimSpace(line))
+	packet, err := response.Pack()
+	if err != nil {
+		return []byte{}
 	}
-	return names, nil
+	return packet
 }
 
-// Download ad-servers list from winhelp2002.mvps.org and return those domain names.
-func (daemon *Daemon) GetAdBlacklistMVPS() ([]string, error) {
-	yoyo := "http://winhelp2002.mvps.org/hosts.txt"
-	resp, err := inet.DoHTTP(inet.HTTPRequest{TimeoutSec: 30}, yoyo)
-	if err != nil {
-		return nil, err
-	}
-	if statusErr := resp.Non2xxToError(); statusErr != nil {
-		return nil, statusErr
-	}
-	// Collect host names from the hosts file content
-	names := make([]string, 0, 16384)
-	for _, line := range strings.Split(string(resp.Body), "\n") {
-		indexZero := strings.Index(line, "0.0.0.0")
-		nameEnd := strings.IndexRune(line, '#')
-		if indexZero == -1 {
-			// Skip lines that do not have a host name
-			continue
-		}
-		if nameEnd == -1 {
-			nameEnd = len(line)
-		}
-		nameBegin := indexZero + len("0.0.0.0")
-		if nameBegin >= nameEnd {
-			// The line looks like # this is a comment 0.0.0.0
-			continue
-		}
-		names = append(names, strings.TrimSpace(line[nameBegin:nameEnd]))
-	}
-	if len(names) < 100 {
-		return nil, fmt.Errorf("DNSD.GetAdBlacklistMVPS: MVPS' ad-server list is suspiciously short at only %d lines", len(names))
+// RespondToBlackListed creates a response to the query that asks for a black-listed name, according to daemon configuration.
+func (daemon *Daemon) RespondToBlackListed(queryNoLength []byte) []byte {
+	if daemon.AnswerBlackListWithNXDomain {
+		return RespondWithNXDomain(queryNoLength)
 	}
-	return names, nil
+	return RespondWith0(queryNoLength)
 }
 
-var StandardResponseNoError = []byte{129, 128} // DNS response packet flag - standard response, no indication of error.
-
-//                            Domain     A    IN      TTL 1466  IPv4     0.0.0.0
-var BlackHoleAnswer = []byte{192, 12, 0, 1, 0, 1, 0, 0, 5, 186, 0, 4, 0, 0, 0, 0} // DNS answer 0.0.0.0
-
-// Create a DNS response packet without prefix length bytes, that points incoming query to 0.0.0.0.
-func RespondWith0(queryNoLength []byte) []byte {
-	if queryNoLength == nil || len(queryNoLength) < MinNameQuerySize {
-		return []byte{}
+// appendDomainNames appends the domain name and then the same name with leading components removed.
+func appendDomainNames(ret []string, domainName string) []string {
+	// First return value is domain name unchanged (apart from letter case)
+	domainName = strings.ToLower(domainName)
+	if domainName == "" {
+		// Root domain does not have a name to check
+		return ret
 	}
-	answerPacket := make([]byte, 2+2+len(queryNoLength)-4+len(BlackHoleAnswer))
-	// Match transaction ID of original query
-	answerPacket[0] = queryNoLength[0]
-	answerPacket[1] = queryNoLength[1]
-	// 0x8180 - response is a standard query response, without indication of error.
-	copy(answerPacket[2:4], StandardResponseNoError)
-	// Copy of original query structure
-	copy(answerPacket[4:], queryNoLength[4:])
-	// There is exactly one answer RR
-	answerPacket[6] = 0
-	answerPacket[7] = 1
-	// Answer 0.0.0.0 to the query
-	copy(answerPacket[len(answerPacket)-len(BlackHoleAnswer):], BlackHoleAnswer)
-	// Finally, respond!
-	return answerPacket
+	ret = append(ret, domainName)
+	// Append more of the same domain name, each with leading component removed.
+	for {
+		index := strings.IndexRune(domainName, '.')
+		if index < 1 || index == len(domainName)-1 {
+			break
+		}
+		domainName = domainName[index+1:]
+		ret = append(ret, domainName)
+	}
+	return ret
 }
 
 /*
@@ -271,105 +342,105 @@ E.g. for a query packet that asks for "a.b.github.com", the function returns:
 - a.b.github.com
 - b.github.com
 - github.com
+The query may ask for any type of record. Return an empty slice if the packet is not a well-formed standard query.
 */
 func ExtractDomainName(packet []byte) (ret []string) {
 	ret = make([]string, 0, 8)
 	if packet == nil || len(packet) < MinNameQuerySize {
 		return
 	}
-	indexTypeAClassIN := bytes.Index(packet[13:], []byte{0, 1, 0, 1})
-	if indexTypeAClassIN < 1 {
+	query, err := ParseMessage(packet)
+	if err != nil || query.Header.Response || query.Header.Opcode != OpcodeQuery || len(query.Questions) == 0 {
 		return
 	}
-	indexTypeAClassIN += 13
-	// The byte right before Type-A Class-IN is an empty byte to be discarded
-	domainNameBytes := make([]byte, indexTypeAClassIN-13-1)
-	copy(domainNameBytes, packet[13:indexTypeAClassIN-1])
-	/*
-		Restore full-stops of the domain name portion so that it can be checked against black list.
-		Not sure why those byte ranges show up in place of full-stops, probably due to some RFCs.
-	*/
-	for i, b := range domainNameBytes {
-		if b <= 44 || b >= 58 && b <= 64 || b >= 91 && b <= 96 {
-			domainNameBytes[i] = '.'
-		}
+	return appendDomainNames(ret, query.Questions[0].Name)
+}
+
+/*
+ExtractCNAMETargets returns the names that CNAME records among answers of a DNS response point to, each name is followed
+by the same name with leading components removed. Return an empty slice if the response does not carry a CNAME answer.
+*/
+func ExtractCNAMETargets(packet []byte) (ret []string) {
+	ret = make([]string, 0, 8)
+	if packet == nil || len(packet) < MinNameQuerySize {
+		return
 	}
-	// First return value is domain name unchanged
-	domainName := string(domainNameBytes)
-	if len(domainName) > 1024 {
-		// Domain name is unrealistically long
+	response, err := ParseMessage(packet)
+	if err != nil || !response.Header.Response {
 		return
 	}
-	ret = append(ret, domainName)
-	// Append more of the same domain name, each with leading component removed.
-	for {
-		index := strings.IndexRune(domainName, '.')
-		if index < 1 || index == len(domainName)-1 {
-			break
+	for _, answer := range response.Answers {
+		if answer.Type != TypeCNAME {
+			continue
+		}
+		if target, err := answer.DataName(); err == nil {
+			ret = appendDomainNames(ret, target)
 		}
-		domainName = domainName[index+1:]
-		ret = append(ret, domainName)
 	}
 	return
 }
 
-func (daemon *Daemon) UpdatedAdBlockLists() {
-	pglEntries, pglErr := daemon.GetAdBlacklistPGL()
-	if pglErr == nil {
-		daemon.logger.Printf("GetAdBlacklistPGL", "", nil, "successfully retrieved ad-blacklist with %d entries", len(pglEntries))
-	} else {
-		daemon.logger.Warningf("GetAdBlacklistPGL", "", pglErr, "failed to update ad-blacklist")
+/*
+KeepAdBlockListsUpdated updates ad-block black list right away and then whenever a black list source is due for refresh,
+until a value arrives from the stop channel or the channel is closed. If the channel is nil, the updates carry on forever.
+*/
+func (daemon *Daemon) KeepAdBlockListsUpdated(stop chan bool) {
+	daemon.UpdatedAdBlockLists()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(BlackListCheckIntervalSec * time.Second):
+			daemon.UpdatedAdBlockLists()
+		}
 	}
-	mvpsEntries, mvpsErr := daemon.GetAdBlacklistMVPS()
-	if mvpsErr == nil {
-		daemon.logger.Printf("GetAdBlacklistMVPS", "", nil, "successfully retrieved ad-blacklist with %d entries", len(mvpsEntries))
-		daemon.logger.Printf("GetAdBlacklistMVPS", "", nil, "Please comply with the following liences for your usage of http://winhelp2002.mvps.org/hosts.txt: %s", MVPSLicense)
-	} else {
-		daemon.logger.Warningf("GetAdBlacklistMVPS", "", mvpsErr, "failed to update ad-blacklist")
+}
+
+/*
+StartBackgroundRefresh begins updating ad-block black list and checking forwarders in background, unless they are already
+running for another caller. The DNS daemon and DNS-over-HTTPS handlers of web servers share a single set of refresh
+routines. Each call must be paired with a call to StopBackgroundRefresh.
+*/
+func (daemon *Daemon) StartBackgroundRefresh() {
+	daemon.refreshMutex.Lock()
+	defer daemon.refreshMutex.Unlock()
+	daemon.refreshUsers++
+	if daemon.refreshUsers == 1 {
+		daemon.stopRefresh = make(chan bool)
+		go daemon.KeepAdBlockListsUpdated(daemon.stopRefresh)
+		go daemon.KeepForwardersChecked(daemon.stopRefresh)
 	}
-	daemon.blackListMutex.Lock()
-	daemon.blackList = make(map[string]struct{})
-	if pglErr == nil {
-		for _, name := range pglEntries {
-			daemon.blackList[name] = struct{}{}
-		}
+}
+
+// StopBackgroundRefresh stops updating black list and checking forwarders after the last caller no longer needs them.
+func (daemon *Daemon) StopBackgroundRefresh() {
+	daemon.refreshMutex.Lock()
+	defer daemon.refreshMutex.Unlock()
+	if daemon.refreshUsers == 0 {
+		return
 	}
-	if mvpsErr == nil {
-		for _, name := range mvpsEntries {
-			daemon.blackList[name] = struct{}{}
-		}
+	daemon.refreshUsers--
+	if daemon.refreshUsers == 0 {
+		close(daemon.stopRefresh)
 	}
-	daemon.blackListMutex.Unlock()
-	daemon.logger.Printf("UpdatedAdBlockLists", "", nil, "ad-blacklist now has %d entries", len(daemon.blackList))
 }
 
 /*
 You may call this function only after having called Initialise()!
-Start DNS daemon on configured TCP and UDP ports. Block caller until both listeners are told to stop.
-If either TCP or UDP port fails to listen, all listeners are closed and an error is returned.
+Start DNS daemon on configured TCP, UDP, and TLS ports. Block caller until all listeners are told to stop.
+If any of the ports fails to listen, all listeners are closed and an error is returned.
 */
 func (daemon *Daemon) StartAndBlock() error {
-	// Keep updating ad-block black list in background
-	stopAdBlockUpdater := make(chan bool, 1)
-	go func() {
-		daemon.UpdatedAdBlockLists()
-		for {
-			select {
-			case <-stopAdBlockUpdater:
-				return
-			case <-time.After(BlacklistUpdateIntervalSec * time.Second):
-				daemon.UpdatedAdBlockLists()
-			}
-		}
-	}()
+	// Keep updating ad-block black list and checking forwarders in background
+	daemon.StartBackgroundRefresh()
+	defer daemon.StopBackgroundRefresh()
 	numListeners := 0
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 3)
 	if daemon.UDPPort != 0 {
 		numListeners++
 		go func() {
 			err := daemon.StartAndBlockUDP()
 			errChan <- err
-			stopAdBlockUpdater <- true
 		}()
 	}
 	if daemon.TCPPort != 0 {
@@ -377,7 +448,13 @@ func (daemon *Daemon) StartAndBlock() error {
 		go func() {
 			err := daemon.StartAndBlockTCP()
 			errChan <- err
-			stopAdBlockUpdater <- true
+		}()
+	}
+	if daemon.TLSPort != 0 {
+		numListeners++
+		go func() {
+			err := daemon.StartAndBlockTLS()
+			errChan <- err
 		}()
 	}
 	for i := 0; i < numListeners; i++ {
@@ -389,13 +466,18 @@ func (daemon *Daemon) StartAndBlock() error {
 	return nil
 }
 
-// Close all of open TCP and UDP listeners so that they will cease processing incoming connections.
+// Close all of open TCP, UDP, and TLS listeners so that they will cease processing incoming connections.
 func (daemon *Daemon) Stop() {
 	if listener := daemon.tcpListener; listener != nil {
 		if err := listener.Close(); err != nil {
 			daemon.logger.Warningf("Stop", "", err, "failed to close TCP listener")
 		}
 	}
+	if listener := daemon.tlsListener; listener != nil {
+		if err := listener.Close(); err != nil {
+			daemon.logger.Warningf("Stop", "", err, "failed to close TLS listener")
+		}
+	}
 	if listener := daemon.udpListener; listener != nil {
 		if err := listener.Close(); err != nil {
 			daemon.logger.Warningf("Stop", "", err, "failed to close UDP listener")
@@ -403,18 +485,32 @@ func (daemon *Daemon) Stop() {
 	}
 }
 
-// Return true if any of the input domain names is black listed.
+/*
+Return true if any of the input domain names is black listed. The names come in groups, each group begins with a domain
+name followed by the same name with leading components removed (see ExtractDomainName). If any name of a group is
+white-listed, the entire group is not black-listed.
+*/
 func (daemon *Daemon) NamesAreBlackListed(names []string) bool {
 	daemon.blackListMutex.Lock()
 	defer daemon.blackListMutex.Unlock()
-	var blacklisted bool
-	for _, name := range names {
-		_, blacklisted = daemon.blackList[name]
-		if blacklisted {
-			return true
+	var blackListed, whiteListed bool
+	for i, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		// A new group begins if the name is not a parent domain of the previous name
+		if i > 0 && !strings.HasSuffix(strings.ToLower(strings.TrimSuffix(names[i-1], ".")), "."+name) {
+			if blackListed && !whiteListed {
+				return true
+			}
+			blackListed, whiteListed = false, false
+		}
+		if _, exists := daemon.whiteList[name]; exists {
+			whiteListed = true
+		}
+		if _, exists := daemon.blackList[name]; exists {
+			blackListed = true
 		}
 	}
-	return false
+	return blackListed && !whiteListed
 }
 
 var githubComTCPQuery, githubComUDPQuery []byte // Sample queries for composing test cases
@@ -1,10 +1,24 @@
 package dnsd
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestExtractDomainName(t *testing.T) {
@@ -17,6 +31,22 @@ func TestExtractDomainName(t *testing.T) {
 	if name := ExtractDomainName(githubComUDPQuery); !reflect.DeepEqual(name, []string{"github.com", "com"}) {
 		t.Fatal(name)
 	}
+	if name := ExtractDomainName(mustDecodeHex(t, sampleAAAAQuery)); !reflect.DeepEqual(name, []string{"www.google.com", "google.com", "com"}) {
+		t.Fatal(name)
+	}
+	if name := ExtractDomainName(mustDecodeHex(t, sampleMXQuery)); !reflect.DeepEqual(name, []string{"gmail.com", "com"}) {
+		t.Fatal(name)
+	}
+	if name := ExtractDomainName(mustDecodeHex(t, sampleTXTQuery)); !reflect.DeepEqual(name, []string{"_dmarc.example.com", "example.com", "com"}) {
+		t.Fatal(name)
+	}
+	if name := ExtractDomainName(mustDecodeHex(t, sampleHTTPSQuery)); !reflect.DeepEqual(name, []string{"www.cloudflare.com", "cloudflare.com", "com"}) {
+		t.Fatal(name)
+	}
+	// Responses are not queries
+	if name := ExtractDomainName(mustDecodeHex(t, sampleCNAMEResp)); !reflect.DeepEqual(name, []string{}) {
+		t.Fatal(name)
+	}
 }
 
 func TestRespondWith0(t *testing.T) {
@@ -26,22 +56,70 @@ func TestRespondWith0(t *testing.T) {
 	if packet := RespondWith0([]byte{}); len(packet) != 0 {
 		t.Fatal(packet)
 	}
-	match, err := hex.DecodeString("e575818000010001000000010667697468756203636f6d00000100010000291000000000000000c00c00010001000005ba000400000000")
+	match, err := hex.DecodeString("e575818000010001000000010667697468756203636f6d0000010001c00c00010001000005ba0004000000000000291000000000000000")
 	if err != nil {
 		t.Fatal(err)
 	}
 	if packet := RespondWith0(githubComUDPQuery); !reflect.DeepEqual(packet, match) {
 		t.Fatal(hex.EncodeToString(packet))
 	}
+	// AAAA query gets ::
+	match = mustDecodeHex(t, "1b2c818000010001000000010377777706676f6f676c6503636f6d00001c0001"+
+		"c00c001c0001000005ba001000000000000000000000000000000000"+"00002904d0000000000000")
+	if packet := RespondWith0(mustDecodeHex(t, sampleAAAAQuery)); !reflect.DeepEqual(packet, match) {
+		t.Fatal(hex.EncodeToString(packet))
+	}
+	// Other types of query get a response without answer
+	match = mustDecodeHex(t, "5f1081800001000000000001037777770a636c6f7564666c61726503636f6d0000410001"+"0000291000000000000000")
+	if packet := RespondWith0(mustDecodeHex(t, sampleHTTPSQuery)); !reflect.DeepEqual(packet, match) {
+		t.Fatal(hex.EncodeToString(packet))
+	}
 }
 
-func TestDNSD_DownloadBlacklists(t *testing.T) {
-	daemon := Daemon{}
-	if entries, err := daemon.GetAdBlacklistPGL(); err != nil || len(entries) < 100 {
-		t.Fatal(err, entries)
+func TestRespondWithNXDomain(t *testing.T) {
+	if packet := RespondWithNXDomain(nil); len(packet) != 0 {
+		t.Fatal(packet)
+	}
+	match := mustDecodeHex(t, "e575818300010000000000010667697468756203636f6d0000010001"+"0000291000000000000000")
+	if packet := RespondWithNXDomain(githubComUDPQuery); !reflect.DeepEqual(packet, match) {
+		t.Fatal(hex.EncodeToString(packet))
+	}
+	daemon := Daemon{AnswerBlackListWithNXDomain: true}
+	if packet := daemon.RespondToBlackListed(githubComUDPQuery); !reflect.DeepEqual(packet, match) {
+		t.Fatal(hex.EncodeToString(packet))
 	}
-	if entries, err := daemon.GetAdBlacklistMVPS(); err != nil || len(entries) < 100 {
-		t.Fatal(err, entries)
+	daemon.AnswerBlackListWithNXDomain = false
+	if packet := daemon.RespondToBlackListed(githubComUDPQuery); !reflect.DeepEqual(packet, RespondWith0(githubComUDPQuery)) {
+		t.Fatal(hex.EncodeToString(packet))
+	}
+}
+
+func TestExtractCNAMETargets(t *testing.T) {
+	if names := ExtractCNAMETargets(nil); !reflect.DeepEqual(names, []string{}) {
+		t.Fatal(names)
+	}
+	// Queries do not carry answers
+	if names := ExtractCNAMETargets(githubComUDPQuery); !reflect.DeepEqual(names, []string{}) {
+		t.Fatal(names)
+	}
+	if names := ExtractCNAMETargets(mustDecodeHex(t, sampleNXDomain)); !reflect.DeepEqual(names, []string{}) {
+		t.Fatal(names)
+	}
+	if names := ExtractCNAMETargets(mustDecodeHex(t, sampleCNAMEResp)); !reflect.DeepEqual(names, []string{"github.com", "com"}) {
+		t.Fatal(names)
+	}
+	// The CNAME chain leads into a black-listed domain
+	daemon := Daemon{blackListMutex: new(sync.Mutex), blackList: map[string]struct{}{"github.com": {}}}
+	if !daemon.NamesAreBlackListed(ExtractCNAMETargets(mustDecodeHex(t, sampleCNAMEResp))) {
+		t.Fatal("did not block CNAME")
+	}
+}
+
+func TestDNSD_DownloadBlacklists(t *testing.T) {
+	for _, src := range DefaultBlackListSources {
+		if entries, err := src.Retrieve(); err != nil || len(entries) < 100 {
+			t.Fatal(err, entries)
+		}
 	}
 }
 
@@ -119,3 +197,124 @@ func TestDNSD_StartAndBlockTCP(t *testing.T) {
 	}
 	TestTCPQueries(&daemon, t)
 }
+
+// writeSelfSignedCert writes a self-signed certificate and its key for 127.0.0.1 into temporary files.
+func writeSelfSignedCert(t *testing.T) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "laitos-dnsd-test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, err := ioutil.TempFile("", "laitos-dnsd-TestTLS-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certFile.Close()
+	keyFile, err := ioutil.TempFile("", "laitos-dnsd-TestTLS-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyFile.Close()
+	if err := pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: certDER}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pem.Encode(keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}); err != nil {
+		t.Fatal(err)
+	}
+	return certFile.Name(), keyFile.Name()
+}
+
+func TestDNSD_StartAndBlockTLS(t *testing.T) {
+	certPath, keyPath := writeSelfSignedCert(t)
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+	daemon := Daemon{
+		Address:              "127.0.0.1",
+		TLSPort:              38531,
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"192."},
+		UDPForwarder:         TestForwarders,
+		LocalRecords:         map[string]LocalRecords{"github.com": {A: []string{"192.168.1.10"}}},
+	}
+	if err := daemon.Initialise(); err == nil || strings.Index(err.Error(), "certificate or key path") == -1 {
+		t.Fatal(err)
+	}
+	daemon.TLSCertPath = certPath
+	daemon.TLSKeyPath = keyPath
+	if err := daemon.Initialise(); err == nil || strings.Index(err.Error(), "TCP forwarder") == -1 {
+		t.Fatal(err)
+	}
+	daemon.TCPForwarder = TestForwarders
+	daemon.TLSKeyPath = certPath
+	if err := daemon.Initialise(); err == nil || strings.Index(err.Error(), "failed to read TLS certificate") == -1 {
+		t.Fatal(err)
+	}
+	daemon.TLSKeyPath = keyPath
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// The error from server goroutine is checked by the test goroutine after the daemon stops
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- daemon.StartAndBlock()
+	}()
+	time.Sleep(2 * time.Second)
+	// Ask for the local record over TLS
+	clientConn, err := tls.Dial("tcp", "127.0.0.1:38531", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clientConn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientConn.Write(githubComTCPQuery); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ioutil.ReadAll(clientConn)
+	clientConn.Close()
+	if err != nil || len(resp) < 2 || int(resp[0])*256+int(resp[1]) != len(resp)-2 {
+		t.Fatal(err, hex.EncodeToString(resp))
+	}
+	if msg, err := ParseMessage(resp[2:]); err != nil || len(msg.Answers) != 1 || !reflect.DeepEqual(msg.Answers[0].Data, []byte{192, 168, 1, 10}) {
+		t.Fatalf("%+v %v", msg, err)
+	}
+	// Plain TCP client does not get an answer from TLS port
+	plainConn, err := net.Dial("tcp", "127.0.0.1:38531")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plainConn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	plainConn.Write(githubComTCPQuery)
+	if resp, err := ioutil.ReadAll(plainConn); len(resp) > 0 && bytes.Contains(resp, []byte{192, 168, 1, 10}) {
+		t.Fatal(err, resp)
+	}
+	plainConn.Close()
+	// Daemon must stop in a second
+	daemon.Stop()
+	select {
+	case err := <-serverErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("did not stop")
+	}
+}
@@ -0,0 +1,312 @@
+package dnsd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ForwarderIOTimeoutSec     = 10  // ForwarderIOTimeoutSec is the IO timeout of each conversation with a forwarder, it is kept short for a quick failover.
+	ForwarderCheckIntervalSec = 30  // ForwarderCheckIntervalSec is the interval of health probes made to all forwarders.
+	ForwarderMaxFailures      = 3   // ForwarderMaxFailures is the number of consecutive failures that take a forwarder out of rotation.
+	ForwarderMaxAttempts      = 2   // ForwarderMaxAttempts is the number of forwarders to try for a single query before giving up.
+	ForwarderDefaultLatencyMS = 100 // ForwarderDefaultLatencyMS is the presumed latency of a forwarder that has not yet answered.
+	ForwarderLatencySmoothing = 0.3 // ForwarderLatencySmoothing is the weight of the latest measurement in a forwarder's average latency.
+)
+
+// forwarderState is the health of a forwarder, it is shared by all DNS daemons that use the same forwarder.
+type forwarderState struct {
+	protocol string        // protocol is either "udp" or "tcp".
+	addr     string        // addr is the forwarder address in form of IP:Port.
+	mutex    *sync.Mutex   // mutex protects all of the following fields.
+	healthy  bool          // healthy forwarders are chosen to answer queries, a new forwarder is presumed healthy.
+	failures int           // failures is the number of consecutive failures.
+	latency  time.Duration // latency is the smoothed average latency of successful conversations.
+	lastErr  error         // lastErr is the error of the latest failed conversation.
+}
+
+var (
+	forwarderStates      = make(map[string]*forwarderState) // forwarderStates are the forwarders of all DNS daemons, keyed by protocol and address.
+	forwarderStatesMutex = new(sync.Mutex)
+)
+
+// getForwarderState returns the existing state of a forwarder, or creates a new state if the forwarder is not yet known.
+func getForwarderState(protocol, addr string) *forwarderState {
+	forwarderStatesMutex.Lock()
+	defer forwarderStatesMutex.Unlock()
+	key := protocol + " " + addr
+	state, exists := forwarderStates[key]
+	if !exists {
+		state = &forwarderState{protocol: protocol, addr: addr, mutex: new(sync.Mutex), healthy: true}
+		forwarderStates[key] = state
+	}
+	return state
+}
+
+// GetForwarderStats returns the health and average latency of each forwarder, in a single line of text.
+func GetForwarderStats() string {
+	forwarderStatesMutex.Lock()
+	defer forwarderStatesMutex.Unlock()
+	keys := make([]string, 0, len(forwarderStates))
+	for key := range forwarderStates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	stats := make([]string, 0, len(keys))
+	for _, key := range keys {
+		state := forwarderStates[key]
+		state.mutex.Lock()
+		if state.healthy {
+			stats = append(stats, fmt.Sprintf("%s: up %dms", key, state.latency.Nanoseconds()/1000000))
+		} else {
+			stats = append(stats, fmt.Sprintf("%s: down (%v)", key, state.lastErr))
+		}
+		state.mutex.Unlock()
+	}
+	return strings.Join(stats, ", ")
+}
+
+/*
+report updates the forwarder health with the outcome of a conversation. Return true only if the forwarder has just
+been taken out of or re-admitted into rotation.
+*/
+func (state *forwarderState) report(latency time.Duration, err error) (changed bool) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if err == nil {
+		changed = !state.healthy
+		state.healthy = true
+		state.failures = 0
+		if state.latency == 0 {
+			state.latency = latency
+		} else {
+			state.latency = time.Duration(ForwarderLatencySmoothing*float64(latency) + (1-ForwarderLatencySmoothing)*float64(state.latency))
+		}
+		return
+	}
+	state.failures++
+	state.lastErr = err
+	if state.healthy && state.failures >= ForwarderMaxFailures {
+		state.healthy = false
+		changed = true
+	}
+	return
+}
+
+// weight returns the likelihood of choosing the forwarder, it is zero for an unhealthy forwarder.
+func (state *forwarderState) weight() float64 {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if !state.healthy {
+		return 0
+	}
+	latency := state.latency
+	if latency == 0 {
+		latency = ForwarderDefaultLatencyMS * time.Millisecond
+	}
+	if latency < time.Millisecond {
+		latency = time.Millisecond
+	}
+	return 1 / latency.Seconds()
+}
+
+/*
+chooseForwarder picks a healthy forwarder at random, faster forwarders are more likely to be picked. If none of the
+forwarders is healthy, any forwarder may be picked so that queries still get a chance to be answered. The excluded
+forwarder is never picked. Return nil if there is no forwarder to pick.
+*/
+func chooseForwarder(states []*forwarderState, exclude *forwarderState) *forwarderState {
+	candidates := make([]*forwarderState, 0, len(states))
+	weights := make([]float64, 0, len(states))
+	var totalWeight float64
+	for _, state := range states {
+		if state == exclude {
+			continue
+		}
+		if weight := state.weight(); weight > 0 {
+			candidates = append(candidates, state)
+			weights = append(weights, weight)
+			totalWeight += weight
+		}
+	}
+	if len(candidates) == 0 {
+		for _, state := range states {
+			if state != exclude {
+				candidates = append(candidates, state)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		return candidates[rand.Intn(len(candidates))]
+	}
+	pick := rand.Float64() * totalWeight
+	for i, weight := range weights {
+		if pick < weight {
+			return candidates[i]
+		}
+		pick -= weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+/*
+exchangeUDP sends a query (without prefix length bytes) over a UDP connection made to forwarder and returns its response.
+The connection is reused by many queries, hence a late or duplicated response to an earlier query may arrive first,
+such response is discarded if its transaction ID or question does not match the query.
+*/
+func exchangeUDP(conn net.Conn, query, packetBuf []byte) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(ForwarderIOTimeoutSec * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("failed to write query - %v", err)
+	}
+	for {
+		packetLength, err := conn.Read(packetBuf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response - %v", err)
+		}
+		if responseMatchesQuery(query, packetBuf[:packetLength]) {
+			return packetBuf[:packetLength], nil
+		}
+	}
+}
+
+/*
+responseMatchesQuery returns true only if the response carries the transaction ID of the query and answers the same
+questions. If the query is not a well-formed message, only the transaction ID is compared.
+*/
+func responseMatchesQuery(queryPacket, responsePacket []byte) bool {
+	if len(queryPacket) < 2 || len(responsePacket) < 2 || queryPacket[0] != responsePacket[0] || queryPacket[1] != responsePacket[1] {
+		return false
+	}
+	query, err := ParseMessage(queryPacket)
+	if err != nil {
+		return true
+	}
+	response, err := ParseMessage(responsePacket)
+	if err != nil || !response.Header.Response || len(response.Questions) != len(query.Questions) {
+		return false
+	}
+	for i, question := range query.Questions {
+		answered := response.Questions[i]
+		if !strings.EqualFold(question.Name, answered.Name) || question.Type != answered.Type || question.Class != answered.Class {
+			return false
+		}
+	}
+	return true
+}
+
+// exchangeTCP sends a query (without prefix length bytes) to TCP forwarder and returns its response without prefix length bytes.
+func exchangeTCP(addr string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, ForwarderIOTimeoutSec*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect - %v", err)
+	}
+	defer conn.Close()
+	// Send original query to forwarder without modification
+	conn.SetDeadline(time.Now().Add(ForwarderIOTimeoutSec * time.Second))
+	if _, err = conn.Write(append([]byte{byte(len(query) / 256), byte(len(query) % 256)}, query...)); err != nil {
+		return nil, fmt.Errorf("failed to write query - %v", err)
+	}
+	// Retrieve forwarder's response
+	responseLenBuf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, responseLenBuf); err != nil {
+		return nil, fmt.Errorf("failed to read response length - %v", err)
+	}
+	responseLen := int(responseLenBuf[0])*256 + int(responseLenBuf[1])
+	if responseLen > MaxPacketSize || responseLen < 1 {
+		return nil, errors.New("bad response length")
+	}
+	response := make([]byte, responseLen)
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return nil, fmt.Errorf("failed to read response - %v", err)
+	}
+	return response, nil
+}
+
+// probe asks the forwarder for name servers of root domain, and returns the latency of its answer.
+func (state *forwarderState) probe() (latency time.Duration, err error) {
+	query, err := (&Message{
+		Header:    Header{ID: uint16(rand.Intn(65536)), RecursionDesired: true},
+		Questions: []Question{{Name: ".", Type: TypeNS, Class: ClassIN}},
+	}).Pack()
+	if err != nil {
+		return
+	}
+	beginTime := time.Now()
+	var responsePacket []byte
+	if state.protocol == "udp" {
+		var conn net.Conn
+		if conn, err = net.DialTimeout("udp", state.addr, ForwarderIOTimeoutSec*time.Second); err != nil {
+			return
+		}
+		defer conn.Close()
+		responsePacket, err = exchangeUDP(conn, query, make([]byte, MaxPacketSize))
+	} else {
+		responsePacket, err = exchangeTCP(state.addr, query)
+	}
+	if err != nil {
+		return
+	}
+	latency = time.Since(beginTime)
+	response, err := ParseMessage(responsePacket)
+	if err != nil {
+		return
+	}
+	if !response.Header.Response || response.Header.ID != uint16(query[0])<<8|uint16(query[1]) {
+		return 0, errors.New("response does not match the probe query")
+	}
+	if response.Header.Rcode == RcodeServerFailure || response.Header.Rcode == RcodeRefused {
+		return 0, fmt.Errorf("response code is %d", response.Header.Rcode)
+	}
+	return
+}
+
+// reportForwarder updates the forwarder health with the outcome of a conversation, and logs the change of its health.
+func (daemon *Daemon) reportForwarder(state *forwarderState, latency time.Duration, err error) {
+	if !state.report(latency, err) {
+		return
+	}
+	if err == nil {
+		daemon.logger.Printf("reportForwarder", state.protocol+" "+state.addr, nil, "forwarder has recovered and is back in rotation")
+	} else {
+		daemon.logger.Warningf("reportForwarder", state.protocol+" "+state.addr, err, "forwarder is taken out of rotation")
+	}
+}
+
+// CheckForwarders probes all UDP and TCP forwarders in parallel, and updates their health with the outcome.
+func (daemon *Daemon) CheckForwarders() {
+	waitProbes := new(sync.WaitGroup)
+	for _, state := range append(append([]*forwarderState{}, daemon.udpForwarders...), daemon.tcpForwarders...) {
+		waitProbes.Add(1)
+		go func(state *forwarderState) {
+			defer waitProbes.Done()
+			latency, err := state.probe()
+			daemon.reportForwarder(state, latency, err)
+		}(state)
+	}
+	waitProbes.Wait()
+}
+
+/*
+KeepForwardersChecked probes forwarders right away and then periodically, until a value arrives from the stop channel
+or the channel is closed. If the channel is nil, the probes carry on forever.
+*/
+func (daemon *Daemon) KeepForwardersChecked(stop chan bool) {
+	daemon.CheckForwarders()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(ForwarderCheckIntervalSec * time.Second):
+			daemon.CheckForwarders()
+		}
+	}
+}
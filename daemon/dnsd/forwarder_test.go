@@ -0,0 +1,217 @@
+package dnsd
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startFakeForwarders starts UDP and TCP forwarders on the same port, they answer all queries with empty responses.
+func startFakeForwarders(t *testing.T) (addr string, stop func()) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = udpConn.LocalAddr().String()
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := func(query []byte) []byte {
+		msg, err := ParseMessage(query)
+		if err != nil {
+			return nil
+		}
+		response, _ := msg.Reply().Pack()
+		return response
+	}
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, clientAddr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpConn.WriteTo(answer(buf[:n]), clientAddr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			lenBuf := make([]byte, 2)
+			if _, err := io.ReadFull(conn, lenBuf); err == nil {
+				query := make([]byte, int(lenBuf[0])*256+int(lenBuf[1]))
+				if _, err := io.ReadFull(conn, query); err == nil {
+					response := answer(query)
+					conn.Write(append([]byte{byte(len(response) / 256), byte(len(response) % 256)}, response...))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return addr, func() {
+		udpConn.Close()
+		tcpListener.Close()
+	}
+}
+
+func TestExchangeUDP(t *testing.T) {
+	// The forwarder sends a stale response and a response to another question ahead of the real response
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, clientAddr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := ParseMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			stale := query.Reply()
+			stale.Header.ID++
+			otherQuestion := query.Reply()
+			otherQuestion.Questions[0].Type = TypeAAAA
+			for _, response := range []*Message{stale, otherQuestion, query.Reply()} {
+				packet, _ := response.Pack()
+				udpConn.WriteTo(packet, clientAddr)
+			}
+		}
+	}()
+	conn, err := net.Dial("udp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	query := makeQuery(t, "example.com", TypeA)
+	response, err := exchangeUDP(conn, query, make([]byte, MaxPacketSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ParseMessage(response)
+	if err != nil || msg.Header.ID != 0x4321 || msg.Questions[0].Type != TypeA {
+		t.Fatalf("%+v %v", msg, err)
+	}
+	if !responseMatchesQuery(query, response) || responseMatchesQuery(query, query) || responseMatchesQuery(query, nil) {
+		t.Fatal("wrong match")
+	}
+}
+
+func TestForwarderState_Report(t *testing.T) {
+	state := &forwarderState{protocol: "udp", addr: "192.0.2.1:53", mutex: new(sync.Mutex), healthy: true}
+	if state.report(100*time.Millisecond, nil) || state.latency != 100*time.Millisecond {
+		t.Fatalf("%+v", state)
+	}
+	if state.report(200*time.Millisecond, nil) || state.latency != 130*time.Millisecond {
+		t.Fatalf("%+v", state)
+	}
+	// Forwarder is taken out of rotation after consecutive failures
+	for i := 0; i < ForwarderMaxFailures-1; i++ {
+		if state.report(0, errors.New("timeout")) || !state.healthy {
+			t.Fatalf("%+v", state)
+		}
+	}
+	if !state.report(0, errors.New("timeout")) || state.healthy || state.weight() != 0 {
+		t.Fatalf("%+v", state)
+	}
+	if state.report(0, errors.New("timeout")) {
+		t.Fatalf("%+v", state)
+	}
+	// And it is re-admitted upon success
+	if !state.report(100*time.Millisecond, nil) || !state.healthy || state.failures != 0 {
+		t.Fatalf("%+v", state)
+	}
+}
+
+func TestChooseForwarder(t *testing.T) {
+	fast := &forwarderState{addr: "fast", mutex: new(sync.Mutex), healthy: true, latency: 10 * time.Millisecond}
+	slow := &forwarderState{addr: "slow", mutex: new(sync.Mutex), healthy: true, latency: 90 * time.Millisecond}
+	down := &forwarderState{addr: "down", mutex: new(sync.Mutex), healthy: false}
+	states := []*forwarderState{fast, slow, down}
+	picks := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		picks[chooseForwarder(states, nil).addr]++
+	}
+	// Fast forwarder is nine times as likely to be picked
+	if picks["down"] != 0 || picks["fast"] < 800 || picks["slow"] < 50 {
+		t.Fatal(picks)
+	}
+	if state := chooseForwarder(states, fast); state != slow {
+		t.Fatal(state)
+	}
+	// Unhealthy forwarders are picked only if there is no healthy forwarder
+	if state := chooseForwarder([]*forwarderState{fast, down}, fast); state != down {
+		t.Fatal(state)
+	}
+	if state := chooseForwarder([]*forwarderState{fast}, fast); state != nil {
+		t.Fatal(state)
+	}
+}
+
+func TestDaemon_ForwarderFailover(t *testing.T) {
+	addr, stop := startFakeForwarders(t)
+	defer stop()
+	// Nothing listens on port 9 of localhost
+	daemon := Daemon{
+		Address:              "127.0.0.1",
+		TCPPort:              62151,
+		UDPForwarder:         []string{"127.0.0.1:9", addr},
+		TCPForwarder:         []string{"127.0.0.1:9", addr},
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127."},
+		BlackListSources:     []BlackListSource{{FilePath: "/dev/null", Format: BlackListFormatPlain}},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.CheckForwarders()
+	for _, state := range append(daemon.udpForwarders, daemon.tcpForwarders...) {
+		if state.addr == addr && (!state.healthy || state.latency == 0) {
+			t.Fatalf("%+v", state)
+		}
+		if state.addr != addr && (state.failures == 0 || state.lastErr == nil) {
+			t.Fatalf("%+v", state)
+		}
+	}
+	// Queries are answered even if the dead forwarder is chosen
+	for i := 0; i < 10; i++ {
+		if response := daemon.ProcessTCPQuery("127.0.0.1", makeQuery(t, "failover.example.com", TypeA)); len(response) == 0 {
+			t.Fatal("did not answer")
+		}
+		daemon.responseCache = NewResponseCache(0)
+	}
+	// Dead forwarder is eventually taken out of rotation
+	daemon.CheckForwarders()
+	daemon.CheckForwarders()
+	for _, state := range append(daemon.udpForwarders, daemon.tcpForwarders...) {
+		if state.addr != addr && state.healthy {
+			t.Fatalf("%+v", state)
+		}
+	}
+	if stats := GetForwarderStats(); !strings.Contains(stats, "udp "+addr+": up") || !strings.Contains(stats, "tcp 127.0.0.1:9: down") {
+		t.Fatal(stats)
+	}
+	// UDP queue fails over to the healthy forwarder as well
+	conns := make(map[*forwarderState]net.Conn)
+	for i := 0; i < 10; i++ {
+		forwarder := chooseForwarder(daemon.udpForwarders, nil)
+		if forwarder.addr != addr {
+			t.Fatal(forwarder.addr)
+		}
+		if _, err := daemon.askUDPForwarder(conns, forwarder, makeQuery(t, "failover.example.com", TypeA), make([]byte, MaxPacketSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package dnsd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	LocalRecordTTL     = 300 // LocalRecordTTL is the TTL of answers made from local records.
+	MaxLocalCNAMEChain = 8   // MaxLocalCNAMEChain is the maximum number of local CNAME records to follow in a single answer.
+	MaxTXTStringLength = 255 // MaxTXTStringLength is the maximum length of a single character-string in TXT record data.
+)
+
+/*
+LocalRecords are static records of a domain name, they are answered by the DNS daemon itself. The domain name may be a
+wildcard such as "*.dev.lan", which then matches all names underneath "dev.lan" unless they have records of their own.
+CNAME must not be used together with other types of records.
+*/
+type LocalRecords struct {
+	A     []string `json:"A"`     // A are IPv4 addresses.
+	AAAA  []string `json:"AAAA"`  // AAAA are IPv6 addresses.
+	CNAME string   `json:"CNAME"` // CNAME is the canonical name of this name.
+	TXT   []string `json:"TXT"`   // TXT are texts, each text becomes its own record.
+	PTR   []string `json:"PTR"`   // PTR are domain names pointed to, it is useful for reverse names such as "1.1.168.192.in-addr.arpa".
+}
+
+// localRecordSet carries record data in wire format of a local domain name, grouped by type.
+type localRecordSet struct {
+	data  map[uint16][][]byte
+	cname string // cname is the target of CNAME record, if there is one.
+}
+
+/*
+localZone answers queries from local records authoritatively. PTR records are automatically generated for A and AAAA
+records of non-wildcard names.
+*/
+type localZone struct {
+	exact    map[string]*localRecordSet // exact are record sets of ordinary names.
+	wildcard map[string]*localRecordSet // wildcard are record sets of wildcard names, the key is the name without leading "*.".
+}
+
+// normaliseName turns a configured domain name into lower case without trailing full-stop.
+func normaliseName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// newLocalZone validates configured local records and turns them into a local zone.
+func newLocalZone(config map[string]LocalRecords) (*localZone, error) {
+	zone := &localZone{
+		exact:    make(map[string]*localRecordSet),
+		wildcard: make(map[string]*localRecordSet),
+	}
+	// Automatically generated PTR records do not override configured ones
+	autoPTR := make(map[string][]string)
+	// Iterate in a stable order so that automatic PTR records come out in a predictable order
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, configName := range names {
+		records := config[configName]
+		name := normaliseName(configName)
+		if name == "" {
+			return nil, fmt.Errorf("local record name must not be empty")
+		}
+		isWildcard := strings.HasPrefix(name, "*.")
+		if _, err := EncodeName(strings.TrimPrefix(name, "*.")); err != nil || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+			return nil, fmt.Errorf("local record name \"%s\" is malformed", configName)
+		}
+		set := &localRecordSet{data: make(map[uint16][][]byte)}
+		for _, addr := range records.A {
+			ip := net.ParseIP(strings.TrimSpace(addr))
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("local record \"%s\" has a malformed IPv4 address \"%s\"", configName, addr)
+			}
+			set.data[TypeA] = append(set.data[TypeA], []byte(ip.To4()))
+			if !isWildcard {
+				autoPTR[ReverseName(ip)] = append(autoPTR[ReverseName(ip)], name)
+			}
+		}
+		for _, addr := range records.AAAA {
+			ip := net.ParseIP(strings.TrimSpace(addr))
+			if ip == nil || ip.To4() != nil {
+				return nil, fmt.Errorf("local record \"%s\" has a malformed IPv6 address \"%s\"", configName, addr)
+			}
+			set.data[TypeAAAA] = append(set.data[TypeAAAA], []byte(ip.To16()))
+			if !isWildcard {
+				autoPTR[ReverseName(ip)] = append(autoPTR[ReverseName(ip)], name)
+			}
+		}
+		if records.CNAME != "" {
+			if len(records.A) > 0 || len(records.AAAA) > 0 || len(records.TXT) > 0 || len(records.PTR) > 0 {
+				return nil, fmt.Errorf("local record \"%s\" must not have other records alongside CNAME", configName)
+			}
+			set.cname = normaliseName(records.CNAME)
+			target, err := EncodeName(set.cname)
+			if err != nil || set.cname == "" {
+				return nil, fmt.Errorf("local record \"%s\" has a malformed CNAME \"%s\"", configName, records.CNAME)
+			}
+			set.data[TypeCNAME] = [][]byte{target}
+		}
+		for _, text := range records.TXT {
+			set.data[TypeTXT] = append(set.data[TypeTXT], encodeTXT(text))
+		}
+		for _, ptr := range records.PTR {
+			target, err := EncodeName(normaliseName(ptr))
+			if err != nil || normaliseName(ptr) == "" {
+				return nil, fmt.Errorf("local record \"%s\" has a malformed PTR \"%s\"", configName, ptr)
+			}
+			set.data[TypePTR] = append(set.data[TypePTR], target)
+		}
+		if isWildcard {
+			zone.wildcard[strings.TrimPrefix(name, "*.")] = set
+		} else {
+			zone.exact[name] = set
+		}
+	}
+	for reverseName, targets := range autoPTR {
+		set, exists := zone.exact[reverseName]
+		if !exists {
+			set = &localRecordSet{data: make(map[uint16][][]byte)}
+			zone.exact[reverseName] = set
+		}
+		if len(set.data[TypePTR]) > 0 || set.cname != "" {
+			continue
+		}
+		for _, target := range targets {
+			encoded, err := EncodeName(target)
+			if err != nil {
+				return nil, err
+			}
+			set.data[TypePTR] = append(set.data[TypePTR], encoded)
+		}
+	}
+	return zone, nil
+}
+
+// encodeTXT encodes a text into TXT record data, long text is split into several character-strings.
+func encodeTXT(text string) []byte {
+	ret := make([]byte, 0, len(text)+len(text)/MaxTXTStringLength+1)
+	for {
+		chunk := text
+		if len(chunk) > MaxTXTStringLength {
+			chunk = chunk[:MaxTXTStringLength]
+		}
+		ret = append(ret, byte(len(chunk)))
+		ret = append(ret, chunk...)
+		text = text[len(chunk):]
+		if text == "" {
+			return ret
+		}
+	}
+}
+
+// ReverseName returns the reverse lookup name of an IP address, e.g. "1.1.168.192.in-addr.arpa" for 192.168.1.1.
+func ReverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+	v6 := ip.To16()
+	nibbles := make([]string, 0, 32+2)
+	for i := len(v6) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", v6[i]&0xf), fmt.Sprintf("%x", v6[i]>>4))
+	}
+	return strings.Join(append(nibbles, "ip6", "arpa"), ".")
+}
+
+// lookup finds the record set of a name, or a wildcard record set that covers the name. Return nil if nothing is found.
+func (zone *localZone) lookup(name string) *localRecordSet {
+	name = normaliseName(name)
+	if set, exists := zone.exact[name]; exists {
+		return set
+	}
+	// The closest wildcard wins
+	for {
+		index := strings.IndexRune(name, '.')
+		if index < 0 {
+			return nil
+		}
+		name = name[index+1:]
+		if set, exists := zone.wildcard[name]; exists {
+			return set
+		}
+	}
+}
+
+/*
+answer returns an authoritative response to the query if the queried name is among local records. CNAME records pointing
+to other local names are followed. Return nil if the name is not local.
+*/
+func (zone *localZone) answer(query *Message) *Message {
+	if query.Header.Response || query.Header.Opcode != OpcodeQuery || len(query.Questions) != 1 {
+		return nil
+	}
+	question := query.Questions[0]
+	if question.Class != ClassIN {
+		return nil
+	}
+	set := zone.lookup(question.Name)
+	if set == nil {
+		return nil
+	}
+	response := query.Reply()
+	response.Header.Authoritative = true
+	name := question.Name
+	seen := map[string]bool{normaliseName(name): true}
+	for i := 0; i < MaxLocalCNAMEChain; i++ {
+		if set.cname != "" && question.Type != TypeCNAME {
+			response.Answers = append(response.Answers, ResourceRecord{Name: name, Type: TypeCNAME, Class: ClassIN, TTL: LocalRecordTTL, Data: set.data[TypeCNAME][0]})
+			// Follow the CNAME only if it points to another local name, otherwise client will resolve the target by itself.
+			target := set.cname
+			if seen[target] {
+				break
+			}
+			seen[target] = true
+			if set = zone.lookup(target); set == nil {
+				break
+			}
+			name = target
+			continue
+		}
+		// An empty answer (NODATA) is made if there is no record of the queried type
+		for _, rrType := range []uint16{TypeA, TypeAAAA, TypeCNAME, TypeTXT, TypePTR} {
+			if question.Type != rrType && question.Type != TypeANY {
+				continue
+			}
+			for _, data := range set.data[rrType] {
+				response.Answers = append(response.Answers, ResourceRecord{Name: name, Type: rrType, Class: ClassIN, TTL: LocalRecordTTL, Data: data})
+			}
+		}
+		break
+	}
+	return response
+}
+
+/*
+AnswerLocally returns a response packet without prefix length bytes if the query asks for a name among local records.
+Return nil if the name is not local, in which case the query should go through black list check and forwarding.
+*/
+func (daemon *Daemon) AnswerLocally(queryNoLength []byte) []byte {
+	if daemon.localZone == nil || len(queryNoLength) < MinNameQuerySize {
+		return nil
+	}
+	query, err := ParseMessage(queryNoLength)
+	if err != nil {
+		return nil
+	}
+	response := daemon.localZone.answer(query)
+	if response == nil {
+		return nil
+	}
+	packet, err := response.Pack()
+	if err != nil {
+		daemon.logger.Warningf("AnswerLocally", query.Questions[0].Name, err, "failed to pack response")
+		return nil
+	}
+	return packet
+}
@@ -0,0 +1,147 @@
+package dnsd
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// makeQuery returns a standard query packet that asks for the name and record type.
+func makeQuery(t testing.TB, name string, rrType uint16) []byte {
+	query := &Message{
+		Header:    Header{ID: 0x4321, RecursionDesired: true},
+		Questions: []Question{{Name: name, Type: rrType, Class: ClassIN}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func TestNewLocalZone(t *testing.T) {
+	badConfigs := []map[string]LocalRecords{
+		{"": {A: []string{"192.168.1.1"}}},
+		{"a..lan": {A: []string{"192.168.1.1"}}},
+		{"a.*.lan": {A: []string{"192.168.1.1"}}},
+		{"nas.lan": {A: []string{"::1"}}},
+		{"nas.lan": {AAAA: []string{"192.168.1.1"}}},
+		{"nas.lan": {A: []string{"not an ip"}}},
+		{"nas.lan": {CNAME: "a.lan", TXT: []string{"a"}}},
+		{"nas.lan": {PTR: []string{"a..lan"}}},
+	}
+	for i, config := range badConfigs {
+		if _, err := newLocalZone(config); err == nil {
+			t.Fatal(i, "did not error")
+		}
+	}
+	zone, err := newLocalZone(nil)
+	if err != nil || len(zone.exact) != 0 || len(zone.wildcard) != 0 {
+		t.Fatal(err, zone)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	if name := ReverseName(net.ParseIP("192.168.1.10")); name != "10.1.168.192.in-addr.arpa" {
+		t.Fatal(name)
+	}
+	if name := ReverseName(net.ParseIP("2001:db8::567:89ab")); name != "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa" {
+		t.Fatal(name)
+	}
+}
+
+func TestDaemon_AnswerLocally(t *testing.T) {
+	daemon := Daemon{}
+	if resp := daemon.AnswerLocally(makeQuery(t, "nas.lan", TypeA)); resp != nil {
+		t.Fatal(resp)
+	}
+	var err error
+	daemon.localZone, err = newLocalZone(map[string]LocalRecords{
+		"NAS.lan.":                  {A: []string{"192.168.1.10"}, AAAA: []string{"fd00::10"}, TXT: []string{"hello", strings.Repeat("a", 300)}},
+		"printer.lan":               {A: []string{"192.168.1.20"}},
+		"files.lan":                 {CNAME: "nas.lan"},
+		"www.lan":                   {CNAME: "files.lan"},
+		"loop1.lan":                 {CNAME: "loop2.lan"},
+		"loop2.lan":                 {CNAME: "loop1.lan"},
+		"*.dev.lan":                 {A: []string{"192.168.1.30"}},
+		"app.dev.lan":               {A: []string{"192.168.1.31"}},
+		"outside.lan":               {CNAME: "github.com"},
+		"20.1.168.192.in-addr.arpa": {PTR: []string{"laser.lan"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := func(name string, rrType uint16) *Message {
+		packet := daemon.AnswerLocally(makeQuery(t, name, rrType))
+		if packet == nil {
+			return nil
+		}
+		msg, err := ParseMessage(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !msg.Header.Response || !msg.Header.Authoritative || msg.Header.ID != 0x4321 || msg.Header.Rcode != RcodeSuccess {
+			t.Fatalf("%+v", msg.Header)
+		}
+		return msg
+	}
+	// Names that are not local
+	if msg := answer("github.com", TypeA); msg != nil {
+		t.Fatalf("%+v", msg)
+	}
+	if msg := answer("dev.lan", TypeA); msg != nil {
+		t.Fatalf("%+v", msg)
+	}
+	// Ordinary records
+	if msg := answer("nas.LAN", TypeA); len(msg.Answers) != 1 || msg.Answers[0].Name != "nas.LAN" || !reflect.DeepEqual(msg.Answers[0].Data, []byte{192, 168, 1, 10}) {
+		t.Fatalf("%+v", msg)
+	}
+	if msg := answer("nas.lan", TypeAAAA); len(msg.Answers) != 1 || !net.IP(msg.Answers[0].Data).Equal(net.ParseIP("fd00::10")) {
+		t.Fatalf("%+v", msg)
+	}
+	if msg := answer("nas.lan", TypeTXT); len(msg.Answers) != 2 || len(msg.Answers[1].Data) != 302 || msg.Answers[1].Data[0] != 255 || msg.Answers[1].Data[256] != 45 {
+		t.Fatalf("%+v", msg)
+	}
+	if msg := answer("nas.lan", TypeANY); len(msg.Answers) != 4 {
+		t.Fatalf("%+v", msg)
+	}
+	// No data of the type
+	if msg := answer("printer.lan", TypeMX); len(msg.Answers) != 0 {
+		t.Fatalf("%+v", msg)
+	}
+	// Automatic and configured PTR records
+	if msg := answer("10.1.168.192.in-addr.arpa", TypePTR); len(msg.Answers) != 1 {
+		t.Fatalf("%+v", msg)
+	} else if name, err := msg.Answers[0].DataName(); err != nil || name != "nas.lan" {
+		t.Fatal(name, err)
+	}
+	if msg := answer("0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", TypePTR); len(msg.Answers) != 1 {
+		t.Fatalf("%+v", msg)
+	}
+	if msg := answer("20.1.168.192.in-addr.arpa", TypePTR); len(msg.Answers) != 1 {
+		t.Fatalf("%+v", msg)
+	} else if name, err := msg.Answers[0].DataName(); err != nil || name != "laser.lan" {
+		t.Fatal(name, err)
+	}
+	// Wildcard
+	if msg := answer("a.b.dev.lan", TypeA); len(msg.Answers) != 1 || msg.Answers[0].Name != "a.b.dev.lan" || !reflect.DeepEqual(msg.Answers[0].Data, []byte{192, 168, 1, 30}) {
+		t.Fatalf("%+v", msg)
+	}
+	if msg := answer("app.dev.lan", TypeA); len(msg.Answers) != 1 || !reflect.DeepEqual(msg.Answers[0].Data, []byte{192, 168, 1, 31}) {
+		t.Fatalf("%+v", msg)
+	}
+	// CNAME chain
+	if msg := answer("www.lan", TypeA); len(msg.Answers) != 3 || msg.Answers[0].Type != TypeCNAME || msg.Answers[1].Name != "files.lan" || msg.Answers[2].Name != "nas.lan" || msg.Answers[2].Type != TypeA {
+		t.Fatalf("%+v", msg)
+	}
+	if msg := answer("www.lan", TypeCNAME); len(msg.Answers) != 1 {
+		t.Fatalf("%+v", msg)
+	}
+	if msg := answer("loop1.lan", TypeA); len(msg.Answers) != 2 {
+		t.Fatalf("%+v", msg)
+	}
+	if msg := answer("outside.lan", TypeA); len(msg.Answers) != 1 || msg.Answers[0].Type != TypeCNAME {
+		t.Fatalf("%+v", msg)
+	}
+}
@@ -0,0 +1,562 @@
+package dnsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Resource record types, classes, and response codes that are of interest to the DNS daemon (RFC 1035, 3596, 6891, 9460).
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeSRV   uint16 = 33
+	TypeOPT   uint16 = 41
+	TypeSVCB  uint16 = 64
+	TypeHTTPS uint16 = 65
+	TypeANY   uint16 = 255
+
+	ClassIN uint16 = 1
+
+	RcodeSuccess        uint8 = 0
+	RcodeFormatError    uint8 = 1
+	RcodeServerFailure  uint8 = 2
+	RcodeNameError      uint8 = 3
+	RcodeNotImplemented uint8 = 4
+	RcodeRefused        uint8 = 5
+
+	OpcodeQuery uint8 = 0
+
+	HeaderSize         = 12  // HeaderSize is the fixed length of DNS message header.
+	MaxNameLength      = 255 // MaxNameLength is the maximum length of a domain name in its wire format.
+	MaxLabelLength     = 63  // MaxLabelLength is the maximum length of a single label of domain name.
+	MaxPointerFollowed = 32  // MaxPointerFollowed is the maximum number of compression pointers to follow when reading a name.
+)
+
+var (
+	ErrMessageTooShort = errors.New("DNS message is truncated")
+	ErrBadPointer      = errors.New("DNS message carries a bad compression pointer")
+	ErrNameTooLong     = errors.New("domain name is too long")
+	ErrLabelTooLong    = errors.New("domain name label is too long")
+	ErrBadLabel        = errors.New("domain name contains an empty or malformed label")
+	ErrDuplicatedOPT   = errors.New("DNS message carries more than one OPT record")
+)
+
+// Header is the fixed-size header at the beginning of every DNS message.
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	AuthenticatedData  bool
+	CheckingDisabled   bool
+	Rcode              uint8 // Rcode is the lower four bits of response code, the upper bits are carried by OPT record.
+}
+
+// flags returns the header flags in their wire format.
+func (header Header) flags() (ret uint16) {
+	if header.Response {
+		ret |= 1 << 15
+	}
+	ret |= uint16(header.Opcode&0xf) << 11
+	if header.Authoritative {
+		ret |= 1 << 10
+	}
+	if header.Truncated {
+		ret |= 1 << 9
+	}
+	if header.RecursionDesired {
+		ret |= 1 << 8
+	}
+	if header.RecursionAvailable {
+		ret |= 1 << 7
+	}
+	if header.AuthenticatedData {
+		ret |= 1 << 5
+	}
+	if header.CheckingDisabled {
+		ret |= 1 << 4
+	}
+	ret |= uint16(header.Rcode & 0xf)
+	return
+}
+
+// setFlags decodes header flags from their wire format.
+func (header *Header) setFlags(flags uint16) {
+	header.Response = flags&(1<<15) != 0
+	header.Opcode = uint8(flags>>11) & 0xf
+	header.Authoritative = flags&(1<<10) != 0
+	header.Truncated = flags&(1<<9) != 0
+	header.RecursionDesired = flags&(1<<8) != 0
+	header.RecursionAvailable = flags&(1<<7) != 0
+	header.AuthenticatedData = flags&(1<<5) != 0
+	header.CheckingDisabled = flags&(1<<4) != 0
+	header.Rcode = uint8(flags & 0xf)
+}
+
+// Question is an entry of the question section, it asks for records of a type and class under a name.
+type Question struct {
+	Name  string // Name is in presentation format without the trailing full-stop, e.g. "github.com".
+	Type  uint16
+	Class uint16
+}
+
+/*
+ResourceRecord is an entry of the answer, authority, or additional section.
+Domain names that appear in the data of well known record types (e.g. CNAME, MX, SOA) are decompressed during parsing,
+therefore the data may always be copied into another message as-is.
+*/
+type ResourceRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// DataName decodes the domain name carried by the data of NS, CNAME, and PTR records.
+func (rr ResourceRecord) DataName() (string, error) {
+	name, next, err := readName(rr.Data, 0)
+	if err != nil {
+		return "", err
+	}
+	if next != len(rr.Data) {
+		return "", fmt.Errorf("DataName: there are %d excessive bytes after the name", len(rr.Data)-next)
+	}
+	return name, nil
+}
+
+// OPTRecord is the EDNS pseudo resource record (RFC 6891) that may appear in the additional section.
+type OPTRecord struct {
+	UDPSize       uint16 // UDPSize is the largest UDP payload that the sender can reassemble.
+	ExtendedRcode uint8  // ExtendedRcode is the upper eight bits of the response code.
+	Version       uint8
+	DNSSECOK      bool
+	Options       []byte // Options are kept in their wire format.
+}
+
+// Message is a decoded DNS query or response.
+type Message struct {
+	Header      Header
+	Questions   []Question
+	Answers     []ResourceRecord
+	Authorities []ResourceRecord
+	Additionals []ResourceRecord // Additionals does not include the OPT record.
+	OPT         *OPTRecord       // OPT is the EDNS record from the additional section, it is nil if absent.
+}
+
+/*
+ParseMessage decodes a DNS message from its wire format, without the two length bytes that prefix TCP messages.
+Excessive bytes that follow the last section are ignored.
+*/
+func ParseMessage(packet []byte) (*Message, error) {
+	if len(packet) < HeaderSize {
+		return nil, ErrMessageTooShort
+	}
+	msg := new(Message)
+	msg.Header.ID = binary.BigEndian.Uint16(packet[0:2])
+	msg.Header.setFlags(binary.BigEndian.Uint16(packet[2:4]))
+	numQuestions := int(binary.BigEndian.Uint16(packet[4:6]))
+	numAnswers := int(binary.BigEndian.Uint16(packet[6:8]))
+	numAuthorities := int(binary.BigEndian.Uint16(packet[8:10]))
+	numAdditionals := int(binary.BigEndian.Uint16(packet[10:12]))
+	offset := HeaderSize
+	// Each question occupies at least 5 bytes, avoid allocating for a bogus count.
+	msg.Questions = make([]Question, 0, minInt(numQuestions, len(packet)/5))
+	for i := 0; i < numQuestions; i++ {
+		var question Question
+		var err error
+		if question.Name, offset, err = readName(packet, offset); err != nil {
+			return nil, err
+		}
+		if offset+4 > len(packet) {
+			return nil, ErrMessageTooShort
+		}
+		question.Type = binary.BigEndian.Uint16(packet[offset : offset+2])
+		question.Class = binary.BigEndian.Uint16(packet[offset+2 : offset+4])
+		offset += 4
+		msg.Questions = append(msg.Questions, question)
+	}
+	var err error
+	if msg.Answers, offset, err = readRecords(packet, offset, numAnswers); err != nil {
+		return nil, err
+	}
+	if msg.Authorities, offset, err = readRecords(packet, offset, numAuthorities); err != nil {
+		return nil, err
+	}
+	additionals, _, err := readRecords(packet, offset, numAdditionals)
+	if err != nil {
+		return nil, err
+	}
+	// Take the OPT pseudo record out of additional section
+	msg.Additionals = make([]ResourceRecord, 0, len(additionals))
+	for _, rr := range additionals {
+		if rr.Type != TypeOPT {
+			msg.Additionals = append(msg.Additionals, rr)
+			continue
+		}
+		if msg.OPT != nil {
+			return nil, ErrDuplicatedOPT
+		}
+		if rr.Name != "" {
+			return nil, errors.New("OPT record must be owned by the root domain")
+		}
+		msg.OPT = &OPTRecord{
+			UDPSize:       rr.Class,
+			ExtendedRcode: uint8(rr.TTL >> 24),
+			Version:       uint8(rr.TTL >> 16),
+			DNSSECOK:      rr.TTL&(1<<15) != 0,
+			Options:       rr.Data,
+		}
+	}
+	return msg, nil
+}
+
+// readRecords decodes a number of resource records beginning at the offset, and returns offset of the following section.
+func readRecords(packet []byte, offset, count int) (ret []ResourceRecord, next int, err error) {
+	// Each record occupies at least 11 bytes, avoid allocating for a bogus count.
+	ret = make([]ResourceRecord, 0, minInt(count, len(packet)/11))
+	for i := 0; i < count; i++ {
+		var rr ResourceRecord
+		if rr.Name, offset, err = readName(packet, offset); err != nil {
+			return
+		}
+		if offset+10 > len(packet) {
+			err = ErrMessageTooShort
+			return
+		}
+		rr.Type = binary.BigEndian.Uint16(packet[offset : offset+2])
+		rr.Class = binary.BigEndian.Uint16(packet[offset+2 : offset+4])
+		rr.TTL = binary.BigEndian.Uint32(packet[offset+4 : offset+8])
+		dataLen := int(binary.BigEndian.Uint16(packet[offset+8 : offset+10]))
+		offset += 10
+		if offset+dataLen > len(packet) {
+			err = ErrMessageTooShort
+			return
+		}
+		if rr.Data, err = readRecordData(packet, offset, dataLen, rr.Type); err != nil {
+			return
+		}
+		offset += dataLen
+		ret = append(ret, rr)
+	}
+	next = offset
+	return
+}
+
+/*
+readRecordData copies record data out of the packet. If the record type is known to carry domain names in its data,
+the names are decompressed so that the data no longer relies on other parts of the packet.
+*/
+func readRecordData(packet []byte, offset, dataLen int, rrType uint16) ([]byte, error) {
+	end := offset + dataLen
+	// numPrefix is the number of fixed bytes preceding the names, numNames is the number of names, numSuffix is the number of fixed bytes following the names.
+	var numPrefix, numNames, numSuffix int
+	switch rrType {
+	case TypeNS, TypeCNAME, TypePTR:
+		numNames = 1
+	case TypeMX:
+		numPrefix, numNames = 2, 1
+	case TypeSRV:
+		numPrefix, numNames = 6, 1
+	case TypeSOA:
+		numNames, numSuffix = 2, 20
+	default:
+		data := make([]byte, dataLen)
+		copy(data, packet[offset:end])
+		return data, nil
+	}
+	if offset+numPrefix > end {
+		return nil, ErrMessageTooShort
+	}
+	data := make([]byte, 0, dataLen)
+	data = append(data, packet[offset:offset+numPrefix]...)
+	offset += numPrefix
+	for i := 0; i < numNames; i++ {
+		// Names are read out of the whole packet, as compression pointers may refer to any earlier position.
+		name, next, err := readName(packet[:end], offset)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = appendName(data, name, nil); err != nil {
+			return nil, err
+		}
+		offset = next
+	}
+	if offset+numSuffix != end {
+		return nil, fmt.Errorf("record data of type %d has an unexpected length", rrType)
+	}
+	return append(data, packet[offset:end]...), nil
+}
+
+/*
+readName decodes a possibly compressed domain name beginning at the offset. It returns the name in presentation format
+without the trailing full-stop, and offset of the byte that follows the name.
+*/
+func readName(packet []byte, offset int) (name string, next int, err error) {
+	var labels []string
+	// wireLen is the length of name in its wire format, including length bytes and the terminating zero.
+	wireLen := 1
+	numPointers := 0
+	// segmentStart is where the latest run of labels began, a pointer must point before it.
+	segmentStart := offset
+	// next is determined by the first pointer, or by the terminating zero when there is no pointer.
+	next = -1
+	for {
+		if offset >= len(packet) {
+			return "", 0, ErrMessageTooShort
+		}
+		labelLen := int(packet[offset])
+		switch labelLen & 0xc0 {
+		case 0x00:
+			if labelLen == 0 {
+				if next == -1 {
+					next = offset + 1
+				}
+				return strings.Join(labels, "."), next, nil
+			}
+			if offset+1+labelLen > len(packet) {
+				return "", 0, ErrMessageTooShort
+			}
+			wireLen += 1 + labelLen
+			if wireLen > MaxNameLength {
+				return "", 0, ErrNameTooLong
+			}
+			labels = append(labels, escapeLabel(packet[offset+1:offset+1+labelLen]))
+			offset += 1 + labelLen
+		case 0xc0:
+			if offset+2 > len(packet) {
+				return "", 0, ErrMessageTooShort
+			}
+			// A pointer may only refer to a position earlier than the labels read so far, which prevents it from looping.
+			pointer := int(binary.BigEndian.Uint16(packet[offset:offset+2]) & 0x3fff)
+			if pointer >= segmentStart {
+				return "", 0, ErrBadPointer
+			}
+			segmentStart = pointer
+			if numPointers++; numPointers > MaxPointerFollowed {
+				return "", 0, ErrBadPointer
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			offset = pointer
+		default:
+			// 0x40 and 0x80 are reserved label types (RFC 6891 deprecated extended label types)
+			return "", 0, ErrBadLabel
+		}
+	}
+}
+
+// escapeLabel returns a label in presentation format, in which full-stop, backslash, and unprintable characters are escaped.
+func escapeLabel(label []byte) string {
+	var ret bytes.Buffer
+	for _, b := range label {
+		switch {
+		case b == '.' || b == '\\':
+			ret.WriteByte('\\')
+			ret.WriteByte(b)
+		case b <= ' ' || b >= 127:
+			ret.WriteString(fmt.Sprintf("\\%03d", b))
+		default:
+			ret.WriteByte(b)
+		}
+	}
+	return ret.String()
+}
+
+// splitName splits a name in presentation format into labels in their wire format, undoing escape sequences.
+func splitName(name string) (labels [][]byte, err error) {
+	if name == "" || name == "." {
+		return nil, nil
+	}
+	label := make([]byte, 0, MaxLabelLength)
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '.':
+			if len(label) == 0 {
+				return nil, ErrBadLabel
+			}
+			labels = append(labels, label)
+			if i == len(name)-1 {
+				// The name ends with a trailing full-stop
+				return labels, nil
+			}
+			label = make([]byte, 0, MaxLabelLength)
+		case '\\':
+			if i+3 < len(name) && name[i+1] >= '0' && name[i+1] <= '9' {
+				decimal, convErr := strconv.Atoi(name[i+1 : i+4])
+				if convErr != nil || decimal > 255 {
+					return nil, ErrBadLabel
+				}
+				label = append(label, byte(decimal))
+				i += 3
+			} else if i+1 < len(name) {
+				label = append(label, name[i+1])
+				i++
+			} else {
+				return nil, ErrBadLabel
+			}
+		default:
+			label = append(label, c)
+		}
+	}
+	if len(label) == 0 {
+		return nil, ErrBadLabel
+	}
+	return append(labels, label), nil
+}
+
+/*
+appendName encodes a name in presentation format and appends it to the buffer. If the compression table is not nil,
+the name is compressed against names written earlier, and new suffixes of the name are remembered in the table.
+*/
+func appendName(buf []byte, name string, compression map[string]int) ([]byte, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+	wireLen := 1
+	for _, label := range labels {
+		if len(label) > MaxLabelLength {
+			return nil, ErrLabelTooLong
+		}
+		wireLen += 1 + len(label)
+	}
+	if wireLen > MaxNameLength {
+		return nil, ErrNameTooLong
+	}
+	for i, label := range labels {
+		if compression != nil {
+			// The suffix is identified by its wire format, so that labels containing full-stop cannot be confused.
+			var suffix bytes.Buffer
+			for _, suffixLabel := range labels[i:] {
+				suffix.WriteByte(byte(len(suffixLabel)))
+				suffix.Write(suffixLabel)
+			}
+			if pointer, exists := compression[suffix.String()]; exists {
+				return append(buf, byte(0xc0|pointer>>8), byte(pointer)), nil
+			}
+			// Pointer can only address the first 16KB of a message
+			if len(buf) < 0x4000 {
+				compression[suffix.String()] = len(buf)
+			}
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0), nil
+}
+
+// EncodeName returns the uncompressed wire format of a name, it is useful for composing data of NS, CNAME, and PTR records.
+func EncodeName(name string) ([]byte, error) {
+	return appendName(make([]byte, 0, len(name)+2), name, nil)
+}
+
+// Pack encodes the message into its wire format, owner names of questions and records are compressed.
+func (msg *Message) Pack() ([]byte, error) {
+	numAdditionals := len(msg.Additionals)
+	if msg.OPT != nil {
+		numAdditionals++
+	}
+	if len(msg.Questions) > 0xffff || len(msg.Answers) > 0xffff || len(msg.Authorities) > 0xffff || numAdditionals > 0xffff {
+		return nil, errors.New("DNS message has too many entries")
+	}
+	buf := make([]byte, HeaderSize, 512)
+	binary.BigEndian.PutUint16(buf[0:2], msg.Header.ID)
+	binary.BigEndian.PutUint16(buf[2:4], msg.Header.flags())
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(msg.Questions)))
+	binary.BigEndian.PutUint16(buf[6:8], uint16(len(msg.Answers)))
+	binary.BigEndian.PutUint16(buf[8:10], uint16(len(msg.Authorities)))
+	binary.BigEndian.PutUint16(buf[10:12], uint16(numAdditionals))
+	compression := make(map[string]int)
+	var err error
+	for _, question := range msg.Questions {
+		if buf, err = appendName(buf, question.Name, compression); err != nil {
+			return nil, err
+		}
+		buf = appendUint16(buf, question.Type)
+		buf = appendUint16(buf, question.Class)
+	}
+	for _, section := range [][]ResourceRecord{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, rr := range section {
+			if buf, err = appendRecord(buf, rr, compression); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opt := msg.OPT; opt != nil {
+		ttl := uint32(opt.ExtendedRcode)<<24 | uint32(opt.Version)<<16
+		if opt.DNSSECOK {
+			ttl |= 1 << 15
+		}
+		rr := ResourceRecord{Type: TypeOPT, Class: opt.UDPSize, TTL: ttl, Data: opt.Options}
+		if buf, err = appendRecord(buf, rr, nil); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// appendRecord encodes a resource record and appends it to the buffer.
+func appendRecord(buf []byte, rr ResourceRecord, compression map[string]int) ([]byte, error) {
+	if len(rr.Data) > 0xffff {
+		return nil, errors.New("resource record data is too long")
+	}
+	var err error
+	if buf, err = appendName(buf, rr.Name, compression); err != nil {
+		return nil, err
+	}
+	buf = appendUint16(buf, rr.Type)
+	buf = appendUint16(buf, rr.Class)
+	buf = append(buf, byte(rr.TTL>>24), byte(rr.TTL>>16), byte(rr.TTL>>8), byte(rr.TTL))
+	buf = appendUint16(buf, uint16(len(rr.Data)))
+	return append(buf, rr.Data...), nil
+}
+
+func appendUint16(buf []byte, val uint16) []byte {
+	return append(buf, byte(val>>8), byte(val))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/*
+Reply returns a response skeleton to the query message. The response carries the same ID, opcode, and questions, and it
+echoes the EDNS record if the query carries one.
+*/
+func (msg *Message) Reply() *Message {
+	ret := &Message{
+		Header: Header{
+			ID:                 msg.Header.ID,
+			Response:           true,
+			Opcode:             msg.Header.Opcode,
+			RecursionDesired:   msg.Header.RecursionDesired,
+			RecursionAvailable: true,
+			CheckingDisabled:   msg.Header.CheckingDisabled,
+			Rcode:              RcodeSuccess,
+		},
+		Questions: make([]Question, len(msg.Questions)),
+	}
+	copy(ret.Questions, msg.Questions)
+	if msg.OPT != nil {
+		ret.OPT = &OPTRecord{UDPSize: msg.OPT.UDPSize, DNSSECOK: msg.OPT.DNSSECOK}
+	}
+	return ret
+}
@@ -0,0 +1,245 @@
+package dnsd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+/*
+Sample packets in the shape that dig and public resolvers produce. Queries use EDNS in the same way as dig does,
+responses use name compression in the same way as typical recursive resolvers do.
+*/
+var (
+	sampleAAAAQuery  = "1b2c012000010000000000010377777706676f6f676c6503636f6d00001c000100002904d000000000000c000a00086c2e8a1f03b4d9e7"
+	sampleMXQuery    = "3d010100000100000000000005676d61696c03636f6d00000f0001"
+	sampleTXTQuery   = "88e201200001000000000001065f646d617263074578616d706c6503434f4d00001000010000291000000000000000"
+	sampleHTTPSQuery = "5f1001000001000000000001037777770a636c6f7564666c61726503636f6d00004100010000291000000000000000"
+	sampleCNAMEResp  = "7a1181800001000200000001037777770667697468756203636f6d0000010001c00c0005000100000e100002c010c010000100010000003c00048c5279040000291000000000000000"
+	sampleNXDomain   = "4242818300010000000100000b6e6f6e6578697374656e74076578616d706c6503636f6d0000010001c0180006000100000e10002c026e73056963616e6e036f726700036e6f6303646e73c03878a3f17500001c2000000e100012750000000e10"
+)
+
+func mustDecodeHex(t testing.TB, in string) []byte {
+	ret, err := hex.DecodeString(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		packet    string
+		header    Header
+		questions []Question
+		answers   []ResourceRecord
+		authority []ResourceRecord
+		opt       *OPTRecord
+	}{
+		{
+			packet:    hex.EncodeToString(githubComUDPQuery),
+			header:    Header{ID: 0xe575, RecursionDesired: true, AuthenticatedData: true},
+			questions: []Question{{Name: "github.com", Type: TypeA, Class: ClassIN}},
+			opt:       &OPTRecord{UDPSize: 4096, Options: []byte{}},
+		},
+		{
+			packet:    sampleAAAAQuery,
+			header:    Header{ID: 0x1b2c, RecursionDesired: true, AuthenticatedData: true},
+			questions: []Question{{Name: "www.google.com", Type: TypeAAAA, Class: ClassIN}},
+			opt:       &OPTRecord{UDPSize: 1232, Options: mustDecodeHex(t, "000a00086c2e8a1f03b4d9e7")},
+		},
+		{
+			packet:    sampleMXQuery,
+			header:    Header{ID: 0x3d01, RecursionDesired: true},
+			questions: []Question{{Name: "gmail.com", Type: TypeMX, Class: ClassIN}},
+		},
+		{
+			packet:    sampleTXTQuery,
+			header:    Header{ID: 0x88e2, RecursionDesired: true, AuthenticatedData: true},
+			questions: []Question{{Name: "_dmarc.Example.COM", Type: TypeTXT, Class: ClassIN}},
+			opt:       &OPTRecord{UDPSize: 4096, Options: []byte{}},
+		},
+		{
+			packet:    sampleHTTPSQuery,
+			header:    Header{ID: 0x5f10, RecursionDesired: true},
+			questions: []Question{{Name: "www.cloudflare.com", Type: TypeHTTPS, Class: ClassIN}},
+			opt:       &OPTRecord{UDPSize: 4096, Options: []byte{}},
+		},
+		{
+			packet:    sampleCNAMEResp,
+			header:    Header{ID: 0x7a11, Response: true, RecursionDesired: true, RecursionAvailable: true},
+			questions: []Question{{Name: "www.github.com", Type: TypeA, Class: ClassIN}},
+			answers: []ResourceRecord{
+				{Name: "www.github.com", Type: TypeCNAME, Class: ClassIN, TTL: 3600, Data: mustDecodeHex(t, "0667697468756203636f6d00")},
+				{Name: "github.com", Type: TypeA, Class: ClassIN, TTL: 60, Data: []byte{140, 82, 121, 4}},
+			},
+			opt: &OPTRecord{UDPSize: 4096, Options: []byte{}},
+		},
+		{
+			packet:    sampleNXDomain,
+			header:    Header{ID: 0x4242, Response: true, RecursionDesired: true, RecursionAvailable: true, Rcode: RcodeNameError},
+			questions: []Question{{Name: "nonexistent.example.com", Type: TypeA, Class: ClassIN}},
+			authority: []ResourceRecord{
+				{Name: "example.com", Type: TypeSOA, Class: ClassIN, TTL: 3600, Data: mustDecodeHex(t,
+					"026e73056963616e6e036f726700"+"036e6f6303646e73056963616e6e036f726700"+"78a3f17500001c2000000e100012750000000e10")},
+			},
+		},
+	}
+	for i, test := range tests {
+		msg, err := ParseMessage(mustDecodeHex(t, test.packet))
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if msg.Header != test.header {
+			t.Fatalf("%d: %+v", i, msg.Header)
+		}
+		if !reflect.DeepEqual(msg.Questions, test.questions) {
+			t.Fatalf("%d: %+v", i, msg.Questions)
+		}
+		if len(msg.Answers) != len(test.answers) || len(test.answers) > 0 && !reflect.DeepEqual(msg.Answers, test.answers) {
+			t.Fatalf("%d: %+v", i, msg.Answers)
+		}
+		if len(msg.Authorities) != len(test.authority) || len(test.authority) > 0 && !reflect.DeepEqual(msg.Authorities, test.authority) {
+			t.Fatalf("%d: %+v", i, msg.Authorities)
+		}
+		if !reflect.DeepEqual(msg.OPT, test.opt) {
+			t.Fatalf("%d: %+v", i, msg.OPT)
+		}
+		// Packing the message and then parsing it again must result in an identical message
+		packed, err := msg.Pack()
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		again, err := ParseMessage(packed)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatalf("%d: %+v\n%+v", i, msg, again)
+		}
+	}
+}
+
+func TestParseMessage_Malformed(t *testing.T) {
+	tests := []struct {
+		packet string
+		err    error
+	}{
+		{"", ErrMessageTooShort},
+		{"e5750120000100000000", ErrMessageTooShort},
+		// Question name runs past the end of packet
+		{"e5750120000100000000000006676974687562", ErrMessageTooShort},
+		// Question name points to itself
+		{"e575012000010000000000000667697468756203636f6dc00c00010001", ErrBadPointer},
+		// Question name points forward
+		{"e5750120000100000000000006676974687562c01400010001000000", ErrBadPointer},
+		// Reserved label type
+		{"e5750120000100000000000046676974687562", ErrBadLabel},
+		// Answer data length exceeds the packet
+		{"7a1181800001000100000000037777770667697468756203636f6d0000010001c00c00010001000000010010010203", ErrMessageTooShort},
+		// Two OPT records
+		{"e575012000010000000000020667697468756203636f6d0000010001" + "0000291000000000000000" + "0000291000000000000000", ErrDuplicatedOPT},
+	}
+	for i, test := range tests {
+		if msg, err := ParseMessage(mustDecodeHex(t, test.packet)); err != test.err {
+			t.Fatal(i, msg, err)
+		}
+	}
+}
+
+func TestName_Escape(t *testing.T) {
+	// A label that contains a full-stop and an unprintable character must survive a round trip
+	packet := mustDecodeHex(t, "000101000001000000000000"+"03612e62"+"0201ff"+"00"+"00100001")
+	msg, err := ParseMessage(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := msg.Questions[0].Name; name != `a\.b.\001\255` {
+		t.Fatal(name)
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packed, packet) {
+		t.Fatal(hex.EncodeToString(packed))
+	}
+	if _, err := EncodeName("a..b"); err != ErrBadLabel {
+		t.Fatal(err)
+	}
+	if _, err := EncodeName("0123456789012345678901234567890123456789012345678901234567890123.com"); err != ErrLabelTooLong {
+		t.Fatal(err)
+	}
+	if encoded, err := EncodeName("github.com."); err != nil || hex.EncodeToString(encoded) != "0667697468756203636f6d00" {
+		t.Fatal(hex.EncodeToString(encoded), err)
+	}
+}
+
+func TestMessage_Reply(t *testing.T) {
+	query, err := ParseMessage(mustDecodeHex(t, sampleAAAAQuery))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := query.Reply()
+	reply.Answers = []ResourceRecord{{Name: "www.google.com", Type: TypeAAAA, Class: ClassIN, TTL: 1, Data: make([]byte, 16)}}
+	packed, err := reply.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The answer name must have been compressed into a pointer toward question name
+	if !bytes.Contains(packed, mustDecodeHex(t, "c00c001c0001")) {
+		t.Fatal(hex.EncodeToString(packed))
+	}
+	decoded, err := ParseMessage(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Header.Response || decoded.Header.ID != 0x1b2c || decoded.OPT == nil || decoded.OPT.UDPSize != 1232 || len(decoded.Answers) != 1 {
+		t.Fatalf("%+v", decoded)
+	}
+}
+
+func TestParseMessage_RoundTrip(t *testing.T) {
+	samples := [][]byte{githubComUDPQuery}
+	for _, sample := range []string{sampleAAAAQuery, sampleMXQuery, sampleTXTQuery, sampleHTTPSQuery, sampleCNAMEResp, sampleNXDomain} {
+		samples = append(samples, mustDecodeHex(t, sample))
+	}
+	// Feed the samples, their truncated forms, and their corrupted forms to the parser
+	packets := make([][]byte, 0, 1024)
+	for _, sample := range samples {
+		for length := 0; length <= len(sample); length++ {
+			packets = append(packets, sample[:length])
+		}
+		for i := range sample {
+			for _, corrupt := range []byte{0x00, 0xc0, 0xff} {
+				packet := append([]byte{}, sample...)
+				packet[i] = corrupt
+				packets = append(packets, packet)
+			}
+		}
+	}
+	for _, packet := range packets {
+		msg, err := ParseMessage(packet)
+		if err == nil {
+			// Whatever is successfully parsed must pack, and the packed message must stay stable through another round trip.
+			packed, err := msg.Pack()
+			if err != nil {
+				t.Fatal(hex.EncodeToString(packet), err)
+			}
+			again, err := ParseMessage(packed)
+			if err != nil {
+				t.Fatal(hex.EncodeToString(packet), err)
+			}
+			packedAgain, err := again.Pack()
+			if err != nil {
+				t.Fatal(hex.EncodeToString(packet), err)
+			}
+			if !bytes.Equal(packed, packedAgain) {
+				t.Fatal(hex.EncodeToString(packet), hex.EncodeToString(packed), hex.EncodeToString(packedAgain))
+			}
+		}
+		ExtractDomainName(packet)
+		RespondWith0(packet)
+	}
+}
@@ -0,0 +1,47 @@
+package dnsd
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/laitos/misc"
+	"strings"
+	"time"
+)
+
+// Results of queries memorised by misc.LatestDNSQueries.
+const (
+	QueryLocal     = "local"     // QueryLocal means the query was answered from local records.
+	QueryBlocked   = "blocked"   // QueryBlocked means the query asked for a black-listed name, or was answered by forwarder with a black-listed name.
+	QueryCached    = "cached"    // QueryCached means the query was answered from cache.
+	QueryForwarded = "forwarded" // QueryForwarded means the query was answered by a forwarder.
+	QueryFailed    = "failed"    // QueryFailed means the query could not be answered due to an IO error.
+)
+
+// queryTypeNames are the textual representation of query types of interest.
+var queryTypeNames = map[uint16]string{
+	TypeA: "A", TypeNS: "NS", TypeCNAME: "CNAME", TypeSOA: "SOA", TypePTR: "PTR", TypeMX: "MX", TypeTXT: "TXT",
+	TypeAAAA: "AAAA", TypeSRV: "SRV", TypeSVCB: "SVCB", TypeHTTPS: "HTTPS", TypeANY: "ANY",
+}
+
+// QueryTypeName returns textual representation of a query type, e.g. "AAAA" for 28, or "TYPE99" for unknown type 99.
+func QueryTypeName(rrType uint16) string {
+	if name, found := queryTypeNames[rrType]; found {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", rrType)
+}
+
+// logQuery places the query made by the client into misc.LatestDNSQueries.
+func logQuery(clientIP string, queryNoLength []byte, result, upstream string, beginTime time.Time) {
+	entry := misc.QueryLogEntry{
+		Time:     time.Now(),
+		ClientIP: clientIP,
+		Result:   result,
+		Upstream: upstream,
+	}
+	entry.Latency = entry.Time.Sub(beginTime)
+	if query, err := ParseMessage(queryNoLength); err == nil && len(query.Questions) > 0 {
+		entry.Name = strings.ToLower(query.Questions[0].Name)
+		entry.Type = QueryTypeName(query.Questions[0].Type)
+	}
+	misc.LatestDNSQueries.Push(entry)
+}
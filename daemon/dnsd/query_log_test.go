@@ -0,0 +1,31 @@
+package dnsd
+
+import (
+	"github.com/HouzuoGuo/laitos/misc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogQuery(t *testing.T) {
+	beginTime := time.Now().Add(-15 * time.Millisecond)
+	logQuery("192.0.2.10", makeQuery(t, "Log-Query.Example.com", TypeAAAA), QueryForwarded, "8.8.8.8:53", beginTime)
+	logQuery("192.0.2.10", []byte{1, 2, 3}, QueryFailed, "8.8.8.8:53", beginTime)
+	found := misc.LatestDNSQueries.Find("192.0.2.10", "")
+	if len(found) != 2 {
+		t.Fatal(found)
+	}
+	if entry := found[0]; entry.Name != "" || entry.Result != QueryFailed || !strings.Contains(entry.String(), "(non-name query) failed") {
+		t.Fatal(entry.String())
+	}
+	entry := found[1]
+	if entry.Name != "log-query.example.com" || entry.Type != "AAAA" || entry.Latency < 15*time.Millisecond {
+		t.Fatalf("%+v", entry)
+	}
+	if line := entry.String(); !strings.Contains(line, "192.0.2.10 AAAA log-query.example.com forwarded via 8.8.8.8:53 in ") {
+		t.Fatal(line)
+	}
+	if name := QueryTypeName(99); name != "TYPE99" {
+		t.Fatal(name)
+	}
+}
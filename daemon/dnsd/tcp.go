@@ -2,11 +2,12 @@ package dnsd
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/testingstub"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"net"
 	"strconv"
 	"strings"
@@ -15,6 +16,10 @@ import (
 
 var TCPDurationStats = misc.NewStats() // TCPDurationStats stores statistics of duration of all TCP DNS queries.
 
+/*
+HandleTCPQuery answers a single query made by the client over TCP connection, the connection is closed afterwards.
+The connection may also be a TLS connection accepted by DNS-over-TLS listener.
+*/
 func (daemon *Daemon) HandleTCPQuery(clientConn net.Conn) {
 	// Put query duration (including IO time) into statistics
 	beginTimeNano := time.Now().UnixNano()
@@ -34,7 +39,8 @@ func (daemon *Daemon) HandleTCPQuery(clientConn net.Conn) {
 	// Read query length
 	clientConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
 	queryLenBuf := make([]byte, 2)
-	_, err := clientConn.Read(queryLenBuf)
+	// TLS connection may deliver the query in several pieces, hence read it in full.
+	_, err := io.ReadFull(clientConn, queryLenBuf)
 	if err != nil {
 		daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to read query length from client")
 		return
@@ -46,77 +52,96 @@ func (daemon *Daemon) HandleTCPQuery(clientConn net.Conn) {
 		return
 	}
 	queryBuf := make([]byte, queryLen)
-	_, err = clientConn.Read(queryBuf)
+	_, err = io.ReadFull(clientConn, queryBuf)
 	if err != nil {
 		daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to read query from client")
 		return
 	}
+	responseBuf := daemon.ProcessTCPQuery(clientIP, queryBuf)
+	if responseBuf == nil {
+		return
+	}
+	// Both black hole and forwarder's response need to be prefixed by their length
+	responseLen := len(responseBuf)
+	responseLenBuf := []byte{byte(responseLen / 256), byte(responseLen % 256)}
+	// Send response to my client
+	if _, err = clientConn.Write(responseLenBuf); err != nil {
+		daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to answer length to client")
+		return
+	} else if _, err = clientConn.Write(responseBuf); err != nil {
+		daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to answer to client")
+		return
+	}
+	return
+}
+
+/*
+ProcessTCPQuery answers a query (without prefix length bytes) made by the client IP, by checking it against local records,
+black list, and cache, and eventually asking a healthy TCP forwarder. Return the response without prefix length bytes, or nil if
+the query cannot be answered. The caller is responsible for checking client IP against rate limit and allowed prefixes.
+*/
+func (daemon *Daemon) ProcessTCPQuery(clientIP string, queryBuf []byte) (responseBuf []byte) {
+	beginTime := time.Now()
 	domainName := ExtractDomainName(queryBuf)
 	// Formulate response
-	var responseLen int
-	var responseLenBuf []byte
-	var responseBuf []byte
 	var doForward bool
 	if len(domainName) == 0 {
 		// If I cannot figure out what domain is from the query, simply forward it without much concern.
-		daemon.logger.Printf("HandleTCPQuery", clientIP, nil, "handle non-name query")
+		daemon.logger.Printf("ProcessTCPQuery", clientIP, nil, "handle non-name query")
 		doForward = true
 	} else {
-		// This is a domain name query, check the name against black list and then forward.
-		if daemon.NamesAreBlackListed(domainName) {
-			daemon.logger.Printf("HandleTCPQuery", clientIP, nil, "handle black-listed domain \"%s\"", domainName[0])
-			responseBuf = RespondWith0(queryBuf)
-			responseLen = len(responseBuf)
-			responseLenBuf = make([]byte, 2)
-			responseLenBuf[0] = byte(responseLen / 256)
-			responseLenBuf[1] = byte(responseLen % 256)
+		// This is a domain name query, check the name against local records, black list, and then forward.
+		if localAnswer := daemon.AnswerLocally(queryBuf); localAnswer != nil {
+			daemon.logger.Printf("ProcessTCPQuery", clientIP, nil, "handle local domain \"%s\"", domainName[0])
+			responseBuf = localAnswer
+			logQuery(clientIP, queryBuf, QueryLocal, "", beginTime)
+		} else if daemon.NamesAreBlackListed(domainName) {
+			daemon.logger.Printf("ProcessTCPQuery", clientIP, nil, "handle black-listed domain \"%s\"", domainName[0])
+			responseBuf = daemon.RespondToBlackListed(queryBuf)
+			logQuery(clientIP, queryBuf, QueryBlocked, "", beginTime)
+		} else if cachedResponse := daemon.responseCache.Lookup(queryBuf, false); cachedResponse != nil {
+			daemon.logger.Printf("ProcessTCPQuery", clientIP, nil, "handle domain \"%s\" from cache", domainName[0])
+			responseBuf = cachedResponse
+			logQuery(clientIP, queryBuf, QueryCached, "", beginTime)
 		} else {
-			daemon.logger.Printf("HandleTCPQuery", clientIP, nil, "handle domain \"%s\"", domainName[0])
+			daemon.logger.Printf("ProcessTCPQuery", clientIP, nil, "handle domain \"%s\"", domainName[0])
 			doForward = true
 		}
 	}
-	// If queried domain is not black listed, forward the query to forwarder.
-	if doForward {
-		// Ask a randomly chosen TCP forwarder to process the query
-		myForwarder, err := net.DialTimeout("tcp", daemon.TCPForwarder[rand.Intn(len(daemon.TCPForwarder))], IOTimeoutSec*time.Second)
-		if err != nil {
-			daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to connect to forwarder")
-			return
-		}
-		defer myForwarder.Close()
-		// Send original query to forwarder without modification
-		myForwarder.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
-		if _, err = myForwarder.Write(queryLenBuf); err != nil {
-			daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to write length to forwarder")
-			return
-		} else if _, err = myForwarder.Write(queryBuf); err != nil {
-			daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to write query to forwarder")
-			return
-		}
-		// Retrieve forwarder's response
-		responseLenBuf = make([]byte, 2)
-		if _, err = myForwarder.Read(responseLenBuf); err != nil {
-			daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to read length from forwarder")
-			return
-		}
-		responseLen = int(responseLenBuf[0])*256 + int(responseLenBuf[1])
-		if responseLen > MaxPacketSize || responseLen < 1 {
-			daemon.logger.Warningf("HandleTCPQuery", clientIP, nil, "bad response length from forwarder")
-			return
+	if !doForward {
+		return
+	}
+	// Ask a healthy TCP forwarder to process the query, and fail over to another forwarder if it does not answer.
+	var forwarder *forwarderState
+	for attempt := 0; attempt < ForwarderMaxAttempts; attempt++ {
+		if forwarder = chooseForwarder(daemon.tcpForwarders, forwarder); forwarder == nil {
+			break
 		}
-		responseBuf = make([]byte, responseLen)
-		if _, err = myForwarder.Read(responseBuf); err != nil {
-			daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to read response from forwarder")
-			return
+		forwarderBeginTime := time.Now()
+		var err error
+		if responseBuf, err = exchangeTCP(forwarder.addr, queryBuf); err == nil {
+			daemon.reportForwarder(forwarder, time.Since(forwarderBeginTime), nil)
+			break
 		}
+		daemon.reportForwarder(forwarder, 0, err)
+		daemon.logger.Warningf("ProcessTCPQuery", clientIP, err, "failed to get answer from forwarder %s", forwarder.addr)
 	}
-	// Send response to my client
-	if _, err = clientConn.Write(responseLenBuf); err != nil {
-		daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to answer length to client")
-		return
-	} else if _, err = clientConn.Write(responseBuf); err != nil {
-		daemon.logger.Warningf("HandleTCPQuery", clientIP, err, "failed to answer to client")
-		return
+	upstream := ""
+	if forwarder != nil {
+		upstream = forwarder.addr
+	}
+	if responseBuf == nil {
+		logQuery(clientIP, queryBuf, QueryFailed, upstream, beginTime)
+		return nil
+	}
+	// The forwarder may have answered with a CNAME that points into a black-listed domain
+	if cnameTargets := ExtractCNAMETargets(responseBuf); daemon.NamesAreBlackListed(cnameTargets) {
+		daemon.logger.Printf("ProcessTCPQuery", clientIP, nil, "forwarder's answer points to black-listed domain \"%s\"", cnameTargets[0])
+		responseBuf = daemon.RespondToBlackListed(queryBuf)
+		logQuery(clientIP, queryBuf, QueryBlocked, upstream, beginTime)
+	} else {
+		daemon.responseCache.Store(queryBuf, responseBuf)
+		logQuery(clientIP, queryBuf, QueryForwarded, upstream, beginTime)
 	}
 	return
 }
@@ -151,6 +176,36 @@ func (daemon *Daemon) StartAndBlockTCP() error {
 
 }
 
+/*
+You may call this function only after having called Initialise()!
+Start DNS daemon to listen on DNS-over-TLS port only, until daemon is told to stop. Queries made over TLS go through the
+same processing as TCP queries.
+*/
+func (daemon *Daemon) StartAndBlockTLS() error {
+	listenAddr := fmt.Sprintf("%s:%d", daemon.Address, daemon.TLSPort)
+	listener, err := tls.Listen("tcp", listenAddr, &tls.Config{Certificates: []tls.Certificate{daemon.tlsCert}})
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	daemon.tlsListener = listener
+	// Process incoming DNS-over-TLS queries
+	daemon.logger.Printf("StartAndBlockTLS", listenAddr, nil, "going to listen for queries")
+	for {
+		if misc.EmergencyLockDown {
+			return misc.ErrEmergencyLockDown
+		}
+		clientConn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return nil
+			}
+			return fmt.Errorf("DNSD.StartAndBlockTLS: failed to accept new connection - %v", err)
+		}
+		go daemon.HandleTCPQuery(clientConn)
+	}
+}
+
 // Run unit tests on DNS TCP daemon. See TestDNSD_StartAndBlockTCP for daemon setup.
 func TestTCPQueries(dnsd *Daemon, t testingstub.T) {
 	// Prevent daemon from listening to UDP queries in this TCP test case
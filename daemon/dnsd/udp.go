@@ -14,29 +14,63 @@ import (
 
 var UDPDurationStats = misc.NewStats() // UDPDurationStats stores statistics of duration of all UDP DNS queries.
 
-// Send forward queries to forwarder and forward the response to my DNS client.
-func (daemon *Daemon) HandleUDPQueries(myQueue chan *UDPQuery, forwarderConn net.Conn) {
+/*
+Send forward queries to a healthy forwarder and forward the response to my DNS client. If the forwarder fails to
+answer, the query is sent to another forwarder.
+*/
+func (daemon *Daemon) HandleUDPQueries(myQueue chan *UDPQuery) {
 	packetBuf := make([]byte, MaxPacketSize)
+	// Each queue makes its own connections to forwarders on demand, the connections are reused by later queries.
+	forwarderConns := make(map[*forwarderState]net.Conn)
 	for {
 		query := <-myQueue
 		// Put query duration (including IO time) into statistics
-		beginTimeNano := time.Now().UnixNano()
-		// Set deadline for IO with forwarder
-		forwarderConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
-		if _, err := forwarderConn.Write(query.QueryPacket); err != nil {
-			daemon.logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to write to forwarder")
+		beginTime := time.Now()
+		beginTimeNano := beginTime.UnixNano()
+		clientIP := query.ClientAddr.IP.String()
+		// Answer the query from cache if possible
+		if cachedResponse := daemon.responseCache.Lookup(query.QueryPacket, true); cachedResponse != nil {
+			logQuery(clientIP, query.QueryPacket, QueryCached, "", beginTime)
+			query.MyServer.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+			if _, err := query.MyServer.WriteTo(cachedResponse, query.ClientAddr); err != nil {
+				daemon.logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to answer to client")
+			}
 			UDPDurationStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 			continue
 		}
-		packetLength, err := forwarderConn.Read(packetBuf)
-		if err != nil {
-			daemon.logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to read from forwarder")
+		var forwarder *forwarderState
+		var responsePacket []byte
+		for attempt := 0; attempt < ForwarderMaxAttempts; attempt++ {
+			if forwarder = chooseForwarder(daemon.udpForwarders, forwarder); forwarder == nil {
+				break
+			}
+			var err error
+			if responsePacket, err = daemon.askUDPForwarder(forwarderConns, forwarder, query.QueryPacket, packetBuf); err == nil {
+				break
+			}
+			daemon.logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to get answer from forwarder %s", forwarder.addr)
+		}
+		upstream := ""
+		if forwarder != nil {
+			upstream = forwarder.addr
+		}
+		if responsePacket == nil {
+			logQuery(clientIP, query.QueryPacket, QueryFailed, upstream, beginTime)
 			UDPDurationStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 			continue
 		}
+		// The forwarder may have answered with a CNAME that points into a black-listed domain
+		if cnameTargets := ExtractCNAMETargets(responsePacket); daemon.NamesAreBlackListed(cnameTargets) {
+			daemon.logger.Printf("HandleUDPQueries", query.ClientAddr.String(), nil, "forwarder's answer points to black-listed domain \"%s\"", cnameTargets[0])
+			responsePacket = daemon.RespondToBlackListed(query.QueryPacket)
+			logQuery(clientIP, query.QueryPacket, QueryBlocked, upstream, beginTime)
+		} else {
+			daemon.responseCache.Store(query.QueryPacket, responsePacket)
+			logQuery(clientIP, query.QueryPacket, QueryForwarded, upstream, beginTime)
+		}
 		// Set deadline for responding to my DNS client
 		query.MyServer.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
-		if _, err := query.MyServer.WriteTo(packetBuf[:packetLength], query.ClientAddr); err != nil {
+		if _, err := query.MyServer.WriteTo(responsePacket, query.ClientAddr); err != nil {
 			daemon.logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to answer to client")
 			UDPDurationStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 			continue
@@ -45,14 +79,40 @@ func (daemon *Daemon) HandleUDPQueries(myQueue chan *UDPQuery, forwarderConn net
 	}
 }
 
+/*
+askUDPForwarder sends the query to forwarder via the connection made by the calling queue, and reports the outcome to
+forwarder health. The connection is discarded upon failure, a new connection will be made to the forwarder next time.
+*/
+func (daemon *Daemon) askUDPForwarder(conns map[*forwarderState]net.Conn, forwarder *forwarderState, query, packetBuf []byte) (response []byte, err error) {
+	beginTime := time.Now()
+	conn, exists := conns[forwarder]
+	if !exists {
+		if conn, err = net.DialTimeout("udp", forwarder.addr, ForwarderIOTimeoutSec*time.Second); err != nil {
+			daemon.reportForwarder(forwarder, 0, err)
+			return
+		}
+		conns[forwarder] = conn
+	}
+	if response, err = exchangeUDP(conn, query, packetBuf); err != nil {
+		conn.Close()
+		delete(conns, forwarder)
+		daemon.reportForwarder(forwarder, 0, err)
+		return nil, err
+	}
+	daemon.reportForwarder(forwarder, time.Since(beginTime), nil)
+	return
+}
+
 // Send blackhole answer to my DNS client.
 func (daemon *Daemon) HandleBlackHoleAnswer(myQueue chan *UDPQuery) {
 	for {
 		query := <-myQueue
 		// Put query duration (including IO time) into statistics
-		beginTimeNano := time.Now().UnixNano()
+		beginTime := time.Now()
+		beginTimeNano := beginTime.UnixNano()
 		// Set deadline for responding to my DNS client
-		blackHoleAnswer := RespondWith0(query.QueryPacket)
+		blackHoleAnswer := daemon.RespondToBlackListed(query.QueryPacket)
+		logQuery(query.ClientAddr.IP.String(), query.QueryPacket, QueryBlocked, "", beginTime)
 		query.MyServer.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
 		if _, err := query.MyServer.WriteTo(blackHoleAnswer, query.ClientAddr); err != nil {
 			daemon.logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "IO failure")
@@ -79,8 +139,8 @@ func (daemon *Daemon) StartAndBlockUDP() error {
 	daemon.udpListener = udpServer
 	daemon.logger.Printf("StartAndBlockUDP", listenAddr, nil, "going to listen for queries")
 	// Start queues that will respond to DNS clients
-	for i, queue := range daemon.udpForwarderQueue {
-		go daemon.HandleUDPQueries(queue, daemon.udpForwardConn[i])
+	for _, queue := range daemon.udpForwarderQueue {
+		go daemon.HandleUDPQueries(queue)
 	}
 	for _, queue := range daemon.udpBlackHoleQueue {
 		go daemon.HandleBlackHoleAnswer(queue)
@@ -98,6 +158,7 @@ func (daemon *Daemon) StartAndBlockUDP() error {
 			}
 			return fmt.Errorf("DNSD.StartAndBlockUDP: failed to accept new connection - %v", err)
 		}
+		beginTime := time.Now()
 		// Check address against rate limit and allowed IP prefixes
 		clientIP := clientAddr.IP.String()
 		if !daemon.rateLimit.Add(clientIP, true) {
@@ -122,6 +183,14 @@ func (daemon *Daemon) StartAndBlockUDP() error {
 				MyServer:    udpServer,
 				QueryPacket: forwardPacket,
 			}
+		} else if localAnswer := daemon.AnswerLocally(forwardPacket); localAnswer != nil {
+			// Requested domain name is among local records, answer it right away.
+			daemon.logger.Printf("UDPLoop", clientIP, nil, "handle local domain \"%s\"", domainName[0])
+			logQuery(clientIP, forwardPacket, QueryLocal, "", beginTime)
+			udpServer.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+			if _, err := udpServer.WriteTo(localAnswer, clientAddr); err != nil {
+				daemon.logger.Warningf("UDPLoop", clientIP, err, "failed to answer to client")
+			}
 		} else if daemon.NamesAreBlackListed(domainName) {
 			// Requested domain name is black-listed
 			randBlackListResponder := rand.Intn(len(daemon.udpBlackHoleQueue))
@@ -0,0 +1,24 @@
+package api
+
+import (
+	"errors"
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/misc"
+	"net/http"
+)
+
+// Answer HTTP-01 challenges of ACME certificate authority on behalf of the certificate manager.
+type HandleACMEChallenge struct {
+	CertManager *common.CertManager `json:"-"`
+}
+
+func (acme *HandleACMEChallenge) MakeHandler(logger misc.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	if acme.CertManager == nil {
+		return nil, errors.New("HandleACMEChallenge.MakeHandler: CertManager must not be nil")
+	}
+	return acme.CertManager.ServeHTTPChallenge, nil
+}
+
+func (_ *HandleACMEChallenge) GetRateLimitFactor() int {
+	return 10
+}
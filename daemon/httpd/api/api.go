@@ -31,6 +31,12 @@ type HandlerFactory interface {
 	GetRateLimitFactor() int                                                     // Factor of how expensive the handler is to execute, 1 being most expensive.
 }
 
+// BackgroundWorker is implemented by handler factories that need work done in background while web server is running.
+type BackgroundWorker interface {
+	StartBackgroundWork() // Web server calls this function before it starts serving.
+	StopBackgroundWork()  // Web server calls this function after it stops serving.
+}
+
 // Escape sequences in a string to make it safe for being element data.
 func XMLEscape(in string) string {
 	var escapeOutput bytes.Buffer
@@ -75,8 +81,12 @@ maintenance.go of maintenance package.
 func GetLatestStats() string {
 	numDecimals := 2
 	factor := 1000000000.0
+	dnsCacheHits, dnsCacheMisses := dnsd.GetCacheStats()
 	return fmt.Sprintf(`Web and bot commands: %s
 DNS server  TCP|UDP:  %s | %s
+DNS cache hit|miss:   %d | %d
+DNS black lists:      %s
+DNS forwarders:       %s
 Web servers:          %s
 Mail commands:        %s
 Text server TCP|UDP:  %s | %s
@@ -86,6 +96,9 @@ Telegram commands:    %s
 `,
 		common.DurationStats.Format(factor, numDecimals),
 		dnsd.TCPDurationStats.Format(factor, numDecimals), dnsd.UDPDurationStats.Format(factor, numDecimals),
+		dnsCacheHits, dnsCacheMisses,
+		dnsd.GetBlackListStats(),
+		dnsd.GetForwarderStats(),
 		DurationStats.Format(factor, numDecimals),
 		mailcmd.DurationStats.Format(factor, numDecimals),
 		plainsocket.TCPDurationStats.Format(factor, numDecimals), plainsocket.UDPDurationStats.Format(factor, numDecimals),
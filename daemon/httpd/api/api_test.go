@@ -1,7 +1,16 @@
 package api
 
 import (
+	"encoding/json"
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/misc"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestXMLEscape(t *testing.T) {
@@ -10,4 +19,93 @@ func TestXMLEscape(t *testing.T) {
 	}
 }
 
-// API handlers are tested in httpd_test.go
+func TestSelectJSONValue(t *testing.T) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{"event": {"text": "hi", "n": 1.5, "ok": true, "items": [{"a": ["x", "y"]}], "obj": {"b": null}}}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"$.event.text":        "hi",
+		"event.text":          "hi",
+		"$.event.n":           "1.5",
+		"event.ok":            "true",
+		"event.items[0].a[1]": "y",
+		"event.items[0].a":    `["x","y"]`,
+		"event.obj":           `{"b":null}`,
+		"event.obj.b":         "",
+		"event.items[1]":      "",
+		"event.items[x]":      "",
+		"event.items[0":       "",
+		"event.text.more":     "",
+		"nothing":             "",
+		"":                    "",
+	} {
+		if out := SelectJSONString(doc, path); out != expected {
+			t.Fatalf("%s: %q", path, out)
+		}
+	}
+	if val, found := SelectJSONValue(doc, "$"); !found || val == nil {
+		t.Fatal(val)
+	}
+}
+
+// Webhook handler is tested in httpd_test.go, except for the callback that needs a separate server.
+func TestHandleWebhook_Callback(t *testing.T) {
+	if _, err := (&HandleWebhook{TextSelector: "text"}).MakeHandler(misc.Logger{}, common.GetTestCommandProcessor()); err == nil {
+		t.Fatal("should have failed")
+	}
+	if _, err := (&HandleWebhook{SigningSecret: "secret", SignatureHeader: "X-Sig", SignatureAlgorithm: "md5", TextSelector: "text"}).MakeHandler(misc.Logger{}, common.GetTestCommandProcessor()); err == nil {
+		t.Fatal("should have failed")
+	}
+	callbacks := make(chan string, 1)
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		callbacks <- r.Header.Get("Content-Type") + " " + string(body)
+	}))
+	defer callbackServer.Close()
+	hook := &HandleWebhook{
+		Token:               "verysecret-webhook-token",
+		TokenSelector:       "token",
+		TextSelector:        "text",
+		CallbackURLSelector: "response_url",
+		ResponseTemplate:    "{{.Output}}",
+		ResponseContentType: "text/plain",
+	}
+	// Callback URL from request content must be restricted to the allowed hosts
+	if _, err := hook.MakeHandler(misc.Logger{}, common.GetTestCommandProcessor()); err == nil {
+		t.Fatal("should have failed")
+	}
+	callbackServerURL, err := url.Parse(callbackServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.CallbackHosts = []string{"hooks.slack.com", callbackServerURL.Hostname()}
+	handler, err := hook.MakeHandler(misc.Logger{}, common.GetTestCommandProcessor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, badURL := range []string{"http://169.254.169.254/latest/meta-data", "file:///etc/passwd", "https://hooks.slack.com.example.com/a"} {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("token=verysecret-webhook-token&text=verysecret.s+echo+-n+hi&response_url="+url.QueryEscape(badURL)))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Fatal(badURL, rec.Code, rec.Body.String())
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("token=verysecret-webhook-token&text=verysecret.s+echo+-n+hi&response_url="+callbackServer.URL))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	select {
+	case callback := <-callbacks:
+		if callback != "text/plain hi" {
+			t.Fatal(callback)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not receive callback")
+	}
+}
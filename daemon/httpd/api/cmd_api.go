@@ -0,0 +1,198 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/HouzuoGuo/laitos/toolbox/filter"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	CommandAPIDefaultTimeoutSec      = 30          // CommandAPIDefaultTimeoutSec is the command timeout if request does not specify one.
+	CommandAPIMaxTimeoutSec          = 55          // CommandAPIMaxTimeoutSec keeps command execution within IO timeout of HTTP daemon.
+	CommandAPIDefaultMaxOutputLength = 1024 * 1024 // CommandAPIDefaultMaxOutputLength is the default maximum length of output in response.
+	CommandAPIDefaultMaxClockSkewSec = 300         // CommandAPIDefaultMaxClockSkewSec is the default maximum age of a signed request.
+	CommandAPIMaxRequestSize         = 64 * 1024   // CommandAPIMaxRequestSize is the maximum size of request body.
+	CommandAPIMinSecretLength        = 16          // CommandAPIMinSecretLength is the minimum length of bearer token and HMAC secret.
+	CommandAPITimestampHeader        = "X-Laitos-Timestamp"
+	CommandAPISignatureHeader        = "X-Laitos-Signature"
+)
+
+// CommandAPIRequest is the JSON document that asks the command API to execute a toolbox command.
+type CommandAPIRequest struct {
+	Command string `json:"command"` // Command is the toolbox command including PIN or shortcut.
+	Timeout int    `json:"timeout"` // Timeout is the number of seconds the command may run for.
+}
+
+// CommandAPIResponse is the JSON document of command execution result.
+type CommandAPIResponse struct {
+	Trigger        string `json:"trigger"`        // Trigger is the prefix of toolbox feature that executed the command.
+	Output         string `json:"output"`         // Output is the feature output before it is linted, at most MaxOutputLength long.
+	Encrypted      bool   `json:"encrypted"`      // Encrypted is true if output has been encrypted by EncryptOutput filter.
+	Error          string `json:"error"`          // Error is the command execution error.
+	CombinedOutput string `json:"combinedOutput"` // CombinedOutput is the error and output after all result filters, as other daemons would reply.
+	DurationMS     int64  `json:"durationMS"`     // DurationMS is the number of milliseconds it took to process the command.
+	OutputLength   int    `json:"outputLength"`   // OutputLength is the length of output before truncation.
+	Truncated      bool   `json:"truncated"`      // Truncated is true if output was longer than MaxOutputLength.
+}
+
+/*
+Execute toolbox commands for scripts and home automation systems via JSON request and response. A request is
+authenticated by the bearer token in Authorization header, or by HMAC-SHA256 signature of its timestamp and body.
+*/
+type HandleCommandAPI struct {
+	BearerToken     string `json:"BearerToken"`     // BearerToken authenticates requests carrying "Authorization: Bearer <token>".
+	HMACSecret      string `json:"HMACSecret"`      // HMACSecret authenticates requests carrying signature of timestamp and body.
+	MaxClockSkewSec int    `json:"MaxClockSkewSec"` // MaxClockSkewSec is the maximum difference between request timestamp and clock.
+	MaxOutputLength int    `json:"MaxOutputLength"` // MaxOutputLength is the maximum length of output in response.
+}
+
+// GetCommandAPISignature returns the hex-encoded HMAC-SHA256 signature of request timestamp and body.
+func GetCommandAPISignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticate returns true only if the request carries the bearer token, or a recent timestamp and its valid signature.
+func (cmdAPI *HandleCommandAPI) authenticate(r *http.Request, body []byte) bool {
+	if cmdAPI.BearerToken != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[7:])), []byte(cmdAPI.BearerToken)) == 1 {
+			return true
+		}
+	}
+	if cmdAPI.HMACSecret != "" {
+		timestamp := r.Header.Get(CommandAPITimestampHeader)
+		unixSec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return false
+		}
+		if skew := time.Now().Unix() - unixSec; skew > int64(cmdAPI.MaxClockSkewSec) || skew < -int64(cmdAPI.MaxClockSkewSec) {
+			return false
+		}
+		signature := strings.TrimPrefix(r.Header.Get(CommandAPISignatureHeader), "sha256=")
+		return hmac.Equal([]byte(strings.ToLower(signature)), []byte(GetCommandAPISignature(cmdAPI.HMACSecret, timestamp, body)))
+	}
+	return false
+}
+
+// writeCommandAPIError responds with the HTTP status and a JSON document that carries the error message.
+func writeCommandAPIError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(CommandAPIResponse{Error: message})
+}
+
+func (cmdAPI *HandleCommandAPI) MakeHandler(logger misc.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	if cmdAPI.BearerToken == "" && cmdAPI.HMACSecret == "" {
+		return nil, errors.New("HandleCommandAPI.MakeHandler: either BearerToken or HMACSecret must be configured")
+	}
+	if cmdAPI.BearerToken != "" && len(cmdAPI.BearerToken) < CommandAPIMinSecretLength ||
+		cmdAPI.HMACSecret != "" && len(cmdAPI.HMACSecret) < CommandAPIMinSecretLength {
+		return nil, fmt.Errorf("HandleCommandAPI.MakeHandler: BearerToken and HMACSecret must be at least %d characters long", CommandAPIMinSecretLength)
+	}
+	if cmdAPI.MaxClockSkewSec < 1 {
+		cmdAPI.MaxClockSkewSec = CommandAPIDefaultMaxClockSkewSec
+	}
+	if cmdAPI.MaxOutputLength < 1 {
+		cmdAPI.MaxOutputLength = CommandAPIDefaultMaxOutputLength
+	}
+	// The whole output is given in a single response, there is no point in retaining it for pagination.
+	proc := *cmdProc
+	proc.NoPagination = true
+	// Output does not bypass the encryption configured for HTTP daemon
+	var encrypt *filter.EncryptOutput
+	for _, resultFilter := range proc.ResultFilters {
+		if enc, isEncrypt := resultFilter.(*filter.EncryptOutput); isEncrypt && enc.IsConfigured() {
+			encrypt = enc
+		}
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		NoCache(w)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeCommandAPIError(w, http.StatusMethodNotAllowed, "only POST method is supported")
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, CommandAPIMaxRequestSize))
+		if err != nil {
+			writeCommandAPIError(w, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+		clientIP := GetRealClientIP(r)
+		if !cmdAPI.authenticate(r, body) {
+			logger.Warningf("HandleCommandAPI", clientIP, nil, "failed to authenticate request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="laitos"`)
+			writeCommandAPIError(w, http.StatusUnauthorized, "authentication failed")
+			return
+		}
+		var req CommandAPIRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeCommandAPIError(w, http.StatusBadRequest, "request body must be a JSON object")
+			return
+		}
+		if strings.TrimSpace(req.Command) == "" {
+			writeCommandAPIError(w, http.StatusBadRequest, "command must not be empty")
+			return
+		}
+		if req.Timeout < 1 {
+			req.Timeout = CommandAPIDefaultTimeoutSec
+		} else if req.Timeout > CommandAPIMaxTimeoutSec {
+			req.Timeout = CommandAPIMaxTimeoutSec
+		}
+		beginTime := time.Now()
+		result := proc.Process(toolbox.Command{
+			Content:    req.Command,
+			TimeoutSec: req.Timeout,
+			DaemonName: "httpd-api",
+			ClientID:   clientIP,
+		})
+		resp := CommandAPIResponse{
+			Trigger:        string(result.Trigger),
+			Output:         result.Output,
+			Error:          result.ErrText(),
+			CombinedOutput: result.CombinedOutput,
+			DurationMS:     time.Since(beginTime).Nanoseconds() / 1000000,
+			OutputLength:   len(result.Output),
+		}
+		if len(resp.Output) > cmdAPI.MaxOutputLength {
+			// Do not cut a multi-byte character in half
+			cut := cmdAPI.MaxOutputLength
+			for cut > 0 && !utf8.RuneStart(resp.Output[cut]) {
+				cut--
+			}
+			resp.Output = resp.Output[:cut]
+			resp.Truncated = true
+		}
+		if encrypt != nil && resp.Output != "" {
+			if resp.Output, err = encrypt.Encrypt(resp.Output); err != nil {
+				logger.Warningf("HandleCommandAPI", clientIP, err, "failed to encrypt output")
+				writeCommandAPIError(w, http.StatusInternalServerError, "failed to encrypt output")
+				return
+			}
+			resp.Encrypted = true
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+	return fun, nil
+}
+
+func (_ *HandleCommandAPI) GetRateLimitFactor() int {
+	return 1
+}
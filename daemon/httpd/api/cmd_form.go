@@ -46,6 +46,8 @@ func (_ *HandleCommandForm) MakeHandler(logger misc.Logger, cmdProc *common.Comm
 				result := cmdProc.Process(toolbox.Command{
 					Content:    cmd,
 					TimeoutSec: CommandFormTimeoutSec,
+					DaemonName: "httpd-form",
+					ClientID:   GetRealClientIP(r),
 				})
 				w.Write([]byte(fmt.Sprintf(HandleCommandFormPage, html.EscapeString(result.CombinedOutput))))
 			}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/misc"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const DNSMessageContentType = "application/dns-message" // DNSMessageContentType is the media type of DNS-over-HTTPS query and response.
+
+/*
+Answer DNS-over-HTTPS (RFC 8484) queries via DNS daemon's local records, black list, cache, and TCP forwarders.
+A query may come in GET request as base64url-encoded parameter "dns", or in POST request body as a DNS message.
+Just like DNS daemon, only clients from AllowQueryIPPrefixes of DNS daemon may query, unless AllowAllClients is true.
+*/
+type HandleDNSOverHTTPS struct {
+	AllowAllClients bool         `json:"AllowAllClients"` // AllowAllClients answers queries from all clients, turning the endpoint into an open resolver.
+	DNSDaemon       *dnsd.Daemon `json:"-"`               // DNSDaemon is an initialised DNS daemon that processes the queries.
+}
+
+func (doh *HandleDNSOverHTTPS) MakeHandler(logger misc.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	if doh.DNSDaemon == nil {
+		return nil, errors.New("HandleDNSOverHTTPS.MakeHandler: DNS daemon must be assigned")
+	}
+	if len(doh.DNSDaemon.TCPForwarder) == 0 {
+		return nil, errors.New("HandleDNSOverHTTPS.MakeHandler: DNS daemon must have at least one TCP forwarder")
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		clientIP := GetRealClientIP(r)
+		if !doh.AllowAllClients && !doh.DNSDaemon.IsClientAllowed(clientIP) {
+			logger.Warningf("HandleDNSOverHTTPS", clientIP, nil, "client IP is not allowed to query")
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		var query []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			// The parameter is encoded without padding, though tolerate padding just in case.
+			query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.FormValue("dns"), "="))
+			if err != nil {
+				http.Error(w, "bad dns parameter", http.StatusBadRequest)
+				return
+			}
+		case http.MethodPost:
+			if contentType := r.Header.Get("Content-Type"); contentType != DNSMessageContentType {
+				http.Error(w, "content type must be "+DNSMessageContentType, http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = ioutil.ReadAll(io.LimitReader(r.Body, dnsd.MaxPacketSize+1))
+			if err != nil {
+				http.Error(w, "failed to read query", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(query) < dnsd.HeaderSize || len(query) > dnsd.MaxPacketSize {
+			http.Error(w, "bad query size", http.StatusBadRequest)
+			return
+		}
+		response := doh.DNSDaemon.ProcessTCPQuery(clientIP, query)
+		if len(response) == 0 {
+			logger.Warningf("HandleDNSOverHTTPS", clientIP, nil, "failed to answer the query")
+			http.Error(w, "failed to answer the query", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", DNSMessageContentType)
+		NoCache(w)
+		w.Write(response)
+	}
+	return fun, nil
+}
+
+func (_ *HandleDNSOverHTTPS) GetRateLimitFactor() int {
+	// Web browsers look up a lot of names, make the rate limit generous.
+	return 25
+}
+
+// StartBackgroundWork keeps black list and forwarders of DNS daemon up to date while web server is running.
+func (doh *HandleDNSOverHTTPS) StartBackgroundWork() {
+	doh.DNSDaemon.StartBackgroundRefresh()
+}
+
+// StopBackgroundWork stops refreshing black list and forwarders, unless DNS daemon or another web server still needs them.
+func (doh *HandleDNSOverHTTPS) StopBackgroundWork() {
+	doh.DNSDaemon.StopBackgroundRefresh()
+}
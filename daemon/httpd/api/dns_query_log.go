@@ -0,0 +1,31 @@
+package api
+
+import (
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/misc"
+	"net/http"
+)
+
+/*
+Retrieve latest DNS queries handled by DNS daemon in text form, one query per line and latest query comes first.
+Optional parameter "client" narrows down the queries to those made by client IP beginning with the parameter value, and
+optional parameter "name" narrows down the queries to those asking for a name that contains the parameter value.
+*/
+type HandleDNSQueryLog struct {
+}
+
+func (_ *HandleDNSQueryLog) MakeHandler(logger misc.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		NoCache(w)
+		if !WarnIfNoHTTPS(r, w) {
+			return
+		}
+		w.Write([]byte(misc.FormatQueries(misc.LatestDNSQueries.Find(r.FormValue("client"), r.FormValue("name")))))
+	}
+	return fun, nil
+}
+
+func (_ *HandleDNSQueryLog) GetRateLimitFactor() int {
+	return 2
+}
@@ -145,7 +145,12 @@ func (hand *HandleMicrosoftBot) MakeHandler(logger misc.Logger, cmdProc *common.
 			}
 
 			// Process feature command from incoming chat text
-			result := cmdProc.Process(toolbox.Command{TimeoutSec: MicrosoftBotCommandTimeoutSec, Content: incoming.Text})
+			result := cmdProc.Process(toolbox.Command{
+				TimeoutSec: MicrosoftBotCommandTimeoutSec,
+				Content:    incoming.Text,
+				DaemonName: "microsoft-bot",
+				ClientID:   incoming.Conversation.ID,
+			})
 
 			// Most of the reply properties are directly copied from incoming request
 			var reply MicrosoftBotReply
@@ -40,10 +40,16 @@ const (
 
 // Handle Twilio phone number's SMS hook.
 type HandleTwilioSMSHook struct {
+	CommandProcessor *common.CommandProcessor `json:"-"` // CommandProcessor overrides the HTTP daemon's processor if it is set, e.g. to demand TOTP.
+
 	senderRateLimit *misc.RateLimit // senderRateLimit prevents excessive SMS replies from being replied to spam numbers
 }
 
 func (hand *HandleTwilioSMSHook) MakeHandler(logger misc.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	if hand.CommandProcessor != nil {
+		cmdProc = hand.CommandProcessor
+		cmdProc.SetLogger(logger)
+	}
 	// Allows maximum of 1 SMS to be received every 5 seconds
 	hand.senderRateLimit = &misc.RateLimit{
 		UnitSecs: TwilioPhoneNumberRateLimitIntervalSec,
@@ -75,6 +81,8 @@ func (hand *HandleTwilioSMSHook) MakeHandler(logger misc.Logger, cmdProc *common
 		ret := cmdProc.Process(toolbox.Command{
 			TimeoutSec: TwilioHandlerTimeoutSec,
 			Content:    r.FormValue("Body"),
+			DaemonName: "twilio-sms",
+			ClientID:   phoneNumber,
 		})
 		// Generate normal XML response
 		w.Write([]byte(fmt.Sprintf(xml.Header+`
@@ -138,12 +146,17 @@ func (hand *HandleTwilioCallHook) GetRateLimitFactor() int {
 
 // Carry on with command processing in Twilio telephone call conversation.
 type HandleTwilioCallCallback struct {
-	MyEndpoint string `json:"-"` // URL endpoint to the callback itself, including prefix /.
+	MyEndpoint       string                   `json:"-"` // URL endpoint to the callback itself, including prefix /.
+	CommandProcessor *common.CommandProcessor `json:"-"` // CommandProcessor overrides the HTTP daemon's processor if it is set, e.g. to demand TOTP.
 
 	senderRateLimit *misc.RateLimit // senderRateLimit prevents excessive calls from being made by spam numbers
 }
 
 func (hand *HandleTwilioCallCallback) MakeHandler(logger misc.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	if hand.CommandProcessor != nil {
+		cmdProc = hand.CommandProcessor
+		cmdProc.SetLogger(logger)
+	}
 	// Allows maximum of 1 DTMF command to be received every 5 seconds
 	hand.senderRateLimit = &misc.RateLimit{
 		UnitSecs: TwilioPhoneNumberRateLimitIntervalSec,
@@ -181,6 +194,8 @@ func (hand *HandleTwilioCallCallback) MakeHandler(logger misc.Logger, cmdProc *c
 		ret := cmdProc.Process(toolbox.Command{
 			TimeoutSec: TwilioHandlerTimeoutSec,
 			Content:    DTMFDecode(dtmfInput),
+			DaemonName: "twilio-call",
+			ClientID:   phoneNumber,
 		})
 		combinedOutput := ret.CombinedOutput
 		if phoneticSpelling {
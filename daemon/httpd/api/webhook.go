@@ -0,0 +1,385 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	WebhookDefaultTimeoutSec       = 30                           // WebhookDefaultTimeoutSec is the default timeout of command execution.
+	WebhookCallbackTimeoutSec      = 30                           // WebhookCallbackTimeoutSec is the timeout of outgoing callback request.
+	WebhookDefaultMaxClockSkewSec  = 300                          // WebhookDefaultMaxClockSkewSec is the default maximum age of a signed request.
+	WebhookMaxRequestSize          = 256 * 1024                   // WebhookMaxRequestSize is the maximum size of incoming request body.
+	WebhookDefaultResponseTemplate = `{"text": {{json .Output}}}` // WebhookDefaultResponseTemplate suits Slack, Mattermost, and Rocket.Chat.
+)
+
+// webhookHashFunctions are the supported algorithms of HMAC signature.
+var webhookHashFunctions = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+/*
+SelectJSONValue walks through the JSON document along the path and returns the value found at the end. The path
+resembles JSONPath, it consists of object keys separated by dots and array indices in brackets, such as
+"$.event.messages[0].text". The leading "$" is optional.
+*/
+func SelectJSONValue(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			continue
+		}
+		// Separate the object key from array indices that follow it
+		key := segment
+		var indices []string
+		if bracket := strings.IndexRune(segment, '['); bracket != -1 {
+			key = segment[:bracket]
+			if !strings.HasSuffix(segment, "]") {
+				return nil, false
+			}
+			indices = strings.Split(segment[bracket+1:len(segment)-1], "][")
+		}
+		if key != "" {
+			obj, isObj := doc.(map[string]interface{})
+			if !isObj {
+				return nil, false
+			}
+			var exists bool
+			if doc, exists = obj[key]; !exists {
+				return nil, false
+			}
+		}
+		for _, indexStr := range indices {
+			array, isArray := doc.([]interface{})
+			index, err := strconv.Atoi(indexStr)
+			if !isArray || err != nil || index < 0 || index >= len(array) {
+				return nil, false
+			}
+			doc = array[index]
+		}
+	}
+	return doc, true
+}
+
+// SelectJSONString returns the value found by SelectJSONValue in text form, or an empty string if it is not found.
+func SelectJSONString(doc interface{}, path string) string {
+	if path == "" {
+		return ""
+	}
+	val, found := SelectJSONValue(doc, path)
+	if !found || val == nil {
+		return ""
+	}
+	switch v := val.(type) {
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	serialised, _ := json.Marshal(val)
+	return string(serialised)
+}
+
+// WebhookReply is the data given to response template.
+type WebhookReply struct {
+	Output string // Output is the command execution result after all result filters.
+	Sender string // Sender is the message sender selected from incoming request.
+}
+
+/*
+HandleWebhook runs toolbox commands that arrive from a chat platform's outgoing webhook, such as that of Slack,
+Mattermost, Discord, Rocket.Chat, and Matrix bridges. The incoming request is authenticated by its HMAC signature or a
+token in its content, message text and sender are picked from the content via JSONPath-like selectors, and the command
+result is rendered by a template into the HTTP response or a request sent to a callback URL.
+*/
+type HandleWebhook struct {
+	SigningSecret         string `json:"SigningSecret"`         // SigningSecret is the HMAC key of request signature.
+	SignatureHeader       string `json:"SignatureHeader"`       // SignatureHeader is the request header that carries the signature, e.g. "X-Slack-Signature".
+	SignatureAlgorithm    string `json:"SignatureAlgorithm"`    // SignatureAlgorithm is one of "hmac-sha1", "hmac-sha256" (default), and "hmac-sha512".
+	SignatureEncoding     string `json:"SignatureEncoding"`     // SignatureEncoding is either "hex" (default) or "base64".
+	SignaturePrefix       string `json:"SignaturePrefix"`       // SignaturePrefix precedes the encoded signature in header value, e.g. "v0=".
+	SignedContentTemplate string `json:"SignedContentTemplate"` // SignedContentTemplate composes the signed content from "{timestamp}" and "{body}", default is "{body}".
+	TimestampHeader       string `json:"TimestampHeader"`       // TimestampHeader carries the unix time of request, e.g. "X-Slack-Request-Timestamp".
+	MaxClockSkewSec       int    `json:"MaxClockSkewSec"`       // MaxClockSkewSec is the maximum difference between request timestamp and clock.
+
+	Token         string `json:"Token"`         // Token authenticates requests whose content carries it, e.g. Mattermost outgoing webhook token.
+	TokenSelector string `json:"TokenSelector"` // TokenSelector locates the token in request content.
+
+	TextSelector        string   `json:"TextSelector"`        // TextSelector locates the message text (toolbox command) in request content.
+	SenderSelector      string   `json:"SenderSelector"`      // SenderSelector locates the sender who is tracked as the command client.
+	ChallengeSelector   string   `json:"ChallengeSelector"`   // ChallengeSelector locates the URL verification challenge that is echoed back.
+	CommandTimeoutSec   int      `json:"CommandTimeoutSec"`   // CommandTimeoutSec is the timeout of command execution.
+	ResponseTemplate    string   `json:"ResponseTemplate"`    // ResponseTemplate renders the command result, its data is WebhookReply.
+	ResponseContentType string   `json:"ResponseContentType"` // ResponseContentType is the content type of rendered response, default is "application/json".
+	CallbackURL         string   `json:"CallbackURL"`         // CallbackURL receives the rendered response instead of the HTTP response, e.g. an incoming webhook.
+	CallbackURLSelector string   `json:"CallbackURLSelector"` // CallbackURLSelector locates the callback URL in request content, e.g. Slack "response_url".
+	CallbackHosts       []string `json:"CallbackHosts"`       // CallbackHosts are the only host names that a callback URL from request content may point to, e.g. "hooks.slack.com".
+
+	hashFunc         func() hash.Hash
+	responseTemplate *template.Template
+}
+
+// initialise checks configuration and sets default parameters.
+func (hook *HandleWebhook) initialise() error {
+	if hook.SigningSecret == "" && hook.Token == "" {
+		return errors.New("HandleWebhook.MakeHandler: either SigningSecret or Token must be configured")
+	}
+	if hook.SigningSecret != "" {
+		if hook.SignatureHeader == "" {
+			return errors.New("HandleWebhook.MakeHandler: SignatureHeader must not be empty")
+		}
+		if hook.SignatureAlgorithm == "" {
+			hook.SignatureAlgorithm = "hmac-sha256"
+		}
+		if hook.hashFunc = webhookHashFunctions[strings.ToLower(hook.SignatureAlgorithm)]; hook.hashFunc == nil {
+			return fmt.Errorf("HandleWebhook.MakeHandler: unsupported SignatureAlgorithm \"%s\"", hook.SignatureAlgorithm)
+		}
+		if hook.SignatureEncoding == "" {
+			hook.SignatureEncoding = "hex"
+		}
+		if hook.SignatureEncoding != "hex" && hook.SignatureEncoding != "base64" {
+			return fmt.Errorf("HandleWebhook.MakeHandler: unsupported SignatureEncoding \"%s\"", hook.SignatureEncoding)
+		}
+		if hook.SignedContentTemplate == "" {
+			hook.SignedContentTemplate = "{body}"
+		}
+		if strings.Contains(hook.SignedContentTemplate, "{timestamp}") && hook.TimestampHeader == "" {
+			return errors.New("HandleWebhook.MakeHandler: TimestampHeader is required by SignedContentTemplate")
+		}
+	}
+	if hook.Token != "" && hook.TokenSelector == "" {
+		return errors.New("HandleWebhook.MakeHandler: TokenSelector must not be empty")
+	}
+	if hook.TextSelector == "" {
+		return errors.New("HandleWebhook.MakeHandler: TextSelector must not be empty")
+	}
+	if hook.CallbackURLSelector != "" && len(hook.CallbackHosts) == 0 {
+		return errors.New("HandleWebhook.MakeHandler: CallbackHosts must not be empty when CallbackURLSelector is used")
+	}
+	if hook.MaxClockSkewSec < 1 {
+		hook.MaxClockSkewSec = WebhookDefaultMaxClockSkewSec
+	}
+	if hook.CommandTimeoutSec < 1 {
+		hook.CommandTimeoutSec = WebhookDefaultTimeoutSec
+	}
+	if hook.ResponseTemplate == "" {
+		hook.ResponseTemplate = WebhookDefaultResponseTemplate
+	}
+	if hook.ResponseContentType == "" {
+		hook.ResponseContentType = "application/json"
+	}
+	var err error
+	hook.responseTemplate, err = template.New("response").Funcs(template.FuncMap{
+		"json": func(in string) (string, error) {
+			out, err := json.Marshal(in)
+			return string(out), err
+		},
+	}).Parse(hook.ResponseTemplate)
+	if err != nil {
+		return fmt.Errorf("HandleWebhook.MakeHandler: failed to parse ResponseTemplate - %v", err)
+	}
+	return nil
+}
+
+// verifySignature returns true only if the request carries a recent timestamp (if required) and valid signature.
+func (hook *HandleWebhook) verifySignature(r *http.Request, body []byte) bool {
+	timestamp := ""
+	if hook.TimestampHeader != "" {
+		timestamp = r.Header.Get(hook.TimestampHeader)
+		unixSec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return false
+		}
+		if skew := time.Now().Unix() - unixSec; skew > int64(hook.MaxClockSkewSec) || skew < -int64(hook.MaxClockSkewSec) {
+			return false
+		}
+	}
+	// Substitute timestamp first, so that body content cannot influence the substitution.
+	signedContent := strings.Replace(hook.SignedContentTemplate, "{timestamp}", timestamp, -1)
+	bodyAt := strings.Index(signedContent, "{body}")
+	mac := hmac.New(hook.hashFunc, []byte(hook.SigningSecret))
+	if bodyAt == -1 {
+		mac.Write([]byte(signedContent))
+	} else {
+		mac.Write([]byte(signedContent[:bodyAt]))
+		mac.Write(body)
+		mac.Write([]byte(signedContent[bodyAt+len("{body}"):]))
+	}
+	var expected string
+	if hook.SignatureEncoding == "base64" {
+		expected = hook.SignaturePrefix + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	} else {
+		expected = hook.SignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+	}
+	return hmac.Equal([]byte(strings.TrimSpace(r.Header.Get(hook.SignatureHeader))), []byte(expected))
+}
+
+/*
+isCallbackAllowed returns true only if the callback URL uses HTTP or HTTPS and points to one of the configured callback
+hosts. The callback URL comes from request content, hence it must not lead the server to arbitrary destinations.
+*/
+func (hook *HandleWebhook) isCallbackAllowed(callbackURL string) bool {
+	parsed, err := url.Parse(callbackURL)
+	if err != nil || parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return false
+	}
+	for _, host := range hook.CallbackHosts {
+		if strings.EqualFold(parsed.Hostname(), strings.TrimSpace(host)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWebhookContent decodes the request body in JSON or URL-encoded form into a JSON document.
+func parseWebhookContent(r *http.Request, body []byte) (interface{}, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		doc := make(map[string]interface{})
+		for key, val := range values {
+			doc[key] = val[0]
+			// Slack delivers interactive payloads in JSON under form field "payload"
+			var nested interface{}
+			if key == "payload" && json.Unmarshal([]byte(val[0]), &nested) == nil {
+				doc[key] = nested
+			}
+		}
+		return doc, nil
+	}
+	var doc interface{}
+	err := json.Unmarshal(body, &doc)
+	return doc, err
+}
+
+func (hook *HandleWebhook) MakeHandler(logger misc.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	if err := hook.initialise(); err != nil {
+		return nil, err
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		NoCache(w)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, WebhookMaxRequestSize))
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		clientIP := GetRealClientIP(r)
+		if hook.SigningSecret != "" && !hook.verifySignature(r, body) {
+			logger.Warningf("HandleWebhook", clientIP, nil, "request signature is invalid")
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		doc, err := parseWebhookContent(r, body)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		if hook.Token != "" && subtle.ConstantTimeCompare([]byte(SelectJSONString(doc, hook.TokenSelector)), []byte(hook.Token)) != 1 {
+			logger.Warningf("HandleWebhook", clientIP, nil, "request token is invalid")
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		// Chat platforms verify the endpoint by expecting the challenge in response
+		if challenge := SelectJSONString(doc, hook.ChallengeSelector); challenge != "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(challenge))
+			return
+		}
+		// Chat platforms may deliver events that do not carry a message, just ignore them.
+		text := SelectJSONString(doc, hook.TextSelector)
+		if strings.TrimSpace(text) == "" {
+			return
+		}
+		sender := SelectJSONString(doc, hook.SenderSelector)
+		clientID := sender
+		if clientID == "" {
+			clientID = clientIP
+		}
+		callbackURL := hook.CallbackURL
+		if selected := SelectJSONString(doc, hook.CallbackURLSelector); selected != "" {
+			if !hook.isCallbackAllowed(selected) {
+				logger.Warningf("HandleWebhook", clientID, nil, "callback URL \"%s\" is not among the allowed hosts", selected)
+				http.Error(w, "", http.StatusForbidden)
+				return
+			}
+			callbackURL = selected
+		}
+		process := func() (string, error) {
+			result := cmdProc.Process(toolbox.Command{
+				TimeoutSec: hook.CommandTimeoutSec,
+				Content:    text,
+				DaemonName: "webhook",
+				ClientID:   clientID,
+			})
+			var reply bytes.Buffer
+			err := hook.responseTemplate.Execute(&reply, WebhookReply{Output: result.CombinedOutput, Sender: sender})
+			return reply.String(), err
+		}
+		if callbackURL == "" {
+			reply, err := process()
+			if err != nil {
+				logger.Warningf("HandleWebhook", clientID, err, "failed to render response")
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", hook.ResponseContentType)
+			w.Write([]byte(reply))
+			return
+		}
+		// Acknowledge the request right away, the command may take longer than chat platform is willing to wait.
+		go func() {
+			reply, err := process()
+			if err != nil {
+				logger.Warningf("HandleWebhook", clientID, err, "failed to render response")
+				return
+			}
+			resp, err := inet.DoHTTP(inet.HTTPRequest{
+				Method:      http.MethodPost,
+				ContentType: hook.ResponseContentType,
+				TimeoutSec:  WebhookCallbackTimeoutSec,
+				Body:        strings.NewReader(reply),
+			}, strings.Replace(callbackURL, "%", "%%", -1))
+			if err == nil {
+				err = resp.Non2xxToError()
+			}
+			if err != nil {
+				logger.Warningf("HandleWebhook", clientID, err, "failed to send response to callback URL")
+			}
+		}()
+	}
+	return fun, nil
+}
+
+func (_ *HandleWebhook) GetRateLimitFactor() int {
+	return 1
+}
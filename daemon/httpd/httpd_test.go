@@ -1,14 +1,21 @@
 package httpd
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
 	"github.com/HouzuoGuo/laitos/daemon/httpd/api"
 	"github.com/HouzuoGuo/laitos/inet"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -61,6 +68,19 @@ func TestHTTPD_StartAndBlock(t *testing.T) {
 	daemon.Processor = common.GetTestCommandProcessor()
 	daemon.SpecialHandlers["/info"] = &api.HandleSystemInfo{FeaturesToCheck: daemon.Processor.Features}
 	daemon.SpecialHandlers["/cmd_form"] = &api.HandleCommandForm{}
+	daemon.SpecialHandlers["/cmd_api"] = &api.HandleCommandAPI{BearerToken: "verysecret-api-token", HMACSecret: "verysecret-api-hmac"}
+	dnsDaemon := &dnsd.Daemon{
+		Address:              "127.0.0.1",
+		TCPPort:              1024 + rand.Intn(65535-1024),
+		TCPForwarder:         []string{"8.8.8.8:53", "8.8.4.4:53"},
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127."},
+	}
+	if err := dnsDaemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.SpecialHandlers["/dns_query"] = &api.HandleDNSOverHTTPS{DNSDaemon: dnsDaemon}
+	daemon.SpecialHandlers["/dns_log"] = &api.HandleDNSQueryLog{}
 	daemon.SpecialHandlers["/gitlab"] = &api.HandleGitlabBrowser{PrivateToken: "token-does-not-matter-in-this-test"}
 	daemon.SpecialHandlers["/html"] = &api.HandleHTMLDocument{HTMLFilePath: indexFile}
 	daemon.SpecialHandlers["/mail_me"] = &api.HandleMailMe{
@@ -76,6 +96,23 @@ func TestHTTPD_StartAndBlock(t *testing.T) {
 		ClientAppSecret: "dummy secret",
 	}
 	daemon.SpecialHandlers["/proxy"] = &api.HandleWebProxy{MyEndpoint: "/proxy"}
+	daemon.SpecialHandlers["/webhook"] = &api.HandleWebhook{
+		SigningSecret:         "verysecret-webhook",
+		SignatureHeader:       "X-Signature",
+		SignaturePrefix:       "v0=",
+		SignedContentTemplate: "v0:{timestamp}:{body}",
+		TimestampHeader:       "X-Timestamp",
+		TextSelector:          "$.event.text",
+		SenderSelector:        "$.event.user",
+		ChallengeSelector:     "challenge",
+	}
+	daemon.SpecialHandlers["/webhook_token"] = &api.HandleWebhook{
+		Token:            "verysecret-webhook-token",
+		TokenSelector:    "token",
+		TextSelector:     "text",
+		SenderSelector:   "user_name",
+		ResponseTemplate: `{"content": {{json .Output}}, "to": {{json .Sender}}}`,
+	}
 	daemon.SpecialHandlers["/sms"] = &api.HandleTwilioSMSHook{}
 	daemon.SpecialHandlers["/call_greeting"] = &api.HandleTwilioCallHook{CallGreeting: "Hi there", CallbackEndpoint: "/test"}
 	daemon.SpecialHandlers["/call_command"] = &api.HandleTwilioCallCallback{MyEndpoint: "/endpoint-does-not-matter-in-this-test"}
@@ -108,3 +145,217 @@ func TestHTTPD_StartAndBlock(t *testing.T) {
 	daemon.Stop()
 	daemon.Stop()
 }
+
+func TestHTTPD_VirtualHosts(t *testing.T) {
+	// Backend "app" echoes request details and answers WebSocket with an echo server
+	appBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nX-Path: " + r.URL.Path + "\r\n\r\n")
+			buf.Flush()
+			for {
+				line, err := buf.ReadString('\n')
+				if err != nil {
+					return
+				}
+				buf.WriteString("echo " + line)
+				buf.Flush()
+			}
+		}
+		w.Header().Set("X-Powered-By", "app")
+		fmt.Fprintf(w, "app %s %s host=%s fwd-host=%s proto=%s secret=%s cookie=%s",
+			r.Method, r.URL.RequestURI(), r.Host, r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Proto"),
+			r.Header.Get("X-App-Secret"), r.Header.Get("Cookie"))
+	}))
+	defer appBackend.Close()
+	// Backends "blue" and "green" serve the same site, their health is controlled by test case.
+	var blueUnhealthy, greenUnhealthy int32
+	newColourBackend := func(colour string, unhealthy *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" && atomic.LoadInt32(unhealthy) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(colour))
+		}))
+	}
+	blueBackend := newColourBackend("blue", &blueUnhealthy)
+	defer blueBackend.Close()
+	greenBackend := newColourBackend("green", &greenUnhealthy)
+	defer greenBackend.Close()
+
+	daemon := Daemon{
+		Address:       "127.0.0.1",
+		Port:          1024 + rand.Intn(65535-1024),
+		BaseRateLimit: 10,
+		SpecialHandlers: map[string]api.HandlerFactory{
+			"/": &api.HandleHTMLDocument{HTMLFilePath: "/dev/null"},
+		},
+		VirtualHosts: []VirtualHost{
+			{Hosts: []string{"app.example.com"}, Backends: []string{"not a url"}},
+		},
+	}
+	// Must not initialise with malformed virtual hosts
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "malformed") {
+		t.Fatal(err)
+	}
+	daemon.VirtualHosts = []VirtualHost{{Hosts: []string{"app.example.com"}}}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "backend") {
+		t.Fatal(err)
+	}
+	daemon.VirtualHosts = []VirtualHost{
+		{Hosts: []string{"app.example.com"}, Backends: []string{appBackend.URL}},
+		{Hosts: []string{"APP.example.com."}, PathPrefix: "/", Backends: []string{appBackend.URL}},
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "duplicated") {
+		t.Fatal(err)
+	}
+	daemon.VirtualHosts = []VirtualHost{
+		{
+			Hosts:                 []string{"app.example.com", "*.app.example.com"},
+			Backends:              []string{appBackend.URL},
+			SetRequestHeaders:     map[string]string{"X-App-Secret": "very-secret"},
+			RemoveRequestHeaders:  []string{"Cookie"},
+			SetResponseHeaders:    map[string]string{"Strict-Transport-Security": "max-age=31536000"},
+			RemoveResponseHeaders: []string{"X-Powered-By"},
+		},
+		{
+			Hosts:           []string{"app.example.com"},
+			PathPrefix:      "/api/",
+			Backends:        []string{appBackend.URL + "/v2?key=1"},
+			StripPathPrefix: true,
+			PreserveHost:    true,
+			RateLimit:       3,
+		},
+		{
+			PathPrefix:             "/site",
+			Backends:               []string{blueBackend.URL, greenBackend.URL},
+			HealthCheckPath:        "/health",
+			HealthCheckIntervalSec: 1,
+		},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	var stoppedNormally bool
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+		stoppedNormally = true
+	}()
+	time.Sleep(2 * time.Second)
+	addr := fmt.Sprintf("http://%s:%d", daemon.Address, daemon.Port)
+	get := func(host, path string) (inet.HTTPResponse, error) {
+		return inet.DoHTTP(inet.HTTPRequest{
+			Header: map[string][]string{"Cookie": {"session=1"}},
+			RequestFunc: func(req *http.Request) error {
+				req.Host = host
+				return nil
+			},
+		}, addr+path)
+	}
+
+	// Requests that do not match a virtual host are served by laitos itself
+	if resp, err := get("laitos.example.com", "/"); err != nil || resp.StatusCode != http.StatusOK || len(resp.Body) != 0 {
+		t.Fatal(err, resp.StatusCode, string(resp.Body))
+	}
+	// Match host name and rewrite headers
+	resp, err := get("App.Example.com:443", "/hello?a=b")
+	if err != nil || resp.StatusCode != http.StatusOK ||
+		string(resp.Body) != "app GET /hello?a=b host="+appBackend.Listener.Addr().String()+" fwd-host=App.Example.com:443 proto=http secret=very-secret cookie=" ||
+		resp.Header.Get("X-Powered-By") != "" || resp.Header.Get("Strict-Transport-Security") != "max-age=31536000" {
+		t.Fatal(err, resp.StatusCode, string(resp.Body), resp.Header)
+	}
+	// Wildcard host name
+	if resp, err := get("www.app.example.com", "/"); err != nil || !strings.HasPrefix(string(resp.Body), "app GET / ") {
+		t.Fatal(err, string(resp.Body))
+	}
+	if resp, err := get("evilapp.example.com", "/"); err != nil || strings.HasPrefix(string(resp.Body), "app") {
+		t.Fatal(err, string(resp.Body))
+	}
+	// Longer path prefix wins, the prefix is stripped and backend path is joined
+	if resp, err := get("app.example.com", "/api/users"); err != nil || !strings.HasPrefix(string(resp.Body), "app GET /v2/users?key=1 host=app.example.com ") {
+		t.Fatal(err, string(resp.Body))
+	}
+	if resp, err := get("app.example.com", "/apiary"); err != nil || !strings.HasPrefix(string(resp.Body), "app GET /apiary ") {
+		t.Fatal(err, string(resp.Body))
+	}
+	// Per-route rate limit, the route has been visited once already.
+	for i := 0; i < 2; i++ {
+		if resp, err := get("app.example.com", "/api"); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal(i, err, resp.StatusCode)
+		}
+	}
+	if resp, err := get("app.example.com", "/api"); err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal(err, resp.StatusCode)
+	}
+	// Other routes are not affected by the rate limit
+	if resp, err := get("app.example.com", "/"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal(err, resp.StatusCode)
+	}
+
+	// WebSocket upgrade passthrough
+	conn, err := net.Dial("tcp", net.JoinHostPort(daemon.Address, strconv.Itoa(daemon.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("GET /chat HTTP/1.1\r\nHost: app.example.com\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n\r\n"))
+	connReader := bufio.NewReader(conn)
+	wsResp, err := http.ReadResponse(connReader, nil)
+	if err != nil || wsResp.StatusCode != http.StatusSwitchingProtocols || wsResp.Header.Get("X-Path") != "/chat" ||
+		wsResp.Header.Get("Strict-Transport-Security") == "" {
+		t.Fatal(err, wsResp)
+	}
+	for _, msg := range []string{"hello\n", "world\n"} {
+		conn.Write([]byte(msg))
+		if echo, err := connReader.ReadString('\n'); err != nil || echo != "echo "+msg {
+			t.Fatal(err, echo)
+		}
+	}
+	conn.Close()
+
+	// Requests are spread across healthy backends
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		resp, err := get("anything.example.com", "/site/index.html")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal(err, resp.StatusCode)
+		}
+		seen[string(resp.Body)] = true
+	}
+	if !seen["blue"] || !seen["green"] {
+		t.Fatal(seen)
+	}
+	// Unhealthy backend is skipped
+	atomic.StoreInt32(&blueUnhealthy, 1)
+	time.Sleep(2 * time.Second)
+	for i := 0; i < 4; i++ {
+		if resp, err := get("anything.example.com", "/site"); err != nil || string(resp.Body) != "green" {
+			t.Fatal(err, string(resp.Body))
+		}
+	}
+	// No healthy backend left
+	atomic.StoreInt32(&greenUnhealthy, 1)
+	time.Sleep(2 * time.Second)
+	if resp, err := get("anything.example.com", "/site"); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal(err, resp.StatusCode)
+	}
+	// Recovered backend is used again
+	atomic.StoreInt32(&blueUnhealthy, 0)
+	time.Sleep(2 * time.Second)
+	if resp, err := get("anything.example.com", "/site"); err != nil || string(resp.Body) != "blue" {
+		t.Fatal(err, string(resp.Body))
+	}
+
+	daemon.Stop()
+	time.Sleep(1 * time.Second)
+	if !stoppedNormally {
+		t.Fatal("did not stop")
+	}
+}
@@ -0,0 +1,443 @@
+package httpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/misc"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	VirtualHostRateLimitFactor               = 10 // VirtualHostRateLimitFactor is the default rate limit of a virtual host, multiplied by BaseRateLimit.
+	VirtualHostDefaultHealthCheckIntervalSec = 10 // VirtualHostDefaultHealthCheckIntervalSec is the default interval between health checks of a backend.
+	VirtualHostHealthCheckTimeoutSec         = 5  // VirtualHostHealthCheckTimeoutSec is the timeout of each health check request.
+	VirtualHostDialTimeoutSec                = 10 // VirtualHostDialTimeoutSec is the timeout of connecting to backend for a WebSocket.
+)
+
+/*
+VirtualHost reverse-proxies requests that match host name and URL path prefix to backend servers. Requests are spread
+across backends in turn, and backends that fail health check are skipped until they recover.
+*/
+type VirtualHost struct {
+	Hosts                  []string          `json:"Hosts"`                  // Host names to match, "*.example.com" matches all of its sub-domains. Empty matches all host names.
+	PathPrefix             string            `json:"PathPrefix"`             // URL path prefix to match, default is "/".
+	Backends               []string          `json:"Backends"`               // Base URLs of backend servers, e.g. "http://127.0.0.1:8080".
+	StripPathPrefix        bool              `json:"StripPathPrefix"`        // Remove path prefix from URL path before handing request to backend
+	PreserveHost           bool              `json:"PreserveHost"`           // Hand the original Host header to backend instead of the backend's host name
+	SetRequestHeaders      map[string]string `json:"SetRequestHeaders"`      // Set these headers in request to backend
+	RemoveRequestHeaders   []string          `json:"RemoveRequestHeaders"`   // Remove these headers from request to backend
+	SetResponseHeaders     map[string]string `json:"SetResponseHeaders"`     // Set these headers in response to client
+	RemoveResponseHeaders  []string          `json:"RemoveResponseHeaders"`  // Remove these headers from response to client
+	RateLimit              int               `json:"RateLimit"`              // How many times in 10 seconds interval an IP may visit, default is 10 times BaseRateLimit.
+	HealthCheckPath        string            `json:"HealthCheckPath"`        // (Optional) Backend URL path to visit periodically, a backend is healthy if it responds with 2xx or 3xx.
+	HealthCheckIntervalSec int               `json:"HealthCheckIntervalSec"` // Interval between health checks, default is 10 seconds.
+}
+
+// virtualHostBackend is a backend server of virtual host and its health.
+type virtualHostBackend struct {
+	url       *url.URL
+	proxy     *httputil.ReverseProxy
+	unhealthy int32 // unhealthy is 1 if the latest health check failed, it is accessed atomically.
+}
+
+// virtualHostRoute is an initialised virtual host that routes requests to its backends.
+type virtualHostRoute struct {
+	VirtualHost
+	name        string // name identifies the virtual host in log messages and among rate limits.
+	backends    []*virtualHostBackend
+	nextBackend uint32 // nextBackend counts requests to pick backends in turn, it is accessed atomically.
+	handler     http.HandlerFunc
+	logger      misc.Logger
+}
+
+// matchHost returns 0 if host name is not matched, otherwise the higher the return value the more specific the match is.
+func (route *virtualHostRoute) matchHost(host string) int {
+	if len(route.Hosts) == 0 {
+		return 1
+	}
+	best := 0
+	for _, pattern := range route.Hosts {
+		if pattern == host {
+			return 3
+		} else if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			best = 2
+		}
+	}
+	return best
+}
+
+// matchPath returns true only if the URL path is the path prefix itself or underneath it.
+func (route *virtualHostRoute) matchPath(urlPath string) bool {
+	return route.PathPrefix == "/" || urlPath == route.PathPrefix || strings.HasPrefix(urlPath, route.PathPrefix+"/")
+}
+
+// pickBackend returns the next healthy backend, or nil if none of them is healthy.
+func (route *virtualHostRoute) pickBackend() *virtualHostBackend {
+	start := int(atomic.AddUint32(&route.nextBackend, 1) % uint32(len(route.backends)))
+	for i := 0; i < len(route.backends); i++ {
+		backend := route.backends[(start+i)%len(route.backends)]
+		if atomic.LoadInt32(&backend.unhealthy) == 0 {
+			return backend
+		}
+	}
+	return nil
+}
+
+// rewriteRequest points the request at backend and rewrites its path and headers according to configuration.
+func (route *virtualHostRoute) rewriteRequest(r *http.Request, backend *virtualHostBackend) {
+	originalHost := r.Host
+	urlPath := r.URL.Path
+	if route.StripPathPrefix && route.PathPrefix != "/" {
+		urlPath = strings.TrimPrefix(urlPath, route.PathPrefix)
+		if !strings.HasPrefix(urlPath, "/") {
+			urlPath = "/" + urlPath
+		}
+	}
+	r.URL.Scheme = backend.url.Scheme
+	r.URL.Host = backend.url.Host
+	r.URL.Path = strings.TrimSuffix(backend.url.Path, "/") + urlPath
+	r.URL.RawPath = ""
+	if backend.url.RawQuery != "" {
+		if r.URL.RawQuery == "" {
+			r.URL.RawQuery = backend.url.RawQuery
+		} else {
+			r.URL.RawQuery = backend.url.RawQuery + "&" + r.URL.RawQuery
+		}
+	}
+	if !route.PreserveHost {
+		r.Host = backend.url.Host
+	}
+	r.Header.Set("X-Forwarded-Host", originalHost)
+	if r.TLS == nil {
+		r.Header.Set("X-Forwarded-Proto", "http")
+	} else {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
+	for _, name := range route.RemoveRequestHeaders {
+		r.Header.Del(name)
+	}
+	for name, value := range route.SetRequestHeaders {
+		r.Header.Set(name, value)
+	}
+}
+
+// rewriteResponseHeader removes and sets response headers according to configuration.
+func (route *virtualHostRoute) rewriteResponseHeader(header http.Header) {
+	for _, name := range route.RemoveResponseHeaders {
+		header.Del(name)
+	}
+	for name, value := range route.SetResponseHeaders {
+		header.Set(name, value)
+	}
+}
+
+// serveHTTP hands the request to a healthy backend and relays its response.
+func (route *virtualHostRoute) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	backend := route.pickBackend()
+	if backend == nil {
+		http.Error(w, "no healthy backend", http.StatusServiceUnavailable)
+		return
+	}
+	if isWebSocketUpgrade(r) {
+		route.serveWebSocket(w, r, backend)
+		return
+	}
+	backend.proxy.ServeHTTP(w, r)
+}
+
+// isWebSocketUpgrade returns true only if the request asks to switch protocol to WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+serveWebSocket relays the WebSocket handshake to backend, and then copies data between client and backend until either
+of them closes the connection. IO timeout of HTTP daemon does not apply to an established WebSocket.
+*/
+func (route *virtualHostRoute) serveWebSocket(w http.ResponseWriter, r *http.Request, backend *virtualHostBackend) {
+	clientIP := r.RemoteAddr[:strings.LastIndexByte(r.RemoteAddr, ':')]
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket is not supported", http.StatusInternalServerError)
+		return
+	}
+	// Prepare handshake request to backend
+	outReq := new(http.Request)
+	*outReq = *r
+	outURL := *r.URL
+	outReq.URL = &outURL
+	outReq.Header = make(http.Header, len(r.Header))
+	for name, values := range r.Header {
+		outReq.Header[name] = append([]string{}, values...)
+	}
+	route.rewriteRequest(outReq, backend)
+	if prior := outReq.Header.Get("X-Forwarded-For"); prior == "" {
+		outReq.Header.Set("X-Forwarded-For", clientIP)
+	} else {
+		outReq.Header.Set("X-Forwarded-For", prior+", "+clientIP)
+	}
+	// Connect to backend and carry out the handshake
+	backendAddr := backend.url.Host
+	if backend.url.Port() == "" {
+		if backend.url.Scheme == "https" {
+			backendAddr = net.JoinHostPort(backend.url.Hostname(), "443")
+		} else {
+			backendAddr = net.JoinHostPort(backend.url.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{Timeout: VirtualHostDialTimeoutSec * time.Second}
+	var backendConn net.Conn
+	var err error
+	if backend.url.Scheme == "https" {
+		backendConn, err = tls.DialWithDialer(dialer, "tcp", backendAddr, &tls.Config{ServerName: backend.url.Hostname()})
+	} else {
+		backendConn, err = dialer.Dial("tcp", backendAddr)
+	}
+	if err != nil {
+		route.logger.Warningf("serveWebSocket", clientIP, err, "failed to connect to backend %s", backend.url.Host)
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+	defer backendConn.Close()
+	backendConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	if err := outReq.Write(backendConn); err != nil {
+		route.logger.Warningf("serveWebSocket", clientIP, err, "failed to send handshake to backend %s", backend.url.Host)
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendReader, outReq)
+	if err != nil {
+		route.logger.Warningf("serveWebSocket", clientIP, err, "failed to read handshake response from backend %s", backend.url.Host)
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+	route.rewriteResponseHeader(resp.Header)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Backend declined the upgrade, relay its response as-is.
+		defer resp.Body.Close()
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		route.logger.Warningf("serveWebSocket", clientIP, err, "failed to take over client connection")
+		return
+	}
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Time{})
+	backendConn.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return
+	}
+	if err := resp.Header.Write(clientBuf); err != nil {
+		return
+	}
+	if _, err := clientBuf.WriteString("\r\n"); err != nil {
+		return
+	}
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+	// Copy data in both directions, the first direction to finish closes both connections.
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backendConn, clientBuf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(clientConn, backendReader)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// checkHealth visits health check path of each backend and remembers whether the backend is healthy.
+func (route *virtualHostRoute) checkHealth() {
+	for _, backend := range route.backends {
+		checkURL := strings.TrimSuffix(backend.url.Scheme+"://"+backend.url.Host+backend.url.Path, "/") + route.HealthCheckPath
+		resp, err := inet.DoHTTP(inet.HTTPRequest{TimeoutSec: VirtualHostHealthCheckTimeoutSec}, strings.Replace(checkURL, "%", "%%", -1))
+		var unhealthy int32
+		if err == nil && resp.StatusCode/100 != 2 && resp.StatusCode/100 != 3 {
+			err = fmt.Errorf("HTTP status %d", resp.StatusCode)
+		}
+		if err != nil {
+			unhealthy = 1
+		}
+		if previous := atomic.SwapInt32(&backend.unhealthy, unhealthy); previous != unhealthy {
+			if unhealthy == 1 {
+				route.logger.Warningf("checkHealth", route.name, err, "backend %s is now unhealthy", backend.url.Host)
+			} else {
+				route.logger.Printf("checkHealth", route.name, nil, "backend %s has recovered", backend.url.Host)
+			}
+		}
+	}
+}
+
+// runHealthCheck checks backend health periodically until the stop channel is closed.
+func (route *virtualHostRoute) runHealthCheck(stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(route.HealthCheckIntervalSec) * time.Second)
+	defer ticker.Stop()
+	for {
+		route.checkHealth()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// newVirtualHostRoute checks virtual host configuration and returns an initialised route.
+func (daemon *Daemon) newVirtualHostRoute(vhost VirtualHost) (*virtualHostRoute, error) {
+	route := &virtualHostRoute{VirtualHost: vhost, logger: daemon.logger}
+	// Host names and path prefix are normalised to make matching easier
+	route.Hosts = make([]string, 0, len(vhost.Hosts))
+	for _, host := range vhost.Hosts {
+		if host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), "."); host != "" {
+			route.Hosts = append(route.Hosts, host)
+		}
+	}
+	if !strings.HasPrefix(route.PathPrefix, "/") {
+		route.PathPrefix = "/" + route.PathPrefix
+	}
+	if route.PathPrefix != "/" {
+		route.PathPrefix = strings.TrimSuffix(route.PathPrefix, "/")
+	}
+	if len(route.Hosts) == 0 {
+		route.name = "*" + route.PathPrefix
+	} else {
+		route.name = strings.Join(route.Hosts, ",") + route.PathPrefix
+	}
+	if len(vhost.Backends) == 0 {
+		return nil, fmt.Errorf("httpd.Initialise: virtual host %s does not have a backend", route.name)
+	}
+	if route.RateLimit < 0 {
+		return nil, fmt.Errorf("httpd.Initialise: virtual host %s must not have a negative RateLimit", route.name)
+	} else if route.RateLimit == 0 {
+		route.RateLimit = VirtualHostRateLimitFactor * daemon.BaseRateLimit
+	}
+	if route.HealthCheckPath != "" && !strings.HasPrefix(route.HealthCheckPath, "/") {
+		return nil, fmt.Errorf("httpd.Initialise: HealthCheckPath of virtual host %s must begin with a slash", route.name)
+	}
+	if route.HealthCheckIntervalSec < 1 {
+		route.HealthCheckIntervalSec = VirtualHostDefaultHealthCheckIntervalSec
+	}
+	for _, backendURL := range vhost.Backends {
+		parsedURL, err := url.Parse(backendURL)
+		if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+			return nil, fmt.Errorf("httpd.Initialise: virtual host %s has a malformed backend URL \"%s\"", route.name, backendURL)
+		}
+		backend := &virtualHostBackend{url: parsedURL}
+		backend.proxy = &httputil.ReverseProxy{
+			Director: func(r *http.Request) {
+				route.rewriteRequest(r, backend)
+			},
+			ModifyResponse: func(resp *http.Response) error {
+				route.rewriteResponseHeader(resp.Header)
+				return nil
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				route.logger.Warningf("serveHTTP", route.name, err, "failed to proxy %s %s to backend %s", r.Method, r.URL.Path, backend.url.Host)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}
+		route.backends = append(route.backends, backend)
+	}
+	return route, nil
+}
+
+// findVirtualHost returns the virtual host that matches the request, or nil if there is none.
+func (daemon *Daemon) findVirtualHost(r *http.Request) *virtualHostRoute {
+	// ACME HTTP-01 challenge is always answered by laitos itself
+	if strings.HasPrefix(r.URL.Path, common.ACMEHTTPChallengePath) {
+		return nil
+	}
+	host := r.Host
+	if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+		host = hostOnly
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	// Prefer the more specific host name, and then the longer path prefix
+	var best *virtualHostRoute
+	bestHostMatch := 0
+	for _, route := range daemon.vhostRoutes {
+		hostMatch := route.matchHost(host)
+		if hostMatch == 0 || !route.matchPath(r.URL.Path) {
+			continue
+		}
+		if hostMatch > bestHostMatch || hostMatch == bestHostMatch && len(route.PathPrefix) > len(best.PathPrefix) {
+			best = route
+			bestHostMatch = hostMatch
+		}
+	}
+	return best
+}
+
+// initialiseVirtualHosts prepares virtual host routes and their rate limits.
+func (daemon *Daemon) initialiseVirtualHosts() error {
+	daemon.vhostRoutes = make([]*virtualHostRoute, 0, len(daemon.VirtualHosts))
+	for _, vhost := range daemon.VirtualHosts {
+		route, err := daemon.newVirtualHostRoute(vhost)
+		if err != nil {
+			return err
+		}
+		if _, exists := daemon.AllRateLimits[route.name]; exists {
+			return fmt.Errorf("httpd.Initialise: virtual host %s is duplicated", route.name)
+		}
+		rl := &misc.RateLimit{
+			UnitSecs: RateLimitIntervalSec,
+			MaxCount: route.RateLimit,
+			Logger:   daemon.logger,
+		}
+		daemon.AllRateLimits[route.name] = rl
+		route.handler = daemon.Middleware(rl, route.serveHTTP)
+		daemon.vhostRoutes = append(daemon.vhostRoutes, route)
+	}
+	return nil
+}
+
+// startHealthChecks begins checking health of virtual host backends in background.
+func (daemon *Daemon) startHealthChecks() {
+	for _, route := range daemon.vhostRoutes {
+		if route.HealthCheckPath != "" {
+			go route.runHealthCheck(daemon.stopHealthCheck)
+		}
+	}
+}
+
+// stopHealthChecks stops all background health checks once HTTP daemon stops serving.
+func (daemon *Daemon) stopHealthChecks() {
+	if daemon.stopHealthCheck == nil {
+		return
+	}
+	select {
+	case <-daemon.stopHealthCheck:
+	default:
+		close(daemon.stopHealthCheck)
+	}
+}
@@ -67,8 +67,12 @@ maintenance.go of maintenance package.
 func GetLatestStats() string {
 	numDecimals := 2
 	factor := 1000000000.0
+	dnsCacheHits, dnsCacheMisses := dnsd.GetCacheStats()
 	return fmt.Sprintf(`Web and bot commands: %s
 DNS server  TCP|UDP:  %s | %s
+DNS cache hit|miss:   %d | %d
+DNS black lists:      %s
+DNS forwarders:       %s
 Web servers:          %s
 Mail commands:        %s
 Text server TCP|UDP:  %s | %s
@@ -78,6 +82,9 @@ Telegram commands:    %s
 `,
 		common.DurationStats.Format(factor, numDecimals),
 		dnsd.TCPDurationStats.Format(factor, numDecimals), dnsd.UDPDurationStats.Format(factor, numDecimals),
+		dnsCacheHits, dnsCacheMisses,
+		dnsd.GetBlackListStats(),
+		dnsd.GetForwarderStats(),
 		api.DurationStats.Format(factor, numDecimals),
 		mailcmd.DurationStats.Format(factor, numDecimals),
 		plainsocket.TCPDurationStats.Format(factor, numDecimals), plainsocket.UDPDurationStats.Format(factor, numDecimals),
@@ -0,0 +1,145 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxLookAheadYears limits how far into the future the next run of a schedule is searched for.
+const MaxLookAheadYears = 5
+
+// ScheduleShortcuts are the descriptive schedule expressions and their equivalent five-field expressions.
+var ScheduleShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+/*
+Schedule is a parsed cron expression made of five fields - minute, hour, day of month, month, and day of week. Each
+field may be an asterisk, a number, a range (e.g. "1-5"), a stepped range (e.g. "0-30/10"), or a comma-separated list
+of them. Like in cron, if both day of month and day of week are restricted, a day matching either of them is eligible.
+*/
+type Schedule struct {
+	minutes, hours, daysOfMonth, months, daysOfWeek map[int]bool
+	anyDayOfMonth, anyDayOfWeek                     bool
+}
+
+// parseScheduleField returns the values matched by a field of cron expression, and whether the field is an asterisk.
+func parseScheduleField(field string, min, max int) (map[int]bool, bool, error) {
+	ret := make(map[int]bool)
+	for _, item := range strings.Split(field, ",") {
+		step, stepped := 1, false
+		if slash := strings.IndexRune(item, '/'); slash != -1 {
+			var err error
+			if step, err = strconv.Atoi(item[slash+1:]); err != nil || step < 1 {
+				return nil, false, fmt.Errorf("bad step in \"%s\"", item)
+			}
+			item = item[:slash]
+			stepped = true
+		}
+		from, to := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, false, fmt.Errorf("bad number in \"%s\"", item)
+			}
+			// Like in cron, a number followed by a step (e.g. "5/15") runs from the number through the maximum
+			if !stepped {
+				to = from
+			}
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, false, fmt.Errorf("bad range in \"%s\"", item)
+				}
+			}
+			if from < min || to > max || from > to {
+				return nil, false, fmt.Errorf("\"%s\" is not within %d-%d", item, min, max)
+			}
+		}
+		for i := from; i <= to; i += step {
+			ret[i] = true
+		}
+	}
+	return ret, field == "*", nil
+}
+
+// ParseSchedule parses a five-field cron expression or one of the ScheduleShortcuts.
+func ParseSchedule(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if equivalent, exists := ScheduleShortcuts[expr]; exists {
+		expr = equivalent
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("ParseSchedule: \"%s\" must have five fields - minute, hour, day of month, month, day of week", expr)
+	}
+	sched := &Schedule{}
+	var err error
+	if sched.minutes, _, err = parseScheduleField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("ParseSchedule: minute - %v", err)
+	}
+	if sched.hours, _, err = parseScheduleField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("ParseSchedule: hour - %v", err)
+	}
+	if sched.daysOfMonth, sched.anyDayOfMonth, err = parseScheduleField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("ParseSchedule: day of month - %v", err)
+	}
+	if sched.months, _, err = parseScheduleField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("ParseSchedule: month - %v", err)
+	}
+	// Both 0 and 7 stand for Sunday
+	if sched.daysOfWeek, sched.anyDayOfWeek, err = parseScheduleField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("ParseSchedule: day of week - %v", err)
+	}
+	if sched.daysOfWeek[7] {
+		sched.daysOfWeek[0] = true
+	}
+	return sched, nil
+}
+
+// matchDay returns true if the schedule runs on the day of the time.
+func (sched *Schedule) matchDay(t time.Time) bool {
+	domMatch := sched.daysOfMonth[t.Day()]
+	dowMatch := sched.daysOfWeek[int(t.Weekday())]
+	if sched.anyDayOfMonth || sched.anyDayOfWeek {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+/*
+Next returns the earliest time (at minute precision) strictly after the input time that matches the schedule, in the
+input time's location. If there is no such time in the next MaxLookAheadYears years (e.g. 30th of February), the zero
+time is returned.
+*/
+func (sched *Schedule) Next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(MaxLookAheadYears, 0, 0)
+	for t.Before(limit) {
+		if !sched.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !sched.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !sched.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !sched.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,50 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "@never"} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Fatal("should have failed", bad)
+		}
+	}
+	for _, good := range []string{"* * * * *", "0 7 * * 1-5", "*/15 0-6/2 1,15 1-12 7", "@daily"} {
+		if _, err := ParseSchedule(good); err != nil {
+			t.Fatal(good, err)
+		}
+	}
+}
+
+func TestSchedule_Next(t *testing.T) {
+	// 2018-01-01 is a Monday
+	from := time.Date(2018, 1, 1, 10, 30, 45, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2018, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2018, 1, 2, 10, 30, 0, 0, time.UTC)},
+		{"0 7 * * 1-5", time.Date(2018, 1, 2, 7, 0, 0, 0, time.UTC)},
+		{"0 7 * * 6", time.Date(2018, 1, 6, 7, 0, 0, 0, time.UTC)},
+		{"0 7 * * 7", time.Date(2018, 1, 7, 7, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2018, 1, 1, 10, 40, 0, 0, time.UTC)},
+		{"50/5 * * * *", time.Date(2018, 1, 1, 10, 50, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day of month or day of week
+		{"0 0 15 * 3", time.Date(2018, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, c := range cases {
+		sched, err := ParseSchedule(c.expr)
+		if err != nil {
+			t.Fatal(c.expr, err)
+		}
+		if next := sched.Next(from); !next.Equal(c.next) {
+			t.Fatal(c.expr, next)
+		}
+	}
+}
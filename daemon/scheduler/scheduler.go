@@ -0,0 +1,345 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/telegrambot"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	TickIntervalSec       = 20  // TickIntervalSec is the interval at which the daemon looks for jobs that are due to run.
+	MissedRunGraceSec     = 300 // MissedRunGraceSec is the delay after which a scheduled run is considered missed rather than late.
+	DefaultTimeoutSec     = 120 // DefaultTimeoutSec is the default timeout of each scheduled command.
+	DefaultHistorySize    = 10  // DefaultHistorySize is the default number of runs to remember for each job.
+	HistoryMaxOutputChars = 256 // HistoryMaxOutputChars is the maximum number of output characters to remember in each run.
+)
+
+/*
+Job is a toolbox command that runs on a schedule. The command result is delivered to mail recipients, telegram chats,
+and SMS recipients.
+*/
+type Job struct {
+	Name       string `json:"Name"`       // Name uniquely identifies the job.
+	Schedule   string `json:"Schedule"`   // Schedule is a five-field cron expression, e.g. "0 7 * * 1-5".
+	Command    string `json:"Command"`    // Command is the toolbox command to run, including PIN, e.g. "mypin.i 10 10".
+	TimeoutSec int    `json:"TimeoutSec"` // TimeoutSec is the timeout of the command.
+	/*
+		CatchUp determines whether the command should run as soon as possible if its scheduled run was missed, such
+		as when laitos was offline or the computer was asleep. Several missed runs result in only one catch-up run.
+	*/
+	CatchUp bool `json:"CatchUp"`
+
+	MailRecipients  []string `json:"MailRecipients"`  // MailRecipients are email addresses that receive the command result.
+	TelegramChatIDs []uint64 `json:"TelegramChatIDs"` // TelegramChatIDs are telegram chats that receive the command result.
+	SMSRecipients   []string `json:"SMSRecipients"`   // SMSRecipients are telephone numbers (e.g. "+4912345") that receive the command result.
+}
+
+// Run describes an occasion of a job that ran or was supposed to run.
+type Run struct {
+	Begin      time.Time `json:"Begin"`      // Begin is the moment the run began, or the moment the run was skipped.
+	DurationMS int64     `json:"DurationMS"` // DurationMS is the number of milliseconds spent in running the command and delivering its result.
+	CatchUp    bool      `json:"CatchUp"`    // CatchUp is true if the run makes up for a missed run.
+	Skipped    string    `json:"Skipped"`    // Skipped is the reason for not running the command, it is empty if the command ran.
+	Output     string    `json:"Output"`     // Output is the beginning of command result.
+	Error      string    `json:"Error"`      // Error describes failures in running the command or delivering its result.
+}
+
+// Return the run in a single line of text.
+func (run Run) String() string {
+	var status string
+	if run.Skipped != "" {
+		status = "skipped - " + run.Skipped
+	} else if run.Error != "" {
+		status = fmt.Sprintf("error \"%s\"", run.Error)
+	} else {
+		status = fmt.Sprintf("ok \"%s\"", run.Output)
+	}
+	if run.CatchUp {
+		status = "catch-up " + status
+	}
+	return fmt.Sprintf("%s in %dms %s", run.Begin.Format("2006-01-02 15:04:05"), run.DurationMS, status)
+}
+
+// JobState is the runtime state of a job, the exported fields are persisted in daemon's state file.
+type JobState struct {
+	LastRun time.Time `json:"LastRun"` // LastRun is the moment the job began to run for the last time.
+	History []Run     `json:"History"` // History contains recent runs of the job, latest run comes first.
+
+	job      Job
+	schedule *Schedule
+	nextRun  time.Time
+	running  bool
+}
+
+/*
+Daemon runs toolbox commands on their schedule using a command processor, and delivers the command results by mail,
+telegram chat, and SMS. A job does not run again while its previous run is still ongoing. If state file is configured,
+the time of last run and history of each job survive restart, which helps to catch up missed runs while laitos was
+offline.
+*/
+type Daemon struct {
+	Jobs          []Job  `json:"Jobs"`          // Jobs are the commands to run and their schedules.
+	StateFilePath string `json:"StateFilePath"` // StateFilePath is the location of file that remembers job history across restart.
+	HistorySize   int    `json:"HistorySize"`   // HistorySize is the number of recent runs to remember for each job.
+
+	Processor   *common.CommandProcessor `json:"-"` // Processor runs scheduled commands.
+	MailClient  inet.MailClient          `json:"-"` // MailClient delivers command results to mail recipients.
+	TelegramBot *telegrambot.Daemon      `json:"-"` // TelegramBot delivers command results to telegram chats using its authorization token.
+	SMS         *toolbox.Twilio          `json:"-"` // SMS delivers command results to telephone numbers.
+
+	states        map[string]*JobState
+	mutex         *sync.Mutex
+	loopIsRunning int32     // Value is 1 only when scheduler loop is running
+	stop          chan bool // Signal scheduler loop to stop
+	logger        misc.Logger
+}
+
+// Initialise validates job configuration, restores job history from state file, and calculates when jobs will run.
+func (daemon *Daemon) Initialise() error {
+	daemon.logger = misc.Logger{ComponentName: "scheduler", ComponentID: strconv.Itoa(len(daemon.Jobs))}
+	if daemon.Processor == nil || daemon.Processor.IsEmpty() {
+		return errors.New("scheduler.Initialise: command processor and its filters must be configured")
+	}
+	daemon.Processor.SetLogger(daemon.logger)
+	if len(daemon.Jobs) == 0 {
+		return errors.New("scheduler.Initialise: there must be at least one job")
+	}
+	if daemon.HistorySize < 1 {
+		daemon.HistorySize = DefaultHistorySize
+	}
+	daemon.states = make(map[string]*JobState)
+	daemon.mutex = new(sync.Mutex)
+	daemon.stop = make(chan bool)
+	for _, job := range daemon.Jobs {
+		if job.Name == "" || job.Command == "" {
+			return errors.New("scheduler.Initialise: each job must have a name and command")
+		}
+		if _, exists := daemon.states[job.Name]; exists {
+			return fmt.Errorf("scheduler.Initialise: job name \"%s\" is not unique", job.Name)
+		}
+		schedule, err := ParseSchedule(job.Schedule)
+		if err != nil {
+			return fmt.Errorf("scheduler.Initialise: job \"%s\" - %v", job.Name, err)
+		}
+		if len(job.MailRecipients) > 0 && !daemon.MailClient.IsConfigured() {
+			return fmt.Errorf("scheduler.Initialise: job \"%s\" needs mail client to be configured", job.Name)
+		}
+		if len(job.TelegramChatIDs) > 0 && (daemon.TelegramBot == nil || daemon.TelegramBot.AuthorizationToken == "") {
+			return fmt.Errorf("scheduler.Initialise: job \"%s\" needs telegram bot to be configured", job.Name)
+		}
+		if len(job.SMSRecipients) > 0 && (daemon.SMS == nil || !daemon.SMS.IsConfigured()) {
+			return fmt.Errorf("scheduler.Initialise: job \"%s\" needs Twilio to be configured", job.Name)
+		}
+		if job.TimeoutSec < 1 {
+			job.TimeoutSec = DefaultTimeoutSec
+		}
+		daemon.states[job.Name] = &JobState{job: job, schedule: schedule, History: []Run{}}
+	}
+	if err := daemon.loadState(); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, state := range daemon.states {
+		/*
+			A job that missed its run while laitos was offline is due immediately, the loop will then decide whether to
+			catch up or skip the missed run.
+		*/
+		if !state.LastRun.IsZero() {
+			if missed := state.schedule.Next(state.LastRun); !missed.IsZero() && missed.Before(now) {
+				state.nextRun = missed
+				continue
+			}
+		}
+		state.nextRun = state.schedule.Next(now)
+	}
+	return nil
+}
+
+// loadState restores time of last run and history of jobs from state file. Absent state file is not an error.
+func (daemon *Daemon) loadState() error {
+	if daemon.StateFilePath == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(daemon.StateFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("scheduler.loadState: failed to read state file - %v", err)
+	}
+	saved := make(map[string]*JobState)
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return fmt.Errorf("scheduler.loadState: failed to parse state file - %v", err)
+	}
+	// Jobs that are no longer configured are forgotten
+	for name, state := range daemon.states {
+		if savedState, exists := saved[name]; exists && savedState != nil {
+			state.LastRun = savedState.LastRun
+			if savedState.History != nil {
+				state.History = savedState.History
+			}
+		}
+	}
+	return nil
+}
+
+// saveState writes time of last run and history of all jobs into state file. Caller must hold the mutex.
+func (daemon *Daemon) saveState() {
+	if daemon.StateFilePath == "" {
+		return
+	}
+	content, err := json.Marshal(daemon.states)
+	if err != nil {
+		daemon.logger.Warningf("saveState", "", err, "failed to serialise job states")
+		return
+	}
+	if err := ioutil.WriteFile(daemon.StateFilePath, content, 0600); err != nil {
+		daemon.logger.Warningf("saveState", "", err, "failed to write state file")
+	}
+}
+
+// addHistory remembers a run of the job and discards the oldest runs beyond history size. Caller must hold the mutex.
+func (daemon *Daemon) addHistory(state *JobState, run Run) {
+	state.History = append([]Run{run}, state.History...)
+	if len(state.History) > daemon.HistorySize {
+		state.History = state.History[:daemon.HistorySize]
+	}
+	daemon.saveState()
+}
+
+/*
+runDueJobs starts jobs that are due to run at the moment. A job that is still running from previous occasion is skipped,
+so is a job that missed its run by more than MissedRunGraceSec seconds unless it should catch up. Jobs run in
+background, the function does not wait for them to finish.
+*/
+func (daemon *Daemon) runDueJobs(now time.Time) {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	for name, state := range daemon.states {
+		if state.nextRun.IsZero() || now.Before(state.nextRun) {
+			continue
+		}
+		isLate := now.Sub(state.nextRun) > MissedRunGraceSec*time.Second
+		state.nextRun = state.schedule.Next(now)
+		if state.running {
+			daemon.logger.Warningf("runDueJobs", name, nil, "skipped because previous run is still ongoing")
+			daemon.addHistory(state, Run{Begin: now, Skipped: "previous run is still ongoing"})
+			continue
+		}
+		if isLate && !state.job.CatchUp {
+			daemon.logger.Warningf("runDueJobs", name, nil, "skipped missed run")
+			daemon.addHistory(state, Run{Begin: now, Skipped: "missed run"})
+			continue
+		}
+		state.running = true
+		state.LastRun = now
+		go daemon.runJob(state, Run{Begin: now, CatchUp: isLate})
+	}
+}
+
+// runJob runs the job's command, delivers the result, and then records the run in job history.
+func (daemon *Daemon) runJob(state *JobState, run Run) {
+	job := state.job
+	beginTime := time.Now()
+	daemon.logger.Printf("runJob", job.Name, nil, "running scheduled command (catch-up %v)", run.CatchUp)
+	result := daemon.Processor.Process(toolbox.Command{
+		DaemonName: "scheduler",
+		ClientID:   job.Name,
+		TimeoutSec: job.TimeoutSec,
+		Content:    job.Command,
+	})
+	errs := make([]string, 0, 4)
+	if result.Error != nil {
+		errs = append(errs, result.Error.Error())
+	}
+	for _, err := range daemon.deliver(job, result.CombinedOutput) {
+		daemon.logger.Warningf("runJob", job.Name, err, "failed to deliver command result")
+		errs = append(errs, err.Error())
+	}
+	run.DurationMS = time.Since(beginTime).Nanoseconds() / 1000000
+	run.Error = strings.Join(errs, "; ")
+	run.Output = result.CombinedOutput
+	if len(run.Output) > HistoryMaxOutputChars {
+		// Do not cut a multi-byte character in half
+		cut := HistoryMaxOutputChars
+		for cut > 0 && !utf8.RuneStart(run.Output[cut]) {
+			cut--
+		}
+		run.Output = run.Output[:cut]
+	}
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	state.running = false
+	daemon.addHistory(state, run)
+}
+
+// deliver sends command result to all recipients of the job, and returns delivery errors.
+func (daemon *Daemon) deliver(job Job, text string) (errs []error) {
+	if len(job.MailRecipients) > 0 {
+		if err := daemon.MailClient.Send(inet.OutgoingMailSubjectKeyword+"-scheduler-"+job.Name, text, job.MailRecipients...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, chatID := range job.TelegramChatIDs {
+		if err := daemon.TelegramBot.ReplyTo(chatID, text); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, number := range job.SMSRecipients {
+		if result := daemon.SMS.SendSMS(toolbox.Command{TimeoutSec: job.TimeoutSec, Content: number + " " + text}); result.Error != nil {
+			errs = append(errs, fmt.Errorf("failed to send SMS to %s - %v", number, result.Error))
+		}
+	}
+	return
+}
+
+// GetHistory returns recent runs of the job (latest run comes first), or nil if the job does not exist.
+func (daemon *Daemon) GetHistory(jobName string) []Run {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	state, exists := daemon.states[jobName]
+	if !exists {
+		return nil
+	}
+	return append([]Run{}, state.History...)
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start scheduler loop and block caller until Stop function is called.
+*/
+func (daemon *Daemon) StartAndBlock() error {
+	atomic.StoreInt32(&daemon.loopIsRunning, 1)
+	for {
+		if misc.EmergencyLockDown {
+			atomic.StoreInt32(&daemon.loopIsRunning, 0)
+			return misc.ErrEmergencyLockDown
+		}
+		daemon.runDueJobs(time.Now())
+		select {
+		case <-daemon.stop:
+			atomic.StoreInt32(&daemon.loopIsRunning, 0)
+			return nil
+		case <-time.After(TickIntervalSec * time.Second):
+		}
+	}
+}
+
+// Stop previously started scheduler loop. Commands that are already running will carry on until they finish.
+func (daemon *Daemon) Stop() {
+	if atomic.CompareAndSwapInt32(&daemon.loopIsRunning, 1, 0) {
+		daemon.stop <- true
+	}
+}
@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForHistory waits until the job has the number of runs in its history, and returns the history.
+func waitForHistory(t *testing.T, daemon *Daemon, jobName string, numRuns int) []Run {
+	for i := 0; i < 100; i++ {
+		if history := daemon.GetHistory(jobName); len(history) >= numRuns {
+			return history
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("job did not run")
+	return nil
+}
+
+func TestScheduler(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "laitos-TestScheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	daemon := Daemon{}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+	daemon.Processor = common.GetTestCommandProcessor()
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+	daemon.Jobs = []Job{{Name: "a", Schedule: "* * *", Command: "verysecret.s echo a"}}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+	daemon.Jobs = []Job{{Name: "a", Schedule: "* * * * *", Command: "verysecret.s echo a", MailRecipients: []string{"me@example.com"}}}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+	daemon.Jobs = []Job{
+		{Name: "a", Schedule: "* * * * *", Command: "verysecret.s echo a"},
+		{Name: "slow", Schedule: "* * * * *", Command: "verysecret.s sleep 2; echo slow"},
+		{Name: "hourly", Schedule: "@hourly", Command: "verysecret.s echo hourly", CatchUp: true},
+		{Name: "daily", Schedule: "@daily", Command: "verysecret.s echo daily"},
+	}
+	daemon.StateFilePath = filepath.Join(tmpDir, "state.json")
+	daemon.HistorySize = 2
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Run everything that runs every minute
+	now := time.Now().Add(1 * time.Minute)
+	daemon.runDueJobs(now)
+	if history := waitForHistory(t, &daemon, "a", 1); history[0].Output != "a" || history[0].Error != "" || history[0].CatchUp {
+		t.Fatal(history)
+	}
+	// The slow job is still running and must not run again
+	now = now.Add(1 * time.Minute)
+	daemon.runDueJobs(now)
+	if history := daemon.GetHistory("slow"); len(history) != 1 || history[0].Skipped == "" {
+		t.Fatal(history)
+	}
+	if history := waitForHistory(t, &daemon, "slow", 2); history[0].Output != "slow" || history[1].Skipped == "" {
+		t.Fatal(history)
+	}
+	// History is limited in size
+	if history := waitForHistory(t, &daemon, "a", 2); len(history) != 2 {
+		t.Fatal(history)
+	}
+	now = now.Add(1 * time.Minute)
+	daemon.runDueJobs(now)
+	time.Sleep(500 * time.Millisecond)
+	if history := daemon.GetHistory("a"); len(history) != 2 || !history[0].Begin.Equal(now) {
+		t.Fatal(history)
+	}
+	if history := daemon.GetHistory("does not exist"); history != nil {
+		t.Fatal(history)
+	}
+	waitForHistory(t, &daemon, "slow", 2)
+	time.Sleep(2500 * time.Millisecond)
+
+	// Pretend that laitos was offline for a day, the job that catches up runs while the other one is skipped.
+	daemon.mutex.Lock()
+	for _, state := range daemon.states {
+		state.LastRun = time.Now().Add(-24 * time.Hour)
+	}
+	daemon.saveState()
+	daemon.mutex.Unlock()
+	restarted := Daemon{Jobs: daemon.Jobs, StateFilePath: daemon.StateFilePath, Processor: common.GetTestCommandProcessor()}
+	if err := restarted.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if history := restarted.GetHistory("a"); len(history) != 2 {
+		t.Fatal(history)
+	}
+	restarted.runDueJobs(time.Now())
+	if history := waitForHistory(t, &restarted, "hourly", 1); !history[0].CatchUp || history[0].Output != "hourly" {
+		t.Fatal(history)
+	}
+	if history := restarted.GetHistory("daily"); len(history) < 1 || history[0].Skipped != "missed run" {
+		t.Fatal(history)
+	}
+
+	// Stop the loop
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- restarted.StartAndBlock()
+	}()
+	time.Sleep(1 * time.Second)
+	restarted.Stop()
+	select {
+	case err := <-serverErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("did not stop")
+	}
+	// Repeatedly stopping the daemon should have no negative consequence
+	restarted.Stop()
+	restarted.Stop()
+}
@@ -116,6 +116,8 @@ func (runner *CommandRunner) Process(mailContent []byte, replyAddresses ...strin
 		result := runner.Processor.Process(toolbox.Command{
 			Content:    string(body),
 			TimeoutSec: CommandTimeoutSec,
+			DaemonName: "mail",
+			ClientID:   prop.FromAddress,
 		})
 		// If this part does not have a PIN/shortcut match, simply move on to the next part.
 		if result.Error == filter.ErrPINAndShortcutNotFound {
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailcmd"
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/smtp"
 	"github.com/HouzuoGuo/laitos/inet"
@@ -36,6 +37,7 @@ type Daemon struct {
 
 	CommandRunner     *mailcmd.CommandRunner `json:"-"` // Process feature commands from incoming mails
 	ForwardMailClient inet.MailClient        `json:"-"` // ForwardMailClient is used to forward arriving emails.
+	CertManager       *common.CertManager    `json:"-"` // (Optional) serve StartTLS via certificate obtained from ACME certificate authority
 
 	myDomainsHash map[string]struct{} // "MyDomains" values in map keys
 	smtpConfig    smtp.Config         // SMTP processor configuration
@@ -72,6 +74,9 @@ func (daemon *Daemon) Initialise() error {
 		if err != nil {
 			return fmt.Errorf("smtpd.Initialise: failed to read TLS certificate - %v", err)
 		}
+		if daemon.CertManager != nil {
+			return errors.New("smtpd.Initialise: TLS certificate must come from either files or ACME, but not both")
+		}
 	}
 	daemon.smtpConfig = smtp.Config{
 		Limits: &smtp.Limits{
@@ -84,6 +89,9 @@ func (daemon *Daemon) Initialise() error {
 	}
 	if daemon.TLSCertPath != "" {
 		daemon.smtpConfig.TLSConfig = &tls.Config{Certificates: []tls.Certificate{daemon.tlsCert}}
+	} else if daemon.CertManager != nil {
+		// Certificate manager hands out the latest certificate during handshake
+		daemon.smtpConfig.TLSConfig = &tls.Config{GetCertificate: daemon.CertManager.GetCertificate}
 	}
 	daemon.rateLimit = &misc.RateLimit{
 		MaxCount: daemon.PerIPLimit,
@@ -154,7 +154,12 @@ func (bot *Daemon) ProcessMessages(updates APIUpdates) {
 		}
 		// Find and run command in background
 		go func(ding APIUpdate, beginTimeNano int64) {
-			result := bot.Processor.Process(toolbox.Command{TimeoutSec: CommandTimeoutSec, Content: ding.Message.Text})
+			result := bot.Processor.Process(toolbox.Command{
+				TimeoutSec: CommandTimeoutSec,
+				Content:    ding.Message.Text,
+				DaemonName: "telegram",
+				ClientID:   strconv.FormatUint(ding.Message.Chat.ID, 10),
+			})
 			if err := bot.ReplyTo(ding.Message.Chat.ID, result.CombinedOutput); err != nil {
 				bot.logger.Warningf("ProcessMessages", ding.Message.Chat.UserName, err, "failed to send message reply")
 			}
@@ -10,6 +10,7 @@ import (
 	"github.com/HouzuoGuo/laitos/daemon/httpd/api"
 	"github.com/HouzuoGuo/laitos/daemon/maintenance"
 	"github.com/HouzuoGuo/laitos/daemon/plainsocket"
+	"github.com/HouzuoGuo/laitos/daemon/scheduler"
 	"github.com/HouzuoGuo/laitos/daemon/smtpd"
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailcmd"
 	"github.com/HouzuoGuo/laitos/daemon/sockd"
@@ -21,6 +22,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 /*
@@ -32,10 +34,30 @@ type StandardFilters struct {
 	// For input command content
 	TranslateSequences filter.TranslateSequences `json:"TranslateSequences"`
 	PINAndShortcuts    filter.PINAndShortcuts    `json:"PINAndShortcuts"`
+	TOTP               filter.TOTP               `json:"TOTP"`
+
+	// For condensing command execution result before LintText
+	TransliterateText filter.TransliterateText `json:"TransliterateText"`
 
 	// For command execution result
 	NotifyViaEmail filter.NotifyViaEmail `json:"NotifyViaEmail"`
 	LintText       filter.LintText       `json:"LintText"`
+	EncryptOutput  filter.EncryptOutput  `json:"EncryptOutput"`
+
+	// For running several commands in a single input
+	CommandChain common.CommandChain `json:"CommandChain"`
+}
+
+/*
+GetCommandFilters returns the input command filters in the order of application. TOTP filter is only used if it is
+configured and the caller demands it.
+*/
+func (filters *StandardFilters) GetCommandFilters(demandTOTP bool) []filter.CommandFilter {
+	ret := []filter.CommandFilter{&filters.PINAndShortcuts}
+	if demandTOTP && filters.TOTP.IsConfigured() {
+		ret = append(ret, &filters.TOTP)
+	}
+	return append(ret, &filters.TranslateSequences)
 }
 
 // Configure path to HTTP handlers and handler themselves.
@@ -45,8 +67,15 @@ type HTTPHandlers struct {
 	BrowserEndpoint       string            `json:"BrowserEndpoint"`
 	BrowserEndpointConfig api.HandleBrowser `json:"BrowserEndpointConfig"`
 
+	CommandAPIEndpoint       string               `json:"CommandAPIEndpoint"`
+	CommandAPIEndpointConfig api.HandleCommandAPI `json:"CommandAPIEndpointConfig"`
+
 	CommandFormEndpoint string `json:"CommandFormEndpoint"`
 
+	DNSOverHTTPSEndpoint       string                 `json:"DNSOverHTTPSEndpoint"`
+	DNSOverHTTPSEndpointConfig api.HandleDNSOverHTTPS `json:"DNSOverHTTPSEndpointConfig"`
+	DNSQueryLogEndpoint        string                 `json:"DNSQueryLogEndpoint"`
+
 	GitlabBrowserEndpoint       string                  `json:"GitlabBrowserEndpoint"`
 	GitlabBrowserEndpointConfig api.HandleGitlabBrowser `json:"GitlabBrowserEndpointConfig"`
 
@@ -65,6 +94,8 @@ type HTTPHandlers struct {
 
 	WebProxyEndpoint string `json:"WebProxyEndpoint"`
 
+	WebhookEndpoints map[string]api.HandleWebhook `json:"WebhookEndpoints"`
+
 	TwilioSMSEndpoint        string                   `json:"TwilioSMSEndpoint"`
 	TwilioCallEndpoint       string                   `json:"TwilioCallEndpoint"`
 	TwilioCallEndpointConfig api.HandleTwilioCallHook `json:"TwilioCallEndpointConfig"`
@@ -90,6 +121,9 @@ type Config struct {
 	PlainSocketDaemon  plainsocket.Daemon `json:"PlainSocketDaemon"`  // Plain text protocol TCP and UDP daemon configuration
 	PlainSocketFilters StandardFilters    `json:"PlainSocketFilters"` // Plain text daemon filter configuration
 
+	Scheduler        scheduler.Daemon `json:"Scheduler"`        // Scheduler runs toolbox commands on a schedule and delivers their results
+	SchedulerFilters StandardFilters  `json:"SchedulerFilters"` // SchedulerFilters configure command processor for scheduled commands
+
 	SockDaemon sockd.Daemon `json:"SockDaemon"` // Intentionally undocumented
 
 	TelegramBot     telegrambot.Daemon `json:"TelegramBot"`     // Telegram bot configuration
@@ -97,7 +131,16 @@ type Config struct {
 
 	SupervisorNotificationRecipients []string `json:"SupervisorNotificationRecipients"` // Email addresses of supervisor notification recipients
 
-	logger misc.Logger // logger handles log output from configuration serialisation and initialisation routines.
+	CommandAuditLog misc.AuditLog   `json:"CommandAuditLog"` // CommandAuditLog records toolbox commands executed by all daemons into a file.
+	BackgroundJobs  common.JobStore `json:"BackgroundJobs"`  // BackgroundJobs configures limits of toolbox commands that run in background.
+
+	PINLockout common.Lockout `json:"PINLockout"` // PINLockout slows down and bans clients that repeatedly fail to match PIN.
+
+	ACME common.CertManager `json:"ACME"` // ACME obtains and renews TLS certificate of HTTP and mail daemons from a certificate authority such as Let's Encrypt.
+
+	dnsDaemon     *dnsd.Daemon // dnsDaemon is shared by DNS server and DNS-over-HTTPS handlers of web servers.
+	dnsDaemonInit *sync.Once   // dnsDaemonInit initialises the shared DNS daemon upon its first use.
+	logger        misc.Logger  // logger handles log output from configuration serialisation and initialisation routines.
 }
 
 // Initialise decorates feature configuration and bridges in preparation for daemon operations.
@@ -106,9 +149,37 @@ func (config *Config) Initialise() error {
 	config.HTTPFilters.NotifyViaEmail.MailClient = config.MailClient
 	config.MailFilters.NotifyViaEmail.MailClient = config.MailClient
 	config.PlainSocketFilters.NotifyViaEmail.MailClient = config.MailClient
+	config.SchedulerFilters.NotifyViaEmail.MailClient = config.MailClient
 	config.TelegramFilters.NotifyViaEmail.MailClient = config.MailClient
 	// SendMail feature also shares the common mail client
 	config.Features.SendMail.MailClient = config.MailClient
+	// All command processors share the background jobs
+	config.BackgroundJobs.Initialise()
+	common.BackgroundJobs = &config.BackgroundJobs
+	// All command processors share the audit log
+	if config.CommandAuditLog.IsConfigured() {
+		if err := config.CommandAuditLog.Initialise(); err != nil {
+			return err
+		}
+		misc.CommandAuditLog = &config.CommandAuditLog
+	}
+	// All command processors share the lockout of clients who fail to match PIN
+	if config.PINLockout.IsConfigured() {
+		config.PINLockout.MailClient = config.MailClient
+		if err := config.PINLockout.Initialise(); err != nil {
+			return err
+		}
+		common.ClientLockouts = &config.PINLockout
+	}
+	// DNS server and DNS-over-HTTPS handlers share the DNS daemon, which is initialised upon first use.
+	config.dnsDaemon = new(dnsd.Daemon)
+	config.dnsDaemonInit = new(sync.Once)
+	// HTTP and mail daemons share the certificate obtained via ACME
+	if config.ACME.IsConfigured() {
+		if err := config.ACME.Initialise(); err != nil {
+			return err
+		}
+	}
 	if err := config.Features.Initialise(); err != nil {
 		return err
 	}
@@ -130,14 +201,15 @@ func (config *Config) DeserialiseFromJSON(in []byte) error {
 	return nil
 }
 
-// Construct a DNS daemon from configuration and return.
+// Construct a DNS daemon from configuration and return. All callers share the same DNS daemon.
 func (config Config) GetDNSD() *dnsd.Daemon {
-	ret := config.DNSDaemon
-	if err := ret.Initialise(); err != nil {
-		config.logger.Fatalf("GetDNSD", "", err, "failed to initialise")
-		return nil
-	}
-	return &ret
+	config.dnsDaemonInit.Do(func() {
+		*config.dnsDaemon = config.DNSDaemon
+		if err := config.dnsDaemon.Initialise(); err != nil {
+			config.logger.Fatalf("GetDNSD", "", err, "failed to initialise")
+		}
+	})
+	return config.dnsDaemon
 }
 
 // GetMaintenance constructs a system maintenance / health check daemon from configuration and return.
@@ -161,17 +233,24 @@ func (config Config) GetHTTPD() *httpd.Daemon {
 	config.logger.Printf("GetHTTPD", "", nil, "enabled features are - %v", config.Features.GetTriggers())
 	// Assemble command processor from features and filters
 	ret.Processor = &common.CommandProcessor{
-		Features: &config.Features,
-		CommandFilters: []filter.CommandFilter{
-			&config.HTTPFilters.PINAndShortcuts,
-			&config.HTTPFilters.TranslateSequences,
-		},
+		Features:       &config.Features,
+		CommandFilters: config.HTTPFilters.GetCommandFilters(false),
 		ResultFilters: []filter.ResultFilter{
 			&filter.ResetCombinedText{}, // this is mandatory but not configured by user's config file
+			&config.HTTPFilters.TransliterateText,
 			&config.HTTPFilters.LintText,
 			&filter.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+			&config.HTTPFilters.EncryptOutput,
 			&config.HTTPFilters.NotifyViaEmail,
 		},
+		Chain: config.HTTPFilters.CommandChain,
+	}
+	// Twilio hooks demand TOTP if it is configured, whereas the other handlers such as the command form do not.
+	var twilioProcessor *common.CommandProcessor
+	if config.HTTPFilters.TOTP.IsConfigured() {
+		withTOTP := *ret.Processor
+		withTOTP.CommandFilters = config.HTTPFilters.GetCommandFilters(true)
+		twilioProcessor = &withTOTP
 	}
 	// Make handler factories
 	handlers := map[string]api.HandlerFactory{}
@@ -203,9 +282,22 @@ func (config Config) GetHTTPD() *httpd.Daemon {
 		browserImageHandler.Browsers = &browserHandler.Browsers
 		handlers[config.HTTPHandlers.BrowserEndpoint] = &browserHandler
 	}
+	if config.HTTPHandlers.CommandAPIEndpoint != "" {
+		handler := config.HTTPHandlers.CommandAPIEndpointConfig
+		handlers[config.HTTPHandlers.CommandAPIEndpoint] = &handler
+	}
 	if config.HTTPHandlers.CommandFormEndpoint != "" {
 		handlers[config.HTTPHandlers.CommandFormEndpoint] = &api.HandleCommandForm{}
 	}
+	if config.HTTPHandlers.DNSOverHTTPSEndpoint != "" {
+		// The handler shares DNS daemon with web servers and DNS server, it refreshes black list and forwarders only while web server runs.
+		handler := config.HTTPHandlers.DNSOverHTTPSEndpointConfig
+		handler.DNSDaemon = config.GetDNSD()
+		handlers[config.HTTPHandlers.DNSOverHTTPSEndpoint] = &handler
+	}
+	if config.HTTPHandlers.DNSQueryLogEndpoint != "" {
+		handlers[config.HTTPHandlers.DNSQueryLogEndpoint] = &api.HandleDNSQueryLog{}
+	}
 	if config.HTTPHandlers.GitlabBrowserEndpoint != "" {
 		config.HTTPHandlers.GitlabBrowserEndpointConfig.MailClient = config.MailClient
 		handlers[config.HTTPHandlers.GitlabBrowserEndpoint] = &config.HTTPHandlers.GitlabBrowserEndpointConfig
@@ -236,8 +328,12 @@ func (config Config) GetHTTPD() *httpd.Daemon {
 	if proxyEndpoint := config.HTTPHandlers.WebProxyEndpoint; proxyEndpoint != "" {
 		handlers[proxyEndpoint] = &api.HandleWebProxy{MyEndpoint: proxyEndpoint}
 	}
+	for endpoint, webhookConfig := range config.HTTPHandlers.WebhookEndpoints {
+		handler := webhookConfig
+		handlers[endpoint] = &handler
+	}
 	if config.HTTPHandlers.TwilioSMSEndpoint != "" {
-		handlers[config.HTTPHandlers.TwilioSMSEndpoint] = &api.HandleTwilioSMSHook{}
+		handlers[config.HTTPHandlers.TwilioSMSEndpoint] = &api.HandleTwilioSMSHook{CommandProcessor: twilioProcessor}
 	}
 	if config.HTTPHandlers.TwilioCallEndpoint != "" {
 		/*
@@ -257,7 +353,14 @@ func (config Config) GetHTTPD() *httpd.Daemon {
 		callEndpointConfig.CallbackEndpoint = callbackEndpoint
 		handlers[config.HTTPHandlers.TwilioCallEndpoint] = &callEndpointConfig
 		// The callback handler will use the callback point that points to itself to carry on with phone conversation
-		handlers[callbackEndpoint] = &api.HandleTwilioCallCallback{MyEndpoint: callbackEndpoint}
+		handlers[callbackEndpoint] = &api.HandleTwilioCallCallback{MyEndpoint: callbackEndpoint, CommandProcessor: twilioProcessor}
+	}
+	if config.ACME.IsConfigured() {
+		// Both HTTP and HTTPS daemons answer HTTP-01 challenges, though certificate authority only visits port 80.
+		handlers[common.ACMEHTTPChallengePath] = &api.HandleACMEChallenge{CertManager: &config.ACME}
+		if ret.TLSCertPath == "" {
+			ret.CertManager = &config.ACME
+		}
 	}
 	ret.SpecialHandlers = handlers
 	// Call initialise and print out prefixes of installed routes
@@ -283,6 +386,7 @@ func (config Config) GetInsecureHTTPD() *httpd.Daemon {
 	ret := config.GetHTTPD()
 	ret.TLSCertPath = ""
 	ret.TLSKeyPath = ""
+	ret.CertManager = nil
 	if envPort := strings.TrimSpace(os.Getenv("PORT")); envPort == "" {
 		ret.Port = 80
 	} else {
@@ -320,17 +424,17 @@ func (config Config) GetMailCommandRunner() *mailcmd.CommandRunner {
 	config.logger.Printf("GetMailCommandRunner", "", nil, "enabled features are - %v", config.Features.GetTriggers())
 	// Assemble command processor from features and filters
 	ret.Processor = &common.CommandProcessor{
-		Features: &config.Features,
-		CommandFilters: []filter.CommandFilter{
-			&config.MailFilters.PINAndShortcuts,
-			&config.MailFilters.TranslateSequences,
-		},
+		Features:       &config.Features,
+		CommandFilters: config.MailFilters.GetCommandFilters(true),
 		ResultFilters: []filter.ResultFilter{
 			&filter.ResetCombinedText{}, // this is mandatory but not configured by user's config file
+			&config.MailFilters.TransliterateText,
 			&config.MailFilters.LintText,
 			&filter.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+			&config.MailFilters.EncryptOutput,
 			&config.MailFilters.NotifyViaEmail,
 		},
+		Chain: config.MailFilters.CommandChain,
 	}
 	ret.ReplyMailClient = config.MailClient
 	return &ret
@@ -344,6 +448,9 @@ func (config Config) GetMailDaemon() *smtpd.Daemon {
 	ret := config.MailDaemon
 	ret.CommandRunner = config.GetMailCommandRunner()
 	ret.ForwardMailClient = config.MailClient
+	if config.ACME.IsConfigured() && ret.TLSCertPath == "" {
+		ret.CertManager = &config.ACME
+	}
 	if err := ret.Initialise(); err != nil {
 		config.logger.Fatalf("GetMailDaemon", "", err, "failed to initialise")
 		return nil
@@ -361,17 +468,17 @@ func (config Config) GetPlainSocketDaemon() *plainsocket.Daemon {
 	config.logger.Printf("GetPlainSocketDaemon", "", nil, "enabled features are - %v", config.Features.GetTriggers())
 	// Assemble command processor from features and filters
 	ret.Processor = &common.CommandProcessor{
-		Features: &config.Features,
-		CommandFilters: []filter.CommandFilter{
-			&config.PlainSocketFilters.PINAndShortcuts,
-			&config.PlainSocketFilters.TranslateSequences,
-		},
+		Features:       &config.Features,
+		CommandFilters: config.PlainSocketFilters.GetCommandFilters(true),
 		ResultFilters: []filter.ResultFilter{
 			&filter.ResetCombinedText{}, // this is mandatory but not configured by user's config file
+			&config.PlainSocketFilters.TransliterateText,
 			&config.PlainSocketFilters.LintText,
 			&filter.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+			&config.PlainSocketFilters.EncryptOutput,
 			&config.PlainSocketFilters.NotifyViaEmail,
 		},
+		Chain: config.PlainSocketFilters.CommandChain,
 	}
 	// Call initialise so that daemon is ready to start
 	if err := ret.Initialise(); err != nil {
@@ -381,6 +488,40 @@ func (config Config) GetPlainSocketDaemon() *plainsocket.Daemon {
 	return &ret
 }
 
+/*
+Construct a scheduler that runs toolbox commands on a schedule and return.
+It will use common mail client, telegram bot authorization token, and Twilio feature to deliver command results.
+*/
+func (config Config) GetScheduler() *scheduler.Daemon {
+	ret := config.Scheduler
+
+	config.logger.Printf("GetScheduler", "", nil, "enabled features are - %v", config.Features.GetTriggers())
+	// Assemble command processor from features and filters
+	ret.Processor = &common.CommandProcessor{
+		Features:       &config.Features,
+		CommandFilters: config.SchedulerFilters.GetCommandFilters(false),
+		ResultFilters: []filter.ResultFilter{
+			&filter.ResetCombinedText{}, // this is mandatory but not configured by user's config file
+			&config.SchedulerFilters.TransliterateText,
+			&config.SchedulerFilters.LintText,
+			&filter.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+			&config.SchedulerFilters.EncryptOutput,
+			&config.SchedulerFilters.NotifyViaEmail,
+		},
+		Chain: config.SchedulerFilters.CommandChain,
+		// Recipients of scheduled command results cannot ask for the next page
+		NoPagination: true,
+	}
+	ret.MailClient = config.MailClient
+	ret.TelegramBot = &config.TelegramBot
+	ret.SMS = &config.Features.Twilio
+	if err := ret.Initialise(); err != nil {
+		config.logger.Fatalf("GetScheduler", "", err, "failed to initialise")
+		return nil
+	}
+	return &ret
+}
+
 // Intentionally undocumented
 func (config Config) GetSockDaemon() *sockd.Daemon {
 	ret := config.SockDaemon
@@ -398,17 +539,17 @@ func (config Config) GetTelegramBot() *telegrambot.Daemon {
 	config.logger.Printf("GetTelegramBot", "", nil, "enabled features are - %v", config.Features.GetTriggers())
 	// Assemble telegram bot from features and filters
 	ret.Processor = &common.CommandProcessor{
-		Features: &config.Features,
-		CommandFilters: []filter.CommandFilter{
-			&config.TelegramFilters.PINAndShortcuts,
-			&config.TelegramFilters.TranslateSequences,
-		},
+		Features:       &config.Features,
+		CommandFilters: config.TelegramFilters.GetCommandFilters(true),
 		ResultFilters: []filter.ResultFilter{
 			&filter.ResetCombinedText{}, // this is mandatory but not configured by user's config file
+			&config.TelegramFilters.TransliterateText,
 			&config.TelegramFilters.LintText,
 			&filter.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+			&config.TelegramFilters.EncryptOutput,
 			&config.TelegramFilters.NotifyViaEmail,
 		},
+		Chain: config.TelegramFilters.CommandChain,
 	}
 	if err := ret.Initialise(); err != nil {
 		config.logger.Fatalf("GetTelegramBot", "", err, "failed to initialise")
@@ -68,10 +68,25 @@ func TestConfig(t *testing.T) {
     "ServeDirectories": {
       "/my/dir": "/tmp/test-laitos-dir",
       "/dir": "/tmp/test-laitos-dir"
-    }
+    },
+    "VirtualHosts": [
+      {
+        "Hosts": ["app.example.com"],
+        "PathPrefix": "/app",
+        "Backends": ["http://127.0.0.1:23487"],
+        "StripPathPrefix": true
+      }
+    ]
   },
   "HTTPHandlers": {
+    "CommandAPIEndpoint": "/cmd_api",
+    "CommandAPIEndpointConfig": {
+      "BearerToken": "verysecret-api-token",
+      "HMACSecret": "verysecret-api-hmac"
+    },
     "CommandFormEndpoint": "/cmd_form",
+    "DNSOverHTTPSEndpoint": "/dns_query",
+    "DNSQueryLogEndpoint": "/dns_log",
     "GitlabBrowserEndpoint": "/gitlab",
     "GitlabBrowserEndpointConfig": {
       "PrivateToken": "just a dummy token"
@@ -100,7 +115,26 @@ func TestConfig(t *testing.T) {
       "CallGreeting": "Hi there"
     },
     "TwilioSMSEndpoint": "/sms",
-    "WebProxyEndpoint": "/proxy"
+    "WebProxyEndpoint": "/proxy",
+    "WebhookEndpoints": {
+      "/webhook": {
+        "SigningSecret": "verysecret-webhook",
+        "SignatureHeader": "X-Signature",
+        "SignaturePrefix": "v0=",
+        "SignedContentTemplate": "v0:{timestamp}:{body}",
+        "TimestampHeader": "X-Timestamp",
+        "TextSelector": "$.event.text",
+        "SenderSelector": "$.event.user",
+        "ChallengeSelector": "challenge"
+      },
+      "/webhook_token": {
+        "Token": "verysecret-webhook-token",
+        "TokenSelector": "token",
+        "TextSelector": "text",
+        "SenderSelector": "user_name",
+        "ResponseTemplate": "{\"content\": {{json .Output}}, \"to\": {{json .Sender}}}"
+      }
+    }
   },
   "Maintenance": {
     "IntervalSec": 300,
@@ -242,6 +276,9 @@ func TestConfig(t *testing.T) {
 	maintenance.TestMaintenance(config.GetMaintenance(), t)
 
 	httpDaemon := config.GetHTTPD()
+	if _, exists := httpDaemon.AllRateLimits["app.example.com/app"]; !exists {
+		t.Fatal("virtual host is not installed")
+	}
 	// HTTP daemon is expected to start in two seconds
 	go func() {
 		if err := httpDaemon.StartAndBlock(); err != nil {
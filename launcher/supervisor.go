@@ -23,6 +23,7 @@ const (
 	InsecureHTTPDName = "insecurehttpd"
 	MaintenanceName   = "maintenance"
 	PlainSocketName   = "plainsocket"
+	SchedulerName     = "scheduler"
 	SMTPDName         = "smtpd"
 	SOCKDName         = "sockd"
 	TelegramName      = "telegram"
@@ -34,10 +35,10 @@ const (
 )
 
 // AllDaemons is an unsorted list of string daemon names.
-var AllDaemons = []string{DNSDName, HTTPDName, InsecureHTTPDName, MaintenanceName, PlainSocketName, SMTPDName, SOCKDName, TelegramName}
+var AllDaemons = []string{DNSDName, HTTPDName, InsecureHTTPDName, MaintenanceName, PlainSocketName, SchedulerName, SMTPDName, SOCKDName, TelegramName}
 
 // ShedOrder is the sequence of daemon names to be taken offline one after another in case of program crash.
-var ShedOrder = []string{MaintenanceName, DNSDName, SOCKDName, SMTPDName, HTTPDName, InsecureHTTPDName, PlainSocketName, TelegramName}
+var ShedOrder = []string{MaintenanceName, SchedulerName, DNSDName, SOCKDName, SMTPDName, HTTPDName, InsecureHTTPDName, PlainSocketName, TelegramName}
 
 /*
 RemoveFromFlags removes CLI flag from input flags base on a condition function (true to remove). The input flags must
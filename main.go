@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"github.com/HouzuoGuo/laitos/launcher"
@@ -9,6 +10,7 @@ import (
 	"github.com/HouzuoGuo/laitos/launcher/passwdserver"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/HouzuoGuo/laitos/toolbox/filter"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -76,6 +78,45 @@ func MakeEncryptedArchive(srcDir, archivePath string) {
 	}
 }
 
+// GenerateOutputKey prints a new pair of keys for decrypting and encrypting command output.
+func GenerateOutputKey() {
+	privateKey, publicKey, err := filter.GenerateX25519Key()
+	if err != nil {
+		misc.DefaultLogger.Fatalf("GenerateOutputKey", "main", err, "failed to generate key")
+		return
+	}
+	fmt.Println("Private key (keep it to yourself):", privateKey)
+	fmt.Println("Public key (place it in EncryptOutput configuration):", publicKey)
+}
+
+// DecryptOutput reads private key and encrypted command output from standard input, and prints the decrypted output.
+func DecryptOutput() {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println("Please enter private key (no echo):")
+	SetTermEcho(false)
+	privateKey, _, err := reader.ReadLine()
+	SetTermEcho(true)
+	if err != nil {
+		misc.DefaultLogger.Fatalf("DecryptOutput", "main", err, "failed to read private key")
+		return
+	}
+	fmt.Println("Please paste encrypted output:")
+	var armored bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		armored.WriteString(line)
+		if err != nil || strings.Contains(line, filter.EncryptedOutputEnd) {
+			break
+		}
+	}
+	plainText, err := filter.DecryptOutput(armored.String(), string(privateKey))
+	if err == nil {
+		fmt.Println(plainText)
+	} else {
+		fmt.Println("Error: ", err.Error())
+	}
+}
+
 // StartPasswordWebServer starts the password input web server.
 func StartPasswordWebServer(port int, url, archivePath string) {
 	ws := passwdserver.WebServer{
@@ -120,7 +161,7 @@ func main() {
 	var disableConflicts, tuneSystem, debug, swapOff bool
 	var gomaxprocs int
 	flag.StringVar(&misc.ConfigFilePath, launcher.ConfigFlagName, "", "(Mandatory) path to configuration file in JSON syntax")
-	flag.StringVar(&daemonList, launcher.DaemonsFlagName, "", "(Mandatory) comma-separated daemons to start (dnsd, httpd, insecurehttpd, maintenance, plainsocket, smtpd, telegram)")
+	flag.StringVar(&daemonList, launcher.DaemonsFlagName, "", "(Mandatory) comma-separated daemons to start (dnsd, httpd, insecurehttpd, maintenance, plainsocket, scheduler, smtpd, telegram)")
 	flag.BoolVar(&disableConflicts, "disableconflicts", false, "(Optional) automatically stop and disable other daemon programs that may cause port usage conflicts")
 	flag.BoolVar(&swapOff, "swapoff", false, "(Optional) turn off all swap files and partitions for improved system security")
 	flag.BoolVar(&tuneSystem, "tunesystem", false, "(Optional) tune operating system parameters for optimal performance")
@@ -140,6 +181,9 @@ func main() {
 	flag.StringVar(&dataUtil, "datautil", "", "(Optional) program data encryption utility: extract|archive")
 	flag.StringVar(&dataUtilDir, "datautildir", "", "(Optional) program data encryption utility: extract destination or archive source directory")
 	flag.StringVar(&dataUtilFile, "datautilfile", "", "(Optional) program data encryption utility: extract from or archive file location")
+	// Encrypted command output utility
+	var outputUtil string
+	flag.StringVar(&outputUtil, "outpututil", "", "(Optional) encrypted command output utility: keygen|decrypt")
 	// Internal supervisor flag
 	var isSupervisor = true
 	flag.BoolVar(&isSupervisor, launcher.SupervisorFlagName, true, "(Internal use only) enter supervisor mode")
@@ -161,6 +205,21 @@ func main() {
 		return
 	}
 
+	// ========================================================================
+	// Utility mode - Encrypted command output utilities do not run daemons.
+	// ========================================================================
+	if outputUtil != "" {
+		switch outputUtil {
+		case "keygen":
+			GenerateOutputKey()
+		case "decrypt":
+			DecryptOutput()
+		default:
+			logger.Fatalf("main", "", nil, "please provide mode of operation (keygen|decrypt) for parameter \"-outpututil\"")
+		}
+		return
+	}
+
 	// ========================================================================
 	// Encrypted data archive launcher mode - launch the password input web server.
 	// ========================================================================
@@ -251,6 +310,10 @@ func main() {
 		logger.Warningf("main", "", nil, "System tuning result is: \n%s", toolbox.TuneLinux())
 	}
 	ReseedPseudoRand()
+	// Obtain and renew TLS certificate for HTTP and mail daemons in background
+	if config.ACME.IsConfigured() {
+		config.ACME.StartRenewal()
+	}
 	daemonErrs := make(chan error, len(daemonNames))
 	for _, daemonName := range daemonNames {
 		// Daemons are started asynchronously, the order of startup does not matter.
@@ -275,6 +338,10 @@ func main() {
 			go func() {
 				daemonErrs <- config.GetPlainSocketDaemon().StartAndBlock()
 			}()
+		case launcher.SchedulerName:
+			go func() {
+				daemonErrs <- config.GetScheduler().StartAndBlock()
+			}()
 		case launcher.SMTPDName:
 			go func() {
 				daemonErrs <- config.GetMailDaemon().StartAndBlock()
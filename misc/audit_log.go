@@ -0,0 +1,185 @@
+package misc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditLogDefaultMaxSizeKB = 1024 // AuditLogDefaultMaxSizeKB is the default size of audit log file that triggers rotation.
+	AuditLogDefaultKeepFiles = 3    // AuditLogDefaultKeepFiles is the default number of rotated audit log files to keep.
+)
+
+/*
+CommandAuditLog records toolbox commands executed by all command processors. It is nil (disabled) unless configured
+by the user.
+*/
+var CommandAuditLog *AuditLog
+
+// AuditRecord describes a toolbox command executed by a command processor.
+type AuditRecord struct {
+	Time         time.Time `json:"Time"`         // Time is the moment command execution finished.
+	DaemonName   string    `json:"DaemonName"`   // DaemonName is the daemon or front-end that received the command, e.g. "telegram".
+	ClientID     string    `json:"ClientID"`     // ClientID identifies the client who issued the command, e.g. an IP address or phone number.
+	Principal    string    `json:"Principal"`    // Principal is the name of user identified by PIN or shortcut.
+	Trigger      string    `json:"Trigger"`      // Trigger is the prefix of feature that executed the command.
+	Command      string    `json:"Command"`      // Command is the command content without PIN and one-time password.
+	DurationMS   int64     `json:"DurationMS"`   // DurationMS is the number of milliseconds spent in processing the command.
+	Error        string    `json:"Error"`        // Error is the command execution error, it is empty if the command succeeded.
+	OutputLength int       `json:"OutputLength"` // OutputLength is the number of characters in the command response.
+}
+
+// Return the record in a single line of text, absent fields appear as "-".
+func (record AuditRecord) String() string {
+	fields := []string{record.DaemonName, record.ClientID, record.Principal, record.Trigger}
+	for i, field := range fields {
+		if field == "" {
+			fields[i] = "-"
+		}
+	}
+	errText := ""
+	if record.Error != "" {
+		errText = fmt.Sprintf(" error \"%s\"", record.Error)
+	}
+	return fmt.Sprintf("%s %s \"%s\" in %dms%s output %d chars", record.Time.Format("2006-01-02 15:04:05"),
+		strings.Join(fields, " "), record.Command, record.DurationMS, errText, record.OutputLength)
+}
+
+/*
+AuditLog is an append-only file of audit records, one JSON record per line. When the file grows beyond the maximum
+size, it is renamed with a numeric suffix (e.g. "audit.log.1") and a new file is started in its place.
+*/
+type AuditLog struct {
+	FilePath  string `json:"FilePath"`  // FilePath is the location of the latest audit log file.
+	MaxSizeKB int    `json:"MaxSizeKB"` // MaxSizeKB is the size of audit log file that triggers rotation.
+	KeepFiles int    `json:"KeepFiles"` // KeepFiles is the number of rotated audit log files to keep.
+
+	file   *os.File
+	size   int64
+	mutex  *sync.Mutex
+	logger Logger
+}
+
+// IsConfigured returns true only if audit log file path is present.
+func (log *AuditLog) IsConfigured() bool {
+	return log.FilePath != ""
+}
+
+// Initialise opens (or creates) the audit log file for appending records.
+func (log *AuditLog) Initialise() error {
+	log.logger = Logger{ComponentName: "AuditLog", ComponentID: log.FilePath}
+	if !log.IsConfigured() {
+		return errors.New("AuditLog.Initialise: FilePath must not be empty")
+	}
+	if log.MaxSizeKB < 1 {
+		log.MaxSizeKB = AuditLogDefaultMaxSizeKB
+	}
+	if log.KeepFiles < 1 {
+		log.KeepFiles = AuditLogDefaultKeepFiles
+	}
+	log.mutex = new(sync.Mutex)
+	return log.open()
+}
+
+// open opens the latest audit log file for appending records.
+func (log *AuditLog) open() error {
+	file, err := os.OpenFile(log.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("AuditLog.open: failed to open audit log file - %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("AuditLog.open: failed to read file size - %v", err)
+	}
+	log.file = file
+	log.size = info.Size()
+	return nil
+}
+
+// rotatedFilePath returns the path of the rotated audit log file of the sequence number, 0 being the latest file.
+func (log *AuditLog) rotatedFilePath(seq int) string {
+	if seq == 0 {
+		return log.FilePath
+	}
+	return fmt.Sprintf("%s.%d", log.FilePath, seq)
+}
+
+// rotate renames the latest and rotated audit log files, discards the oldest one, and starts a new latest file.
+func (log *AuditLog) rotate() error {
+	log.file.Close()
+	os.Remove(log.rotatedFilePath(log.KeepFiles))
+	for seq := log.KeepFiles - 1; seq >= 0; seq-- {
+		if err := os.Rename(log.rotatedFilePath(seq), log.rotatedFilePath(seq+1)); err != nil && !os.IsNotExist(err) {
+			log.logger.Warningf("rotate", "", err, "failed to rename audit log file")
+		}
+	}
+	return log.open()
+}
+
+// Write appends a record to the audit log, and rotates the log file if it has grown too large.
+func (log *AuditLog) Write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if log.size > 0 && log.size+int64(len(line)) > int64(log.MaxSizeKB)*1024 {
+		if err := log.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := log.file.Write(line)
+	log.size += int64(n)
+	return err
+}
+
+/*
+Read returns the latest audit records (latest record comes first) that contain the text, from both the latest and
+rotated audit log files. Return at most the specified number of records.
+*/
+func (log *AuditLog) Read(maxRecords int, contains string) (ret []AuditRecord, err error) {
+	ret = make([]AuditRecord, 0, 16)
+	contains = strings.ToLower(contains)
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	for seq := 0; seq <= log.KeepFiles && len(ret) < maxRecords; seq++ {
+		content, err := ioutil.ReadFile(log.rotatedFilePath(seq))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		// Latest record is at the end of file
+		records := make([]AuditRecord, 0, 64)
+		for _, line := range bytes.Split(content, []byte{'\n'}) {
+			var record AuditRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				continue
+			}
+			if strings.Contains(strings.ToLower(record.String()), contains) {
+				records = append(records, record)
+			}
+		}
+		for i := len(records) - 1; i >= 0 && len(ret) < maxRecords; i-- {
+			ret = append(ret, records[i])
+		}
+	}
+	return
+}
+
+// Close closes the latest audit log file, further records may not be written.
+func (log *AuditLog) Close() error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.file.Close()
+}
@@ -0,0 +1,72 @@
+package misc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "laitos-TestAuditLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	auditLog := AuditLog{}
+	if err := auditLog.Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+	auditLog = AuditLog{FilePath: filepath.Join(tmpDir, "audit.log"), MaxSizeKB: 1, KeepFiles: 2}
+	if err := auditLog.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := auditLog.Read(10, ""); err != nil || len(records) != 0 {
+		t.Fatal(records, err)
+	}
+	// Each record is roughly 250 bytes long, hence 4 records fit into a file.
+	for i := 0; i < 20; i++ {
+		if err := auditLog.Write(AuditRecord{Time: time.Now(), DaemonName: "test", ClientID: "client", Command: fmt.Sprintf("cmd-%02d", i), Error: "err"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Oldest files are discarded
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		if info, err := os.Stat(filepath.Join(tmpDir, name)); err != nil || info.Size() > 1024 {
+			t.Fatal(name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "audit.log.3")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Latest records come first, and they are read from rotated files too.
+	records, err := auditLog.Read(6, "")
+	if err != nil || len(records) != 6 {
+		t.Fatal(records, err)
+	}
+	for i, record := range records {
+		if record.Command != fmt.Sprintf("cmd-%02d", 19-i) {
+			t.Fatal(i, record)
+		}
+	}
+	if line := records[0].String(); !strings.Contains(line, " test client - - \"cmd-19\" in 0ms error \"err\" output 0 chars") {
+		t.Fatal(line)
+	}
+	if records, err := auditLog.Read(100, "CMD-1"); err != nil || len(records) < 5 || records[0].Command != "cmd-19" {
+		t.Fatal(records, err)
+	}
+	// Records survive restart
+	if err := auditLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+	auditLog = AuditLog{FilePath: filepath.Join(tmpDir, "audit.log"), MaxSizeKB: 1, KeepFiles: 2}
+	if err := auditLog.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := auditLog.Read(1, "cmd"); err != nil || len(records) != 1 || records[0].Command != "cmd-19" {
+		t.Fatal(records, err)
+	}
+}
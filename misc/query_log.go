@@ -0,0 +1,123 @@
+package misc
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const QueryLogSize = 1000 // QueryLogSize is the number of latest DNS queries memorised by LatestDNSQueries.
+
+// QueryLogEntry describes how a DNS query made by a client was handled.
+type QueryLogEntry struct {
+	Time     time.Time     // Time is the moment the query was answered.
+	ClientIP string        // ClientIP is the IP address of DNS client.
+	Name     string        // Name is the queried domain name in lower case, it is empty for non-name queries.
+	Type     string        // Type is the queried record type in text, e.g. "AAAA".
+	Result   string        // Result tells how the query was handled, e.g. "blocked" or "forwarded".
+	Upstream string        // Upstream is the forwarder address used to answer the query, it is empty if no forwarder was involved.
+	Latency  time.Duration // Latency is the duration between receiving the query and having its response ready.
+}
+
+// Return the entry in a single line of text.
+func (entry QueryLogEntry) String() string {
+	name := entry.Name
+	if name == "" {
+		name = "(non-name query)"
+	}
+	via := ""
+	if entry.Upstream != "" {
+		via = " via " + entry.Upstream
+	}
+	return fmt.Sprintf("%s %s %s %s %s%s in %dms", entry.Time.Format("2006-01-02 15:04:05"), entry.ClientIP,
+		entry.Type, name, entry.Result, via, entry.Latency.Nanoseconds()/1000000)
+}
+
+// Matches returns true only if the entry is made by the client IP prefix and asks for a name that contains the text.
+func (entry QueryLogEntry) Matches(clientIPPrefix, nameContains string) bool {
+	return strings.HasPrefix(entry.ClientIP, clientIPPrefix) && strings.Contains(entry.Name, strings.ToLower(nameContains))
+}
+
+/*
+QueryLog is a ring buffer of query log entries, it works in the same way as RingBuffer. Unlike the string ring
+buffer, an entry consists of several fields and is therefore protected by a mutex.
+*/
+type QueryLog struct {
+	size    int64
+	counter int64
+	buf     []QueryLogEntry
+	mutex   *sync.Mutex
+}
+
+// Pre-allocate entry buffer of the specified size and initialise query log.
+func NewQueryLog(size int64) *QueryLog {
+	if size < 1 {
+		panic("NewQueryLog: size must be greater than 0")
+	}
+	return &QueryLog{
+		size:  size,
+		buf:   make([]QueryLogEntry, size),
+		mutex: new(sync.Mutex),
+	}
+}
+
+// Add a new entry into the query log.
+func (log *QueryLog) Push(entry QueryLogEntry) {
+	log.mutex.Lock()
+	log.counter++
+	log.buf[log.counter%log.size] = entry
+	log.mutex.Unlock()
+}
+
+/*
+Iterate through the query log, beginning from the latest entry through to the oldest entry. If the iterator function
+returns false, iteration is stopped immediately. Iteration loop always skips empty entries.
+*/
+func (log *QueryLog) Iterate(fun func(QueryLogEntry) bool) {
+	log.mutex.Lock()
+	entries := make([]QueryLogEntry, 0, log.size)
+	currentIndex := log.counter % log.size
+	for i := currentIndex; i >= 0; i-- {
+		entries = append(entries, log.buf[i])
+	}
+	for i := log.size - 1; i > currentIndex; i-- {
+		entries = append(entries, log.buf[i])
+	}
+	log.mutex.Unlock()
+	// Call iterator function without holding the lock
+	for _, entry := range entries {
+		if entry.Time.IsZero() {
+			continue
+		}
+		if !fun(entry) {
+			return
+		}
+	}
+}
+
+// Find returns the latest entries (latest entry comes first) made by the client IP prefix toward names that contain the text.
+func (log *QueryLog) Find(clientIPPrefix, nameContains string) (ret []QueryLogEntry) {
+	ret = make([]QueryLogEntry, 0, 16)
+	log.Iterate(func(entry QueryLogEntry) bool {
+		if entry.Matches(clientIPPrefix, nameContains) {
+			ret = append(ret, entry)
+		}
+		return true
+	})
+	return
+}
+
+// LatestDNSQueries memorises the latest queries handled by all DNS daemons, including those made via DNS-over-HTTPS.
+var LatestDNSQueries = NewQueryLog(QueryLogSize)
+
+// FormatQueries returns the query log entries in a multi-line text, one entry per line.
+func FormatQueries(entries []QueryLogEntry) string {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		buf.WriteString(entry.String())
+		buf.WriteRune('\n')
+	}
+	return buf.String()
+}
@@ -0,0 +1,43 @@
+package misc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	queryLog := NewQueryLog(3)
+	queryLog.Iterate(func(entry QueryLogEntry) bool {
+		t.Fatal("should not iterate empty log")
+		return false
+	})
+	for _, name := range []string{"a.lan", "b.lan", "c.lan", "d.lan"} {
+		queryLog.Push(QueryLogEntry{Time: time.Now(), ClientIP: "192.168.1.1" + name[:1], Name: name})
+	}
+	// The oldest entry has been overwritten, and latest entry comes first.
+	var names []string
+	queryLog.Iterate(func(entry QueryLogEntry) bool {
+		names = append(names, entry.Name)
+		return true
+	})
+	if strings.Join(names, " ") != "d.lan c.lan b.lan" {
+		t.Fatal(names)
+	}
+	if found := queryLog.Find("", ""); len(found) != 3 {
+		t.Fatal(found)
+	}
+	if found := queryLog.Find("192.168.1.1c", ""); len(found) != 1 || found[0].Name != "c.lan" {
+		t.Fatal(found)
+	}
+	if found := queryLog.Find("192.168.1.1", "B.LAN"); len(found) != 1 || found[0].Name != "b.lan" {
+		t.Fatal(found)
+	}
+	if found := queryLog.Find("10.", "b.lan"); len(found) != 0 {
+		t.Fatal(found)
+	}
+	// Entries are formatted one per line
+	if text := FormatQueries(queryLog.Find("192.168.1.1d", "")); !strings.HasSuffix(text, "192.168.1.1d  d.lan  in 0ms\n") {
+		t.Fatal(text)
+	}
+}
@@ -13,7 +13,10 @@ import (
 	"time"
 )
 
-var ErrBadEnvInfoChoice = errors.New(`lock | stop | kill | log | warn | runtime | stack | tune`)
+// NumAuditRecordsToRead is the maximum number of latest audit records to retrieve via "audit" command.
+const NumAuditRecordsToRead = 100
+
+var ErrBadEnvInfoChoice = errors.New(`lock | stop | kill | log | warn | runtime | stack | tune | dns [client IP or name] | audit [text]`)
 
 // Retrieve environment information and trigger emergency stop upon request.
 type EnvControl struct {
@@ -39,6 +42,15 @@ func (info *EnvControl) Execute(cmd Command) *Result {
 	if errResult := cmd.Trim(); errResult != nil {
 		return errResult
 	}
+	// DNS query log may be narrowed down by a client IP prefix or a partial domain name
+	if lowerContent := strings.ToLower(cmd.Content); lowerContent == "dns" || strings.HasPrefix(lowerContent, "dns ") {
+		return &Result{Output: GetLatestDNSQueries(strings.TrimSpace(cmd.Content[len("dns"):]))}
+	}
+	// Audit records may be narrowed down by a text, such as daemon name, client ID, or feature trigger.
+	if lowerContent := strings.ToLower(cmd.Content); lowerContent == "audit" || strings.HasPrefix(lowerContent, "audit ") {
+		out, err := GetLatestAuditRecords(strings.TrimSpace(cmd.Content[len("audit"):]))
+		return &Result{Output: out, Error: err}
+	}
 	switch strings.ToLower(cmd.Content) {
 	case "lock":
 		misc.TriggerEmergencyLockDown()
@@ -106,6 +118,42 @@ func GetLatestWarnings() string {
 	return buf.String()
 }
 
+/*
+Return latest DNS queries in a multi-line text, one query per line. Latest query comes first. If filter is not empty,
+only the queries made by client IP beginning with the filter, or asking for a name containing the filter, are returned.
+*/
+func GetLatestDNSQueries(filter string) string {
+	buf := new(bytes.Buffer)
+	misc.LatestDNSQueries.Iterate(func(entry misc.QueryLogEntry) bool {
+		if filter == "" || entry.Matches(filter, "") || entry.Matches("", filter) {
+			buf.WriteString(entry.String())
+			buf.WriteRune('\n')
+		}
+		return true
+	})
+	return buf.String()
+}
+
+/*
+Return latest command audit records in a multi-line text, one record per line. Latest record comes first. If filter is
+not empty, only the records containing the filter text are returned.
+*/
+func GetLatestAuditRecords(filter string) (string, error) {
+	if misc.CommandAuditLog == nil {
+		return "", errors.New("audit log is not configured")
+	}
+	records, err := misc.CommandAuditLog.Read(NumAuditRecordsToRead, filter)
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	for _, record := range records {
+		buf.WriteString(record.String())
+		buf.WriteRune('\n')
+	}
+	return buf.String(), nil
+}
+
 // Return stack traces of all currently running goroutines.
 func GetGoroutineStacktraces() string {
 	buf := new(bytes.Buffer)
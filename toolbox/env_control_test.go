@@ -3,8 +3,12 @@ package toolbox
 import (
 	"fmt"
 	"github.com/HouzuoGuo/laitos/misc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestEnvControl_Execute(t *testing.T) {
@@ -38,6 +42,43 @@ func TestEnvControl_Execute(t *testing.T) {
 	if ret := info.Execute(Command{Content: "stack"}); ret.Error != nil || strings.Index(ret.Output, "routine") == -1 {
 		t.Fatal(ret)
 	}
+	// Test DNS query log retrieval
+	misc.LatestDNSQueries.Push(misc.QueryLogEntry{Time: time.Now(), ClientIP: "192.0.2.1", Name: "envinfo-a.example.com", Type: "A", Result: "forwarded"})
+	misc.LatestDNSQueries.Push(misc.QueryLogEntry{Time: time.Now(), ClientIP: "192.0.2.2", Name: "envinfo-b.example.com", Type: "AAAA", Result: "blocked"})
+	if ret := info.Execute(Command{Content: "dns"}); ret.Error != nil || strings.Index(ret.Output, "envinfo-a") == -1 || strings.Index(ret.Output, "envinfo-b") == -1 {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "dns 192.0.2.2"}); ret.Error != nil || strings.Index(ret.Output, "envinfo-a") != -1 || strings.Index(ret.Output, "192.0.2.2 AAAA envinfo-b.example.com blocked") == -1 {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "DNS ENVINFO-A"}); ret.Error != nil || strings.Index(ret.Output, "envinfo-a") == -1 || strings.Index(ret.Output, "envinfo-b") != -1 {
+		t.Fatal(ret)
+	}
+	// Test audit log retrieval
+	if ret := info.Execute(Command{Content: "audit"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	tmpDir, err := ioutil.TempDir("", "laitos-TestEnvControl_Execute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	auditLog := &misc.AuditLog{FilePath: filepath.Join(tmpDir, "audit.log")}
+	if err := auditLog.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	misc.CommandAuditLog = auditLog
+	defer func() {
+		misc.CommandAuditLog = nil
+	}()
+	auditLog.Write(misc.AuditRecord{Time: time.Now(), DaemonName: "telegram", Trigger: ".s", Command: "envinfo-a"})
+	auditLog.Write(misc.AuditRecord{Time: time.Now(), DaemonName: "httpd-form", Trigger: ".e", Command: "envinfo-b"})
+	if ret := info.Execute(Command{Content: "audit"}); ret.Error != nil || strings.Index(ret.Output, "envinfo-b") > strings.Index(ret.Output, "envinfo-a") {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "AUDIT Telegram"}); ret.Error != nil || strings.Index(ret.Output, "telegram - - .s \"envinfo-a\"") == -1 || strings.Index(ret.Output, "envinfo-b") != -1 {
+		t.Fatal(ret)
+	}
 	// Test system tuning
 	ret := info.Execute(Command{Content: "tune"})
 	fmt.Println(ret.Output)
@@ -21,6 +21,9 @@ var (
 type Command struct {
 	TimeoutSec int
 	Content    string
+	Principal  string // Principal is the name of user identified by PIN or shortcut, it is empty for the default PIN and shortcuts.
+	DaemonName string // DaemonName is the daemon or front-end that received the command, it is recorded in audit log.
+	ClientID   string // ClientID identifies the client who issued the command (e.g. IP address), it is recorded in audit log.
 }
 
 // Modify command content to remove leading and trailing white spaces. Return error result if command becomes empty afterwards.
@@ -63,6 +66,7 @@ type Result struct {
 	Error          error   // Result error if there is any
 	Output         string  // Human readable normal output excluding error text
 	CombinedOutput string  // Human readable error text + normal output. This is set when calling SetCombinedText() function.
+	Trigger        Trigger // Trigger of the feature that executed the command, it is set by CommandProcessor.
 }
 
 // Return error text or empty string if error is absent.
@@ -2,9 +2,15 @@
 package filter
 
 import (
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"github.com/HouzuoGuo/laitos/toolbox"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 /*
@@ -15,37 +21,233 @@ type CommandFilter interface {
 	Transform(toolbox.Command) (toolbox.Command, error)
 }
 
+/*
+Principal is a named user who has their own PIN and shortcuts, and may only use the features permitted to them.
+*/
+type Principal struct {
+	PIN             string                       `json:"PIN"`             // PIN identifies the principal, it may be empty if the principal only uses shortcuts.
+	Shortcuts       map[string]string            `json:"Shortcuts"`       // Shortcuts are expanded into commands that run on behalf of the principal.
+	DaemonShortcuts map[string]map[string]string `json:"DaemonShortcuts"` // DaemonShortcuts are shortcuts that only work for commands received by the named daemon (e.g. "twilio-call").
+	AllowTriggers   []string                     `json:"AllowTriggers"`   // AllowTriggers are the feature triggers (e.g. ".w") permitted to the principal, leave empty to permit all.
+}
+
+const MaxShortcutExpansions = 5 // MaxShortcutExpansions is the maximum number of times a shortcut may expand into another shortcut.
+
+var (
+	RegexShortcutPlaceholder = regexp.MustCompile(`\$[1-9]`) // Match a positional argument placeholder in shortcut, e.g. $1.
+	ErrShortcutTooDeep       = fmt.Errorf("Shortcut expanded more than %d times", MaxShortcutExpansions)
+)
+
+/*
+matchShortcut matches a line of input against shortcut name, and returns the positional arguments that correspond to the
+placeholders among shortcut name. Words of the shortcut name must match the input word by word, a placeholder ($1 to $9)
+captures one word, or the remainder of input if the placeholder is the last word of shortcut name.
+*/
+func matchShortcut(name, line string) (args map[string]string, matched bool) {
+	nameWords := strings.Fields(name)
+	lineWords := strings.Fields(line)
+	if len(nameWords) == 0 || len(lineWords) < len(nameWords) {
+		return nil, false
+	}
+	args = make(map[string]string)
+	for i, nameWord := range nameWords {
+		if !RegexShortcutPlaceholder.MatchString(nameWord) || len(nameWord) != 2 {
+			if nameWord != lineWords[i] {
+				return nil, false
+			}
+			continue
+		}
+		if i == len(nameWords)-1 {
+			args[nameWord] = strings.Join(lineWords[i:], " ")
+			return args, true
+		}
+		args[nameWord] = lineWords[i]
+	}
+	return args, len(lineWords) == len(nameWords)
+}
+
+/*
+findShortcut looks for the shortcut that matches the input line among the shortcut sets, and returns its expansion with
+placeholders substituted by positional arguments. Sets that come first take priority, and within the same set a shortcut
+name that has more words takes priority.
+*/
+func findShortcut(line string, shortcutSets ...map[string]string) (expansion string, found bool) {
+	for _, shortcuts := range shortcutSets {
+		// Shortcut without placeholder must match the entire line
+		if expansion, exists := shortcuts[line]; exists {
+			return expansion, true
+		}
+		var bestName string
+		var bestArgs map[string]string
+		for name := range shortcuts {
+			if !RegexShortcutPlaceholder.MatchString(name) {
+				continue
+			}
+			args, matched := matchShortcut(name, line)
+			if !matched {
+				continue
+			}
+			if bestArgs == nil || len(strings.Fields(name)) > len(strings.Fields(bestName)) ||
+				len(strings.Fields(name)) == len(strings.Fields(bestName)) && name < bestName {
+				bestName, bestArgs = name, args
+			}
+		}
+		if bestArgs != nil {
+			return RegexShortcutPlaceholder.ReplaceAllStringFunc(shortcuts[bestName], func(placeholder string) string {
+				return bestArgs[placeholder]
+			}), true
+		}
+	}
+	return "", false
+}
+
 /*
 Match prefix PIN (or pre-defined shortcuts) against lines among input command. Return the matched line trimmed
 and without PIN prefix, or expanded shortcut if found.
 To successfully expend shortcut, the shortcut must occupy the entire line, without extra prefix or suffix.
+A shortcut may take positional arguments, e.g. shortcut "weather $1" expands "weather sydney" into ".w weather forecast
+sydney", and a shortcut may expand into another shortcut. The command that follows a PIN may also be a shortcut.
+Shortcuts under DaemonShortcuts only work for commands received by the named daemon, and they take priority over others.
+Besides the default PIN and shortcuts that may use all features, named principals may have their own PIN and shortcuts,
+the name of matched principal is recorded in the returned command.
 Return error if neither PIN nor pre-defined shortcuts matched any line of input command.
 */
 type PINAndShortcuts struct {
-	PIN       string            `json:"PIN"`
-	Shortcuts map[string]string `json:"Shortcuts"`
+	PIN             string                       `json:"PIN"`
+	Shortcuts       map[string]string            `json:"Shortcuts"`
+	DaemonShortcuts map[string]map[string]string `json:"DaemonShortcuts"` // DaemonShortcuts are shortcuts that only work for commands received by the named daemon (e.g. "twilio-call").
+	Principals      map[string]Principal         `json:"Principals"`      // Principals are named users, each has its own PIN, shortcuts, and permitted features.
 }
 
 var ErrPINAndShortcutNotFound = errors.New("Failed to match PIN/shortcut")
 
+// IsConfigured returns true only if there is a default PIN, default shortcuts, or a principal.
+func (pin *PINAndShortcuts) IsConfigured() bool {
+	return pin.PIN != "" || len(pin.Shortcuts) > 0 || len(pin.DaemonShortcuts) > 0 || len(pin.Principals) > 0
+}
+
+// getShortcutSets returns the shortcuts of the principal (empty name for default) for commands received by the daemon.
+func (pin *PINAndShortcuts) getShortcutSets(principalName, daemonName string) []map[string]string {
+	if principalName == "" {
+		return []map[string]string{pin.DaemonShortcuts[daemonName], pin.Shortcuts}
+	}
+	principal := pin.Principals[principalName]
+	return []map[string]string{principal.DaemonShortcuts[daemonName], principal.Shortcuts}
+}
+
+/*
+expandShortcut repeatedly expands the line if it matches a shortcut of the principal. Return true only if the line
+was expanded at least once.
+*/
+func (pin *PINAndShortcuts) expandShortcut(principalName, daemonName, line string) (string, bool, error) {
+	shortcutSets := pin.getShortcutSets(principalName, daemonName)
+	for i := 0; ; i++ {
+		expansion, found := findShortcut(line, shortcutSets...)
+		if !found {
+			return line, i > 0, nil
+		}
+		if i == MaxShortcutExpansions {
+			return "", true, ErrShortcutTooDeep
+		}
+		line = strings.TrimSpace(expansion)
+	}
+}
+
+/*
+Check returns an error if a shortcut begins with a placeholder (which would match nearly all input), or its expansion
+refers to a placeholder that is not among the shortcut name, or if a principal's PIN is identical to the default PIN or
+to the PIN of another principal.
+*/
+func (pin *PINAndShortcuts) Check() error {
+	principalNames := make([]string, 0, len(pin.Principals))
+	for name := range pin.Principals {
+		principalNames = append(principalNames, name)
+	}
+	sort.Strings(principalNames)
+	pinOwners := make(map[string]string)
+	for _, name := range principalNames {
+		principalPIN := pin.Principals[name].PIN
+		if principalPIN == "" {
+			continue
+		}
+		if principalPIN == pin.PIN {
+			return fmt.Errorf("PIN of principal \"%s\" must not be identical to the default PIN", name)
+		}
+		if owner, exists := pinOwners[principalPIN]; exists {
+			return fmt.Errorf("principals \"%s\" and \"%s\" must not share the same PIN", owner, name)
+		}
+		pinOwners[principalPIN] = name
+	}
+	allSets := []map[string]string{pin.Shortcuts}
+	for _, shortcuts := range pin.DaemonShortcuts {
+		allSets = append(allSets, shortcuts)
+	}
+	for _, principal := range pin.Principals {
+		allSets = append(allSets, principal.Shortcuts)
+		for _, shortcuts := range principal.DaemonShortcuts {
+			allSets = append(allSets, shortcuts)
+		}
+	}
+	for _, shortcuts := range allSets {
+		for name, expansion := range shortcuts {
+			nameWords := strings.Fields(name)
+			if len(nameWords) == 0 || RegexShortcutPlaceholder.MatchString(nameWords[0]) {
+				return fmt.Errorf("shortcut that expands into \"%s\" must begin with a word that is not a placeholder", expansion)
+			}
+			for _, placeholder := range RegexShortcutPlaceholder.FindAllString(expansion, -1) {
+				if !strings.Contains(" "+strings.Join(nameWords, " ")+" ", " "+placeholder+" ") {
+					return fmt.Errorf("shortcut that expands into \"%s\" does not have placeholder %s", expansion, placeholder)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (pin *PINAndShortcuts) Transform(cmd toolbox.Command) (toolbox.Command, error) {
-	if pin.PIN == "" && (pin.Shortcuts == nil || len(pin.Shortcuts) == 0) {
+	if !pin.IsConfigured() {
 		return toolbox.Command{}, errors.New("Both PIN and shortcuts are undefined")
 	}
+	principalNames := make([]string, 0, len(pin.Principals))
+	for name := range pin.Principals {
+		principalNames = append(principalNames, name)
+	}
+	sort.Strings(principalNames)
 	for _, line := range cmd.Lines() {
 		line = strings.TrimSpace(line)
 		// Try to match shortcut, then return expanded shortcut alone.
-		if pin.Shortcuts != nil {
-			if shortcut, exists := pin.Shortcuts[line]; exists {
+		for _, name := range append([]string{""}, principalNames...) {
+			if expansion, expanded, err := pin.expandShortcut(name, cmd.DaemonName, line); err != nil {
+				return cmd, err
+			} else if expanded {
 				ret := cmd
-				ret.Content = shortcut
+				ret.Content = expansion
+				ret.Principal = name
 				return ret, nil
 			}
 		}
-		// Try to match PIN prefix, then remove it from successfully matched line.
-		if len(line) > len(pin.PIN) && line[0:len(pin.PIN)] == pin.PIN {
+		// Try to match PIN prefix, the longest matching PIN wins in case a PIN begins with another PIN.
+		matched, matchedName, matchedPIN := false, "", ""
+		if pin.PIN != "" && len(line) > len(pin.PIN) && line[0:len(pin.PIN)] == pin.PIN {
+			matched, matchedPIN = true, pin.PIN
+		}
+		for _, name := range principalNames {
+			principal := pin.Principals[name]
+			if principal.PIN != "" && len(line) > len(principal.PIN) && strings.HasPrefix(line, principal.PIN) && (!matched || len(principal.PIN) > len(matchedPIN)) {
+				matched, matchedName, matchedPIN = true, name, principal.PIN
+			}
+		}
+		// Remove PIN from successfully matched line, the remainder may be a shortcut too.
+		if matched {
 			ret := cmd
-			ret.Content = line[len(pin.PIN):]
+			ret.Content = line[len(matchedPIN):]
+			ret.Principal = matchedName
+			expansion, expanded, err := pin.expandShortcut(matchedName, cmd.DaemonName, strings.TrimSpace(ret.Content))
+			if err != nil {
+				return cmd, err
+			} else if expanded {
+				ret.Content = expansion
+			}
 			return ret, nil
 		}
 	}
@@ -53,6 +255,119 @@ func (pin *PINAndShortcuts) Transform(cmd toolbox.Command) (toolbox.Command, err
 	return cmd, ErrPINAndShortcutNotFound
 }
 
+/*
+IsTriggerAllowed returns true only if the principal may use the feature of the trigger. The default PIN and shortcuts
+(empty principal name) may use all features.
+*/
+func (pin *PINAndShortcuts) IsTriggerAllowed(principalName string, trigger toolbox.Trigger) bool {
+	if principalName == "" {
+		return true
+	}
+	principal, exists := pin.Principals[principalName]
+	if !exists {
+		return false
+	}
+	if len(principal.AllowTriggers) == 0 {
+		return true
+	}
+	for _, allowed := range principal.AllowTriggers {
+		if toolbox.Trigger(allowed) == trigger {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	TOTPIntervalSec      = 30 // TOTPIntervalSec is the validity period of a single TOTP code, as suggested by RFC 6238.
+	TOTPCodeLength       = 6  // TOTPCodeLength is the number of digits in a TOTP code.
+	TOTPDefaultWindowSec = 60 // TOTPDefaultWindowSec is the default tolerance of clock drift and delivery delay.
+)
+
+var ErrTOTPNotFound = errors.New("Failed to match TOTP code")
+
+/*
+totpLastUsedIntervals is the time interval of the latest accepted password, keyed by TOTP secret. The record is kept
+outside of filter so that a password is not accepted twice by copies of the same filter configuration, such as
+those among HTTP and HTTPS daemons.
+*/
+var (
+	totpLastUsedIntervals = make(map[string]int64)
+	totpMutex             = new(sync.Mutex)
+)
+
+/*
+TOTP requires the command content to begin with a time-based one-time password (RFC 6238) as the second factor, and
+removes the password from the content. The filter is placed after PINAndShortcuts, therefore the password is entered
+right after the PIN, e.g. "mypin123456 .s date". Because an expanded shortcut does not carry a password, shortcuts are
+effectively disabled wherever TOTP is demanded.
+A password is accepted only once, and passwords of earlier time intervals are no longer accepted after that.
+*/
+type TOTP struct {
+	Secret    string `json:"Secret"`    // Secret is the base32 encoded shared secret, as used by authenticator apps.
+	WindowSec int    `json:"WindowSec"` // WindowSec tolerates passwords of intervals this many seconds before and after now.
+}
+
+// IsConfigured returns true only if TOTP secret is present.
+func (totp *TOTP) IsConfigured() bool {
+	return totp.Secret != ""
+}
+
+// window returns the number of time intervals tolerated before and after the current interval.
+func (totp *TOTP) window() int64 {
+	windowSec := totp.WindowSec
+	if windowSec < 1 {
+		windowSec = TOTPDefaultWindowSec
+	}
+	return int64((windowSec + TOTPIntervalSec - 1) / TOTPIntervalSec)
+}
+
+// Check returns an error if the secret cannot be used to calculate passwords.
+func (totp *TOTP) Check() error {
+	if !totp.IsConfigured() {
+		return errors.New("TOTP secret is undefined")
+	}
+	_, err := toolbox.GetTwoFACodeForTimeDivision(totp.Secret, 0)
+	return err
+}
+
+func (totp *TOTP) Transform(cmd toolbox.Command) (toolbox.Command, error) {
+	if !totp.IsConfigured() {
+		return toolbox.Command{}, errors.New("TOTP secret is undefined")
+	}
+	content := strings.TrimSpace(cmd.Content)
+	if len(content) < TOTPCodeLength {
+		return cmd, ErrTOTPNotFound
+	}
+	code := content[:TOTPCodeLength]
+	for _, digit := range code {
+		if digit < '0' || digit > '9' {
+			return cmd, ErrTOTPNotFound
+		}
+	}
+	currentInterval := time.Now().Unix() / TOTPIntervalSec
+	totpMutex.Lock()
+	defer totpMutex.Unlock()
+	for interval := currentInterval - totp.window(); interval <= currentInterval+totp.window(); interval++ {
+		expected, err := toolbox.GetTwoFACodeForTimeDivision(totp.Secret, interval)
+		if err != nil {
+			return toolbox.Command{}, err
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) != 1 {
+			continue
+		}
+		// Reject a password that is replayed, or that is older than the latest accepted password.
+		if interval <= totpLastUsedIntervals[totp.Secret] {
+			return cmd, ErrTOTPNotFound
+		}
+		totpLastUsedIntervals[totp.Secret] = interval
+		ret := cmd
+		ret.Content = strings.TrimSpace(content[TOTPCodeLength:])
+		return ret, nil
+	}
+	return cmd, ErrTOTPNotFound
+}
+
 // Translate character sequences to something different.
 type TranslateSequences struct {
 	Sequences [][]string `json:"Sequences"`
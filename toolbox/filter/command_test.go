@@ -3,6 +3,7 @@ package filter
 import (
 	"github.com/HouzuoGuo/laitos/toolbox"
 	"testing"
+	"time"
 )
 
 func TestPINAndShortcuts_Transform(t *testing.T) {
@@ -39,6 +40,129 @@ func TestPINAndShortcuts_Transform(t *testing.T) {
 	}
 }
 
+func TestPINAndShortcuts_Principals(t *testing.T) {
+	pin := PINAndShortcuts{Principals: map[string]Principal{
+		"alice": {PIN: "alicepin", AllowTriggers: []string{".w", ".c"}},
+		"bob":   {PIN: "alicepinbob", Shortcuts: map[string]string{"bobdate": ".s date"}},
+		"carol": {Shortcuts: map[string]string{"caroldate": ".s date"}},
+	}}
+	if !pin.IsConfigured() {
+		t.Fatal("should be configured")
+	}
+	// Without a default PIN, nothing else matches
+	if out, err := pin.Transform(toolbox.Command{Content: "abc"}); err != ErrPINAndShortcutNotFound || out.Content != "abc" || out.Principal != "" {
+		t.Fatal(out, err)
+	}
+	if out, err := pin.Transform(toolbox.Command{Content: "line\n alicepin.w abc \n"}); err != nil || out.Content != ".w abc" || out.Principal != "alice" {
+		t.Fatal(out, err)
+	}
+	// The longest PIN wins
+	if out, err := pin.Transform(toolbox.Command{Content: "alicepinbob.s date"}); err != nil || out.Content != ".s date" || out.Principal != "bob" {
+		t.Fatal(out, err)
+	}
+	if out, err := pin.Transform(toolbox.Command{Content: "caroldate"}); err != nil || out.Content != ".s date" || out.Principal != "carol" {
+		t.Fatal(out, err)
+	}
+	// Default PIN does not belong to any principal
+	pin.PIN = "defaultpin"
+	if out, err := pin.Transform(toolbox.Command{Content: "defaultpin.s date"}); err != nil || out.Content != ".s date" || out.Principal != "" {
+		t.Fatal(out, err)
+	}
+	if err := pin.Check(); err != nil {
+		t.Fatal(err)
+	}
+	// Principals must not share PIN with each other or with the default PIN
+	pin.Principals["dave"] = Principal{PIN: "alicepin"}
+	if err := pin.Check(); err == nil {
+		t.Fatal("should have failed")
+	}
+	pin.Principals["dave"] = Principal{PIN: "defaultpin"}
+	if err := pin.Check(); err == nil {
+		t.Fatal("should have failed")
+	}
+	delete(pin.Principals, "dave")
+	// Permissions
+	if !pin.IsTriggerAllowed("", ".s") || !pin.IsTriggerAllowed("alice", ".w") || !pin.IsTriggerAllowed("bob", ".s") {
+		t.Fatal("should have allowed")
+	}
+	if pin.IsTriggerAllowed("alice", ".s") || pin.IsTriggerAllowed("dave", ".w") {
+		t.Fatal("should not have allowed")
+	}
+}
+
+func TestPINAndShortcuts_Macros(t *testing.T) {
+	pin := PINAndShortcuts{
+		PIN: "mypin",
+		Shortcuts: map[string]string{
+			"weather $1":          ".w weather forecast $1",
+			"weather in $1 on $2": ".w weather forecast $1 $2",
+			"wt $1":               "weather $1",
+			"loop":                "loop again",
+			"loop again":          "loop",
+			"date":                ".s date",
+		},
+		DaemonShortcuts: map[string]map[string]string{
+			"twilio-call": {"1 $1": "weather $1", "date": ".s date -u"},
+		},
+		Principals: map[string]Principal{
+			"alice": {PIN: "alicepin", AllowTriggers: []string{".w"}, DaemonShortcuts: map[string]map[string]string{
+				"telegram": {"mail $1 $2": ".m $1 $2"},
+			}},
+		},
+	}
+	if err := pin.Check(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		daemon, input, content, principal string
+	}{
+		// The last placeholder takes the remainder of input
+		{"", "weather  new  york ", ".w weather forecast new york", ""},
+		// More specific shortcut wins
+		{"", "weather in sydney on monday", ".w weather forecast sydney monday", ""},
+		// Shortcut expands into another shortcut
+		{"", "wt sydney", ".w weather forecast sydney", ""},
+		// Daemon shortcut takes priority
+		{"twilio-call", "date", ".s date -u", ""},
+		{"twilio-call", "1 sydney", ".w weather forecast sydney", ""},
+		{"telegram", "date", ".s date", ""},
+		// Shortcut after PIN
+		{"", "mypin weather sydney", ".w weather forecast sydney", ""},
+		{"", "mypin.s date", ".s date", ""},
+		{"telegram", "alicepin mail a@example.com hi there", ".m a@example.com hi there", "alice"},
+		{"telegram", "mail a@example.com hi there", ".m a@example.com hi there", "alice"},
+		{"", "mail a@example.com hi there", "", ""},
+		{"", "alicepin mail a@example.com hi there", " mail a@example.com hi there", "alice"},
+	} {
+		out, err := pin.Transform(toolbox.Command{DaemonName: test.daemon, Content: test.input})
+		if test.content == "" {
+			if err != ErrPINAndShortcutNotFound {
+				t.Fatal(test, out, err)
+			}
+			continue
+		}
+		if err != nil || out.Content != test.content || out.Principal != test.principal {
+			t.Fatal(test, out, err)
+		}
+	}
+	// Shortcuts must not expand indefinitely
+	if _, err := pin.Transform(toolbox.Command{Content: "loop"}); err != ErrShortcutTooDeep {
+		t.Fatal(err)
+	}
+	if _, err := pin.Transform(toolbox.Command{Content: "weather"}); err != ErrPINAndShortcutNotFound {
+		t.Fatal(err)
+	}
+	// Bad shortcuts
+	pin.Shortcuts = map[string]string{"$1": ".s $1"}
+	if err := pin.Check(); err == nil {
+		t.Fatal("should have failed")
+	}
+	pin.Shortcuts = map[string]string{"abc $1": ".s $2"}
+	if err := pin.Check(); err == nil {
+		t.Fatal("should have failed")
+	}
+}
+
 func TestTranslateSequences_Transform(t *testing.T) {
 	tr := TranslateSequences{}
 	if out, err := tr.Transform(toolbox.Command{Content: "abc"}); err != nil || out.Content != "abc" {
@@ -55,3 +179,52 @@ func TestTranslateSequences_Transform(t *testing.T) {
 		t.Fatal(out)
 	}
 }
+
+func TestTOTP_Transform(t *testing.T) {
+	totp := TOTP{}
+	if _, err := totp.Transform(toolbox.Command{Content: "123456 abc"}); err == nil {
+		t.Fatal("should have been an error")
+	}
+	totp = TOTP{Secret: "JBSWY3DPEHPK3PXP", WindowSec: 30}
+	if err := totp.Check(); err != nil {
+		t.Fatal(err)
+	}
+	currentInterval := time.Now().Unix() / TOTPIntervalSec
+	codeOf := func(interval int64) string {
+		code, err := toolbox.GetTwoFACodeForTimeDivision(totp.Secret, interval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	// Missing or malformed code
+	for _, content := range []string{"", "abc", "12345", "12345a abc"} {
+		if out, err := totp.Transform(toolbox.Command{Content: content}); err != ErrTOTPNotFound || out.Content != content {
+			t.Fatal(out, err)
+		}
+	}
+	// Code outside of the window
+	if _, err := totp.Transform(toolbox.Command{Content: codeOf(currentInterval-3) + "abc"}); err != ErrTOTPNotFound {
+		t.Fatal(err)
+	}
+	// Code of the previous interval is within the window
+	if out, err := totp.Transform(toolbox.Command{Content: " " + codeOf(currentInterval-1) + " .s date "}); err != nil || out.Content != ".s date" {
+		t.Fatal(out, err)
+	}
+	// Replay is rejected
+	if _, err := totp.Transform(toolbox.Command{Content: codeOf(currentInterval-1) + ".s date"}); err != ErrTOTPNotFound {
+		t.Fatal(err)
+	}
+	// Code of the next interval is accepted, after which the current code becomes obsolete.
+	if out, err := totp.Transform(toolbox.Command{Content: codeOf(currentInterval+1) + ".s date"}); err != nil || out.Content != ".s date" {
+		t.Fatal(out, err)
+	}
+	if _, err := totp.Transform(toolbox.Command{Content: codeOf(currentInterval) + ".s date"}); err != ErrTOTPNotFound {
+		t.Fatal(err)
+	}
+	// Bad secret
+	totp = TOTP{Secret: "not-base32!"}
+	if err := totp.Check(); err == nil {
+		t.Fatal("should have been an error")
+	}
+}
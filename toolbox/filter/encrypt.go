@@ -0,0 +1,278 @@
+package filter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"strings"
+)
+
+const (
+	EncryptedOutputBegin   = "-----BEGIN LAITOS ENCRYPTED OUTPUT-----" // EncryptedOutputBegin is the first line of armored encrypted output.
+	EncryptedOutputEnd     = "-----END LAITOS ENCRYPTED OUTPUT-----"   // EncryptedOutputEnd is the last line of armored encrypted output.
+	EncryptedOutputVersion = 1                                         // EncryptedOutputVersion is the format version of encrypted output.
+	EncryptedOutputLineLen = 64                                        // EncryptedOutputLineLen is the length of each line of armored base64 text.
+
+	x25519KeyLength   = 32                     // x25519KeyLength is the length of X25519 public and private keys.
+	wrappedKeyLength  = x25519KeyLength + 16   // wrappedKeyLength is the length of AES-GCM encrypted file key including authentication tag.
+	recipientBlockLen = 32 + wrappedKeyLength  // recipientBlockLen is the length of ephemeral public key and wrapped file key for a recipient.
+	x25519KDFInfo     = "laitos-x25519-output" // x25519KDFInfo distinguishes the key derived for wrapping file key.
+)
+
+var (
+	ErrBadEncryptedOutput = errors.New("input is not a valid encrypted output")
+	ErrNotRecipient       = errors.New("the private key is not among the recipients of the encrypted output")
+)
+
+/*
+EncryptOutput encrypts command output for each of the recipients' X25519 public keys, so that the output can travel
+through third-party mail servers and messaging services without revealing its content. Similar to age, the output is
+encrypted by AES-GCM using a random file key, and the file key is wrapped for each recipient using a key derived from
+an X25519 exchange with a freshly generated ephemeral key. The result is armored base64 text.
+The filter does nothing unless recipient public keys are configured.
+*/
+type EncryptOutput struct {
+	RecipientPublicKeys []string `json:"RecipientPublicKeys"` // RecipientPublicKeys are base64-encoded X25519 public keys of recipients.
+}
+
+// IsConfigured returns true only if there is at least one recipient public key.
+func (enc *EncryptOutput) IsConfigured() bool {
+	return len(enc.RecipientPublicKeys) > 0
+}
+
+// getPublicKeys decodes all recipient public keys.
+func (enc *EncryptOutput) getPublicKeys() ([]*ecdh.PublicKey, error) {
+	ret := make([]*ecdh.PublicKey, 0, len(enc.RecipientPublicKeys))
+	for i, encodedKey := range enc.RecipientPublicKeys {
+		keyBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+		if err != nil {
+			return nil, fmt.Errorf("public key #%d is not valid base64 text - %v", i, err)
+		}
+		key, err := ecdh.X25519().NewPublicKey(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("public key #%d is not a valid X25519 key - %v", i, err)
+		}
+		ret = append(ret, key)
+	}
+	return ret, nil
+}
+
+// Check returns an error if any of the recipient public keys is invalid.
+func (enc *EncryptOutput) Check() error {
+	if len(enc.RecipientPublicKeys) > 255 {
+		return errors.New("there may not be more than 255 recipients")
+	}
+	_, err := enc.getPublicKeys()
+	return err
+}
+
+/*
+deriveWrapKey derives the key that wraps file key from an X25519 shared secret, using HKDF-SHA256 bound to the ephemeral
+and recipient public keys.
+*/
+func deriveWrapKey(sharedSecret, ephemeralPublicKey, recipientPublicKey []byte) []byte {
+	extract := hmac.New(sha256.New, append(append([]byte{}, ephemeralPublicKey...), recipientPublicKey...))
+	extract.Write(sharedSecret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(x25519KDFInfo))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// sealAESGCM encrypts plain text with AES-256-GCM and returns cipher text including authentication tag.
+func sealAESGCM(key, nonce, plainText []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nil, nonce, plainText, nil), nil
+}
+
+// openAESGCM decrypts and authenticates cipher text encrypted by sealAESGCM.
+func openAESGCM(key, nonce, cipherText []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, cipherText, nil)
+}
+
+/*
+Encrypt encrypts the text for all recipients and returns armored text. The binary layout is: version (1 byte), number of
+recipients (1 byte), for each recipient an ephemeral public key (32 bytes) and wrapped file key (48 bytes), then the
+nonce (12 bytes) and cipher text of the output.
+*/
+func (enc *EncryptOutput) Encrypt(text string) (string, error) {
+	recipients, err := enc.getPublicKeys()
+	if err != nil {
+		return "", err
+	}
+	if len(recipients) == 0 || len(recipients) > 255 {
+		return "", errors.New("there must be between 1 and 255 recipients")
+	}
+	fileKey := make([]byte, x25519KeyLength)
+	if _, err := rand.Read(fileKey); err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	out.WriteByte(EncryptedOutputVersion)
+	out.WriteByte(byte(len(recipients)))
+	for _, recipient := range recipients {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		sharedSecret, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return "", err
+		}
+		ephemeralPublicKey := ephemeral.PublicKey().Bytes()
+		// Each wrap key is used only once, hence the all-zero nonce is safe.
+		wrappedKey, err := sealAESGCM(deriveWrapKey(sharedSecret, ephemeralPublicKey, recipient.Bytes()), make([]byte, 12), fileKey)
+		if err != nil {
+			return "", err
+		}
+		out.Write(ephemeralPublicKey)
+		out.Write(wrappedKey)
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	cipherText, err := sealAESGCM(fileKey, nonce, []byte(text))
+	if err != nil {
+		return "", err
+	}
+	out.Write(nonce)
+	out.Write(cipherText)
+	// Armor the binary in lines of base64 text
+	encoded := base64.StdEncoding.EncodeToString(out.Bytes())
+	lines := []string{EncryptedOutputBegin}
+	for len(encoded) > EncryptedOutputLineLen {
+		lines = append(lines, encoded[:EncryptedOutputLineLen])
+		encoded = encoded[EncryptedOutputLineLen:]
+	}
+	lines = append(lines, encoded, EncryptedOutputEnd)
+	return strings.Join(lines, "\n"), nil
+}
+
+// ArmoredLength returns the length of armored encrypted output for a plain text of the specified length.
+func (enc *EncryptOutput) ArmoredLength(plainTextLength int) int {
+	binaryLength := 2 + len(enc.RecipientPublicKeys)*recipientBlockLen + 12 + plainTextLength + 16
+	encodedLength := (binaryLength + 2) / 3 * 4
+	numLines := (encodedLength + EncryptedOutputLineLen - 1) / EncryptedOutputLineLen
+	// The encoded lines are sandwiched between the beginning and ending lines, all separated by line breaks.
+	return len(EncryptedOutputBegin) + encodedLength + len(EncryptedOutputEnd) + numLines + 1
+}
+
+/*
+MaxPlainTextLength returns the maximum length of plain text whose armored encrypted output fits into the armored length.
+Return 0 if the armored length is too short for any encrypted output.
+*/
+func (enc *EncryptOutput) MaxPlainTextLength(armoredLength int) int {
+	// Base64 encoding makes the output longer than plain text, hence the search begins from three quarters.
+	ret := armoredLength * 3 / 4
+	for ret > 0 && enc.ArmoredLength(ret) > armoredLength {
+		ret--
+	}
+	return ret
+}
+
+func (enc *EncryptOutput) Transform(result *toolbox.Result) error {
+	if !enc.IsConfigured() {
+		return nil
+	}
+	encrypted, err := enc.Encrypt(result.CombinedOutput)
+	if err != nil {
+		// Never reveal the output in clear text, stop further transformation such as notification mail.
+		result.CombinedOutput = ""
+		return fmt.Errorf("EncryptOutput.Transform: failed to encrypt output - %v", err)
+	}
+	result.CombinedOutput = encrypted
+	return nil
+}
+
+func (_ *EncryptOutput) SetLogger(_ misc.Logger) {
+}
+
+// GenerateX25519Key generates a new pair of private and public keys for decrypting and encrypting output, both are base64-encoded.
+func GenerateX25519Key() (privateKey, publicKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()), base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// DecryptOutput decrypts armored output using the base64-encoded private key of one of its recipients.
+func DecryptOutput(armored, privateKey string) (string, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil {
+		return "", fmt.Errorf("DecryptOutput: private key is not valid base64 text - %v", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(keyBytes)
+	if err != nil {
+		return "", fmt.Errorf("DecryptOutput: private key is not a valid X25519 key - %v", err)
+	}
+	// Remove armor, the text may have been indented, quoted, or wrapped by mail clients.
+	begin := strings.Index(armored, EncryptedOutputBegin)
+	end := strings.Index(armored, EncryptedOutputEnd)
+	if begin == -1 || end < begin {
+		return "", ErrBadEncryptedOutput
+	}
+	encoded := strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '+' || r == '/' || r == '=' {
+			return r
+		}
+		return -1
+	}, armored[begin+len(EncryptedOutputBegin):end])
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < 2 || data[0] != EncryptedOutputVersion {
+		return "", ErrBadEncryptedOutput
+	}
+	numRecipients := int(data[1])
+	blocksEnd := 2 + numRecipients*recipientBlockLen
+	if len(data) < blocksEnd+12 {
+		return "", ErrBadEncryptedOutput
+	}
+	publicKey := key.PublicKey().Bytes()
+	for i := 0; i < numRecipients; i++ {
+		block := data[2+i*recipientBlockLen : 2+(i+1)*recipientBlockLen]
+		ephemeral, err := ecdh.X25519().NewPublicKey(block[:32])
+		if err != nil {
+			continue
+		}
+		sharedSecret, err := key.ECDH(ephemeral)
+		if err != nil {
+			continue
+		}
+		fileKey, err := openAESGCM(deriveWrapKey(sharedSecret, block[:32], publicKey), make([]byte, 12), block[32:])
+		if err != nil {
+			// The block belongs to another recipient
+			continue
+		}
+		plainText, err := openAESGCM(fileKey, data[blocksEnd:blocksEnd+12], data[blocksEnd+12:])
+		if err != nil {
+			return "", ErrBadEncryptedOutput
+		}
+		return string(plainText), nil
+	}
+	return "", ErrNotRecipient
+}
@@ -0,0 +1,96 @@
+package filter
+
+import (
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"strings"
+	"testing"
+)
+
+func TestEncryptOutput_Transform(t *testing.T) {
+	// Not configured - do nothing
+	enc := EncryptOutput{}
+	result := &toolbox.Result{CombinedOutput: "hello"}
+	if err := enc.Transform(result); err != nil || result.CombinedOutput != "hello" {
+		t.Fatal(err, result)
+	}
+	// Bad public key must not reveal the output
+	enc.RecipientPublicKeys = []string{"aGVsbG8="}
+	if err := enc.Check(); err == nil {
+		t.Fatal("should have failed")
+	}
+	if err := enc.Transform(result); err == nil || result.CombinedOutput != "" {
+		t.Fatal(err, result)
+	}
+	// Encrypt for two recipients
+	privateKey1, publicKey1, err := GenerateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey2, publicKey2, err := GenerateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	strangerKey, _, err := GenerateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.RecipientPublicKeys = []string{publicKey1, publicKey2}
+	if err := enc.Check(); err != nil {
+		t.Fatal(err)
+	}
+	plainText := strings.Repeat("hello world ", 20)
+	result = &toolbox.Result{CombinedOutput: plainText}
+	if err := enc.Transform(result); err != nil {
+		t.Fatal(err)
+	}
+	armored := result.CombinedOutput
+	if !strings.HasPrefix(armored, EncryptedOutputBegin+"\n") || !strings.HasSuffix(armored, "\n"+EncryptedOutputEnd) || strings.Contains(armored, "hello") {
+		t.Fatal(armored)
+	}
+	for _, line := range strings.Split(armored, "\n") {
+		if len(line) > EncryptedOutputLineLen && line != EncryptedOutputBegin && line != EncryptedOutputEnd {
+			t.Fatal(line)
+		}
+	}
+	// Predict the length of armored output
+	for _, length := range []int{0, 1, 2, 3, 30, 31, 32, 240, 1000} {
+		armoredLength := enc.ArmoredLength(length)
+		if encrypted, err := enc.Encrypt(strings.Repeat("a", length)); err != nil || len(encrypted) != armoredLength {
+			t.Fatal(length, armoredLength, len(encrypted), err)
+		}
+		if plainLength := enc.MaxPlainTextLength(armoredLength); plainLength < length || enc.ArmoredLength(plainLength) > armoredLength || enc.ArmoredLength(plainLength+1) <= armoredLength {
+			t.Fatal(length, plainLength)
+		}
+	}
+	if plainLength := enc.MaxPlainTextLength(160); plainLength != 0 {
+		t.Fatal(plainLength)
+	}
+	// Both recipients can decrypt, even if the text was indented by a mail client.
+	for _, privateKey := range []string{privateKey1, privateKey2} {
+		if decrypted, err := DecryptOutput(armored, privateKey); err != nil || decrypted != plainText {
+			t.Fatal(decrypted, err)
+		}
+	}
+	if decrypted, err := DecryptOutput("> "+strings.Replace(armored, "\n", "\n> ", -1), privateKey1); err != nil || decrypted != plainText {
+		t.Fatal(decrypted, err)
+	}
+	// Stranger cannot decrypt
+	if _, err := DecryptOutput(armored, strangerKey); err != ErrNotRecipient {
+		t.Fatal(err)
+	}
+	// Tampered output cannot be decrypted
+	lines := strings.Split(armored, "\n")
+	lastLine := []byte(lines[len(lines)-2])
+	if lastLine[0] == 'A' {
+		lastLine[0] = 'B'
+	} else {
+		lastLine[0] = 'A'
+	}
+	lines[len(lines)-2] = string(lastLine)
+	if _, err := DecryptOutput(strings.Join(lines, "\n"), privateKey1); err != ErrBadEncryptedOutput {
+		t.Fatal(err)
+	}
+	if _, err := DecryptOutput("hello", privateKey1); err != ErrBadEncryptedOutput {
+		t.Fatal(err)
+	}
+}
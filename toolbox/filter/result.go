@@ -118,6 +118,9 @@ func (notify *NotifyViaEmail) Transform(result *toolbox.Result) error {
 	if notify.IsConfigured() && result.Error != ErrPINAndShortcutNotFound {
 		go func() {
 			subject := inet.OutgoingMailSubjectKeyword + "-notify-" + result.Command.Content
+			if result.Command.Principal != "" {
+				subject = inet.OutgoingMailSubjectKeyword + "-notify-" + result.Command.Principal + "-" + result.Command.Content
+			}
 			if err := notify.MailClient.Send(subject, result.CombinedOutput, notify.Recipients...); err != nil {
 				notify.logger.Warningf("Transform", "", err, "failed to send notification for command \"%s\"", result.Command.Content)
 			}
@@ -0,0 +1,334 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var (
+	RegexURL         = regexp.MustCompile(`(?i)\bhttps?://(?:www\.)?([^/\s:?#]+)\S*`) // Match a web URL and capture its host name
+	RegexLongWord    = regexp.MustCompile(`\b[A-Za-z]{5,}\b`)                         // Match words made of at least 5 latin letters
+	RegexLineSpaces  = regexp.MustCompile(`[ \t]+`)                                   // Match consecutive spaces within a line
+	RegexLineBreaks  = regexp.MustCompile(`\s*\n\s*`)                                 // Match line breaks and surrounding spaces
+	builtinPinyinMap = parsePinyinTable(builtinPinyin)                                // builtinPinyinMap is the pinyin of common Chinese characters
+
+	pinyinFiles      = make(map[string]map[rune]string) // pinyinFiles caches Chinese character readings loaded from Unihan files by file path
+	pinyinFilesMutex = new(sync.Mutex)                  // pinyinFilesMutex protects pinyinFiles
+
+	abbreviationRegexes      = make(map[string]*regexp.Regexp) // abbreviationRegexes caches compiled abbreviation patterns by their source
+	abbreviationRegexesMutex = new(sync.Mutex)                 // abbreviationRegexesMutex protects abbreviationRegexes
+)
+
+/*
+TransliterateText condenses command result for channels that only carry 7-bit text or have a tight length budget, such
+as satellite terminals and SMS. The transformations take place in the following order, each step is turned on by its
+respective attribute:
+1. Transliterate unicode text into its closest ASCII text, e.g. "Grüße" becomes "Gruesse", Chinese becomes pinyin.
+2. Replace words and phrases by their abbreviations.
+3. Compact encoding - shorten URLs to host names, squeeze spaces, and remove vowels from long words.
+The filter should be placed before LintText, which enforces the ultimate length limit.
+*/
+type TransliterateText struct {
+	ToASCII         bool              `json:"ToASCII"`         // ToASCII transliterates unicode text into ASCII.
+	PinyinTablePath string            `json:"PinyinTablePath"` // PinyinTablePath is an optional Unihan_Readings.txt file that supplements the built-in pinyin of common Chinese characters.
+	Abbreviations   map[string]string `json:"Abbreviations"`   // Abbreviations map (case-insensitive) words and phrases to their abbreviation.
+	CompactEncoding bool              `json:"CompactEncoding"` // CompactEncoding shortens URLs, spaces, and long words.
+
+	logger misc.Logger
+}
+
+// IsConfigured returns true only if any of the transformations is turned on.
+func (trans *TransliterateText) IsConfigured() bool {
+	return trans.ToASCII || len(trans.Abbreviations) > 0 || trans.CompactEncoding
+}
+
+// Check returns an error if the pinyin table cannot be loaded or an abbreviation is empty.
+func (trans *TransliterateText) Check() error {
+	for word := range trans.Abbreviations {
+		if strings.TrimSpace(word) == "" {
+			return errors.New("abbreviation must not be made for empty text")
+		}
+	}
+	if trans.PinyinTablePath != "" {
+		if _, err := LoadPinyinTable(trans.PinyinTablePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePinyinTable reads the compact built-in table in which each Chinese character is followed by its pinyin.
+func parsePinyinTable(table string) map[rune]string {
+	ret := make(map[rune]string)
+	var char rune
+	for _, r := range table {
+		if r >= 'a' && r <= 'z' {
+			ret[char] += string(r)
+		} else if !unicode.IsSpace(r) {
+			char = r
+		}
+	}
+	return ret
+}
+
+/*
+LoadPinyinTable reads kMandarin readings of Chinese characters from a Unihan_Readings.txt file, and returns the toneless
+pinyin of each character, in which letter "v" stands for "ü". The file is only read once.
+*/
+func LoadPinyinTable(filePath string) (map[rune]string, error) {
+	pinyinFilesMutex.Lock()
+	defer pinyinFilesMutex.Unlock()
+	if table, exists := pinyinFiles[filePath]; exists {
+		return table, nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("LoadPinyinTable: failed to open pinyin table - %v", err)
+	}
+	defer file.Close()
+	table := make(map[rune]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Each line looks like: U+4E2D	kMandarin	zhōng
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 || fields[1] != "kMandarin" || !strings.HasPrefix(fields[0], "U+") {
+			continue
+		}
+		codePoint, err := strconv.ParseInt(fields[0][2:], 16, 32)
+		if err != nil {
+			continue
+		}
+		// Use the most common reading, which comes first.
+		readings := strings.Fields(fields[2])
+		if len(readings) == 0 {
+			continue
+		}
+		var reading bytes.Buffer
+		for _, r := range readings[0] {
+			if r == 'ü' {
+				reading.WriteRune('v')
+			} else {
+				reading.WriteString(strings.ToLower(transliterateRune(r)))
+			}
+		}
+		table[rune(codePoint)] = reading.String()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("LoadPinyinTable: failed to read pinyin table - %v", err)
+	}
+	if len(table) == 0 {
+		return nil, errors.New("LoadPinyinTable: the file does not contain any kMandarin reading")
+	}
+	pinyinFiles[filePath] = table
+	return table, nil
+}
+
+// capitalise turns the first letter of the text into upper case.
+func capitalise(text string) string {
+	if text == "" {
+		return text
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+/*
+transliterateRune returns the closest ASCII text of an alphabet, symbol, or emoji. The text is empty if the rune does not
+carry meaning on its own (e.g. combining marks), or "?" if the rune is unknown.
+*/
+func transliterateRune(r rune) string {
+	if r < 128 {
+		return string(r)
+	}
+	if ascii, exists := transliterations[r]; exists {
+		return ascii
+	}
+	if r >= 0x100 && r <= 0x17f {
+		return latinExtendedA[r-0x100 : r-0x100+1]
+	}
+	if r >= 0xff01 && r <= 0xff5e {
+		// Full-width forms of ASCII characters
+		return string(r - 0xfee0)
+	}
+	if unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Cf, r) {
+		return ""
+	}
+	if lower := unicode.ToLower(r); lower != r {
+		if ascii, exists := transliterations[lower]; exists {
+			return capitalise(ascii)
+		}
+	}
+	return "?"
+}
+
+// romaniseHangul returns the Revised Romanization of a Hangul syllable.
+func romaniseHangul(r rune) string {
+	index := int(r - 0xac00)
+	return hangulInitials[index/588] + hangulVowels[(index%588)/28] + hangulFinals[index%28]
+}
+
+// transliterate turns the text into ASCII, using the pinyin table for Chinese characters.
+func transliterate(text string, pinyinTable map[rune]string) string {
+	var out bytes.Buffer
+	// separateWord is true if the last output is a Chinese syllable, which should be separated from the next word.
+	separateWord := false
+	// lastKana is the romaji of the last output if it came from kana.
+	lastKana := ""
+	doubleConsonant := false
+	write := func(ascii string, isSyllable bool) {
+		if ascii == "" {
+			return
+		}
+		first := rune(ascii[0])
+		if (separateWord || isSyllable) && out.Len() > 0 && (unicode.IsLetter(first) || unicode.IsDigit(first)) {
+			if last := rune(out.Bytes()[out.Len()-1]); unicode.IsLetter(last) || unicode.IsDigit(last) {
+				out.WriteByte(' ')
+			}
+		}
+		out.WriteString(ascii)
+		separateWord = isSyllable
+	}
+	for _, r := range text {
+		if r >= 0x30a1 && r <= 0x30f6 {
+			// Katakana is transliterated via its hiragana counterpart
+			r -= 0x60
+		}
+		if romaji, isKana := kana[r]; isKana {
+			switch {
+			case r == 'っ':
+				doubleConsonant = true
+			case (r == 'ゃ' || r == 'ゅ' || r == 'ょ') && len(lastKana) > 1 && strings.HasSuffix(lastKana, "i"):
+				// Combine with the previous kana, e.g. "ki"+"ya" becomes "kya" and "shi"+"ya" becomes "sha".
+				out.Truncate(out.Len() - 1)
+				if strings.HasSuffix(lastKana, "hi") && lastKana != "hi" || lastKana == "ji" {
+					romaji = romaji[1:]
+				}
+				out.WriteString(romaji)
+				lastKana = ""
+			default:
+				if doubleConsonant && romaji[0] != 'a' && romaji[0] != 'i' && romaji[0] != 'u' && romaji[0] != 'e' && romaji[0] != 'o' {
+					romaji = romaji[:1] + romaji
+				}
+				doubleConsonant = false
+				write(romaji, false)
+				lastKana = romaji
+			}
+			continue
+		}
+		lastKana = ""
+		doubleConsonant = false
+		if r >= 0xac00 && r <= 0xd7a3 {
+			write(romaniseHangul(r), false)
+		} else if unicode.Is(unicode.Han, r) {
+			if pinyin, exists := pinyinTable[r]; exists {
+				write(pinyin, true)
+			} else if pinyin, exists := builtinPinyinMap[r]; exists {
+				write(pinyin, true)
+			} else {
+				write("?", false)
+			}
+		} else {
+			write(transliterateRune(r), false)
+		}
+	}
+	return out.String()
+}
+
+// abbreviate replaces (case-insensitive) whole words and phrases by their abbreviations.
+func (trans *TransliterateText) abbreviate(text string) string {
+	// Prefer the longest phrase among those that overlap
+	words := make([]string, 0, len(trans.Abbreviations))
+	abbreviations := make(map[string]string)
+	for word, abbreviation := range trans.Abbreviations {
+		if word = strings.TrimSpace(word); word != "" {
+			words = append(words, regexp.QuoteMeta(word))
+			abbreviations[strings.ToLower(word)] = abbreviation
+		}
+	}
+	if len(words) == 0 {
+		return text
+	}
+	sort.Slice(words, func(i, j int) bool {
+		return len(words[i]) > len(words[j]) || len(words[i]) == len(words[j]) && words[i] < words[j]
+	})
+	// Compile the pattern only once, as the abbreviations do not change after the program starts.
+	pattern := `(?i)\b(?:` + strings.Join(words, "|") + `)\b`
+	abbreviationRegexesMutex.Lock()
+	regexWords, exists := abbreviationRegexes[pattern]
+	if !exists {
+		regexWords = regexp.MustCompile(pattern)
+		abbreviationRegexes[pattern] = regexWords
+	}
+	abbreviationRegexesMutex.Unlock()
+	return regexWords.ReplaceAllStringFunc(text, func(word string) string {
+		return abbreviations[strings.ToLower(word)]
+	})
+}
+
+// compact shortens URLs to their host names, squeezes spaces, and removes vowels from long words.
+func compact(text string) string {
+	text = RegexURL.ReplaceAllString(text, "$1")
+	text = RegexLineSpaces.ReplaceAllString(text, " ")
+	text = strings.TrimSpace(RegexLineBreaks.ReplaceAllString(text, "\n"))
+	var out bytes.Buffer
+	lastEnd := 0
+	for _, match := range RegexLongWord.FindAllStringIndex(text, -1) {
+		begin, end := match[0], match[1]
+		out.WriteString(text[lastEnd:begin])
+		lastEnd = end
+		word := text[begin:end]
+		// Leave acronyms, identifiers in mixed case, host names, and file paths alone
+		if word[1:] != strings.ToLower(word[1:]) ||
+			begin > 0 && strings.IndexByte("./@", text[begin-1]) != -1 ||
+			end < len(text) && strings.IndexByte("/@", text[end]) != -1 ||
+			end+1 < len(text) && text[end] == '.' && unicode.IsLetter(rune(text[end+1])) {
+			out.WriteString(word)
+			continue
+		}
+		out.WriteByte(word[0])
+		for _, c := range word[1 : len(word)-1] {
+			if !strings.ContainsRune("aeiou", c) {
+				out.WriteRune(c)
+			}
+		}
+		out.WriteByte(word[len(word)-1])
+	}
+	out.WriteString(text[lastEnd:])
+	return out.String()
+}
+
+func (trans *TransliterateText) Transform(result *toolbox.Result) error {
+	ret := result.CombinedOutput
+	if trans.ToASCII {
+		var pinyinTable map[rune]string
+		if trans.PinyinTablePath != "" {
+			var err error
+			if pinyinTable, err = LoadPinyinTable(trans.PinyinTablePath); err != nil {
+				trans.logger.Warningf("Transform", "", err, "only the built-in pinyin table will be used")
+			}
+		}
+		ret = transliterate(ret, pinyinTable)
+	}
+	if len(trans.Abbreviations) > 0 {
+		ret = trans.abbreviate(ret)
+	}
+	if trans.CompactEncoding {
+		ret = compact(ret)
+	}
+	result.CombinedOutput = ret
+	return nil
+}
+
+func (trans *TransliterateText) SetLogger(logger misc.Logger) {
+	trans.logger = logger
+}
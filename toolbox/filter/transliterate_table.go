@@ -0,0 +1,127 @@
+package filter
+
+/*
+The tables of this file are used by TransliterateText filter. Only lower case letters are listed, an upper case letter is
+transliterated via its lower case counterpart and then capitalised.
+*/
+
+// latinExtendedA are the ASCII letters of runes U+0100 to U+017F, in the order of code points. "?" marks a ligature.
+const latinExtendedA = "AaAaAaCcCcCcCcDdDdEeEeEeEeEeGgGgGgGgHhHhIiIiIiIiIi??JjKkkLlLlLlLlLlNnNnNnnNnOoOoOo??RrRrRrSsSsSsSsTtTtTtUuUuUuUuUuUuWwYyYZzZzZzs"
+
+// transliterations are the closest ASCII text of individual runes.
+var transliterations = map[rune]string{
+	// Latin-1 supplement, German umlauts follow German convention
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "ae", 'å': "a", 'æ': "ae", 'ç': "c", 'è': "e", 'é': "e", 'ê': "e",
+	'ë': "e", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ð': "d", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o",
+	'ö': "oe", 'ø': "o", 'ù': "u", 'ú': "u", 'û': "u", 'ü': "ue", 'ý': "y", 'þ': "th", 'ÿ': "y", 'ß': "ss",
+	'Ĳ': "IJ", 'ĳ': "ij", 'Œ': "OE", 'œ': "oe",
+	// Pinyin tone marks in Latin extended-B
+	'ǎ': "a", 'ǐ': "i", 'ǒ': "o", 'ǔ': "u", 'ǖ': "v", 'ǘ': "v", 'ǚ': "v", 'ǜ': "v",
+	// Greek
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th", 'ι': "i", 'κ': "k", 'λ': "l",
+	'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f",
+	'χ': "ch", 'ψ': "ps", 'ω': "o", 'ά': "a", 'έ': "e", 'ή': "i", 'ί': "i", 'ό': "o", 'ύ': "y", 'ώ': "o",
+	// Cyrillic
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh", 'з': "z", 'и': "i", 'й': "y",
+	'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f",
+	'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g",
+	// Punctuation, symbols, and spaces
+	'‘': "'", '’': "'", '‚': "'", '‛': "'", '“': "\"", '”': "\"", '„': "\"", '«': "\"", '»': "\"", '‹': "'", '›': "'",
+	'‐': "-", '‑': "-", '‒': "-", '–': "-", '—': "-", '―': "-", '…': "...", '•': "*", '·': ".", '′': "'", '″': "\"",
+	'€': "EUR", '£': "GBP", '¥': "JPY", '₹': "INR", '₽': "RUB", '¢': "c", '©': "(c)", '®': "(R)", '™': "(TM)",
+	'°': "deg", '±': "+/-", '×': "x", '÷': "/", '½': "1/2", '¼': "1/4", '¾': "3/4", '¹': "1", '²': "2", '³': "3",
+	'¿': "?", '¡': "!", '§': "S", '¶': "P", '→': "->", '←': "<-", '↑': "^", '↓': "v", '⇒': "=>", '≤': "<=", '≥': ">=",
+	'≠': "!=", '≈': "~", '\u00a0': " ", '\u2002': " ", '\u2003': " ", '\u2009': " ", '\u200a': " ", '\u202f': " ",
+	'\u200b': "", '\u200c': "", '\u200d': "", '\ufeff': "", '\ufe0f': "", '\ufe0e': "",
+	// CJK punctuation
+	'\u3000': " ", '、': ",", '。': ".", '「': "\"", '」': "\"", '『': "\"", '』': "\"", '【': "[", '】': "]", '《': "<",
+	'》': ">", '〈': "<", '〉': ">", '・': "-", 'ー': "-", '〜': "~",
+	// Emoji
+	'😀': ":D", '😃': ":D", '😄': ":D", '😁': ":D", '😆': "XD", '😂': ":'D", '🤣': ":'D", '🙂': ":)", '😊': ":)",
+	'😉': ";)", '😍': "<3", '😘': ":*", '😛': ":P", '😜': ";P", '😐': ":|", '😕': ":/", '🙁': ":(", '☹': ":(", '😞': ":(",
+	'😢': ":'(", '😭': ":'(", '😠': ">:(", '😡': ">:(", '😮': ":O", '😱': ":O", '❤': "<3", '💔': "</3", '👍': "+1",
+	'👎': "-1", '👌': "OK", '🙏': "thx", '🎉': "\\o/", '✔': "v", '✅': "v", '❌': "x", '⭐': "*", '🔥': "(fire)",
+	'🏻': "", '🏼': "", '🏽': "", '🏾': "", '🏿': "",
+}
+
+// kana are the romaji of hiragana, a katakana is transliterated via its hiragana counterpart.
+var kana = map[rune]string{
+	'あ': "a", 'い': "i", 'う': "u", 'え': "e", 'お': "o", 'か': "ka", 'き': "ki", 'く': "ku", 'け': "ke", 'こ': "ko",
+	'が': "ga", 'ぎ': "gi", 'ぐ': "gu", 'げ': "ge", 'ご': "go", 'さ': "sa", 'し': "shi", 'す': "su", 'せ': "se", 'そ': "so",
+	'ざ': "za", 'じ': "ji", 'ず': "zu", 'ぜ': "ze", 'ぞ': "zo", 'た': "ta", 'ち': "chi", 'つ': "tsu", 'て': "te", 'と': "to",
+	'だ': "da", 'ぢ': "ji", 'づ': "zu", 'で': "de", 'ど': "do", 'な': "na", 'に': "ni", 'ぬ': "nu", 'ね': "ne", 'の': "no",
+	'は': "ha", 'ひ': "hi", 'ふ': "fu", 'へ': "he", 'ほ': "ho", 'ば': "ba", 'び': "bi", 'ぶ': "bu", 'べ': "be", 'ぼ': "bo",
+	'ぱ': "pa", 'ぴ': "pi", 'ぷ': "pu", 'ぺ': "pe", 'ぽ': "po", 'ま': "ma", 'み': "mi", 'む': "mu", 'め': "me", 'も': "mo",
+	'や': "ya", 'ゆ': "yu", 'よ': "yo", 'ら': "ra", 'り': "ri", 'る': "ru", 'れ': "re", 'ろ': "ro", 'わ': "wa", 'を': "wo",
+	'ん': "n", 'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o", 'ゃ': "ya", 'ゅ': "yu", 'ょ': "yo", 'っ': "", 'ゔ': "vu",
+}
+
+// Initial consonants, vowels, and final consonants of Hangul syllables in Revised Romanization of Korean.
+var (
+	hangulInitials = []string{"g", "kk", "n", "d", "tt", "r", "m", "b", "pp", "s", "ss", "", "j", "jj", "ch", "k", "t", "p", "h"}
+	hangulVowels   = []string{"a", "ae", "ya", "yae", "eo", "e", "yeo", "ye", "o", "wa", "wae", "oe", "yo", "u", "wo", "we", "wi", "yu", "eu", "ui", "i"}
+	hangulFinals   = []string{"", "k", "k", "k", "n", "n", "n", "t", "l", "k", "m", "l", "l", "l", "p", "l", "m", "p", "p", "t", "t", "ng", "t", "t", "k", "t", "p", "t"}
+)
+
+/*
+builtinPinyin lists the most frequently used Chinese characters, each followed by its most common pinyin reading without
+tone. Letter "v" stands for "ü".
+*/
+const builtinPinyin = `
+的de一yi是shi不bu了le在zai人ren有you我wo他ta这zhe个ge们men中zhong来lai上shang大da为wei和he国guo地di到dao以yi说shuo
+时shi要yao就jiu出chu会hui可ke也ye你ni对dui生sheng能neng而er子zi那na得de于yu着zhe下xia自zi之zhi年nian过guo发fa后hou
+作zuo里li用yong道dao行xing所suo然ran家jia种zhong事shi成cheng方fang多duo经jing么me去qu法fa学xue如ru都dou同tong现xian
+当dang没mei动dong面mian起qi看kan定ding天tian分fen还hai进jin好hao小xiao部bu其qi些xie主zhu样yang理li心xin她ta本ben前qian
+开kai但dan因yin只zhi从cong想xiang实shi日ri军jun者zhe意yi无wu力li它ta与yu长chang把ba机ji十shi民min第di公gong此ci已yi
+工gong使shi情qing明ming性xing知zhi全quan三san又you关guan点dian正zheng业ye外wai将jiang两liang高gao间jian由you问wen很hen
+最zui重zhong并bing物wu手shou应ying战zhan向xiang头tou文wen体ti政zheng美mei相xiang见jian被bei利li什shen二er等deng产chan
+或huo新xin己ji制zhi身shen果guo加jia西xi斯si月yue话hua合he回hui特te代dai内nei信xin表biao化hua老lao给gei世shi位wei次ci
+度du门men任ren常chang先xian海hai通tong教jiao儿er原yuan东dong声sheng提ti立li及ji比bi员yuan解jie水shui名ming真zhen论lun
+处chu走zou义yi各ge入ru几ji口kou认ren条tiao平ping系xi气qi题ti活huo尔er更geng别bie打da女nv变bian四si神shen总zong何he
+电dian数shu安an少shao报bao才cai结jie反fan受shou目mu太tai量liang再zai感gan建jian务wu做zuo接jie必bi场chang件jian计ji
+管guan期qi市shi直zhi德de资zi命ming山shan金jin指zhi克ke许xu统tong区qu保bao至zhi队dui形xing社she便bian空kong决jue治zhi
+展zhan马ma科ke司si五wu基ji眼yan书shu非fei则ze听ting白bai却que界jie达da光guang放fang强qiang即ji像xiang难nan且qie权quan
+思si王wang象xiang完wan设she式shi色se路lu记ji南nan品pin住zhu告gao类lei求qiu据ju程cheng北bei边bian死si张zhang该gai
+交jiao规gui万wan取qu拉la格ge望wang觉jue术shu领ling共gong确que传chuan师shi观guan清qing今jin切qie院yuan让rang识shi
+候hou带dai导dao争zheng运yun笑xiao飞fei风feng步bu改gai收shou根gen干gan造zao言yan联lian持chi组zu每mei济ji车che亲qin
+极ji林lin服fu快kuai办ban议yi往wang元yuan英ying士shi证zheng近jin失shi转zhuan夫fu令ling准zhun布bu始shi怎zen呢ne存cun
+未wei远yuan叫jiao台tai单dan影ying具ju罗luo字zi爱ai击ji流liu备bei兵bing连lian调diao深shen商shang算suan质zhi团tuan
+集ji百bai需xu价jia花hua党dang华hua城cheng石shi级ji整zheng府fu离li况kuang亚ya请qing技ji际ji约yue示shi复fu病bing息xi
+究jiu线xian似si官guan火huo断duan精jing满man支zhi视shi消xiao越yue器qi容rong照zhao须xu九jiu增zeng研yan写xie称cheng
+企qi八ba功gong吗ma包bao片pian史shi委wei乎hu查cha轻qing易yi早zao曾ceng除chu农nong找zhao装zhuang广guang显xian吧ba
+阿a李li标biao谈tan吃chi图tu念nian六liu引yin历li首shou医yi局ju突tu专zhuan费fei号hao尽jin另ling周zhou较jiao注zhu
+语yu仅jin考kao落luo青qing随sui选xuan列lie武wu红hong响xiang虽sui推tui势shi参can希xi古gu众zhong构gou房fang半ban
+节jie土tu投tou某mou案an黑hei维wei革ge划hua敌di致zhi陈chen律lv足zu态tai护hu七qi兴xing派pai孩hai验yan责ze营ying
+星xing够gou章zhang音yin跟gen志zhi底di站zhan严yan巴ba例li防fang族zu供gong效xiao续xu施shi留liu讲jiang型xing料liao
+终zhong答da紧jin黄huang绝jue奇qi察cha母mu京jing段duan依yi批pi群qun项xiang故gu按an河he米mi围wei江jiang织zhi害hai
+斗dou双shuang境jing客ke纪ji采cai举ju杀sha攻gong父fu苏su密mi低di朝chao友you诉su止zhi细xi愿yuan千qian值zhi仍reng
+男nan钱qian破po网wang热re助zhu倒dao育yu属shu坐zuo帝di限xian船chuan脸lian职zhi速su刻ke乐le否fou刚gang威wei毛mao
+状zhuang率lv甚shen独du球qiu般ban普pu怕pa弹dan校xiao苦ku创chuang假jia久jiu错cuo承cheng印yin晚wan兰lan试shi股gu
+拿na脑nao预yu谁shui益yi阳yang若ruo哪na微wei尼ni继ji送song急ji血xue惊jing伤shang素su药yao适shi波bo夜ye省sheng
+初chu喜xi卫wei源yuan食shi险xian待dai述shu陆lu习xi置zhi居ju劳lao财cai环huan排pai福fu纳na欢huan雷lei警jing获huo
+模mo充chong负fu云yun停ting木mu游you龙long树shu疑yi层ceng冷leng洲zhou冲chong射she略lve范fan竟jing句ju室shi异yi
+激ji汉han村cun哈ha策ce演yan简jian卡ka罪zui判pan担dan州zhou静jing退tui既ji衣yi您nin宗zong积ji余yu痛tong检jian
+差cha富fu灵ling协xie角jiao占zhan配pei征zheng修xiu皮pi挥hui胜sheng降jiang阶jie审shen沉chen坚jian善shan妈ma刘liu
+读du啊a超chao免mian压ya银yin买mai皇huang养yang伊yi怀huai执zhi副fu乱luan抗kang犯fan追zhui帮bang宣xuan佛fo岁sui
+航hang优you怪guai香xiang著zhu田tian铁tie控kong税shui左zuo右you份fen穿chuan艺yi背bei阵zhen草cao脚jiao概gai恶e
+块kuai顿dun敢gan守shou酒jiu岛dao托tuo央yang户hu烈lie洋yang哥ge索suo胡hu款kuan靠kao评ping版ban宝bao座zuo释shi
+景jing顾gu弟di登deng货huo互hu付fu伯bo慢man欧ou换huan闻wen危wei忙mang核he暗an姐jie介jie坏huai讨tao丽li良liang
+序xu升sheng监jian临lin亮liang露lu永yong呼hu味wei野ye架jia域yu沙sha掉diao括kuo舰jian鱼yu杂za误wu湾wan吉ji减jian
+编bian楚chu肯ken测ce败bai屋wu跑pao梦meng散san温wen困kun剑jian渐jian封feng救jiu贵gui枪qiang缺que楼lou县xian
+尚shang毫hao移yi娘niang朋peng画hua班ban智zhi亦yi耳er恩en短duan掌zhang恐kong遗yi固gu席xi松song秘mi谢xie鲁lu
+遇yu康kang虑lv幸xing均jun销xiao钟zhong诗shi藏cang赶gan剧ju票piao损sun忽hu巨ju炮pao旧jiu端duan探tan湖hu录lu
+叶ye春chun乡xiang附fu吸xi予yu礼li港gang雨yu呀ya板ban庭ting妇fu归gui睛jing饭fan额e含han顺shun输shu摇yao招zhao
+婚hun脱tuo补bu谓wei督du毒du油you疗liao旅lv泽ze材cai灭mie逐zhu莫mo笔bi亡wang鲜xian词ci圣sheng择ze寻xun厂chang
+睡shui博bo勒le烟yan授shou诺nuo伦lun岸an奥ao唐tang卖mai俄e炸zha载zai洛luo健jian堂tang旁pang宫gong喝he借jie
+君jun禁jin阴yin园yuan谋mou宋song避bi抓zhua荣rong姑gu孙sun逃tao牙ya束shu跳tiao顶ding玉yu镇zhen雪xue午wu练lian
+迫po爷ye篇pian肉rou嘴zui馆guan遍bian凡fan础chu洞dong卷juan坦tan牛niu宁ning纸zhi诸zhu训xun私si庄zhuang祖zu
+丝si翻fan暴bao森sen塔ta默mo握wo戏xi隐yin熟shu骨gu访fang弱ruo蒙meng歌ge店dian鬼gui软ruan典dian欲yu萨sa伙huo
+遭zao盘pan爸ba扩kuo盖gai弄nong雄xiong稳wen忘wang亿yi刺ci拥yong徒tu姆mu杨yang齐qi赛sai趣qu曲qu刀dao床chuang
+迎ying冰bing虚xu玩wan析xi窗chuang醒xing妻qi透tou购gou替ti塞sai努nu休xiu虎hu扬yang途tu侵qin刑xing绿lv兄xiong
+迅xun套tao贸mao毕bi唯wei谷gu轮lun库ku迹ji尤you竞jing街jie促cu延yan震zhen弃qi甲jia伟wei麻ma川chuan申shen
+缓huan潜qian闪shan售shou灯deng针zhen哲zhe络luo抵di朱zhu埃ai抱bao鼓gu植zhi纯chun夏xia忍ren页ye杰jie筑zhu折zhe
+郑zheng贝bei尊zun吴wu秀xiu混hun臣chen雅ya振zhen染ran盛sheng怒nu舞wu圆yuan搞gao狂kuang措cuo姓xing残can秋qiu
+培pei迷mi诚cheng宽kuan宇yu猛meng摆bai梅mei毁hui伸shen摩mo盟meng末mo乃nai悲bei拍pai丁ding赵zhao邮you零ling
+〇ling晨chen昨zuo晴qing嗯en哦o喂wei嗨hai拜bai
+`
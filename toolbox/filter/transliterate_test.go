@@ -0,0 +1,99 @@
+package filter
+
+import (
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransliterateText_Transform(t *testing.T) {
+	trans := TransliterateText{}
+	if trans.IsConfigured() {
+		t.Fatal("should not be configured")
+	}
+	if err := trans.Check(); err != nil {
+		t.Fatal(err)
+	}
+	result := &toolbox.Result{CombinedOutput: "Grüße"}
+	if err := trans.Transform(result); err != nil || result.CombinedOutput != "Grüße" {
+		t.Fatal(err, result)
+	}
+
+	// Transliterate into ASCII
+	trans.ToASCII = true
+	for input, expected := range map[string]string{
+		"":                            "",
+		"Grüße aus Köln, ÄRGER":       "Gruesse aus Koeln, AeRGER",
+		"Łódź Crème brûlée Ærø Œuvre": "Lodz Creme brulee Aero OEuvre",
+		"Αθήνα Москва":                "Athina Moskva",
+		"“quoted” — 5€ … ½":           "\"quoted\" - 5EUR ... 1/2",
+		"ｆｕｌｌ１２３":                     "full123",
+		"école":                      "ecole",
+		"ok 👍🏽 ❤️ 😂":                  "ok +1 <3 :'D",
+		"中文abc中国 人":                   "zhong wen abc zhong guo ren",
+		"今天天气很好。":                     "jin tian tian qi hen hao.",
+		"钅":                           "?",
+		"ひらがな カタカナ":                   "hiragana katakana",
+		"きょう しゃしん ちょっと":               "kyou shashin chotto",
+		"한국어 서울":                      "hangukeo seoul",
+		"ह":                           "?",
+	} {
+		result := &toolbox.Result{CombinedOutput: input}
+		if err := trans.Transform(result); err != nil || result.CombinedOutput != expected {
+			t.Fatalf("%q: %v %q", input, err, result.CombinedOutput)
+		}
+	}
+
+	// Supplement the built-in pinyin table by Unihan readings
+	tmpDir, err := ioutil.TempDir("", "laitos-TestTransliterateText")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	trans.PinyinTablePath = filepath.Join(tmpDir, "does not exist")
+	if err := trans.Check(); err == nil {
+		t.Fatal("should have failed")
+	}
+	// A missing table does not prevent transformation
+	result = &toolbox.Result{CombinedOutput: "中钅"}
+	if err := trans.Transform(result); err != nil || result.CombinedOutput != "zhong?" {
+		t.Fatal(err, result)
+	}
+	trans.PinyinTablePath = filepath.Join(tmpDir, "Unihan_Readings.txt")
+	unihan := "# comment\nU+4E2D\tkDefinition\tcentral\nU+4E2D\tkMandarin\tzhòng\nU+9485\tkMandarin\tjīn\nU+7EFF\tkMandarin\tlǜ lù\nU+4E00\tkMandarin\t\n"
+	if err := ioutil.WriteFile(trans.PinyinTablePath, []byte(unihan), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := trans.Check(); err != nil {
+		t.Fatal(err)
+	}
+	// The table takes priority over built-in pinyin
+	result = &toolbox.Result{CombinedOutput: "中钅绿一"}
+	if err := trans.Transform(result); err != nil || result.CombinedOutput != "zhong jin lv yi" {
+		t.Fatal(err, result)
+	}
+
+	// Abbreviations and compact encoding
+	trans = TransliterateText{
+		Abbreviations: map[string]string{
+			"as soon as possible": "asap",
+			"as":                  "az",
+			"tomorrow":            "tmrw",
+			" ":                   "should be ignored",
+		},
+		CompactEncoding: true,
+	}
+	if err := trans.Check(); err == nil {
+		t.Fatal("should have failed")
+	}
+	delete(trans.Abbreviations, " ")
+	if err := trans.Check(); err != nil || !trans.IsConfigured() {
+		t.Fatal(err)
+	}
+	result = &toolbox.Result{CombinedOutput: "  Reply  As Soon As Possible,\ttomorrow   has\n\n  Temperature  https://www.example.com/a/b?c=d HTTP LaiTos, temperature.  "}
+	if err := trans.Transform(result); err != nil || result.CombinedOutput != "Rply asap, tmrw has\nTmprtre example.com HTTP LaiTos, tmprtre." {
+		t.Fatalf("%v %q", err, result.CombinedOutput)
+	}
+}
@@ -13,8 +13,8 @@ import (
 )
 
 var (
-	// Captured into three groups, mail command looks like: address@domain.tld "this is email subject" this is email body
-	RegexMailCommand = regexp.MustCompile(`([a-zA-Z0-9!#$%&'*+-/=?_{|}~.^]+@[a-zA-Z0-9!#$%&'*+-/=?_{|}~.^]+.[a-zA-Z0-9!#$%&'*+-/=?_{|}~.^]+)\s*"(.*)"\s*(.*)`)
+	// Captured into three groups, mail command looks like: address@domain.tld "this is email subject" this is email body (may span multiple lines)
+	RegexMailCommand = regexp.MustCompile(`([a-zA-Z0-9!#$%&'*+-/=?_{|}~.^]+@[a-zA-Z0-9!#$%&'*+-/=?_{|}~.^]+.[a-zA-Z0-9!#$%&'*+-/=?_{|}~.^]+)\s*"(.*)"\s*((?s:.*))`)
 	/*
 		SOSEmailRecipientMagic is the magic email recipient that corresponds to a built-in list of rescue coordinate
 		centre Emails.
@@ -16,7 +16,7 @@ const (
 )
 
 var (
-	RegexPhoneNumberAndMessage = regexp.MustCompile(`(\+\d+)[^\w]+(.*)`) // Capture one phone number and one text message
+	RegexPhoneNumberAndMessage = regexp.MustCompile(`(\+\d+)[^\w]+((?s:.*))`) // Capture one phone number and one text message that may span multiple lines
 	ErrBadTwilioParam          = fmt.Errorf("Example: %s|%s +##number message", TwilioMakeCall, TwilioSendSMS)
 )
 